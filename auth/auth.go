@@ -0,0 +1,368 @@
+/*
+Package auth decides who may submit jobs to the http provider and use the stats server. A request authenticates with
+a key sent as a bearer token or in the X-Api-Key header, by signing itself with the key, or with a client certificate
+whose common name is the key's id. Handlers made with TokenHandler also take a short-lived token, handed out to a key,
+in the token query parameter, for clients like a browser's EventSource that can't set headers. A key may be limited to submitting some job types, and only admin keys may use
+the stats server. If no keys are configured every request is let through.
+*/
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/barracudanetworks/GoWorker/config"
+)
+
+const (
+	KEY_HEADER       = "X-Api-Key"
+	KEY_ID_HEADER    = "X-Key-Id"
+	TIMESTAMP_HEADER = "X-Timestamp"
+	SIGNATURE_HEADER = "X-Signature"
+
+	// TOKEN_PARAM the query parameter a token is sent in
+	TOKEN_PARAM = "token"
+)
+
+var (
+	UNAUTHORIZED     = errors.New("auth: a valid key is required")
+	FORBIDDEN        = errors.New("auth: key is not allowed to do this")
+	BAD_SIGNATURE    = errors.New("auth: bad request signature")
+	STALE_SIGNATURE  = errors.New("auth: request was signed too far from now")
+	DUPLICATE_KEY    = errors.New("auth: every key needs its own id and key")
+	MISSING_KEY_PAIR = errors.New("auth: tls needs both a cert_file and a key_file")
+	BAD_CLIENT_CA    = errors.New("auth: no certificates found in client_ca_file")
+	BAD_TOKEN        = errors.New("auth: bad or expired token")
+	BODY_TOO_LARGE   = errors.New("auth: signed request body is too large")
+
+	// std the authenticator set up from the app config, shared by the http provider and the stats server
+	std = &Authenticator{}
+)
+
+// Key a key, and what it may do. A nil key is what requests carry when no keys are configured, and may do anything
+type Key struct {
+	ID     string
+	Admin  bool
+	secret []byte
+	types  map[string]bool
+}
+
+// Allows whether the key may submit jobs of type t
+func (k *Key) Allows(t string) bool {
+	return k == nil || len(k.types) == 0 || k.types[t]
+}
+
+// IsAdmin whether the key may use the stats server
+func (k *Key) IsAdmin() bool {
+	return k == nil || k.Admin
+}
+
+// Authenticator knows the keys requests may authenticate with
+type Authenticator struct {
+	keys   map[string]*Key
+	tokens map[[sha256.Size]byte]*Key
+	skew   time.Duration
+
+	maxBody int64
+}
+
+// New create an authenticator for the keys in conf
+func New(conf config.AuthConfig) (*Authenticator, error) {
+	a := &Authenticator{
+		keys:   make(map[string]*Key, len(conf.Keys)),
+		tokens: make(map[[sha256.Size]byte]*Key, len(conf.Keys)),
+	}
+	skew := conf.SignatureSkew
+	if skew == "" {
+		skew = config.DEFAULT_SIGNATURE_SKEW
+	}
+	var err error
+	if a.skew, err = time.ParseDuration(skew); err != nil {
+		return nil, err
+	}
+	a.maxBody = conf.MaxSignedBody
+	if a.maxBody <= 0 {
+		a.maxBody = config.DEFAULT_MAX_SIGNED_BODY
+	}
+	for _, kc := range conf.Keys {
+		token := sha256.Sum256([]byte(kc.Key))
+		if _, ok := a.keys[kc.ID]; ok || kc.ID == "" || kc.Key == "" {
+			return nil, DUPLICATE_KEY
+		}
+		if _, ok := a.tokens[token]; ok {
+			return nil, DUPLICATE_KEY
+		}
+		k := &Key{
+			ID:     kc.ID,
+			Admin:  kc.Admin,
+			secret: []byte(kc.Key),
+			types:  make(map[string]bool, len(kc.Types)),
+		}
+		for _, t := range kc.Types {
+			k.types[t] = true
+		}
+		a.keys[k.ID] = k
+		a.tokens[token] = k
+	}
+	return a, nil
+}
+
+// Init set up the authenticator shared by the http provider and the stats server
+func Init(conf config.AuthConfig) error {
+	a, err := New(conf)
+	if err != nil {
+		return err
+	}
+	std = a
+	return nil
+}
+
+// Default the authenticator set up by Init
+func Default() *Authenticator {
+	return std
+}
+
+// Enabled whether requests need a key
+func (a *Authenticator) Enabled() bool {
+	return len(a.keys) > 0
+}
+
+// Authenticate find the key a request was made with. Returns a nil key if no keys are configured
+func (a *Authenticator) Authenticate(req *http.Request) (*Key, error) {
+	if !a.Enabled() {
+		return nil, nil
+	}
+
+	// a key sent as is
+	token := req.Header.Get(KEY_HEADER)
+	if h := req.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		token = strings.TrimPrefix(h, "Bearer ")
+	}
+	if token != "" {
+		if k, ok := a.tokens[sha256.Sum256([]byte(token))]; ok {
+			return k, nil
+		}
+		return nil, UNAUTHORIZED
+	}
+
+	// a request signed with a key
+	if id := req.Header.Get(KEY_ID_HEADER); id != "" {
+		return a.verify(req, id)
+	}
+
+	// a client certificate, already verified against the client CAs
+	if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 && len(req.TLS.VerifiedChains[0]) > 0 {
+		if k, ok := a.keys[req.TLS.VerifiedChains[0][0].Subject.CommonName]; ok {
+			return k, nil
+		}
+	}
+	return nil, UNAUTHORIZED
+}
+
+// verify check the signature on a request signed with the key id
+func (a *Authenticator) verify(req *http.Request, id string) (*Key, error) {
+	k, ok := a.keys[id]
+	if !ok {
+		return nil, UNAUTHORIZED
+	}
+	ts := req.Header.Get(TIMESTAMP_HEADER)
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return nil, BAD_SIGNATURE
+	}
+	if d := time.Since(time.Unix(sec, 0)); d > a.skew || d < -a.skew {
+		return nil, STALE_SIGNATURE
+	}
+	sig, err := hex.DecodeString(req.Header.Get(SIGNATURE_HEADER))
+	if err != nil {
+		return nil, BAD_SIGNATURE
+	}
+
+	// put the body back for the handler
+	var body []byte
+	if req.Body != nil {
+		if body, err = ioutil.ReadAll(io.LimitReader(req.Body, a.maxBody+1)); err != nil {
+			return nil, err
+		}
+		if int64(len(body)) > a.maxBody {
+			return nil, BODY_TOO_LARGE
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	if !hmac.Equal(sig, signature(k.secret, ts, req.Method, req.URL.RequestURI(), body)) {
+		return nil, BAD_SIGNATURE
+	}
+	return k, nil
+}
+
+// signature the HMAC-SHA256, under secret, of the time a request was signed at, its method, its path and query, and its body
+func signature(secret []byte, timestamp, method, uri string, body []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n", timestamp, method, uri)
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// Sign the hex encoded signature of a request, as it is sent in the X-Signature header
+func Sign(secret []byte, timestamp, method, uri string, body []byte) string {
+	return hex.EncodeToString(signature(secret, timestamp, method, uri, body))
+}
+
+// SignRequest sign a request with the key id and its secret. body must be the body the request will send
+func SignRequest(req *http.Request, id string, secret, body []byte) {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(KEY_ID_HEADER, id)
+	req.Header.Set(TIMESTAMP_HEADER, ts)
+	req.Header.Set(SIGNATURE_HEADER, Sign(secret, ts, req.Method, req.URL.RequestURI(), body))
+}
+
+// Token a token that authenticates as k until ttl from now. Empty if no keys are configured
+func (a *Authenticator) Token(k *Key, ttl time.Duration) string {
+	if k == nil {
+		return ""
+	}
+	expires := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+	return k.ID + "." + expires + "." + hex.EncodeToString(tokenSignature(k.secret, k.ID, expires))
+}
+
+// verifyToken find the key a token was handed out to, as long as it hasn't expired
+func (a *Authenticator) verifyToken(token string) (*Key, error) {
+	i := strings.LastIndexByte(token, '.')
+	if i < 0 {
+		return nil, BAD_TOKEN
+	}
+	j := strings.LastIndexByte(token[:i], '.')
+	if j < 0 {
+		return nil, BAD_TOKEN
+	}
+	id, expires := token[:j], token[j+1:i]
+	k, ok := a.keys[id]
+	if !ok {
+		return nil, BAD_TOKEN
+	}
+	sec, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().After(time.Unix(sec, 0)) {
+		return nil, BAD_TOKEN
+	}
+	sig, err := hex.DecodeString(token[i+1:])
+	if err != nil || !hmac.Equal(sig, tokenSignature(k.secret, id, expires)) {
+		return nil, BAD_TOKEN
+	}
+	return k, nil
+}
+
+// tokenSignature the HMAC-SHA256, under secret, of the key id a token is for and the unix time it expires at
+func tokenSignature(secret []byte, id, expires string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "token\n%s\n%s", id, expires)
+	return mac.Sum(nil)
+}
+
+// contextKey the key a request's Key is kept under in its context
+type contextKey struct{}
+
+// NewContext a context carrying k
+func NewContext(ctx context.Context, k *Key) context.Context {
+	return context.WithValue(ctx, contextKey{}, k)
+}
+
+// FromContext the key carried by ctx, nil if there is none
+func FromContext(ctx context.Context) *Key {
+	k, _ := ctx.Value(contextKey{}).(*Key)
+	return k
+}
+
+// Handler authenticate requests before passing them on to next, with their key in their context. If admin is set only admin keys are let through
+func (a *Authenticator) Handler(next http.Handler, admin bool) http.Handler {
+	return a.handler(next, admin, false)
+}
+
+// TokenHandler authenticate requests like Handler, also taking a token in the token query parameter
+func (a *Authenticator) TokenHandler(next http.Handler, admin bool) http.Handler {
+	return a.handler(next, admin, true)
+}
+
+// handler authenticate requests before passing them on to next, with tokens if tokens is set
+func (a *Authenticator) handler(next http.Handler, admin, tokens bool) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var k *Key
+		var err error
+		if token := req.URL.Query().Get(TOKEN_PARAM); tokens && token != "" && a.Enabled() {
+			k, err = a.verifyToken(token)
+		} else {
+			k, err = a.Authenticate(req)
+		}
+		if err == BODY_TOO_LARGE {
+			writeError(rw, http.StatusRequestEntityTooLarge, err)
+			return
+		} else if err != nil {
+			rw.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(rw, http.StatusUnauthorized, err)
+			return
+		}
+		if admin && !k.IsAdmin() {
+			writeError(rw, http.StatusForbidden, FORBIDDEN)
+			return
+		}
+		next.ServeHTTP(rw, req.WithContext(NewContext(req.Context(), k)))
+	})
+}
+
+// writeError write err as the body of the response
+func writeError(rw http.ResponseWriter, code int, err error) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(code)
+	json.NewEncoder(rw).Encode(map[string]string{"error": err.Error()})
+}
+
+// TLSConfig the tls config for a server, nil if conf has no certificate
+func TLSConfig(conf config.TLSConfig) (*tls.Config, error) {
+	if conf.CertFile == "" && conf.KeyFile == "" && conf.ClientCAFile == "" {
+		return nil, nil
+	}
+	if conf.CertFile == "" || conf.KeyFile == "" {
+		return nil, MISSING_KEY_PAIR
+	}
+	cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	c := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if conf.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(conf.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		c.ClientCAs = x509.NewCertPool()
+		if !c.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, BAD_CLIENT_CA
+		}
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return c, nil
+}
+
+// ListenAndServe serve srv, over TLS if it has a tls config
+func ListenAndServe(srv *http.Server) error {
+	if srv.TLSConfig != nil {
+		return srv.ListenAndServeTLS("", "")
+	}
+	return srv.ListenAndServe()
+}
@@ -0,0 +1,252 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/barracudanetworks/GoWorker/config"
+)
+
+func authHelper(t *testing.T) *Authenticator {
+	a, err := New(config.AuthConfig{
+		Keys: []config.KeyConfig{
+			{ID: "admin", Key: "admin-secret", Admin: true},
+			{ID: "cli", Key: "cli-secret", Types: []string{"cli"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestNewDuplicateKeys(t *testing.T) {
+	for _, keys := range [][]config.KeyConfig{
+		{{ID: "a", Key: "1"}, {ID: "a", Key: "2"}},
+		{{ID: "a", Key: "1"}, {ID: "b", Key: "1"}},
+		{{ID: "a"}},
+		{{Key: "1"}},
+	} {
+		if _, err := New(config.AuthConfig{Keys: keys}); err != DUPLICATE_KEY {
+			t.Error("expected", DUPLICATE_KEY, "got", err, keys)
+		}
+	}
+	if _, err := New(config.AuthConfig{SignatureSkew: "soon"}); err == nil {
+		t.Error("bad signature_skew accepted")
+	}
+}
+
+func TestAuthenticateToken(t *testing.T) {
+	a := authHelper(t)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	if _, err := a.Authenticate(req); err != UNAUTHORIZED {
+		t.Error("expected", UNAUTHORIZED, "got", err)
+	}
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	if k, err := a.Authenticate(req); err != nil || k.ID != "admin" {
+		t.Error("bearer token not accepted", k, err)
+	}
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(KEY_HEADER, "cli-secret")
+	if k, err := a.Authenticate(req); err != nil || k.ID != "cli" {
+		t.Error("api key not accepted", k, err)
+	}
+	req.Header.Set(KEY_HEADER, "cli")
+	if _, err := a.Authenticate(req); err != UNAUTHORIZED {
+		t.Error("expected", UNAUTHORIZED, "got", err)
+	}
+
+	// with no keys everything is let through
+	if k, err := (&Authenticator{}).Authenticate(req); k != nil || err != nil {
+		t.Error("unexpected result without keys", k, err)
+	}
+}
+
+func TestAuthenticateSignature(t *testing.T) {
+	a := authHelper(t)
+	body := `{"name":"test","type":"cli"}`
+	signed := func(id, secret string) *http.Request {
+		req := httptest.NewRequest("POST", "/job?mode=async", strings.NewReader(body))
+		SignRequest(req, id, []byte(secret), []byte(body))
+		return req
+	}
+
+	req := signed("cli", "cli-secret")
+	k, err := a.Authenticate(req)
+	if err != nil || k.ID != "cli" {
+		t.Fatal("signed request not accepted", k, err)
+	}
+	if b, _ := ioutil.ReadAll(req.Body); string(b) != body {
+		t.Error("body wasn't put back", string(b))
+	}
+
+	if _, err := a.Authenticate(signed("cli", "admin-secret")); err != BAD_SIGNATURE {
+		t.Error("expected", BAD_SIGNATURE, "got", err)
+	}
+	if _, err := a.Authenticate(signed("nobody", "cli-secret")); err != UNAUTHORIZED {
+		t.Error("expected", UNAUTHORIZED, "got", err)
+	}
+	req = signed("cli", "cli-secret")
+	req.URL.RawQuery = "mode=sync"
+	if _, err := a.Authenticate(req); err != BAD_SIGNATURE {
+		t.Error("expected", BAD_SIGNATURE, "got", err)
+	}
+
+	// signed too long ago
+	req = httptest.NewRequest("POST", "/job?mode=async", strings.NewReader(body))
+	ts := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	req.Header.Set(KEY_ID_HEADER, "cli")
+	req.Header.Set(TIMESTAMP_HEADER, ts)
+	req.Header.Set(SIGNATURE_HEADER, Sign([]byte("cli-secret"), ts, "POST", "/job?mode=async", []byte(body)))
+	if _, err := a.Authenticate(req); err != STALE_SIGNATURE {
+		t.Error("expected", STALE_SIGNATURE, "got", err)
+	}
+
+	// a body over max_signed_body isn't read in full
+	a.maxBody = int64(len(body)) - 1
+	if _, err := a.Authenticate(signed("cli", "cli-secret")); err != BODY_TOO_LARGE {
+		t.Error("expected", BODY_TOO_LARGE, "got", err)
+	}
+	rw := httptest.NewRecorder()
+	a.Handler(http.NotFoundHandler(), false).ServeHTTP(rw, signed("cli", "cli-secret"))
+	if rw.Code != http.StatusRequestEntityTooLarge {
+		t.Error("expected 413 got", rw.Code)
+	}
+	a.maxBody = int64(len(body))
+	if _, err := a.Authenticate(signed("cli", "cli-secret")); err != nil {
+		t.Error("body of max_signed_body not accepted", err)
+	}
+}
+
+func TestAuthenticateClientCert(t *testing.T) {
+	a := authHelper(t)
+	req := httptest.NewRequest("GET", "/", nil)
+	req.TLS = &tls.ConnectionState{
+		VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "cli"}}}},
+	}
+	if k, err := a.Authenticate(req); err != nil || k.ID != "cli" {
+		t.Error("client certificate not accepted", k, err)
+	}
+	req.TLS.VerifiedChains[0][0].Subject.CommonName = "nobody"
+	if _, err := a.Authenticate(req); err != UNAUTHORIZED {
+		t.Error("expected", UNAUTHORIZED, "got", err)
+	}
+}
+
+func TestKeyAllows(t *testing.T) {
+	a := authHelper(t)
+	if !a.keys["cli"].Allows("cli") || a.keys["cli"].Allows("http") || a.keys["cli"].IsAdmin() {
+		t.Error("key limited to cli jobs")
+	}
+	if !a.keys["admin"].Allows("http") || !a.keys["admin"].IsAdmin() {
+		t.Error("key with no types may submit anything")
+	}
+	var k *Key
+	if !k.Allows("cli") || !k.IsAdmin() {
+		t.Error("nil key may do anything")
+	}
+}
+
+func TestHandler(t *testing.T) {
+	a := authHelper(t)
+	var seen *Key
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		seen = FromContext(req.Context())
+	})
+
+	for _, tc := range []struct {
+		token string
+		admin bool
+		code  int
+	}{
+		{"", false, http.StatusUnauthorized},
+		{"cli-secret", false, http.StatusOK},
+		{"cli-secret", true, http.StatusForbidden},
+		{"admin-secret", true, http.StatusOK},
+	} {
+		seen = nil
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/", nil)
+		if tc.token != "" {
+			req.Header.Set(KEY_HEADER, tc.token)
+		}
+		a.Handler(next, tc.admin).ServeHTTP(rw, req)
+		if rw.Code != tc.code {
+			t.Error(tc.token, tc.admin, "expected", tc.code, "got", rw.Code)
+		}
+		if tc.code == http.StatusOK && seen == nil {
+			t.Error(tc.token, "key wasn't passed on")
+		}
+		if tc.code == http.StatusUnauthorized && rw.Header().Get("WWW-Authenticate") == "" {
+			t.Error("no WWW-Authenticate header")
+		}
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	if c, err := TLSConfig(config.TLSConfig{}); c != nil || err != nil {
+		t.Error("tls config without a certificate", c, err)
+	}
+	if _, err := TLSConfig(config.TLSConfig{CertFile: "cert.pem"}); err != MISSING_KEY_PAIR {
+		t.Error("expected", MISSING_KEY_PAIR, "got", err)
+	}
+	if _, err := TLSConfig(config.TLSConfig{ClientCAFile: "ca.pem"}); err != MISSING_KEY_PAIR {
+		t.Error("expected", MISSING_KEY_PAIR, "got", err)
+	}
+
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := filepath.Join(dir, "ca.pem")
+	ioutil.WriteFile(ca, []byte("not a certificate"), 0644)
+	if _, err := TLSConfig(config.TLSConfig{CertFile: ca, KeyFile: ca}); err == nil {
+		t.Error("bad key pair accepted")
+	}
+}
+
+func TestToken(t *testing.T) {
+	a := authHelper(t)
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	serve := func(h http.Handler, token string) int {
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest("GET", "/?"+TOKEN_PARAM+"="+token, nil))
+		return rw.Code
+	}
+
+	admin := a.Token(a.keys["admin"], time.Minute)
+	if code := serve(a.TokenHandler(next, true), admin); code != http.StatusOK {
+		t.Error("token not accepted", code)
+	}
+	if code := serve(a.Handler(next, true), admin); code != http.StatusUnauthorized {
+		t.Error("token accepted by a handler that doesn't take them", code)
+	}
+	if code := serve(a.TokenHandler(next, true), a.Token(a.keys["cli"], time.Minute)); code != http.StatusForbidden {
+		t.Error("expected 403 for a token of a key that isn't an admin, got", code)
+	}
+	for _, token := range []string{
+		a.Token(a.keys["admin"], -time.Second),
+		strings.Replace(admin, "admin.", "cli.", 1),
+		admin[:len(admin)-1],
+		"admin",
+	} {
+		if _, err := a.verifyToken(token); err != BAD_TOKEN {
+			t.Error(token, "expected", BAD_TOKEN, "got", err)
+		}
+	}
+	if token := (&Authenticator{}).Token(nil, time.Minute); token != "" {
+		t.Error("token handed out without keys", token)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/barracudanetworks/GoWorker/config"
+	"github.com/barracudanetworks/GoWorker/database"
+	"github.com/barracudanetworks/GoWorker/manager"
+)
+
+// compact compact db through the stats server of the goworker configured by conf, or straight from the file if no
+// goworker is listening there. A goworker that is running but hasn't the db open as a job store may still hold it,
+// so that is an error rather than a reason to open the file
+func compact(db, store string, conf *config.AppConfig) error {
+	host, port, err := net.SplitHostPort(conf.StatsPort)
+	if err != nil {
+		return err
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	client, scheme, err := statsClient(conf.Auth.TLS)
+	if err != nil {
+		return err
+	}
+	u := scheme + "://" + net.JoinHostPort(host, port) + "/manager/stores/compact?db=" + url.QueryEscape(db)
+	req, err := http.NewRequest("POST", u, nil)
+	if err != nil {
+		return err
+	}
+
+	// the stats server only lets admin keys in
+	for _, k := range conf.Auth.Keys {
+		if k.Admin {
+			req.Header.Set("Authorization", "Bearer "+k.Key)
+			break
+		}
+	}
+	resp, err := client.Do(req)
+	if err == nil {
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode == http.StatusOK {
+			fmt.Print(string(b))
+			return nil
+		}
+		return errors.New("compact: " + strings.TrimSpace(string(b)))
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return err
+	}
+
+	// nothing is running, so nothing has the db open
+	if _, err = os.Stat(db); err != nil {
+		return err
+	}
+	s, err := database.OpenStore(store, db)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	before, after, err := database.Compact(s)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(os.Stdout).Encode(&manager.CompactReport{DB: db, Before: before, After: after})
+}
+
+// statsClient a client for the stats server, and the scheme to reach it on. The stats server's own certificate is
+// trusted, along with the system's CAs, so a self signed certificate works
+func statsClient(conf config.TLSConfig) (*http.Client, string, error) {
+	if conf.CertFile == "" {
+		return http.DefaultClient, "http", nil
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	pem, err := ioutil.ReadFile(conf.CertFile)
+	if err != nil {
+		return nil, "", err
+	}
+	pool.AppendCertsFromPEM(pem)
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		},
+	}
+	return client, "https", nil
+}
@@ -13,13 +13,16 @@ import (
 	"strings"
 
 	"github.com/barracudanetworks/GoWorker/config"
+	_ "github.com/barracudanetworks/GoWorker/database/sqlite"
 	"github.com/barracudanetworks/GoWorker/manager"
 	"github.com/barracudanetworks/GoWorker/provider"
+	_ "github.com/barracudanetworks/GoWorker/provider/file"
 	_ "github.com/barracudanetworks/GoWorker/provider/http"
 	_ "github.com/barracudanetworks/GoWorker/provider/redis"
 	"github.com/barracudanetworks/GoWorker/worker"
 	_ "github.com/barracudanetworks/GoWorker/worker/cli"
 	_ "github.com/barracudanetworks/GoWorker/worker/disk"
+	_ "github.com/barracudanetworks/GoWorker/worker/file"
 	_ "github.com/barracudanetworks/GoWorker/worker/http"
 )
 
@@ -28,6 +31,10 @@ var (
 	printConfigs   = flag.Bool("print-confs", false, "Print all of the config options")
 	cpuProfile     = flag.String("prof-cpu", "", "write cpu profile to this file")
 	memProfile     = flag.String("prof-mem", "", "write memory profile to this file")
+
+	// compaction
+	compactDB = flag.String("compact", "", "compact this job store db, through the stats server of the goworker that has it open, then exit")
+	storeType = flag.String("store", "bolt", "the type of job store to compact when no running goworker has the db open")
 )
 
 func init() {
@@ -144,6 +151,15 @@ func main() {
 	}
 	log.SetFlags(log.Llongfile)
 	conf, confErr := config.LoadAppConfigFromFile(*configFileName)
+	if *compactDB != "" {
+		if confErr != nil {
+			conf = config.DefaultAppConfig()
+		}
+		if err := compact(*compactDB, *storeType, conf); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
 	if confErr != nil {
 		log.Fatal(confErr)
 	}
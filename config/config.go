@@ -5,15 +5,25 @@ import (
 	"encoding/json"
 	"errors"
 	"io/ioutil"
-	"os"
 )
 
 const (
-	DEFAULT_STATS_PORT = ":9090"
+	DEFAULT_STATS_PORT             = ":9090"
+	DEFAULT_STATS_MINUTE_RETENTION = "24h"
+	DEFAULT_STATS_HOUR_RETENTION   = "720h"
+	DEFAULT_SERVICE_NAME           = "goworker"
+	DEFAULT_PUSH_INTERVAL          = "10s"
+	DEFAULT_PUSH_PREFIX            = "goworker.{{.Host}}{{with .Type}}.type.{{.}}{{end}}{{with .Provider}}.provider.{{.}}{{end}}{{with .Pool}}.pool.{{.}}{{end}}{{with .Channel}}.channel.{{.}}{{end}}"
+	DEFAULT_SIGNATURE_SKEW         = "5m"
+	DEFAULT_MAX_SIGNED_BODY        = 32 << 20
+	DEFAULT_CALLBACK_TIMEOUT       = "10s"
+	DEFAULT_CALLBACK_MAX_ATTEMPTS  = 8
+	DEFAULT_CALLBACK_BACKOFF       = "1s"
+	DEFAULT_CALLBACK_MAX_BACKOFF   = "5m"
 )
 
 var (
-	DEFAULT_LUA_PATH  = os.Getenv("GOPATH") + "/src/github.com/barracudanetworks/GoWorker/lua"
+	DEFAULT_LUA_PATH  = ""
 	WRONG_CONFIG_TYPE = errors.New("config: wrong config type")
 	LUA_PATH          = DEFAULT_LUA_PATH
 )
@@ -42,19 +52,107 @@ type AppConfig struct {
 	FailureHanldlerConfigs []ConfigPair
 	ManagerToManager       string      `json:"manager_to_manager_port"`
 	StatsPort              string      `json:"stats_port"`
-	LuaPath                string      `json:"lua_path"`
+	LuaPath                string      `json:"lua_path" description:"A directory of lua scripts to use in place of the ones compiled in. Only scripts found there are replaced."`
+	StatsHistoryDB         string      `json:"stats_history_db" description:"The bolt db to persist stats rollups to. History is disabled if this is empty."`
+	StatsMinuteRetention   string      `json:"stats_minute_retention" description:"How long to keep per minute stats rollups."`
+	StatsHourRetention     string      `json:"stats_hour_retention" description:"How long to keep per hour stats rollups."`
 	RawProviders           ConfigBlock `json:"providers"`
 	RawWorkers             ConfigBlock `json:"workers"`
 	RawFailureHandler      ConfigBlock `json:"failure_handler"`
+
+	// Tracing configures how job traces are exported
+	Tracing TracingConfig `json:"tracing"`
+
+	// Push configures pushing stats to a StatsD or Graphite server
+	Push PushConfig `json:"push"`
+
+	// Auth configures who may submit jobs to the http provider and use the stats server
+	Auth AuthConfig `json:"auth"`
+
+	// Callback configures how the results of jobs are posted to their callback_url
+	Callback CallbackConfig `json:"callback"`
+}
+
+// TracingConfig configures how job traces are exported
+type TracingConfig struct {
+	Exporter    string  `json:"exporter" description:"One of otlp, stdout or file. Tracing is disabled if this is empty."`
+	Endpoint    string  `json:"endpoint" description:"The host:port of the OTLP/HTTP collector."`
+	Insecure    bool    `json:"insecure" description:"Send traces to the collector over plain http."`
+	File        string  `json:"file" description:"The file to write traces to when using the file exporter."`
+	ServiceName string  `json:"service_name" description:"The service name traces are reported under."`
+	SampleRatio float64 `json:"sample_ratio" description:"The fraction of new traces to sample, between 0 and 1."`
+}
+
+// PushConfig configures periodically pushing the manager's stats to a StatsD or Graphite server
+type PushConfig struct {
+	Protocol string `json:"protocol" description:"Either statsd or graphite. Pushing is disabled if this is empty."`
+	Network  string `json:"network" description:"udp or tcp. Defaults to udp for statsd and tcp for graphite."`
+	Address  string `json:"address" description:"The host:port of the server to push to."`
+	Interval string `json:"interval" description:"How often to push stats."`
+	Prefix   string `json:"prefix" description:"A text/template for the name metrics are pushed under. May use .Host, .Type, .Provider, .Pool and .Channel."`
+}
+
+// AuthConfig configures the keys that may submit jobs to the http provider and use the stats server, and TLS for the stats server.
+// Requests are let through without a key if no keys are configured
+type AuthConfig struct {
+	Keys          []KeyConfig `json:"keys" description:"The keys that may be used. A request authenticates with one as a bearer token, by signing itself with it, or with a client certificate whose common name is its id."`
+	SignatureSkew string      `json:"signature_skew" description:"How far the time a signed request was signed at may be from now."`
+	TLS           TLSConfig   `json:"tls"`
+
+	MaxSignedBody int64 `json:"max_signed_body" description:"The largest body, in bytes, a signed request may have. Larger ones are turned away with a 413."`
+}
+
+// KeyConfig a key, and what it may do
+type KeyConfig struct {
+	ID    string   `json:"id" description:"Names the key. Sent in the X-Key-Id header of signed requests."`
+	Key   string   `json:"key" description:"The key. Sent as a bearer token, or used as the secret requests are signed with."`
+	Types []string `json:"types" description:"The job types the key may submit. Every type if empty."`
+	Admin bool     `json:"admin" description:"The key may use the stats server."`
+}
+
+// TLSConfig configures TLS for a server. TLS is disabled if no certificate is given
+type TLSConfig struct {
+	CertFile     string `json:"cert_file" description:"The server's certificate."`
+	KeyFile      string `json:"key_file" description:"The server's private key."`
+	ClientCAFile string `json:"client_ca_file" description:"Require clients to present a certificate signed by one of the CAs in this file."`
+}
+
+// CallbackConfig configures how the results of jobs are posted to their callback_url
+type CallbackConfig struct {
+	Secret      string `json:"secret" description:"Signs the callbacks of jobs that don't have their own callback_secret. Callbacks are unsigned if neither is set."`
+	Timeout     string `json:"timeout" description:"How long to wait on a callback_url to answer."`
+	MaxAttempts int    `json:"max_attempts" description:"How many times to try posting a callback before giving up on it."`
+	Backoff     string `json:"backoff" description:"How long to wait before trying a callback again. The wait doubles with every try."`
+	MaxBackoff  string `json:"max_backoff" description:"The longest to wait before trying a callback again."`
 }
 
 // defaultAppConfig returns a app config with defaults params
 func DefaultAppConfig() *AppConfig {
 	return &AppConfig{
-		ProviderConfigs: []ConfigPair{},
-		WorkerConfigs:   []ConfigPair{},
-		LuaPath:         DEFAULT_LUA_PATH,
-		StatsPort:       DEFAULT_STATS_PORT,
+		ProviderConfigs:      []ConfigPair{},
+		WorkerConfigs:        []ConfigPair{},
+		LuaPath:              DEFAULT_LUA_PATH,
+		StatsPort:            DEFAULT_STATS_PORT,
+		StatsMinuteRetention: DEFAULT_STATS_MINUTE_RETENTION,
+		StatsHourRetention:   DEFAULT_STATS_HOUR_RETENTION,
+		Tracing: TracingConfig{
+			ServiceName: DEFAULT_SERVICE_NAME,
+			SampleRatio: 1,
+		},
+		Push: PushConfig{
+			Interval: DEFAULT_PUSH_INTERVAL,
+			Prefix:   DEFAULT_PUSH_PREFIX,
+		},
+		Auth: AuthConfig{
+			SignatureSkew: DEFAULT_SIGNATURE_SKEW,
+			MaxSignedBody: DEFAULT_MAX_SIGNED_BODY,
+		},
+		Callback: CallbackConfig{
+			Timeout:     DEFAULT_CALLBACK_TIMEOUT,
+			MaxAttempts: DEFAULT_CALLBACK_MAX_ATTEMPTS,
+			Backoff:     DEFAULT_CALLBACK_BACKOFF,
+			MaxBackoff:  DEFAULT_CALLBACK_MAX_BACKOFF,
+		},
 	}
 }
 
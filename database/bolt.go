@@ -1,6 +1,7 @@
 package database
 
 import (
+	"bytes"
 	"sync"
 
 	"github.com/barracudanetworks/GoWorker/job"
@@ -14,17 +15,30 @@ var (
 )
 
 func Open(filename string) (*bolt.DB, error) {
+	h, err := openHolder(filename, false)
+	if err != nil {
+		return nil, err
+	}
+	return h.db, nil
+}
+
+// openHolder open filename, or add a user to it if it is already open. Job stores are counted apart
+// from other users, as only they can follow the db when it is compacted
+func openHolder(filename string, store bool) (*holder, error) {
 	dbContainer.Lock()
 	defer dbContainer.Unlock()
 
 	// if we already have this file open, return the reference to the db
-	if db, inMap := dbContainer.dbs[filename]; inMap {
-		db.users += 1
-		return db.db, nil
+	if h, inMap := dbContainer.dbs[filename]; inMap {
+		h.users += 1
+		if store {
+			h.stores += 1
+		}
+		return h, nil
 	}
 
 	// open a new database
-	db, err := bolt.Open(filename, 0660, nil)
+	db, err := bolt.Open(filename, 0660, &bolt.Options{Timeout: OPEN_TIMEOUT})
 	if err != nil {
 		return nil, err
 	}
@@ -34,24 +48,33 @@ func Open(filename string) (*bolt.DB, error) {
 		db:    db,
 		users: 1,
 	}
+	if store {
+		h.stores = 1
+	}
 	dbContainer.dbs[filename] = h
-	return db, nil
+	return h, nil
 }
 
 func Close(db *bolt.DB) error {
 	dbContainer.Lock()
 	defer dbContainer.Unlock()
-	if db, inMap := dbContainer.dbs[db.Path()]; inMap {
-		db.users -= 1
+	if h, inMap := dbContainer.dbs[db.Path()]; inMap {
+		return h.close(false)
+	}
+	return nil
+}
 
-		// if there are no more users for this db, remove it from the map completely
+// close remove a user from the holder. The container must be locked
+func (h *holder) close(store bool) error {
+	h.users -= 1
+	if store {
+		h.stores -= 1
+	}
 
-		if db.users < 1 {
-			delete(dbContainer.dbs, db.db.Path())
-			err := db.db.Close()
-			return err
-		}
-		return nil
+	// if there are no more users for this db, remove it from the map completely
+	if h.users < 1 {
+		delete(dbContainer.dbs, h.db.Path())
+		return h.db.Close()
 	}
 	return nil
 }
@@ -84,12 +107,54 @@ func WriteJob(db *bolt.DB, bucket, key, data []byte) error {
 	return err
 }
 
+// ReadRange read every key value pair in a bucket with a key between min and max, inclusive
+func ReadRange(db *bolt.DB, bucket, min, max []byte) (keys, values [][]byte, err error) {
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.Seek(min); k != nil && bytes.Compare(k, max) <= 0; k, v = c.Next() {
+			// bolt's slices are only valid for the life of the transaction
+			keys = append(keys, append([]byte{}, k...))
+			values = append(values, append([]byte{}, v...))
+		}
+		return nil
+	})
+	return
+}
+
+// DeleteBefore remove every key in a bucket that sorts before max. Returns the number of keys removed
+func DeleteBefore(db *bolt.DB, bucket, max []byte) (int, error) {
+	n := 0
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && bytes.Compare(k, max) < 0; k, _ = c.First() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+			n += 1
+		}
+		return nil
+	})
+	return n, err
+}
+
 type container struct {
 	dbs map[string]*holder
 	sync.Mutex
 }
 
 type holder struct {
-	db    *bolt.DB
-	users int
+	db     *bolt.DB
+	users  int
+	stores int
+
+	// held for writing while the db is being compacted
+	sync.RWMutex
 }
@@ -0,0 +1,475 @@
+package database
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	TMP_BUCKET_PREFIX   = "tmp_"
+	LEASE_BUCKET_PREFIX = "lease_"
+	COMPACT_SUFFIX      = ".compact"
+)
+
+var (
+	// COMPACT_BATCH the most keys copied in one transaction while compacting
+	COMPACT_BATCH = 10000
+
+	// OPEN_TIMEOUT how long to wait for another process to let go of a bolt db before giving up on opening it
+	OPEN_TIMEOUT = 5 * time.Second
+)
+
+func init() {
+	LoadStore("bolt", OpenBoltStore)
+}
+
+// BoltStore a job store in a bolt db. A queue is a bucket, its leased jobs are kept in the
+// tmp_<queue> bucket and their leases in lease_<queue>
+type BoltStore struct {
+	h    *holder
+	path string
+}
+
+// OpenBoltStore open a job store on the bolt db at path, sharing it with anyone else in this process who has it open
+func OpenBoltStore(path string) (JobStore, error) {
+	h, err := openHolder(path, true)
+	if err != nil {
+		return nil, err
+	}
+	b := &BoltStore{h: h, path: path}
+	Register(b)
+	return b, nil
+}
+
+// DB the bolt db under the store
+func (b *BoltStore) DB() *bolt.DB {
+	b.h.RLock()
+	defer b.h.RUnlock()
+	return b.h.db
+}
+
+// view run fn in a read only transaction, on a db that isn't being compacted
+func (b *BoltStore) view(fn func(*bolt.Tx) error) error {
+	b.h.RLock()
+	defer b.h.RUnlock()
+	return b.h.db.View(fn)
+}
+
+// update run fn in a read write transaction, on a db that isn't being compacted
+func (b *BoltStore) update(fn func(*bolt.Tx) error) error {
+	b.h.RLock()
+	defer b.h.RUnlock()
+	return b.h.db.Update(fn)
+}
+
+// buckets the buckets of queue, created if they don't exist
+func (b *BoltStore) buckets(tx *bolt.Tx, queue string) (jobs, tmp, leases *bolt.Bucket, err error) {
+	if jobs, err = tx.CreateBucketIfNotExists([]byte(queue)); err != nil {
+		return
+	}
+	if tmp, err = tx.CreateBucketIfNotExists([]byte(TMP_BUCKET_PREFIX + queue)); err != nil {
+		return
+	}
+	leases, err = tx.CreateBucketIfNotExists([]byte(LEASE_BUCKET_PREFIX + queue))
+	return
+}
+
+// Put add a job to queue under key
+func (b *BoltStore) Put(queue string, key, value []byte) error {
+	return b.update(func(tx *bolt.Tx) error {
+		jobs, err := tx.CreateBucketIfNotExists([]byte(queue))
+		if err != nil {
+			return err
+		}
+		if leased(tx, queue, key) {
+			return LEASED
+		}
+		return jobs.Put(key, value)
+	})
+}
+
+// leased whether the job under key in queue is leased
+func leased(tx *bolt.Tx, queue string, key []byte) bool {
+	tmp := tx.Bucket([]byte(TMP_BUCKET_PREFIX + queue))
+	return tmp != nil && tmp.Get(key) != nil
+}
+
+// PutLimited add a job to queue under key, unless it would put the queue over maxJobs jobs or maxBytes bytes
+func (b *BoltStore) PutLimited(queue string, key, value []byte, maxJobs int, maxBytes int64) error {
+	return b.update(func(tx *bolt.Tx) error {
+		jobs, err := tx.CreateBucketIfNotExists([]byte(queue))
+		if err != nil {
+			return err
+		}
+		n, size := 1, int64(len(key)+len(value))
+		err = jobs.ForEach(func(k, v []byte) error {
+			n += 1
+			size += int64(len(k) + len(v))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if leased(tx, queue, key) {
+			return LEASED
+		}
+		if (maxJobs > 0 && n > maxJobs) || (maxBytes > 0 && size > maxBytes) {
+			return QUEUE_FULL
+		}
+		return jobs.Put(key, value)
+	})
+}
+
+// due gather up to n jobs in the bucket that are due at now, earliest first, and the number of keys skipped
+func due(jobs *bolt.Bucket, now time.Time, n int, valid func([]byte) bool) ([]Entry, int) {
+	var entries []Entry
+	skipped := 0
+	c := jobs.Cursor()
+	for k, v := c.First(); k != nil && len(entries) < n; k, v = c.Next() {
+		ok, more, err := IsDue(k, now)
+		if err != nil || (ok && valid != nil && !valid(v)) {
+			skipped += 1
+			continue
+		}
+		if !more {
+			break
+		}
+		if ok {
+			// bolt's slices are only valid for the life of the transaction, or until the bucket changes
+			entries = append(entries, Entry{Key: append([]byte{}, k...), Value: append([]byte{}, v...)})
+		}
+	}
+	return entries, skipped
+}
+
+// Due up to n jobs in queue that are due at now, earliest first, without taking them out
+func (b *BoltStore) Due(queue string, now time.Time, n int) ([]Entry, error) {
+	var entries []Entry
+	err := b.view(func(tx *bolt.Tx) error {
+		if jobs := tx.Bucket([]byte(queue)); jobs != nil {
+			entries, _ = due(jobs, now, n, nil)
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// Lease take up to n jobs that are due at now out of queue, earliest first, under lease l, in a single transaction
+func (b *BoltStore) Lease(queue string, now time.Time, n int, l *Lease, valid func([]byte) bool) ([]Entry, int, error) {
+	var entries []Entry
+	skipped := 0
+	lease, err := json.Marshal(l)
+	if err != nil {
+		return nil, 0, err
+	}
+	err = b.update(func(tx *bolt.Tx) error {
+		jobs, tmp, leases, err := b.buckets(tx, queue)
+		if err != nil {
+			return err
+		}
+		entries, skipped = due(jobs, now, n, valid)
+		for i := range entries {
+			k := entries[i].Key
+			if err = tmp.Put(k, entries[i].Value); err != nil {
+				return err
+			}
+			if err = leases.Put(k, lease); err != nil {
+				return err
+			}
+			if err = jobs.Delete(k); err != nil {
+				return err
+			}
+			entries[i].Lease = l
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return entries, skipped, nil
+}
+
+// Ack remove a leased job, and its lease, for good
+func (b *BoltStore) Ack(queue string, key []byte) error {
+	return b.update(func(tx *bolt.Tx) error {
+		_, tmp, leases, err := b.buckets(tx, queue)
+		if err != nil {
+			return err
+		}
+		if err = tmp.Delete(key); err != nil {
+			return err
+		}
+		return leases.Delete(key)
+	})
+}
+
+// Leased every job taken out of queue, with its lease
+func (b *BoltStore) Leased(queue string) ([]Entry, error) {
+	var entries []Entry
+	err := b.view(func(tx *bolt.Tx) error {
+		tmp := tx.Bucket([]byte(TMP_BUCKET_PREFIX + queue))
+		leases := tx.Bucket([]byte(LEASE_BUCKET_PREFIX + queue))
+		if tmp == nil {
+			return nil
+		}
+		return tmp.ForEach(func(k, v []byte) error {
+			e := Entry{Key: append([]byte{}, k...), Value: append([]byte{}, v...)}
+			if leases != nil {
+				e.Lease = parseLease(leases.Get(k))
+			}
+			entries = append(entries, e)
+			return nil
+		})
+	})
+	return entries, err
+}
+
+// parseLease parse a lease, nil if there is none or it can't be read
+func parseLease(b []byte) *Lease {
+	if b == nil {
+		return nil
+	}
+	l := &Lease{}
+	if err := json.Unmarshal(b, l); err != nil {
+		return nil
+	}
+	return l
+}
+
+// Renew replace the lease on a leased job
+func (b *BoltStore) Renew(queue string, key []byte, l *Lease) error {
+	lease, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	return b.update(func(tx *bolt.Tx) error {
+		_, tmp, leases, err := b.buckets(tx, queue)
+		if err != nil {
+			return err
+		}
+		if tmp.Get(key) == nil {
+			return NOT_LEASED
+		}
+		return leases.Put(key, lease)
+	})
+}
+
+// Requeue put a leased job back in queue under its original key
+func (b *BoltStore) Requeue(queue string, key []byte) error {
+	return b.update(func(tx *bolt.Tx) error {
+		jobs, tmp, leases, err := b.buckets(tx, queue)
+		if err != nil {
+			return err
+		}
+		v := tmp.Get(key)
+		if v == nil {
+			return NOT_LEASED
+		}
+		if err = jobs.Put(key, v); err != nil {
+			return err
+		}
+		if err = tmp.Delete(key); err != nil {
+			return err
+		}
+		return leases.Delete(key)
+	})
+}
+
+// Count the number of jobs waiting in queue, and the number leased
+func (b *BoltStore) Count(queue string) (ready, leased int, err error) {
+	err = b.view(func(tx *bolt.Tx) error {
+		if jobs := tx.Bucket([]byte(queue)); jobs != nil {
+			ready = jobs.Stats().KeyN
+		}
+		if tmp := tx.Bucket([]byte(TMP_BUCKET_PREFIX + queue)); tmp != nil {
+			leased = tmp.Stats().KeyN
+		}
+		return nil
+	})
+	return
+}
+
+// Exclusive bolt locks its file, so only one process at a time can use the store
+func (b *BoltStore) Exclusive() bool {
+	return true
+}
+
+// Usage the number of jobs waiting in queue, and the bytes taken by their keys and values
+func (b *BoltStore) Usage(queue string) (jobs int, bytes int64, err error) {
+	err = b.view(func(tx *bolt.Tx) error {
+		q := tx.Bucket([]byte(queue))
+		if q == nil {
+			return nil
+		}
+		return q.ForEach(func(k, v []byte) error {
+			jobs += 1
+			bytes += int64(len(k) + len(v))
+			return nil
+		})
+	})
+	return
+}
+
+// EvictBefore remove every job waiting in queue that was due at or before t
+func (b *BoltStore) EvictBefore(queue string, t time.Time) (int, error) {
+	n := 0
+	err := b.update(func(tx *bolt.Tx) error {
+		q := tx.Bucket([]byte(queue))
+		if q == nil {
+			return nil
+		}
+		var old [][]byte
+		c := q.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			ok, more, err := IsDue(k, t)
+			if err == nil && !more {
+				break
+			}
+			if ok {
+				old = append(old, append([]byte{}, k...))
+			}
+		}
+		for _, k := range old {
+			if err := q.Delete(k); err != nil {
+				return err
+			}
+		}
+		n = len(old)
+		return nil
+	})
+	return n, err
+}
+
+// Evict remove waiting jobs from the front of queue, or the back if newest is set, until at least jobs
+// jobs and bytes bytes have been removed
+func (b *BoltStore) Evict(queue string, jobs int, bytes int64, newest bool) (int, error) {
+	n := 0
+	err := b.update(func(tx *bolt.Tx) error {
+		q := tx.Bucket([]byte(queue))
+		if q == nil {
+			return nil
+		}
+		var evict [][]byte
+		var removed int64
+		c := q.Cursor()
+		first, next := c.First, c.Next
+		if newest {
+			first, next = c.Last, c.Prev
+		}
+		for k, v := first(); k != nil && (len(evict) < jobs || removed < bytes); k, v = next() {
+			evict = append(evict, append([]byte{}, k...))
+			removed += int64(len(k) + len(v))
+		}
+		for _, k := range evict {
+			if err := q.Delete(k); err != nil {
+				return err
+			}
+		}
+		n = len(evict)
+		return nil
+	})
+	return n, err
+}
+
+// Compact rewrite the db into a new file and swap it in. Only job stores can follow the db to the new
+// file, so the db can't be compacted while anything else in this process has it open
+func (b *BoltStore) Compact() error {
+	dbContainer.Lock()
+	defer dbContainer.Unlock()
+	if b.h.users != b.h.stores {
+		return IN_USE
+	}
+	b.h.Lock()
+	defer b.h.Unlock()
+
+	tmp := b.path + COMPACT_SUFFIX
+	os.Remove(tmp)
+	if err := copyBolt(b.h.db, tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := b.h.db.Close(); err != nil {
+		return err
+	}
+	err := os.Rename(tmp, b.path)
+	db, openErr := bolt.Open(b.path, 0660, &bolt.Options{Timeout: OPEN_TIMEOUT})
+	if openErr != nil {
+		return openErr
+	}
+	b.h.db = db
+	return err
+}
+
+// copyBolt copy every bucket in src into a new db at dst, a batch of keys at a time, along with its sequence
+func copyBolt(src *bolt.DB, dst string) error {
+	db, err := bolt.Open(dst, 0660, &bolt.Options{Timeout: OPEN_TIMEOUT})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return src.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, from *bolt.Bucket) error {
+			c := from.Cursor()
+			k, v := c.First()
+			for {
+				err := db.Update(func(dtx *bolt.Tx) error {
+					to, err := dtx.CreateBucketIfNotExists(name)
+					if err != nil {
+						return err
+					}
+
+					// keys are copied in order, so pages can be filled
+					to.FillPercent = 1
+					if err = to.SetSequence(from.Sequence()); err != nil {
+						return err
+					}
+					for i := 0; k != nil && i < COMPACT_BATCH; i++ {
+						if err = copyKey(from, to, k, v); err != nil {
+							return err
+						}
+						k, v = c.Next()
+					}
+					return nil
+				})
+				if err != nil || k == nil {
+					return err
+				}
+			}
+		})
+	})
+}
+
+// copyKey copy k into to, along with everything under it if it is a nested bucket
+func copyKey(from, to *bolt.Bucket, k, v []byte) error {
+	if v != nil {
+		return to.Put(k, v)
+	}
+	fromNested := from.Bucket(k)
+	toNested, err := to.CreateBucketIfNotExists(k)
+	if err != nil {
+		return err
+	}
+	toNested.FillPercent = 1
+	if err = toNested.SetSequence(fromNested.Sequence()); err != nil {
+		return err
+	}
+	return fromNested.ForEach(func(k, v []byte) error {
+		return copyKey(fromNested, toNested, k, v)
+	})
+}
+
+// Path the file the db is kept in
+func (b *BoltStore) Path() string {
+	return b.path
+}
+
+// Close release this store's hold on the db
+func (b *BoltStore) Close() error {
+	Unregister(b)
+	dbContainer.Lock()
+	defer dbContainer.Unlock()
+	return b.h.close(true)
+}
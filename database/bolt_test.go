@@ -1,6 +1,13 @@
 package database
 
-import "testing"
+import (
+	"os"
+	"testing"
+)
+
+var (
+	testRangeDB = os.TempDir() + "/goworker_range_test.db"
+)
 
 func TestOpen(t *testing.T) {
 	db, err := Open("test.db")
@@ -41,3 +48,58 @@ func TestClose(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestReadRange(t *testing.T) {
+	defer os.Remove(testRangeDB)
+	db, err := Open(testRangeDB)
+	if err != nil {
+		t.Error(err)
+	}
+	defer Close(db)
+
+	bucket := []byte("test_read_range")
+	for _, k := range []string{"a", "b", "c", "d"} {
+		err = WriteJob(db, bucket, []byte(k), []byte(k))
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	keys, values, rErr := ReadRange(db, bucket, []byte("b"), []byte("c"))
+	if rErr != nil {
+		t.Error(rErr)
+	}
+	if len(keys) != 2 || string(keys[0]) != "b" || string(values[1]) != "c" {
+		t.Fail()
+	}
+}
+
+func TestDeleteBefore(t *testing.T) {
+	defer os.Remove(testRangeDB)
+	db, err := Open(testRangeDB)
+	if err != nil {
+		t.Error(err)
+	}
+	defer Close(db)
+
+	bucket := []byte("test_delete_before")
+	for _, k := range []string{"a", "b", "c", "d"} {
+		err = WriteJob(db, bucket, []byte(k), []byte(k))
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	n, dErr := DeleteBefore(db, bucket, []byte("c"))
+	if dErr != nil {
+		t.Error(dErr)
+	}
+	if n != 2 {
+		t.Error("Expected 2 keys to be removed, removed", n)
+	}
+
+	keys, _, _ := ReadRange(db, bucket, []byte("a"), []byte("z"))
+	if len(keys) != 2 || string(keys[0]) != "c" {
+		t.Fail()
+	}
+}
@@ -0,0 +1,289 @@
+package database
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	EVICT_OLDEST = "oldest"
+	EVICT_NEWEST = "newest"
+	EVICT_REJECT = "reject"
+
+	EVICTED_AGE   = "age"
+	EVICTED_LIMIT = "limit"
+)
+
+var (
+	BAD_POLICY     = errors.New("database: eviction policy must be oldest, newest or reject")
+	QUEUE_FULL     = errors.New("database: queue is full")
+	IN_USE         = errors.New("database: db is open outside of a job store")
+	STORE_NOT_OPEN = errors.New("database: no store is open on that db")
+
+	metrics = &storeMetrics{
+		stores: make(map[string]map[JobStore]bool),
+		files:  make(map[string]*fileMetrics),
+	}
+)
+
+// Retention limits how many jobs may wait in a queue, and for how long. A limit of 0 is no limit
+type Retention struct {
+	MaxJobs  int
+	MaxBytes int64
+	MaxAge   time.Duration
+
+	// Policy what to do when a queue is over its limits. oldest and newest evict jobs from the front or
+	// back of the queue, reject refuses new jobs instead
+	Policy string
+}
+
+// NewRetention build a retention from config values. maxAge is a duration, and may be empty
+func NewRetention(maxJobs int, maxBytes int64, maxAge, policy string) (*Retention, error) {
+	r := &Retention{
+		MaxJobs:  maxJobs,
+		MaxBytes: maxBytes,
+		Policy:   policy,
+	}
+	if r.Policy == "" {
+		r.Policy = EVICT_OLDEST
+	}
+	if r.Policy != EVICT_OLDEST && r.Policy != EVICT_NEWEST && r.Policy != EVICT_REJECT {
+		return nil, BAD_POLICY
+	}
+	if maxAge != "" {
+		var err error
+		if r.MaxAge, err = time.ParseDuration(maxAge); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Limited whether the retention limits anything
+func (r *Retention) Limited() bool {
+	return r.MaxJobs > 0 || r.MaxBytes > 0 || r.MaxAge > 0
+}
+
+// over how many jobs and bytes a queue holding jobs jobs in bytes bytes is over the limits by
+func (r *Retention) over(jobs int, bytes int64) (int, int64) {
+	var overJobs int
+	var overBytes int64
+	if r.MaxJobs > 0 && jobs > r.MaxJobs {
+		overJobs = jobs - r.MaxJobs
+	}
+	if r.MaxBytes > 0 && bytes > r.MaxBytes {
+		overBytes = bytes - r.MaxBytes
+	}
+	return overJobs, overBytes
+}
+
+// Enforce evict the jobs waiting in queue that are older than the retention's max age, then, unless the
+// policy is to reject new jobs, the jobs that put the queue over its limits. Returns the number evicted
+func Enforce(s JobStore, queue string, r *Retention, now time.Time) (int, error) {
+	n := 0
+	if r.MaxAge > 0 {
+		evicted, err := s.EvictBefore(queue, now.Add(-r.MaxAge))
+		metrics.evicted(s.Path(), EVICTED_AGE, evicted)
+		n += evicted
+		if err != nil {
+			return n, err
+		}
+	}
+	if r.Policy == EVICT_REJECT || (r.MaxJobs <= 0 && r.MaxBytes <= 0) {
+		return n, nil
+	}
+
+	jobs, bytes, err := s.Usage(queue)
+	if err != nil {
+		return n, err
+	}
+	overJobs, overBytes := r.over(jobs, bytes)
+	if overJobs == 0 && overBytes == 0 {
+		return n, nil
+	}
+	evicted, err := s.Evict(queue, overJobs, overBytes, r.Policy == EVICT_NEWEST)
+	metrics.evicted(s.Path(), EVICTED_LIMIT, evicted)
+	return n + evicted, err
+}
+
+// Admit add a job to queue under key. Returns QUEUE_FULL if the policy is to reject new jobs and the job would
+// put the queue over its limits, checked in the same transaction as the job is added in
+func Admit(s JobStore, queue string, r *Retention, key, value []byte) error {
+	if r.Policy != EVICT_REJECT || (r.MaxJobs <= 0 && r.MaxBytes <= 0) {
+		return s.Put(queue, key, value)
+	}
+	err := s.PutLimited(queue, key, value, r.MaxJobs, r.MaxBytes)
+	if err == QUEUE_FULL {
+		metrics.rejected(s.Path())
+	}
+	return err
+}
+
+// CompactStore compact the db at path through a store that has it open, however its path is spelled. Returns the
+// size of the db before and after
+func CompactStore(path string) (before, after int64, err error) {
+	s := metrics.store(path)
+	if s == nil {
+		return 0, 0, STORE_NOT_OPEN
+	}
+	return Compact(s)
+}
+
+// Compact compact the db under s. Returns the size of the db before and after
+func Compact(s JobStore) (before, after int64, err error) {
+	before = fileSize(s.Path())
+	start := time.Now()
+	if err = s.Compact(); err != nil {
+		return before, fileSize(s.Path()), err
+	}
+	after = fileSize(s.Path())
+	metrics.compacted(s.Path(), before-after, time.Since(start))
+	return before, after, nil
+}
+
+// fileSize the bytes taken by the db at path, along with any write ahead log it keeps
+func fileSize(path string) int64 {
+	var size int64
+	for _, f := range []string{path, path + "-wal"} {
+		if info, err := os.Stat(f); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+// fileMetrics what retention and compaction have done to a db
+type fileMetrics struct {
+	evicted        map[string]uint64
+	rejected       uint64
+	compactions    uint64
+	reclaimed      int64
+	lastCompaction time.Time
+	lastDuration   time.Duration
+}
+
+// storeMetrics the stores open on each db, and what has been done to it
+type storeMetrics struct {
+	stores map[string]map[JobStore]bool
+	files  map[string]*fileMetrics
+	sync.Mutex
+}
+
+// file the metrics for the db at path. The metrics must be locked
+func (m *storeMetrics) file(path string) *fileMetrics {
+	f, ok := m.files[path]
+	if !ok {
+		f = &fileMetrics{evicted: make(map[string]uint64)}
+		m.files[path] = f
+	}
+	return f
+}
+
+// canonical the absolute path of a db, so a db is found however its path is spelled
+func canonical(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+// Register note that s is open, so its db can be compacted and reported on
+func Register(s JobStore) {
+	metrics.Lock()
+	defer metrics.Unlock()
+	path := canonical(s.Path())
+	if metrics.stores[path] == nil {
+		metrics.stores[path] = make(map[JobStore]bool)
+	}
+	metrics.stores[path][s] = true
+	metrics.file(s.Path())
+}
+
+// Unregister note that s has been closed
+func Unregister(s JobStore) {
+	metrics.Lock()
+	defer metrics.Unlock()
+	path := canonical(s.Path())
+	delete(metrics.stores[path], s)
+	if len(metrics.stores[path]) == 0 {
+		delete(metrics.stores, path)
+	}
+}
+
+// store any store open on the db at path
+func (m *storeMetrics) store(path string) JobStore {
+	m.Lock()
+	defer m.Unlock()
+	for s := range m.stores[canonical(path)] {
+		return s
+	}
+	return nil
+}
+
+// evicted count n jobs evicted from the db at path for reason
+func (m *storeMetrics) evicted(path, reason string, n int) {
+	if n == 0 {
+		return
+	}
+	m.Lock()
+	m.file(path).evicted[reason] += uint64(n)
+	m.Unlock()
+}
+
+// rejected count a job turned away from the db at path
+func (m *storeMetrics) rejected(path string) {
+	m.Lock()
+	m.file(path).rejected += 1
+	m.Unlock()
+}
+
+// compacted count a compaction of the db at path that gave back reclaimed bytes
+func (m *storeMetrics) compacted(path string, reclaimed int64, took time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	f := m.file(path)
+	f.compactions += 1
+	f.reclaimed += reclaimed
+	f.lastCompaction = time.Now()
+	f.lastDuration = took
+}
+
+// Report the size of every db a store has opened, and the jobs evicted from it, for the stats server
+func Report() map[string]map[string]interface{} {
+	metrics.Lock()
+	defer metrics.Unlock()
+	rep := make(map[string]map[string]interface{}, len(metrics.files))
+	for path := range metrics.files {
+		rep[path] = metrics.report(path)
+	}
+	return rep
+}
+
+// ReportFile the size of the db at path and the jobs evicted from it
+func ReportFile(path string) map[string]interface{} {
+	metrics.Lock()
+	defer metrics.Unlock()
+	return metrics.report(path)
+}
+
+// report the metrics for the db at path. The metrics must be locked
+func (m *storeMetrics) report(path string) map[string]interface{} {
+	f := m.file(path)
+	evicted := make(map[string]uint64, len(f.evicted))
+	for reason, n := range f.evicted {
+		evicted[reason] = n
+	}
+	return map[string]interface{}{
+		"file_size":        fileSize(path),
+		"open":             len(m.stores[canonical(path)]) > 0,
+		"evicted":          evicted,
+		"rejected":         f.rejected,
+		"compactions":      f.compactions,
+		"reclaimed":        f.reclaimed,
+		"last_compaction":  f.lastCompaction,
+		"compaction_taken": f.lastDuration,
+	}
+}
@@ -0,0 +1,177 @@
+package database
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/barracudanetworks/GoWorker/time_util"
+	"github.com/boltdb/bolt"
+)
+
+// retentionStore open a store with jobs due every second up to now, the newest last
+func retentionStore(t *testing.T, name string, jobs int, now time.Time) JobStore {
+	path := os.TempDir() + "/goworker_retention_" + name + ".db"
+	os.Remove(path)
+	s, err := OpenBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < jobs; i++ {
+		k := time_util.TimeToName(now.Add(time.Duration(i-jobs+1)*time.Second), "job")
+		if err = s.Put("retention", k, []byte("0123456789")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s
+}
+
+func TestNewRetention(t *testing.T) {
+	if _, err := NewRetention(0, 0, "", "sometimes"); err != BAD_POLICY {
+		t.Error("Expected a bad policy", err)
+	}
+	if _, err := NewRetention(0, 0, "soon", ""); err == nil {
+		t.Error("Expected a bad max age")
+	}
+	r, err := NewRetention(0, 0, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Policy != EVICT_OLDEST || r.Limited() {
+		t.Error("Expected no limits, evicting the oldest jobs", r)
+	}
+}
+
+func TestEnforce(t *testing.T) {
+	tests := []struct {
+		name      string
+		retention Retention
+		evicted   int
+		left      int
+	}{
+		{"unlimited", Retention{Policy: EVICT_OLDEST}, 0, 10},
+		{"max jobs", Retention{MaxJobs: 4, Policy: EVICT_OLDEST}, 6, 4},
+		{"max bytes", Retention{MaxBytes: 100, Policy: EVICT_NEWEST}, 8, 2},
+		{"max age", Retention{MaxAge: 5500 * time.Millisecond, Policy: EVICT_OLDEST}, 4, 6},
+		{"reject only evicts by age", Retention{MaxJobs: 1, MaxAge: time.Hour, Policy: EVICT_REJECT}, 0, 10},
+	}
+	for _, test := range tests {
+		// names only keep whole seconds
+		now := time.Now().Truncate(time.Second)
+		s := retentionStore(t, "enforce", 10, now)
+		n, err := Enforce(s, "retention", &test.retention, now)
+		if err != nil {
+			t.Error(test.name, err)
+		}
+		jobs, _, _ := s.Usage("retention")
+		if n != test.evicted || jobs != test.left {
+			t.Error(test.name, "expected", test.evicted, "evicted and", test.left, "left, got", n, jobs)
+		}
+		s.Close()
+		os.Remove(s.Path())
+	}
+}
+
+func TestAdmit(t *testing.T) {
+	s := retentionStore(t, "admit", 3, time.Now())
+	defer os.Remove(s.Path())
+	defer s.Close()
+
+	r := &Retention{MaxJobs: 4, Policy: EVICT_REJECT}
+	n := 0
+	key := func() []byte {
+		n += 1
+		return time_util.TimeToName(time.Now(), "admit"+strconv.Itoa(n))
+	}
+	if err := Admit(s, "retention", r, key(), []byte("0123456789")); err != nil {
+		t.Error("A job that fits should be admitted", err)
+	}
+	if err := Admit(s, "retention", r, key(), []byte("0123456789")); err != QUEUE_FULL {
+		t.Error("Expected a full queue", err)
+	}
+	if ReportFile(s.Path())["rejected"] != uint64(1) {
+		t.Error("Expected the rejection to be counted", ReportFile(s.Path()))
+	}
+	if jobs, _, _ := s.Usage("retention"); jobs != 4 {
+		t.Error("Expected the rejected job to be left out", jobs)
+	}
+
+	// other policies make room instead
+	r.Policy = EVICT_OLDEST
+	if err := Admit(s, "retention", r, key(), []byte("0123456789")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCompactInUse(t *testing.T) {
+	s := retentionStore(t, "in_use", 1, time.Now())
+	defer os.Remove(s.Path())
+	defer s.Close()
+
+	db, err := Open(s.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Compact(); err != IN_USE {
+		t.Error("A db open outside of a store should not be compacted", err)
+	}
+	Close(db)
+	if err = s.Compact(); err != nil {
+		t.Error(err)
+	}
+	if jobs, _, _ := s.Usage("retention"); jobs != 1 {
+		t.Error("The job was lost in compaction", jobs)
+	}
+}
+
+func TestCompactStorePath(t *testing.T) {
+	s := retentionStore(t, "path", 1, time.Now())
+	defer os.Remove(s.Path())
+	defer s.Close()
+
+	// however the path is spelled
+	dir := filepath.Dir(s.Path())
+	other := dir + "/../" + filepath.Base(dir) + "/./" + filepath.Base(s.Path())
+	if _, _, err := CompactStore(other); err != nil {
+		t.Error(err)
+	}
+	if _, _, err := CompactStore(other + ".missing"); err != STORE_NOT_OPEN {
+		t.Error("Expected", STORE_NOT_OPEN, "got", err)
+	}
+}
+
+func TestCompactKeepsBuckets(t *testing.T) {
+	s := retentionStore(t, "keeps", 1, time.Now())
+	defer os.Remove(s.Path())
+	defer s.Close()
+	b := s.(*BoltStore)
+	err := b.update(func(tx *bolt.Tx) error {
+		jobs := tx.Bucket([]byte("retention"))
+		jobs.SetSequence(41)
+		nested, err := jobs.CreateBucket([]byte("nested"))
+		if err != nil {
+			return err
+		}
+		nested.SetSequence(7)
+		return nested.Put([]byte("a"), []byte("b"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	b.view(func(tx *bolt.Tx) error {
+		jobs := tx.Bucket([]byte("retention"))
+		if seq := jobs.Sequence(); seq != 41 {
+			t.Error("Expected the sequence to be kept, got", seq)
+		}
+		nested := jobs.Bucket([]byte("nested"))
+		if nested == nil || nested.Sequence() != 7 || string(nested.Get([]byte("a"))) != "b" {
+			t.Error("Expected the nested bucket to be kept")
+		}
+		return nil
+	})
+}
@@ -0,0 +1,356 @@
+package sqlite
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/barracudanetworks/GoWorker/database"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	// DSN_PARAMS wait on other processes' locks rather than fail, and take the write lock when a
+	// transaction begins, so two leases can't both read the same due jobs
+	DSN_PARAMS = "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_txlock=immediate"
+)
+
+var (
+	schema = []string{
+		`CREATE TABLE IF NOT EXISTS jobs (
+			queue TEXT NOT NULL,
+			key   BLOB NOT NULL,
+			value BLOB NOT NULL,
+			lease BLOB,
+			PRIMARY KEY (queue, key)
+		)`,
+		`CREATE INDEX IF NOT EXISTS jobs_ready ON jobs (queue, key) WHERE lease IS NULL`,
+	}
+)
+
+func init() {
+	database.LoadStore("sqlite", OpenSQLiteStore)
+}
+
+// SQLiteStore a job store in a sqlite db. Every queue is kept in one table, a job is leased while its lease is set.
+// Unlike bolt, sqlite lets several processes share the db
+type SQLiteStore struct {
+	db   *sql.DB
+	path string
+}
+
+// OpenSQLiteStore open a job store on the sqlite db at path, creating it if it doesn't exist
+func OpenSQLiteStore(path string) (database.JobStore, error) {
+	db, err := sql.Open("sqlite", path+DSN_PARAMS)
+	if err != nil {
+		return nil, err
+	}
+
+	// sqlite allows one writer at a time, queueing writers here is cheaper than retrying busy ones
+	db.SetMaxOpenConns(1)
+	for _, s := range schema {
+		if _, err = db.Exec(s); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	s := &SQLiteStore{db: db, path: path}
+	database.Register(s)
+	return s, nil
+}
+
+// Put add a job to queue under key
+func (s *SQLiteStore) Put(queue string, key, value []byte) error {
+	return put(s.db, queue, key, value)
+}
+
+// put add a job to queue under key, unless the job under key is leased
+func put(e execer, queue string, key, value []byte) error {
+	res, err := e.Exec(`INSERT INTO jobs (queue, key, value, lease) VALUES (?, ?, ?, NULL)
+		ON CONFLICT (queue, key) DO UPDATE SET value = excluded.value WHERE lease IS NULL`, queue, key, value)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return database.LEASED
+	}
+	return nil
+}
+
+// PutLimited add a job to queue under key, unless it would put the queue over maxJobs jobs or maxBytes bytes
+func (s *SQLiteStore) PutLimited(queue string, key, value []byte, maxJobs int, maxBytes int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var jobs int
+	var size int64
+	err = tx.QueryRow(`SELECT COUNT(*), COALESCE(SUM(LENGTH(key) + LENGTH(value)), 0) FROM jobs WHERE queue = ? AND lease IS NULL`, queue).Scan(&jobs, &size)
+	if err != nil {
+		return err
+	}
+	if (maxJobs > 0 && jobs+1 > maxJobs) || (maxBytes > 0 && size+int64(len(key)+len(value)) > maxBytes) {
+		return database.QUEUE_FULL
+	}
+	if err = put(tx, queue, key, value); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// due gather up to n jobs in queue that are due at now, earliest first, and the number of keys skipped
+func due(q querier, queue string, now time.Time, n int, valid func([]byte) bool) ([]database.Entry, int, error) {
+	rows, err := q.Query(`SELECT key, value FROM jobs WHERE queue = ? AND lease IS NULL ORDER BY key`, queue)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var entries []database.Entry
+	skipped := 0
+	for len(entries) < n && rows.Next() {
+		var e database.Entry
+		if err = rows.Scan(&e.Key, &e.Value); err != nil {
+			return nil, 0, err
+		}
+		ok, more, err := database.IsDue(e.Key, now)
+		if err != nil || (ok && valid != nil && !valid(e.Value)) {
+			skipped += 1
+			continue
+		}
+		if !more {
+			break
+		}
+		if ok {
+			entries = append(entries, e)
+		}
+	}
+	return entries, skipped, rows.Err()
+}
+
+// querier is either the db or a transaction on it
+type querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// execer is either the db or a transaction on it
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// Due up to n jobs in queue that are due at now, earliest first, without taking them out
+func (s *SQLiteStore) Due(queue string, now time.Time, n int) ([]database.Entry, error) {
+	entries, _, err := due(s.db, queue, now, n, nil)
+	return entries, err
+}
+
+// Lease take up to n jobs that are due at now out of queue, earliest first, under lease l, in a single transaction
+func (s *SQLiteStore) Lease(queue string, now time.Time, n int, l *database.Lease, valid func([]byte) bool) ([]database.Entry, int, error) {
+	lease, err := json.Marshal(l)
+	if err != nil {
+		return nil, 0, err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer tx.Rollback()
+
+	entries, skipped, err := due(tx, queue, now, n, valid)
+	if err != nil {
+		return nil, 0, err
+	}
+	for i := range entries {
+		_, err = tx.Exec(`UPDATE jobs SET lease = ? WHERE queue = ? AND key = ?`, lease, queue, entries[i].Key)
+		if err != nil {
+			return nil, 0, err
+		}
+		entries[i].Lease = l
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, 0, err
+	}
+	return entries, skipped, nil
+}
+
+// Ack remove a leased job for good
+func (s *SQLiteStore) Ack(queue string, key []byte) error {
+	_, err := s.db.Exec(`DELETE FROM jobs WHERE queue = ? AND key = ? AND lease IS NOT NULL`, queue, key)
+	return err
+}
+
+// Leased every job taken out of queue, with its lease
+func (s *SQLiteStore) Leased(queue string) ([]database.Entry, error) {
+	rows, err := s.db.Query(`SELECT key, value, lease FROM jobs WHERE queue = ? AND lease IS NOT NULL ORDER BY key`, queue)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []database.Entry
+	for rows.Next() {
+		var e database.Entry
+		var lease []byte
+		if err = rows.Scan(&e.Key, &e.Value, &lease); err != nil {
+			return nil, err
+		}
+		e.Lease = &database.Lease{}
+		if err = json.Unmarshal(lease, e.Lease); err != nil {
+			e.Lease = nil
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// Renew replace the lease on a leased job
+func (s *SQLiteStore) Renew(queue string, key []byte, l *database.Lease) error {
+	lease, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	return leased(s.db.Exec(`UPDATE jobs SET lease = ? WHERE queue = ? AND key = ? AND lease IS NOT NULL`, lease, queue, key))
+}
+
+// Requeue put a leased job back in queue under its original key
+func (s *SQLiteStore) Requeue(queue string, key []byte) error {
+	return leased(s.db.Exec(`UPDATE jobs SET lease = NULL WHERE queue = ? AND key = ? AND lease IS NOT NULL`, queue, key))
+}
+
+// leased turn an update of a leased job that changed nothing into NOT_LEASED
+func leased(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return database.NOT_LEASED
+	}
+	return nil
+}
+
+// Count the number of jobs waiting in queue, and the number leased
+func (s *SQLiteStore) Count(queue string) (ready, leased int, err error) {
+	err = s.db.QueryRow(`SELECT COALESCE(SUM(lease IS NULL), 0), COALESCE(SUM(lease IS NOT NULL), 0) FROM jobs WHERE queue = ?`, queue).Scan(&ready, &leased)
+	return
+}
+
+// Exclusive sqlite lets several processes share the store
+func (s *SQLiteStore) Exclusive() bool {
+	return false
+}
+
+// Usage the number of jobs waiting in queue, and the bytes taken by their keys and values
+func (s *SQLiteStore) Usage(queue string) (jobs int, bytes int64, err error) {
+	err = s.db.QueryRow(`SELECT COUNT(*), COALESCE(SUM(LENGTH(key) + LENGTH(value)), 0) FROM jobs WHERE queue = ? AND lease IS NULL`, queue).Scan(&jobs, &bytes)
+	return
+}
+
+// EvictBefore remove every job waiting in queue that was due at or before t
+func (s *SQLiteStore) EvictBefore(queue string, t time.Time) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT key FROM jobs WHERE queue = ? AND lease IS NULL ORDER BY key`, queue)
+	if err != nil {
+		return 0, err
+	}
+	var old [][]byte
+	for rows.Next() {
+		var k []byte
+		if err = rows.Scan(&k); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ok, more, err := database.IsDue(k, t)
+		if err == nil && !more {
+			break
+		}
+		if ok {
+			old = append(old, k)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	return remove(tx, queue, old)
+}
+
+// Evict remove waiting jobs from the front of queue, or the back if newest is set, until at least jobs
+// jobs and bytes bytes have been removed
+func (s *SQLiteStore) Evict(queue string, jobs int, bytes int64, newest bool) (int, error) {
+	order := "ASC"
+	if newest {
+		order = "DESC"
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT key, LENGTH(key) + LENGTH(value) FROM jobs WHERE queue = ? AND lease IS NULL ORDER BY key `+order, queue)
+	if err != nil {
+		return 0, err
+	}
+	var evict [][]byte
+	var removed int64
+	for (len(evict) < jobs || removed < bytes) && rows.Next() {
+		var k []byte
+		var size int64
+		if err = rows.Scan(&k, &size); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		evict = append(evict, k)
+		removed += size
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	return remove(tx, queue, evict)
+}
+
+// remove delete the waiting jobs under keys, and commit the transaction. Returns the number removed
+func remove(tx *sql.Tx, queue string, keys [][]byte) (int, error) {
+	for _, k := range keys {
+		if _, err := tx.Exec(`DELETE FROM jobs WHERE queue = ? AND key = ? AND lease IS NULL`, queue, k); err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(keys), nil
+}
+
+// Compact rebuild the db, and empty its write ahead log
+func (s *SQLiteStore) Compact() error {
+	if _, err := s.db.Exec(`VACUUM`); err != nil {
+		return err
+	}
+	_, err := s.db.Exec(`PRAGMA wal_checkpoint(TRUNCATE)`)
+	return err
+}
+
+// Path the file the db is kept in
+func (s *SQLiteStore) Path() string {
+	return s.path
+}
+
+// Close close the db
+func (s *SQLiteStore) Close() error {
+	database.Unregister(s)
+	return s.db.Close()
+}
@@ -0,0 +1,11 @@
+package sqlite
+
+import (
+	"testing"
+
+	"github.com/barracudanetworks/GoWorker/database/storetest"
+)
+
+func TestSQLiteStore(t *testing.T) {
+	storetest.Run(t, "sqlite", OpenSQLiteStore)
+}
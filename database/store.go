@@ -0,0 +1,111 @@
+package database
+
+import (
+	"errors"
+	"time"
+
+	"github.com/barracudanetworks/GoWorker/time_util"
+)
+
+const (
+	DEFAULT_STORE = "bolt"
+)
+
+var (
+	Stores          = make(map[string]StoreFactory)
+	STORE_NOT_EXIST = errors.New("database: store type does not exist")
+	NOT_LEASED      = errors.New("database: job is not leased")
+	LEASED          = errors.New("database: a job under this key is leased")
+)
+
+// JobStore keeps jobs in named queues until they are due. Jobs are keyed by names made by
+// time_util.TimeToName, so they sort by when they are due. A job taken out of a queue is held under a
+// lease until it is acked, or requeued when the lease is abandoned
+type JobStore interface {
+	// Put add a job to queue under key, replacing a job waiting under it. Returns LEASED, leaving the job as it
+	// is, if the job under key is leased
+	Put(queue string, key, value []byte) error
+	// PutLimited add a job to queue under key in the same transaction that checks it won't put the queue over
+	// maxJobs jobs or maxBytes bytes, returning QUEUE_FULL if it would. A limit of 0 is no limit. Returns LEASED
+	// like Put
+	PutLimited(queue string, key, value []byte, maxJobs int, maxBytes int64) error
+	// Due up to n jobs in queue that are due at now, earliest first, without taking them out
+	Due(queue string, now time.Time, n int) ([]Entry, error)
+	// Lease take up to n jobs that are due at now out of queue, earliest first, under lease l. Jobs that
+	// valid turns down are left in the queue. Returns the jobs, and the number of keys and jobs skipped
+	Lease(queue string, now time.Time, n int, l *Lease, valid func(value []byte) bool) ([]Entry, int, error)
+	// Ack remove a leased job for good
+	Ack(queue string, key []byte) error
+	// Leased every job taken out of queue, with its lease. The lease is nil if it is missing or unreadable
+	Leased(queue string) ([]Entry, error)
+	// Renew replace the lease on a leased job
+	Renew(queue string, key []byte, l *Lease) error
+	// Requeue put a leased job back in queue under its original key
+	Requeue(queue string, key []byte) error
+	// Count the number of jobs waiting in queue, and the number leased
+	Count(queue string) (ready, leased int, err error)
+	// Usage the number of jobs waiting in queue, and the bytes taken by their keys and values
+	Usage(queue string) (jobs int, bytes int64, err error)
+	// EvictBefore remove every job waiting in queue that was due at or before t. Returns the number removed
+	EvictBefore(queue string, t time.Time) (int, error)
+	// Evict remove waiting jobs from the front of queue, or the back if newest is set, until at least
+	// jobs jobs and bytes bytes have been removed. Returns the number removed
+	Evict(queue string, jobs int, bytes int64, newest bool) (int, error)
+	// Compact rewrite the store's file, giving back the space of removed jobs
+	Compact() error
+	// Path the file the store is kept in
+	Path() string
+	// Exclusive whether only one process at a time can use the store
+	Exclusive() bool
+	// Close release the store
+	Close() error
+}
+
+// Entry a job in a store, and the lease on it if it has been taken out of its queue
+type Entry struct {
+	Key   []byte
+	Value []byte
+	Lease *Lease
+}
+
+// Lease records who took a job out of its queue, and until when
+type Lease struct {
+	Owner   string    `json:"owner"`
+	Host    string    `json:"host"`
+	Pid     int       `json:"pid"`
+	Leased  time.Time `json:"leased"`
+	Expires time.Time `json:"expires"`
+}
+
+// StoreFactory open the store at path
+type StoreFactory func(path string) (JobStore, error)
+
+// LoadStore make a store available under name
+func LoadStore(name string, f StoreFactory) {
+	Stores[name] = f
+}
+
+// OpenStore open the store of type name at path
+func OpenStore(name, path string) (JobStore, error) {
+	if name == "" {
+		name = DEFAULT_STORE
+	}
+	f, ok := Stores[name]
+	if !ok {
+		return nil, STORE_NOT_EXIST
+	}
+	return f(path)
+}
+
+// IsDue whether the job under key is due at now. more is false once key is in the future in UTC, as
+// every key after it is later still. Keys that aren't names made by time_util return BAD_FORMAT
+func IsDue(key []byte, now time.Time) (due, more bool, err error) {
+	t, _, err := time_util.NameToTime(key)
+	if err != nil {
+		return false, true, err
+	}
+	if t.After(now) {
+		return false, !time_util.InUTC(key), nil
+	}
+	return true, true, nil
+}
@@ -0,0 +1,18 @@
+package database_test
+
+import (
+	"testing"
+
+	"github.com/barracudanetworks/GoWorker/database"
+	"github.com/barracudanetworks/GoWorker/database/storetest"
+)
+
+func TestBoltStore(t *testing.T) {
+	storetest.Run(t, "bolt", database.OpenBoltStore)
+}
+
+func TestOpenStore(t *testing.T) {
+	if _, err := database.OpenStore("nope", "nope.db"); err != database.STORE_NOT_EXIST {
+		t.Error("Expected an unknown store to be refused", err)
+	}
+}
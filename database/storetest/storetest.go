@@ -0,0 +1,515 @@
+// Package storetest is the conformance suite every database.JobStore must pass
+package storetest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/barracudanetworks/GoWorker/database"
+	"github.com/barracudanetworks/GoWorker/time_util"
+)
+
+const (
+	QUEUE = "storetest"
+)
+
+// Run run the conformance suite against the stores made by open
+func Run(t *testing.T, name string, open database.StoreFactory) {
+	tests := []struct {
+		name string
+		test func(*testing.T, database.JobStore)
+	}{
+		{"PutAndCount", testPutAndCount},
+		{"DueInOrder", testDueInOrder},
+		{"DueSkipsMalformed", testDueSkipsMalformed},
+		{"Lease", testLease},
+		{"LeaseValid", testLeaseValid},
+		{"Ack", testAck},
+		{"RenewAndRequeue", testRenewAndRequeue},
+		{"Queues", testQueues},
+		{"Usage", testUsage},
+		{"PutLimited", testPutLimited},
+		{"PutLeased", testPutLeased},
+		{"EvictBefore", testEvictBefore},
+		{"Evict", testEvict},
+		{"Compact", testCompact},
+	}
+	for _, test := range tests {
+		path := filepath.Join(os.TempDir(), fmt.Sprintf("goworker_storetest_%s_%s.db", name, test.name))
+		remove(path)
+		s, err := open(path)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		t.Run(test.name, func(t *testing.T) {
+			test.test(t, s)
+		})
+		if err = s.Close(); err != nil {
+			t.Error(name, test.name, err)
+		}
+		remove(path)
+	}
+
+	// jobs and leases outlive the store
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("goworker_storetest_%s_reopen.db", name))
+	remove(path)
+	defer remove(path)
+	t.Run("Reopen", func(t *testing.T) {
+		testReopen(t, path, open)
+	})
+}
+
+// remove remove a store's files
+func remove(path string) {
+	files, _ := filepath.Glob(path + "*")
+	for _, f := range files {
+		os.Remove(f)
+	}
+}
+
+// key the key of a job due at offset from now
+func key(now time.Time, offset time.Duration, suffix string) []byte {
+	return time_util.TimeToName(now.Add(offset), suffix)
+}
+
+// put add jobs under keys to queue, each job's value is its key
+func put(t *testing.T, s database.JobStore, queue string, keys ...[]byte) {
+	for _, k := range keys {
+		if err := s.Put(queue, k, k); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// keys the keys of entries
+func keys(entries []database.Entry) []string {
+	var ks []string
+	for _, e := range entries {
+		ks = append(ks, string(e.Key))
+	}
+	return ks
+}
+
+// count check the number of jobs ready and leased in queue
+func count(t *testing.T, s database.JobStore, queue string, ready, leased int) {
+	r, l, err := s.Count(queue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != ready || l != leased {
+		t.Errorf("Expected %d ready and %d leased, got %d and %d", ready, leased, r, l)
+	}
+}
+
+func testLease(t *testing.T, s database.JobStore) {
+	now := time.Now()
+	a, b, c := key(now, -3*time.Second, "a"), key(now, -2*time.Second, "b"), key(now, time.Hour, "c")
+	put(t, s, QUEUE, c, b, a)
+	l := lease(now)
+
+	entries, skipped, err := s.Lease(QUEUE, now, 10, l, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(keys(entries)) != fmt.Sprint([]string{string(a), string(b)}) || skipped != 0 {
+		t.Error("Expected the due jobs in order, got", keys(entries), skipped)
+	}
+	if string(entries[0].Value) != string(a) || entries[0].Lease == nil {
+		t.Error("Leased jobs should carry their value and lease", entries[0])
+	}
+	count(t, s, QUEUE, 1, 2)
+
+	// leased jobs are not due again
+	if entries, _, _ = s.Lease(QUEUE, now, 10, l, nil); len(entries) != 0 {
+		t.Error("Leased jobs were leased again", keys(entries))
+	}
+	if entries, _ = s.Due(QUEUE, now, 10); len(entries) != 0 {
+		t.Error("Leased jobs are still due", keys(entries))
+	}
+
+	leased, err := s.Leased(QUEUE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leased) != 2 || leased[0].Lease == nil || leased[0].Lease.Owner != l.Owner || !leased[0].Lease.Expires.Equal(l.Expires) {
+		t.Error("Leases were not kept", leased)
+	}
+}
+
+// lease a lease taken at now
+func lease(now time.Time) *database.Lease {
+	return &database.Lease{
+		Owner:   "storetest",
+		Host:    "localhost",
+		Pid:     os.Getpid(),
+		Leased:  now.Round(0),
+		Expires: now.Add(time.Minute).Round(0),
+	}
+}
+
+func testPutAndCount(t *testing.T, s database.JobStore) {
+	count(t, s, QUEUE, 0, 0)
+	now := time.Now()
+	put(t, s, QUEUE, key(now, 0, "a"), key(now, 0, "b"))
+	count(t, s, QUEUE, 2, 0)
+
+	// putting a key again replaces the job
+	if err := s.Put(QUEUE, key(now, 0, "a"), []byte("again")); err != nil {
+		t.Fatal(err)
+	}
+	count(t, s, QUEUE, 2, 0)
+	entries, err := s.Due(QUEUE, now, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || string(entries[0].Value) != "again" {
+		t.Error("Expected the job to be replaced", entries)
+	}
+}
+
+func testDueInOrder(t *testing.T, s database.JobStore) {
+	now := time.Now()
+	a, b, c := key(now, -3*time.Second, "a"), key(now, -2*time.Second, "b"), key(now, 0, "c")
+	put(t, s, QUEUE, c, a, key(now, time.Hour, "d"), b, key(now, 2*time.Hour, "e"))
+
+	entries, err := s.Due(QUEUE, now, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(keys(entries)) != fmt.Sprint([]string{string(a), string(b), string(c)}) {
+		t.Error("Expected the due jobs in order, got", keys(entries))
+	}
+	if entries, _ = s.Due(QUEUE, now, 2); len(entries) != 2 {
+		t.Error("Expected no more than 2 jobs, got", len(entries))
+	}
+
+	// the scan leaves the jobs where they are
+	count(t, s, QUEUE, 5, 0)
+}
+
+func testDueSkipsMalformed(t *testing.T, s database.JobStore) {
+	now := time.Now()
+	a := key(now, -time.Second, "a")
+
+	// written in local time, an hour from now but sorting before now in utc
+	local := []byte(now.Add(time.Hour).In(time.FixedZone("", -12*60*60)).Format(time_util.TIME_FORMAT) + "#local")
+	put(t, s, QUEUE, []byte("no separator"), local, a)
+
+	entries, skipped, err := s.Lease(QUEUE, now, 10, lease(now), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || string(entries[0].Key) != string(a) {
+		t.Error("Expected only the due job, got", keys(entries))
+	}
+	if skipped != 1 {
+		t.Error("Expected the malformed key to be skipped, skipped", skipped)
+	}
+	count(t, s, QUEUE, 2, 1)
+}
+
+func testLeaseValid(t *testing.T, s database.JobStore) {
+	now := time.Now()
+	a, b := key(now, -2*time.Second, "a"), key(now, -time.Second, "b")
+	put(t, s, QUEUE, a, b)
+
+	entries, skipped, err := s.Lease(QUEUE, now, 10, lease(now), func(v []byte) bool {
+		return string(v) != string(a)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || string(entries[0].Key) != string(b) || skipped != 1 {
+		t.Error("Expected the invalid job to be skipped, got", keys(entries), skipped)
+	}
+	count(t, s, QUEUE, 1, 1)
+}
+
+func testAck(t *testing.T, s database.JobStore) {
+	now := time.Now()
+	a := key(now, 0, "a")
+	put(t, s, QUEUE, a)
+	if _, _, err := s.Lease(QUEUE, now, 1, lease(now), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Ack(QUEUE, a); err != nil {
+		t.Fatal(err)
+	}
+	count(t, s, QUEUE, 0, 0)
+	if leased, _ := s.Leased(QUEUE); len(leased) != 0 {
+		t.Error("An acked job is still leased", keys(leased))
+	}
+
+	// acking twice does no harm
+	if err := s.Ack(QUEUE, a); err != nil {
+		t.Error(err)
+	}
+}
+
+func testRenewAndRequeue(t *testing.T, s database.JobStore) {
+	now := time.Now()
+	a := key(now, 0, "a")
+	put(t, s, QUEUE, a)
+	if err := s.Renew(QUEUE, a, lease(now)); err != database.NOT_LEASED {
+		t.Error("Only a leased job can be renewed", err)
+	}
+	if err := s.Requeue(QUEUE, a); err != database.NOT_LEASED {
+		t.Error("Only a leased job can be requeued", err)
+	}
+
+	if _, _, err := s.Lease(QUEUE, now, 1, lease(now), nil); err != nil {
+		t.Fatal(err)
+	}
+	renewed := lease(now.Add(time.Hour))
+	if err := s.Renew(QUEUE, a, renewed); err != nil {
+		t.Fatal(err)
+	}
+	leased, err := s.Leased(QUEUE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leased) != 1 || !leased[0].Lease.Expires.Equal(renewed.Expires) {
+		t.Error("The lease was not renewed", leased)
+	}
+
+	if err = s.Requeue(QUEUE, a); err != nil {
+		t.Fatal(err)
+	}
+	count(t, s, QUEUE, 1, 0)
+	entries, _ := s.Due(QUEUE, now, 10)
+	if len(entries) != 1 || string(entries[0].Key) != string(a) || string(entries[0].Value) != string(a) {
+		t.Error("The job was not put back under its key", entries)
+	}
+}
+
+func testQueues(t *testing.T, s database.JobStore) {
+	now := time.Now()
+	put(t, s, QUEUE, key(now, 0, "a"))
+	put(t, s, QUEUE+"_other", key(now, 0, "b"), key(now, 0, "c"))
+	count(t, s, QUEUE, 1, 0)
+	count(t, s, QUEUE+"_other", 2, 0)
+	count(t, s, QUEUE+"_empty", 0, 0)
+
+	entries, _, err := s.Lease(QUEUE, now, 10, lease(now), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Error("Expected only the queue's jobs, got", keys(entries))
+	}
+	count(t, s, QUEUE+"_other", 2, 0)
+}
+
+func testReopen(t *testing.T, path string, open database.StoreFactory) {
+	now := time.Now()
+	a, b := key(now, -time.Second, "a"), key(now, 0, "b")
+	s, err := open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put(t, s, QUEUE, a, b)
+	if _, _, err = s.Lease(QUEUE, now, 1, lease(now), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if s, err = open(path); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	count(t, s, QUEUE, 1, 1)
+	leased, err := s.Leased(QUEUE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leased) != 1 || string(leased[0].Key) != string(a) || leased[0].Lease == nil {
+		t.Error("The lease did not outlive the store", leased)
+	}
+}
+
+func testUsage(t *testing.T, s database.JobStore) {
+	now := time.Now()
+	a, b := key(now, 0, "a"), key(now, 0, "bb")
+	put(t, s, QUEUE, a, b)
+	jobs, bytes, err := s.Usage(QUEUE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jobs != 2 || bytes != int64(2*len(a)+2*len(b)) {
+		t.Error("Bad usage", jobs, bytes)
+	}
+
+	// leased jobs aren't waiting
+	if _, _, err = s.Lease(QUEUE, now, 1, lease(now), nil); err != nil {
+		t.Fatal(err)
+	}
+	if jobs, bytes, _ = s.Usage(QUEUE); jobs != 1 || bytes != int64(2*len(b)) {
+		t.Error("Bad usage once leased", jobs, bytes)
+	}
+	if jobs, bytes, _ = s.Usage(QUEUE + "_empty"); jobs != 0 || bytes != 0 {
+		t.Error("Bad usage of an empty queue", jobs, bytes)
+	}
+}
+
+func testPutLimited(t *testing.T, s database.JobStore) {
+	now := time.Now()
+	a := key(now, 0, "a")
+	if err := s.PutLimited(QUEUE, a, a, 1, int64(2*len(a))); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutLimited(QUEUE, key(now, 0, "b"), a, 1, 0); err != database.QUEUE_FULL {
+		t.Error("Expected", database.QUEUE_FULL, "over max jobs, got", err)
+	}
+	if err := s.PutLimited(QUEUE, key(now, 0, "b"), a, 0, int64(3*len(a))); err != database.QUEUE_FULL {
+		t.Error("Expected", database.QUEUE_FULL, "over max bytes, got", err)
+	}
+
+	// leased jobs don't count
+	if _, _, err := s.Lease(QUEUE, now, 1, lease(now), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// workers putting at once can't get past the limit between them
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			k := key(now, 0, fmt.Sprint("c", i))
+			if err := s.PutLimited(QUEUE, k, k, 5, 0); err != nil && err != database.QUEUE_FULL {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if jobs, _, _ := s.Usage(QUEUE); jobs != 5 {
+		t.Error("Expected the limit to hold, got", jobs, "jobs")
+	}
+}
+
+func testPutLeased(t *testing.T, s database.JobStore) {
+	now := time.Now()
+	a := key(now, 0, "a")
+	put(t, s, QUEUE, a)
+	if _, _, err := s.Lease(QUEUE, now, 1, lease(now), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// a leased job is left as it is
+	if err := s.Put(QUEUE, a, []byte("again")); err != database.LEASED {
+		t.Error("expected", database.LEASED, "got", err)
+	}
+	if err := s.PutLimited(QUEUE, a, []byte("again"), 0, 0); err != database.LEASED {
+		t.Error("expected", database.LEASED, "got", err)
+	}
+	count(t, s, QUEUE, 0, 1)
+	leased, err := s.Leased(QUEUE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leased) != 1 || string(leased[0].Value) != string(a) || leased[0].Lease == nil {
+		t.Error("The leased job was changed", leased)
+	}
+
+	// once it is back in the queue it can be replaced
+	if err = s.Requeue(QUEUE, a); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Put(QUEUE, a, []byte("again")); err != nil {
+		t.Fatal(err)
+	}
+	count(t, s, QUEUE, 1, 0)
+}
+
+func testEvictBefore(t *testing.T, s database.JobStore) {
+	now := time.Now()
+	old, older, fresh := key(now, -2*time.Hour, "old"), key(now, -3*time.Hour, "older"), key(now, -time.Minute, "fresh")
+	leasedOld := key(now, -4*time.Hour, "leased")
+	put(t, s, QUEUE, leasedOld)
+	if _, _, err := s.Lease(QUEUE, now, 1, lease(now), nil); err != nil {
+		t.Fatal(err)
+	}
+	put(t, s, QUEUE, old, []byte("no separator"), older, fresh, key(now, time.Hour, "future"))
+
+	n, err := s.EvictBefore(QUEUE, now.Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Error("Expected the 2 old jobs to be evicted, evicted", n)
+	}
+	entries, _ := s.Due(QUEUE, now, 10)
+	if fmt.Sprint(keys(entries)) != fmt.Sprint([]string{string(fresh)}) {
+		t.Error("Expected only the fresh job to be left due, got", keys(entries))
+	}
+
+	// leased and malformed jobs are left alone
+	count(t, s, QUEUE, 3, 1)
+}
+
+func testEvict(t *testing.T, s database.JobStore) {
+	now := time.Now()
+	var all [][]byte
+	for i := 0; i < 5; i++ {
+		all = append(all, key(now, time.Duration(i)*time.Second, fmt.Sprint(i)))
+	}
+	put(t, s, QUEUE, all...)
+
+	n, err := s.Evict(QUEUE, 2, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Error("Expected 2 jobs to be evicted, evicted", n)
+	}
+	n, err = s.Evict(QUEUE, 0, int64(2*len(all[4])+1), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Error("Expected enough of the newest jobs to cover the bytes to be evicted, evicted", n)
+	}
+	entries, _ := s.Due(QUEUE, now.Add(time.Hour), 10)
+	if fmt.Sprint(keys(entries)) != fmt.Sprint([]string{string(all[2])}) {
+		t.Error("Expected only the middle job to be left, got", keys(entries))
+	}
+
+	// there is only so much to evict
+	if n, _ = s.Evict(QUEUE, 10, 0, false); n != 1 {
+		t.Error("Expected the last job to be evicted, evicted", n)
+	}
+}
+
+func testCompact(t *testing.T, s database.JobStore) {
+	now := time.Now()
+	value := make([]byte, 1024)
+	for i := 0; i < 1000; i++ {
+		if err := s.Put(QUEUE, key(now, time.Duration(i)*time.Millisecond, fmt.Sprint(i)), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.Evict(QUEUE, 990, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	before, after, err := database.Compact(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after > before {
+		t.Error("The db grew when compacted", before, after)
+	}
+
+	// the store still works, and kept its jobs
+	count(t, s, QUEUE, 10, 0)
+	put(t, s, QUEUE, key(now, 0, "after"))
+	count(t, s, QUEUE, 11, 0)
+	if rep := database.ReportFile(s.Path()); rep["compactions"] != uint64(1) {
+		t.Error("Bad report", rep)
+	}
+}
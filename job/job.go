@@ -12,3 +12,15 @@ type Job interface {
 type JobConfirmer interface {
 	ConfirmJob(j Job) error
 }
+
+// ResultConfirmer is a JobConfirmer that also wants to know how the job went. The manager calls
+// ConfirmResult in place of ConfirmJob when a job's confirmer implements it, including for runs
+// that will be retried, which are confirmed before the retry starts
+type ResultConfirmer interface {
+	ConfirmResult(j Job, s *JobStats) error
+}
+
+// Identifier is a Job that its provider has given an id, such as the id of the stream entry it was read from
+type Identifier interface {
+	ID() string
+}
@@ -11,7 +11,36 @@ type JobConfig struct {
 	Params        json.RawMessage `json:"params"`         // Params list of parameters to be given to the job at call time
 	Type          string          `json:"type"`           // Type describes how this job can be run
 	raw           []byte          // holds the raw job config to be used at a later time
-	Retries       int             `json:"retries"` // Retries if this job fails, how many times should we retry
+	Retries       int             `json:"retries"`            // Retries if this job fails, how many times should we retry
+	Metadata      Metadata        `json:"metadata,omitempty"` // Metadata free form key value pairs that travel with the job, such as trace context
+	ReplyTo       string          `json:"reply_to,omitempty"` // ReplyTo where providers that support it should send the result of the job
+
+	// callbacks, the manager posts the result of the job to CallbackURL once it succeeds or fails for good
+	ID             string `json:"id,omitempty"`              // ID names the job in its callback. The id its provider gave it, or a random one, is used if empty
+	CallbackURL    string `json:"callback_url,omitempty"`    // CallbackURL where the manager should post the result of the job
+	CallbackSecret string `json:"callback_secret,omitempty"` // CallbackSecret signs the callback, in place of the manager's callback secret
+}
+
+// Metadata holds string key value pairs that travel with a job
+type Metadata map[string]string
+
+// Get returns the value for a key, or an empty string if it is not set
+func (m Metadata) Get(key string) string {
+	return m[key]
+}
+
+// Set sets the value for a key
+func (m Metadata) Set(key, value string) {
+	m[key] = value
+}
+
+// Keys returns every key that has been set
+func (m Metadata) Keys() []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
 }
 
 func (j *JobConfig) Raw() []byte {
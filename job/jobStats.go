@@ -15,6 +15,23 @@ const (
 
 type Status uint8
 
+// String the name of the status
+func (s Status) String() string {
+	switch s {
+	case STATUS_NEW:
+		return "new"
+	case STATUS_STARTED:
+		return "started"
+	case STATUS_SUCCESS:
+		return "success"
+	case STATUS_FAILURE:
+		return "failure"
+	case STATUS_RETRY:
+		return "retry"
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(s))
+}
+
 // JobStats holds information about a run of a job
 type JobStats struct {
 	startTime time.Time
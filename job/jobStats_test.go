@@ -5,3 +5,12 @@ import "testing"
 func TestCreateStats(t *testing.T) {
 
 }
+
+func TestStatusString(t *testing.T) {
+	if STATUS_SUCCESS.String() != "success" || STATUS_FAILURE.String() != "failure" || STATUS_RETRY.String() != "retry" {
+		t.Error("Bad status names")
+	}
+	if Status(42).String() != "unknown(42)" {
+		t.Error("Bad name for an unknown status", Status(42).String())
+	}
+}
@@ -0,0 +1,51 @@
+package job
+
+import (
+	"bytes"
+	"sync"
+)
+
+// OutputBuffer captures the output of a job, up to a limit
+type OutputBuffer struct {
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+	sync.Mutex
+}
+
+// NewOutputBuffer create a buffer that keeps the first max bytes written to it
+func NewOutputBuffer(max int) *OutputBuffer {
+	return &OutputBuffer{max: max}
+}
+
+// Write keep as much of p as there is room for. It never fails, so a job is not failed for having too much to say
+func (o *OutputBuffer) Write(p []byte) (int, error) {
+	o.Lock()
+	defer o.Unlock()
+	room := o.max - o.buf.Len()
+	if room < 0 {
+		room = 0
+	}
+	if len(p) > room {
+		o.truncated = true
+		o.buf.Write(p[:room])
+	} else {
+		o.buf.Write(p)
+	}
+	return len(p), nil
+}
+
+// Reset throw away the output of a run that is being retried
+func (o *OutputBuffer) Reset() {
+	o.Lock()
+	defer o.Unlock()
+	o.buf.Reset()
+	o.truncated = false
+}
+
+// String the captured output, and whether it was cut off
+func (o *OutputBuffer) String() (string, bool) {
+	o.Lock()
+	defer o.Unlock()
+	return o.buf.String(), o.truncated
+}
@@ -0,0 +1,29 @@
+package job
+
+import "testing"
+
+func TestOutputBuffer(t *testing.T) {
+	o := NewOutputBuffer(5)
+	if n, err := o.Write([]byte("hel")); n != 3 || err != nil {
+		t.Error("Bad write", n, err)
+	}
+	if n, err := o.Write([]byte("lo world")); n != 8 || err != nil {
+		t.Error("Output past the limit should be dropped quietly", n, err)
+	}
+	if s, truncated := o.String(); s != "hello" || !truncated {
+		t.Error("Bad output", s, truncated)
+	}
+	o.Reset()
+	if s, truncated := o.String(); s != "" || truncated {
+		t.Error("Output was not reset", s, truncated)
+	}
+
+	// a limit below nothing keeps nothing
+	o = NewOutputBuffer(-1)
+	if n, err := o.Write([]byte("hello")); n != 5 || err != nil {
+		t.Error("Bad write", n, err)
+	}
+	if s, truncated := o.String(); s != "" || !truncated {
+		t.Error("Bad output", s, truncated)
+	}
+}
@@ -1,9 +1,5 @@
--- given a hash wich is provided via KEYS[1]
--- delete the associated temporary job and lock
+-- given a lease token which is provided via ARGV[1]
+-- delete the in flight job from the hash in KEYS[1] and its lease from the sorted set in KEYS[2]
 
--- generate the keys to remove
-local job = "tmp_job:value:" .. KEYS[1]
-local lock = "tmp_job:lock:" .. KEYS[1]
-
--- remove the keys
-return redis.call("del", job,lock)
\ No newline at end of file
+redis.call("zrem", KEYS[2], ARGV[1])
+return redis.call("hdel", KEYS[1], ARGV[1])
@@ -1,3 +0,0 @@
-local keys = redis.call("keys", KEYS[1] .. "*")
-local vals = redis.call("mget", unpack(keys))
-return vals
\ No newline at end of file
@@ -1,72 +1,19 @@
-local keyMatchPatern = "%w+:%w+:(%w+)"
-
--- find every orphan key
-local function findOrphanKeys(keys,locks)
-	local newKeys = {}
-	local i = 1
-	for k,v in pairs(keys) do
-		if locks[k] == nil then
-			newKeys[#newKeys + 1] = v
-		end
-	end
-	return newKeys
-end
-
--- for every value-key, check if it has a lock
-local function FlipHashes(t)
-	local tbl = {}
-	for k,v in pairs(t) do 
-		local s = string.match(v, keyMatchPatern)
-		tbl[s] = v
-	end
-	return tbl
-end
-
--- get hashes
-local function getHashes(t) 
-	local keys = {}
-	for k, v in pairs(t) do
-		local s = string.match(v, keyMatchPatern)
-		keys[k] = s 
-	end
-	return keys
-end
--- get all of the keys and locks of all jobs in progress
-local keys = redis.call("keys", "tmp_job:value:*")
-local locks = redis.call("keys", "tmp_job:lock:*")
-local value_keys = keys
--- get all of the hashes from the complex keys
-locks = FlipHashes(locks)
-keys = FlipHashes(keys)
-
--- find all of the orphans if they exist 
-local orphanKeys = findOrphanKeys(keys,locks)
-
--- if there are no orphans, just return a empty table
-if #orphanKeys == 0 then
-	return orphanKeys 
-end
-
--- get all of the orphans and set a lock on them
-local orphans =  redis.call("mget", unpack(orphanKeys))
-
--- get all of the orphan hashes 
-local orphanHashes = getHashes(orphanKeys)
-
-local max = #orphanKeys 
-if ARGV[1] ~= nil then
-	max = tonumber(ARGV[1])
-end
-
-local count = 0
--- set locks and ttl's on each of the new jobs
-for k,v in pairs(orphanKeys) do
-	redis.call("set", "tmp_job:lock:" .. v, "")
-	redis.call("expire", "tmp_job:lock:" .. v, 30)
-	if count >= max then
-		break
+-- find up to ARGV[3] jobs whose lease expired before ARGV[1] and lease them again until ARGV[2]
+-- KEYS[1] is the hash of in flight jobs, KEYS[2] is the sorted set of lease expiry times
+-- returns a flat list of lease token, value pairs
+
+local tokens = redis.call("zrangebyscore", KEYS[2], "-inf", ARGV[1], "LIMIT", 0, ARGV[3])
+local orphans = {}
+for _, token in ipairs(tokens) do
+	local val = redis.call("hget", KEYS[1], token)
+	if val then
+		redis.call("zadd", KEYS[2], ARGV[2], token)
+		orphans[#orphans + 1] = token
+		orphans[#orphans + 1] = val
+	else
+		-- the job is gone, so is its lease
+		redis.call("zrem", KEYS[2], token)
 	end
-	count = count + 1
 end
 
-return {unpack(orphans, 1, max)}
\ No newline at end of file
+return orphans
@@ -1,2 +1,8 @@
--- set the ttl
-redis.call("expire", KEYS[1], ARGV[1])
\ No newline at end of file
+-- push back the expiry of the lease ARGV[1] in the sorted set KEYS[1] to ARGV[2]
+-- returns 0 if the lease no longer exists
+
+if not redis.call("zscore", KEYS[1], ARGV[1]) then
+	return 0
+end
+redis.call("zadd", KEYS[1], ARGV[2], ARGV[1])
+return 1
@@ -0,0 +1,128 @@
+/*
+Package lua holds the lua scripts the redis provider runs. The scripts are compiled into the binary,
+and any of them may be replaced by a file of the same name in an override directory.
+*/
+package lua
+
+import (
+	"crypto/sha1"
+	"embed"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	redigo "github.com/garyburd/redigo/redis"
+)
+
+const (
+	// confirm deletes a confirmed job and its lease
+	// KEYS: 0 in flight hash 1 lease set ARGS: 0 lease token
+	CONFIRM = "confirm.lua"
+
+	// get orphan leases jobs again whose leases have expired
+	// KEYS: 0 in flight hash 1 lease set ARGS: 0 now 1 new expiry in milliseconds 2 max jobs
+	GET_ORPHAN = "getOrphan.lua"
+
+	// keep alive pushes back the expiry of a lease
+	// KEYS: 0 lease set ARGS: 0 lease token 1 expiry in milliseconds
+	KEEP_ALIVE = "keepAlive.lua"
+
+	// pop and lock pops a job off of a list, holds on to it in a hash, and leases it
+	// KEYS: 0 list 1 in flight hash 2 lease set ARGS: 0 expiry in milliseconds 1 lease token
+	POP_AND_LOCK = "popAndLock.lua"
+
+	// requeue legacy puts a job left in flight by the old key per job layout back on a list, once its lock has expired
+	// KEYS: 0 job 1 lock 2 list
+	REQUEUE_LEGACY = "requeueLegacy.lua"
+)
+
+var (
+	// the number of keys each script takes
+	KEY_COUNTS = map[string]int{
+		CONFIRM:      2,
+		GET_ORPHAN:   2,
+		KEEP_ALIVE:   1,
+		POP_AND_LOCK: 3,
+
+		REQUEUE_LEGACY: 3,
+	}
+
+	//go:embed *.lua
+	embedded embed.FS
+)
+
+// Scripts is the set of scripts used by a redis provider
+type Scripts struct {
+	Confirm    *redigo.Script
+	GetOrphan  *redigo.Script
+	KeepAlive  *redigo.Script
+	PopAndLock *redigo.Script
+
+	RequeueLegacy *redigo.Script
+
+	// Version identifies the exact source of every script in the set
+	Version string
+
+	// Overridden lists the scripts that were read from the override directory
+	Overridden []string
+}
+
+// Load the scripts compiled into the binary, replacing any that have a file of the same name in dir.
+// dir may be empty, or not exist, in which case only the compiled in scripts are used
+func Load(dir string) (*Scripts, error) {
+	names := make([]string, 0, len(KEY_COUNTS))
+	for name := range KEY_COUNTS {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	s := &Scripts{}
+	scripts := make(map[string]*redigo.Script, len(names))
+	version := sha1.New()
+	for _, name := range names {
+		src, overridden, err := source(dir, name)
+		if err != nil {
+			return nil, err
+		}
+		if overridden {
+			s.Overridden = append(s.Overridden, name)
+		}
+		scripts[name] = redigo.NewScript(KEY_COUNTS[name], string(src))
+		fmt.Fprintf(version, "%s:%s\n", name, scripts[name].Hash())
+	}
+
+	s.Confirm = scripts[CONFIRM]
+	s.GetOrphan = scripts[GET_ORPHAN]
+	s.KeepAlive = scripts[KEEP_ALIVE]
+	s.PopAndLock = scripts[POP_AND_LOCK]
+	s.RequeueLegacy = scripts[REQUEUE_LEGACY]
+	s.Version = fmt.Sprintf("%x", version.Sum(nil))[:12]
+	return s, nil
+}
+
+// source read a script from dir if it is there, otherwise from the compiled in scripts
+func source(dir, name string) ([]byte, bool, error) {
+	if dir != "" {
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err == nil {
+			return b, true, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, false, err
+		}
+	}
+	b, err := embedded.ReadFile(name)
+	return b, false, err
+}
+
+// Preload load every script into redis' script cache so the first run of each is an EVALSHA
+func (s *Scripts) Preload(c redigo.Conn) error {
+	for _, script := range []*redigo.Script{s.Confirm, s.GetOrphan, s.KeepAlive, s.PopAndLock, s.RequeueLegacy} {
+		if err := script.Load(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
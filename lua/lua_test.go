@@ -0,0 +1,56 @@
+package lua
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadEmbedded(t *testing.T) {
+	s, err := Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Confirm == nil || s.GetOrphan == nil || s.KeepAlive == nil || s.PopAndLock == nil || s.RequeueLegacy == nil {
+		t.Error("Not every script was loaded")
+	}
+	if len(s.Overridden) != 0 {
+		t.Error("No scripts should be overridden", s.Overridden)
+	}
+
+	// a directory without scripts changes nothing
+	same, err := Load(os.TempDir() + "/goworker_no_such_lua_dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if same.Version != s.Version {
+		t.Error("Version should only depend on the scripts")
+	}
+}
+
+func TestLoadOverride(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goworker_lua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = ioutil.WriteFile(filepath.Join(dir, CONFIRM), []byte("return 1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	embedded, _ := Load("")
+	s, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Overridden) != 1 || s.Overridden[0] != CONFIRM {
+		t.Error("Confirm should be overridden", s.Overridden)
+	}
+	if s.Confirm.Hash() == embedded.Confirm.Hash() || s.KeepAlive.Hash() != embedded.KeepAlive.Hash() {
+		t.Error("Only the confirm script should have changed")
+	}
+	if s.Version == embedded.Version {
+		t.Error("An overridden script should change the version")
+	}
+}
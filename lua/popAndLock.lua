@@ -1,24 +1,21 @@
+-- pop a job off of the list in KEYS[1] and lease it
+-- KEYS[2] is the hash of in flight jobs, KEYS[3] is the sorted set of lease expiry times
+-- ARGV[1] is the time the lease expires, in milliseconds, ARGV[2] is a token unique to this lease
 
 -- grab the value
 local val = redis.call("lpop", KEYS[1])
+if not val then
+	return false
+end
 
-local hash = redis.sha1hex(val)
--- init keys
-local valKey = "tmp_job:value:" .. hash
-local lockKey = "tmp_job:lock:" .. hash
-
--- set it as a temparay job 
-redis.call("set", valKey, val)
+-- jobs are not keyed by their value, identical jobs must each get their own lease
+local token = ARGV[2]
 
--- set a lock on the file
-redis.call("set", lockKey,"")
+-- hold on to the job until it is confirmed
+redis.call("hset", KEYS[2], token, val)
 
--- set a ttl on lock
-local ttl = 30
-if type(ARGV[1]) ~= nil then
-	ttl = ARGV[1]
-end
-redis.call("expire", lockKey, ttl)
+-- lease it
+redis.call("zadd", KEYS[3], ARGV[1], token)
 
--- return the value and lockKey
-return val 
\ No newline at end of file
+-- return the lease token and the value
+return {token, val}
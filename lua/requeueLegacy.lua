@@ -0,0 +1,15 @@
+-- put a job left in flight by the old layout, which kept each job under its own key, back on a list
+-- KEYS[1] holds the job, KEYS[2] is its lock, which only exists while a manager still holds the job, KEYS[3] is the list
+
+if redis.call("exists", KEYS[2]) == 1 then
+	return 0
+end
+local val = redis.call("get", KEYS[1])
+if not val then
+	return 0
+end
+
+-- to the front of the list, so it runs next
+redis.call("lpush", KEYS[3], val)
+redis.call("del", KEYS[1])
+return 1
@@ -0,0 +1,215 @@
+package manager
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/barracudanetworks/GoWorker/job"
+	"github.com/barracudanetworks/GoWorker/provider"
+)
+
+const (
+	MAX_RECENT_FAILURES = 50
+)
+
+// InFlightReport describes a job that is currently being worked on
+type InFlightReport struct {
+	Name     string        `json:"name"`
+	Type     string        `json:"type"`
+	Provider string        `json:"provider"`
+	Started  time.Time     `json:"started"`
+	Running  time.Duration `json:"running"`
+}
+
+// FailureReport describes a job that failed after exhausting its retries
+type FailureReport struct {
+	Name     string        `json:"name"`
+	Type     string        `json:"type"`
+	Provider string        `json:"provider"`
+	Retries  int           `json:"retries"`
+	Duration time.Duration `json:"duration"`
+	Time     time.Time     `json:"time"`
+}
+
+// ProviderStatus describes the most recent interaction the manager had with a provider
+type ProviderStatus struct {
+	Name        string    `json:"name"`
+	Target      float64   `json:"target"`
+	LastRequest time.Time `json:"last_request"`
+	Requested   uint64    `json:"requested"`
+	LastError   string    `json:"last_error"`
+
+	// Report is filled in by providers that implement provider.Reporter
+	Report map[string]interface{} `json:"report,omitempty"`
+}
+
+// activity keeps track of what the manager is doing right now
+type activity struct {
+	inFlight     map[job.Job]time.Time
+	failures     []FailureReport
+	providers    map[provider.Provider]*ProviderStatus
+	lastReceived map[provider.Provider]time.Time
+	sync.Mutex
+}
+
+// newActivity initializes and returns a new activity tracker
+func newActivity() *activity {
+	return &activity{
+		inFlight:     make(map[job.Job]time.Time),
+		failures:     make([]FailureReport, 0, MAX_RECENT_FAILURES),
+		providers:    make(map[provider.Provider]*ProviderStatus),
+		lastReceived: make(map[provider.Provider]time.Time),
+	}
+}
+
+// started mark a job as in flight
+func (a *activity) started(j job.Job, t time.Time) {
+	a.Lock()
+	a.inFlight[j] = t
+	a.Unlock()
+}
+
+// finished mark a job as no longer in flight
+func (a *activity) finished(j job.Job) {
+	a.Lock()
+	delete(a.inFlight, j)
+	a.Unlock()
+}
+
+// failed record a job that has failed for good. Only the most recent failures are kept
+func (a *activity) failed(j job.Job, s *job.JobStats) {
+	conf := j.Config()
+	f := FailureReport{
+		Name:     conf.Name,
+		Type:     conf.Type,
+		Provider: providerName(j),
+		Retries:  s.Retries(),
+		Duration: s.Duration(),
+		Time:     time.Now(),
+	}
+	a.Lock()
+	if len(a.failures) == MAX_RECENT_FAILURES {
+		a.failures = append(a.failures[:0], a.failures[1:]...)
+	}
+	a.failures = append(a.failures, f)
+	a.Unlock()
+}
+
+// requested record a request for work from a provider
+func (a *activity) requested(p provider.Provider, n int) {
+	a.Lock()
+	s := a.providerStatus(p)
+	s.LastRequest = time.Now()
+	s.Requested += uint64(n)
+	a.Unlock()
+}
+
+// answered record the outcome of the last request for work from a provider
+func (a *activity) answered(p provider.Provider, err error) {
+	a.Lock()
+	s := a.providerStatus(p)
+	s.LastError = ""
+	if err != nil {
+		s.LastError = err.Error()
+	}
+	a.Unlock()
+}
+
+// fetched returns the time the manager started waiting on the provider for a job received at t.
+// That is the later of the last request for work, and the last job received from the provider
+func (a *activity) fetched(j job.Job, t time.Time) time.Time {
+	p, ok := j.JobConfirmer().(provider.Provider)
+	if !ok {
+		return t
+	}
+	a.Lock()
+	defer a.Unlock()
+	start := a.lastReceived[p]
+	if s, ok := a.providers[p]; ok && s.LastRequest.After(start) {
+		start = s.LastRequest
+	}
+	a.lastReceived[p] = t
+	return start
+}
+
+// providerStatus get the status of a provider, creating it if we haven't seen it before. The caller must hold the lock
+func (a *activity) providerStatus(p provider.Provider) *ProviderStatus {
+	s, ok := a.providers[p]
+	if !ok {
+		s = &ProviderStatus{}
+		a.providers[p] = s
+	}
+	s.Name = p.Name()
+	s.Target = p.Target()
+	return s
+}
+
+// collectInFlight list every job in flight, longest running first
+func (a *activity) collectInFlight() []InFlightReport {
+	now := time.Now()
+	a.Lock()
+	r := make([]InFlightReport, 0, len(a.inFlight))
+	for j, t := range a.inFlight {
+		conf := j.Config()
+		r = append(r, InFlightReport{
+			Name:     conf.Name,
+			Type:     conf.Type,
+			Provider: providerName(j),
+			Started:  t,
+			Running:  now.Sub(t),
+		})
+	}
+	a.Unlock()
+	sort.Sort(byRunning(r))
+	return r
+}
+
+// collectFailures list the most recent failures, newest first
+func (a *activity) collectFailures() []FailureReport {
+	a.Lock()
+	defer a.Unlock()
+	r := make([]FailureReport, len(a.failures))
+	for i := range a.failures {
+		r[len(r)-1-i] = a.failures[i]
+	}
+	return r
+}
+
+// collectProviders list the status of every provider the manager has requested work from, by name
+func (a *activity) collectProviders() []ProviderStatus {
+	a.Lock()
+	r := make([]ProviderStatus, 0, len(a.providers))
+	for p, s := range a.providers {
+		status := *s
+		if rep, ok := p.(provider.Reporter); ok {
+			status.Report = rep.Report()
+		}
+		r = append(r, status)
+	}
+	a.Unlock()
+	sort.Sort(byName(r))
+	return r
+}
+
+// providerName the name of the provider a job came from
+func providerName(j job.Job) string {
+	if p, ok := j.JobConfirmer().(provider.Provider); ok {
+		return p.Name()
+	}
+	return ""
+}
+
+// byRunning sorts in flight jobs by how long they have been running
+type byRunning []InFlightReport
+
+func (b byRunning) Len() int           { return len(b) }
+func (b byRunning) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byRunning) Less(i, j int) bool { return b[i].Running > b[j].Running }
+
+// byName sorts provider statuses by the name of the provider
+type byName []ProviderStatus
+
+func (b byName) Len() int           { return len(b) }
+func (b byName) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byName) Less(i, j int) bool { return b[i].Name < b[j].Name }
@@ -0,0 +1,302 @@
+package manager
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/barracudanetworks/GoWorker/auth"
+	"github.com/barracudanetworks/GoWorker/config"
+	"github.com/barracudanetworks/GoWorker/job"
+)
+
+const (
+	// CALLBACK_ATTEMPT_HEADER which try at posting a callback a request is, starting from 1
+	CALLBACK_ATTEMPT_HEADER = "X-Callback-Attempt"
+)
+
+var (
+	BAD_CALLBACK_URL = errors.New("manager: callback_url must be an http or https url")
+
+	// MAX_CALLBACK_OUTPUT the most captured output to send in a callback, the rest is cut off
+	MAX_CALLBACK_OUTPUT = 64 * 1024
+)
+
+// Callback is posted to a job's callback_url once the job succeeds or fails for good
+type Callback struct {
+	ID        string        `json:"id"`
+	Name      string        `json:"name"`
+	Type      string        `json:"type"`
+	Provider  string        `json:"provider,omitempty"`
+	Status    string        `json:"status"`
+	Duration  time.Duration `json:"duration"`
+	Retries   int           `json:"retries"`
+	Output    string        `json:"output,omitempty"`
+	Truncated bool          `json:"truncated,omitempty"`
+	Metadata  job.Metadata  `json:"metadata,omitempty"`
+	Time      time.Time     `json:"time"`
+}
+
+// CallbackReport what has become of the callbacks the manager has posted
+type CallbackReport struct {
+	Pending int    `json:"pending"`
+	Sent    uint64 `json:"sent"`
+	Retried uint64 `json:"retried"`
+	Failed  uint64 `json:"failed"`
+}
+
+// pendingCallback what the manager keeps about a job with a callback_url while it is running
+type pendingCallback struct {
+	output  *job.OutputBuffer
+	own     bool
+	retries int
+}
+
+// callbacks posts the result of jobs with a callback_url to it once they succeed or fail for good,
+// trying again with a growing wait when the post fails
+type callbacks struct {
+	client      *http.Client
+	secret      []byte
+	maxAttempts int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	jobs        map[job.Job]*pendingCallback
+	pending     int
+	sent        uint64
+	retried     uint64
+	failed      uint64
+	closed      bool
+	killChan    chan struct{}
+	wg          sync.WaitGroup
+	sync.Mutex
+}
+
+// newCallbacks set up posting callbacks as configured by conf
+func newCallbacks(conf config.CallbackConfig) (*callbacks, error) {
+	c := &callbacks{
+		secret:      []byte(conf.Secret),
+		maxAttempts: conf.MaxAttempts,
+		jobs:        make(map[job.Job]*pendingCallback),
+		killChan:    make(chan struct{}),
+	}
+	timeout, err := time.ParseDuration(conf.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	c.client = &http.Client{Timeout: timeout}
+	if c.backoff, err = time.ParseDuration(conf.Backoff); err != nil {
+		return nil, err
+	}
+	if c.maxBackoff, err = time.ParseDuration(conf.MaxBackoff); err != nil {
+		return nil, err
+	}
+	if c.maxAttempts < 1 {
+		c.maxAttempts = 1
+	}
+	return c, nil
+}
+
+// received note a job the manager is about to run. The output of a job that captures its output is kept for its
+// callback, and thrown away when the job is run again
+func (c *callbacks) received(j job.Job) {
+	conf := j.Config()
+	if conf.CallbackURL == "" {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	pc, ok := c.jobs[j]
+	if ok {
+		pc.retries += 1
+		if pc.own {
+			pc.output.Reset()
+		}
+		return
+	}
+
+	// share the output a provider is already keeping, and resetting between runs, for itself
+	pc = &pendingCallback{}
+	if conf.CaptureOutput {
+		switch w := conf.OutputWriter.(type) {
+		case *job.OutputBuffer:
+			pc.output = w
+		case nil:
+			pc.output = job.NewOutputBuffer(MAX_CALLBACK_OUTPUT)
+			pc.own = true
+			conf.OutputWriter = pc.output
+		}
+	}
+	c.jobs[j] = pc
+}
+
+// done post the callback of a job that has succeeded or failed for good
+func (c *callbacks) done(j job.Job, s *job.JobStats) {
+	conf := j.Config()
+	if conf.CallbackURL == "" {
+		return
+	}
+	c.Lock()
+	pc, ok := c.jobs[j]
+	delete(c.jobs, j)
+	if !ok {
+		pc = &pendingCallback{}
+	}
+	cb := &Callback{
+		ID:       callbackID(j),
+		Name:     conf.Name,
+		Type:     conf.Type,
+		Provider: providerName(j),
+		Status:   s.Status().String(),
+		Duration: s.Duration(),
+		Retries:  pc.retries,
+		Metadata: conf.Metadata,
+		Time:     time.Now(),
+	}
+	if pc.output != nil {
+		cb.Output, cb.Truncated = pc.output.String()
+	}
+	if c.closed {
+		c.failed += 1
+		c.Unlock()
+		log.Println("Not posting the callback of", conf.Name, "the manager is stopping")
+		return
+	}
+	c.pending += 1
+	c.wg.Add(1)
+	c.Unlock()
+
+	secret := c.secret
+	if conf.CallbackSecret != "" {
+		secret = []byte(conf.CallbackSecret)
+	}
+	body, err := json.Marshal(cb)
+	if err != nil {
+		c.finished(err)
+		return
+	}
+	go c.deliver(conf.CallbackURL, secret, body)
+}
+
+// deliver post body to url until it is accepted, it is refused for good, or max_attempts is reached
+func (c *callbacks) deliver(url string, secret, body []byte) {
+	wait := c.backoff
+	for attempt := 1; ; attempt++ {
+		retry, err := c.post(url, secret, body, attempt)
+		if err == nil || !retry || attempt >= c.maxAttempts {
+			if err != nil {
+				log.Println("Unable to post callback to", url, err)
+			}
+			c.finished(err)
+			return
+		}
+		log.Printf("Posting callback to %s failed, trying again in %s: %s", url, wait, err)
+		select {
+		case <-time.After(wait):
+		case <-c.killChan:
+			log.Println("Gave up posting callback to", url, "the manager is stopping")
+			c.finished(err)
+			return
+		}
+		c.Lock()
+		c.retried += 1
+		c.Unlock()
+		if wait *= 2; wait > c.maxBackoff {
+			wait = c.maxBackoff
+		}
+	}
+}
+
+// post try posting a callback once. Returns whether it is worth trying again if it wasn't accepted
+func (c *callbacks) post(url string, secret, body []byte, attempt int) (bool, error) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return false, BAD_CALLBACK_URL
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(CALLBACK_ATTEMPT_HEADER, strconv.Itoa(attempt))
+
+	// signed the same way as requests to the http provider
+	if len(secret) > 0 {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(auth.TIMESTAMP_HEADER, ts)
+		req.Header.Set(auth.SIGNATURE_HEADER, auth.Sign(secret, ts, req.Method, req.URL.RequestURI(), body))
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusRequestTimeout:
+		return true, fmt.Errorf("manager: callback answered %s", resp.Status)
+	}
+	return false, fmt.Errorf("manager: callback refused with %s", resp.Status)
+}
+
+// finished count a callback that was, or failed to be, posted
+func (c *callbacks) finished(err error) {
+	c.Lock()
+	defer c.Unlock()
+	c.pending -= 1
+	if err == nil {
+		c.sent += 1
+	} else {
+		c.failed += 1
+	}
+	c.wg.Done()
+}
+
+// Close stop trying callbacks again, and wait on the posts in progress
+func (c *callbacks) Close() {
+	c.Lock()
+	if !c.closed {
+		c.closed = true
+		close(c.killChan)
+	}
+	c.Unlock()
+	c.wg.Wait()
+}
+
+// report what has become of the callbacks posted so far
+func (c *callbacks) report() *CallbackReport {
+	if c == nil {
+		return nil
+	}
+	c.Lock()
+	defer c.Unlock()
+	return &CallbackReport{
+		Pending: c.pending,
+		Sent:    c.sent,
+		Retried: c.retried,
+		Failed:  c.failed,
+	}
+}
+
+// callbackID the id a job goes by in its callback: the one it was given, the one its provider gave it, or a random one
+func callbackID(j job.Job) string {
+	if id := j.Config().ID; id != "" {
+		return id
+	}
+	if i, ok := j.(job.Identifier); ok && i.ID() != "" {
+		return i.ID()
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
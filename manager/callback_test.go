@@ -0,0 +1,200 @@
+package manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/barracudanetworks/GoWorker/auth"
+	"github.com/barracudanetworks/GoWorker/config"
+	"github.com/barracudanetworks/GoWorker/job"
+)
+
+// callbackJob is a job with a callback_url
+type callbackJob struct {
+	conf *job.JobConfig
+}
+
+func (c *callbackJob) Config() *job.JobConfig {
+	return c.conf
+}
+
+func (c *callbackJob) JobConfirmer() job.JobConfirmer {
+	return c
+}
+
+func (c *callbackJob) ConfirmJob(j job.Job) error {
+	return nil
+}
+
+func callbacksHelper(t *testing.T, edit func(*config.CallbackConfig)) *callbacks {
+	conf := config.DefaultAppConfig().Callback
+	conf.Backoff = "1ms"
+	conf.MaxBackoff = "4ms"
+	if edit != nil {
+		edit(&conf)
+	}
+	c, err := newCallbacks(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// settle wait for every callback to be posted, or given up on
+func settle(t *testing.T, c *callbacks) {
+	for i := 0; c.report().Pending > 0; i++ {
+		if i > 500 {
+			t.Fatal("callbacks still pending")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Close()
+}
+
+// callbackServer answers callbacks with the given status codes in turn, then with 200s, and passes on what it was sent
+func callbackServer(codes ...int) (*httptest.Server, chan *http.Request, chan []byte) {
+	reqs := make(chan *http.Request, 10)
+	bodies := make(chan []byte, 10)
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		b, _ := ioutil.ReadAll(req.Body)
+		reqs <- req
+		bodies <- b
+		if len(codes) > 0 {
+			rw.WriteHeader(codes[0])
+			codes = codes[1:]
+		}
+	})), reqs, bodies
+}
+
+func TestCallback(t *testing.T) {
+	srv, reqs, bodies := callbackServer(http.StatusServiceUnavailable)
+	defer srv.Close()
+	c := callbacksHelper(t, func(conf *config.CallbackConfig) {
+		conf.Secret = "secret"
+	})
+	j := &callbackJob{&job.JobConfig{
+		ID:            "job-1",
+		Name:          "test",
+		Type:          "cli",
+		CaptureOutput: true,
+		CallbackURL:   srv.URL + "/done?from=goworker",
+		Metadata:      job.Metadata{"a": "b"},
+	}}
+
+	// output of a run that is retried isn't sent
+	c.received(j)
+	fmt.Fprint(j.conf.OutputWriter, "first run")
+	c.received(j)
+	fmt.Fprint(j.conf.OutputWriter, "second run")
+	s := job.NewJobStats()
+	s.End(job.STATUS_SUCCESS)
+	c.done(j, s)
+	settle(t, c)
+
+	<-reqs
+	<-bodies
+	req, body := <-reqs, <-bodies
+	if req.Header.Get(CALLBACK_ATTEMPT_HEADER) != "2" {
+		t.Error("expected a second attempt, got", req.Header.Get(CALLBACK_ATTEMPT_HEADER))
+	}
+	ts := req.Header.Get(auth.TIMESTAMP_HEADER)
+	if sig := auth.Sign([]byte("secret"), ts, "POST", "/done?from=goworker", body); req.Header.Get(auth.SIGNATURE_HEADER) != sig {
+		t.Error("bad signature", req.Header.Get(auth.SIGNATURE_HEADER))
+	}
+	cb := &Callback{}
+	if err := json.Unmarshal(body, cb); err != nil {
+		t.Fatal(err)
+	}
+	if cb.ID != "job-1" || cb.Status != "success" || cb.Retries != 1 || cb.Output != "second run" || cb.Metadata["a"] != "b" {
+		t.Error("unexpected callback", string(body))
+	}
+	if r := c.report(); r.Sent != 1 || r.Retried != 1 || r.Failed != 0 || r.Pending != 0 {
+		t.Error("unexpected report", r)
+	}
+}
+
+func TestCallbackGivesUp(t *testing.T) {
+	for _, tc := range []struct {
+		codes    []int
+		attempts int
+	}{
+		{[]int{http.StatusBadRequest}, 1},
+		{[]int{500, 500, 500, 500}, 3},
+	} {
+		srv, reqs, _ := callbackServer(tc.codes...)
+		c := callbacksHelper(t, func(conf *config.CallbackConfig) {
+			conf.MaxAttempts = 3
+		})
+		j := &callbackJob{&job.JobConfig{Name: "test", CallbackURL: srv.URL}}
+		c.received(j)
+		s := job.NewJobStats()
+		s.End(job.STATUS_FAILURE)
+		c.done(j, s)
+		settle(t, c)
+		srv.Close()
+
+		if len(reqs) != tc.attempts {
+			t.Error(tc.codes, "expected", tc.attempts, "attempts got", len(reqs))
+		}
+		req := <-reqs
+		if req.Header.Get(auth.SIGNATURE_HEADER) != "" {
+			t.Error("callback signed without a secret")
+		}
+		if r := c.report(); r.Failed != 1 || r.Sent != 0 {
+			t.Error("unexpected report", r)
+		}
+	}
+}
+
+func TestCallbackStopping(t *testing.T) {
+	c := callbacksHelper(t, func(conf *config.CallbackConfig) {
+		conf.Timeout = "1s"
+		conf.Backoff = "1h"
+	})
+	j := &callbackJob{&job.JobConfig{Name: "test", CallbackURL: "http://127.0.0.1:1/"}}
+	s := job.NewJobStats()
+	s.End(job.STATUS_SUCCESS)
+	c.done(j, s)
+
+	// the wait before trying again is cut short
+	done := make(chan struct{})
+	go func() {
+		c.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("close waited on the backoff")
+	}
+	c.done(j, s)
+	if r := c.report(); r.Failed != 2 || r.Pending != 0 {
+		t.Error("unexpected report", r)
+	}
+}
+
+func TestCallbackID(t *testing.T) {
+	j := &callbackJob{&job.JobConfig{}}
+	if a, b := callbackID(j), callbackID(j); len(a) != 32 || a == b {
+		t.Error("expected random ids", a, b)
+	}
+	j.conf.ID = "given"
+	if id := callbackID(j); id != "given" {
+		t.Error("expected the job's own id, got", id)
+	}
+}
+
+func TestCallbackBadURL(t *testing.T) {
+	c := callbacksHelper(t, nil)
+	if retry, err := c.post("ftp://example.com/", nil, nil, 1); retry || err != BAD_CALLBACK_URL {
+		t.Error("expected", BAD_CALLBACK_URL, "got", retry, err)
+	}
+	if _, err := newCallbacks(config.CallbackConfig{Timeout: "soon"}); err == nil {
+		t.Error("bad timeout accepted")
+	}
+}
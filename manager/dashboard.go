@@ -0,0 +1,84 @@
+package manager
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/barracudanetworks/GoWorker/auth"
+)
+
+var (
+	// STREAM_INTERVAL how often a new stats report is pushed to dashboard clients
+	STREAM_INTERVAL = time.Second
+
+	// STREAM_TOKEN_TTL how long a token for the stats stream may be used to connect with
+	STREAM_TOKEN_TTL = time.Minute
+
+	//go:embed dashboard.html
+	dashboardHtml []byte
+)
+
+// ServeDashboard an http.HandlerFunc that serves the single page dashboard
+func (m *ManagerStats) ServeDashboard(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "text/html; charset=utf-8")
+	w.Write(dashboardHtml)
+}
+
+// streamToken the body of a response to /manager/stats/token
+type streamToken struct {
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+// ServeStreamToken an http.HandlerFunc that hands out a short-lived token the stats stream can be connected to with,
+// for the key the request was made with
+func (m *ManagerStats) ServeStreamToken(w http.ResponseWriter, r *http.Request) {
+	st := &streamToken{
+		Token:   auth.Default().Token(auth.FromContext(r.Context()), STREAM_TOKEN_TTL),
+		Expires: time.Now().Add(STREAM_TOKEN_TTL),
+	}
+	w.Header().Set("content-type", "application/json")
+	if err := json.NewEncoder(w).Encode(st); err != nil {
+		log.Println(err)
+	}
+}
+
+// StreamStats an http.HandlerFunc that pushes a ManagerStatsReport to the client
+// as a server-sent event every STREAM_INTERVAL, until the client goes away. Each client's
+// rates are taken over its own window, so they don't disturb the rates of /manager/stats
+func (m *ManagerStats) StreamStats(w http.ResponseWriter, r *http.Request) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "text/event-stream")
+	w.Header().Set("cache-control", "no-cache")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	rates := newRateWindow(m.startTime)
+	tick := time.NewTicker(STREAM_INTERVAL)
+	defer tick.Stop()
+	for {
+		msr := m.collectStatsOver(rates)
+		b, err := json.Marshal(&msr)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		if _, err = fmt.Fprintf(w, "event: stats\ndata: %s\n\n", b); err != nil {
+			return
+		}
+		f.Flush()
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-tick.C:
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package manager
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/barracudanetworks/GoWorker/auth"
+	"github.com/barracudanetworks/GoWorker/config"
+	"github.com/barracudanetworks/GoWorker/job"
+	"github.com/barracudanetworks/GoWorker/mock"
+)
+
+func TestServeDashboard(t *testing.T) {
+	rw := httptest.NewRecorder()
+	TEST_MANAGER.Stats.ServeDashboard(rw, httptest.NewRequest("GET", "/manager/dashboard", nil))
+	if !strings.Contains(rw.Body.String(), "EventSource") {
+		t.Error("Dashboard was not served")
+	}
+}
+
+func TestServeStreamToken(t *testing.T) {
+	if err := auth.Init(config.AuthConfig{Keys: []config.KeyConfig{{ID: "admin", Key: "secret", Admin: true}}}); err != nil {
+		t.Fatal(err)
+	}
+	defer auth.Init(config.AuthConfig{})
+	streamed := false
+	stream := auth.Default().TokenHandler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		streamed = true
+	}), true)
+
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/manager/stats/token", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	auth.Default().Handler(http.HandlerFunc(TEST_MANAGER.Stats.ServeStreamToken), true).ServeHTTP(rw, req)
+	st := &streamToken{}
+	if err := json.Unmarshal(rw.Body.Bytes(), st); err != nil || st.Token == "" {
+		t.Fatal("no token handed out", rw.Code, rw.Body.String())
+	}
+
+	rw = httptest.NewRecorder()
+	stream.ServeHTTP(rw, httptest.NewRequest("GET", "/manager/stats/stream?"+auth.TOKEN_PARAM+"="+st.Token, nil))
+	if !streamed {
+		t.Error("stream wasn't opened with the token", rw.Code, rw.Body.String())
+	}
+}
+
+func TestStreamStats(t *testing.T) {
+	m := NewManagerStats(TEST_MANAGER)
+	j := mock.NewMockJob()
+	s := job.NewJobStats()
+	s.End(job.STATUS_FAILURE)
+	m.activity.failed(j, s)
+
+	server := httptest.NewServer(http.HandlerFunc(m.StreamStats))
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// read the first event off the stream
+	r := bufio.NewReader(resp.Body)
+	var data string
+	for data == "" {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(line, "data: ") {
+			data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+
+	msr := &ManagerStatsReport{}
+	if err = json.Unmarshal([]byte(data), msr); err != nil {
+		t.Fatal(err)
+	}
+	if len(msr.RecentFailures) != 1 || msr.RecentFailures[0].Provider != "mock" {
+		t.Error("Recent failures were not reported", msr.RecentFailures)
+	}
+}
+
+func TestActivity(t *testing.T) {
+	a := newActivity()
+	j := mock.NewMockJob()
+	p := j.JobConfirmer().(*mock.MockProvider)
+
+	a.started(j, time.Now())
+	if len(a.collectInFlight()) != 1 {
+		t.Error("Job was not marked as in flight")
+	}
+	a.finished(j)
+	if len(a.collectInFlight()) != 0 {
+		t.Error("Job was not removed from in flight")
+	}
+
+	a.requested(p, 10)
+	a.answered(p, errors.New("down"))
+	ps := a.collectProviders()
+	if len(ps) != 1 || ps[0].Requested != 10 || ps[0].LastError != "down" {
+		t.Error("Provider status is not correct", ps)
+	}
+	if ps[0].Report["connection"] != "connected" {
+		t.Error("Provider report was not included", ps[0].Report)
+	}
+
+	s := job.NewJobStats()
+	for i := 0; i < MAX_RECENT_FAILURES+5; i++ {
+		a.failed(j, s)
+	}
+	if len(a.collectFailures()) != MAX_RECENT_FAILURES {
+		t.Error("Too many failures were kept")
+	}
+}
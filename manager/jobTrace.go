@@ -0,0 +1,141 @@
+package manager
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/barracudanetworks/GoWorker/job"
+	"github.com/barracudanetworks/GoWorker/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// jobTrace holds the open spans of a job as it moves through the manager.
+// The root span covers the job from the time it was fetched until it is confirmed,
+// and every attempt after the first gets a retry span under the root
+type jobTrace struct {
+	root    trace.Span
+	rootCtx context.Context
+	attempt context.Context
+	retry   trace.Span
+	retries int
+}
+
+// jobTracer keeps track of the traces of every job the manager is holding
+type jobTracer struct {
+	traces map[job.Job]*jobTrace
+	sync.Mutex
+}
+
+// newJobTracer initializes and returns a new jobTracer
+func newJobTracer() *jobTracer {
+	return &jobTracer{
+		traces: make(map[job.Job]*jobTrace),
+	}
+}
+
+// received start tracing a job the manager has just been handed. fetched is the time
+// the manager started waiting on the provider for the job. If the job is being retried,
+// a retry span is started under the job's root span instead
+func (t *jobTracer) received(j job.Job, fetched, received time.Time) *jobTrace {
+	conf := j.Config()
+	tracer := tracing.Tracer()
+
+	t.Lock()
+	defer t.Unlock()
+	jt, ok := t.traces[j]
+	if ok {
+		jt.retries += 1
+		jt.attempt, jt.retry = tracer.Start(jt.rootCtx, "retry",
+			trace.WithTimestamp(received),
+			trace.WithAttributes(attribute.Int("job.retry", jt.retries)),
+		)
+		return jt
+	}
+
+	// continue the trace of whoever produced the job, if they gave us one
+	parent := tracing.Extract(context.Background(), conf)
+	if fetched.IsZero() || fetched.After(received) {
+		fetched = received
+	}
+	jt = &jobTrace{}
+	jt.rootCtx, jt.root = tracer.Start(parent, "job "+conf.Name,
+		trace.WithTimestamp(fetched),
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("job.name", conf.Name),
+			attribute.String("job.type", conf.Type),
+			attribute.String("job.provider", providerName(j)),
+		),
+	)
+	jt.attempt = jt.rootCtx
+	_, fetch := tracer.Start(jt.rootCtx, "fetch", trace.WithTimestamp(fetched))
+	fetch.End(trace.WithTimestamp(received))
+
+	t.traces[j] = jt
+	return jt
+}
+
+// dispatched record how long the job waited for a worker
+func (jt *jobTrace) dispatched(times *jobTimes) {
+	_, wait := tracing.Tracer().Start(jt.attempt, "dispatch_wait", trace.WithTimestamp(times.received))
+	wait.End(trace.WithTimestamp(times.dispatched))
+}
+
+// work start the span covering Worker.Work, and write its context to the job's metadata
+// so the worker can pass it on
+func (jt *jobTrace) work(j job.Job, times *jobTimes) trace.Span {
+	ctx, span := tracing.Tracer().Start(jt.attempt, "work", trace.WithTimestamp(times.dispatched))
+	tracing.Inject(ctx, j.Config())
+	return span
+}
+
+// worked end the work span, and the retry span if there is one
+func (jt *jobTrace) worked(span trace.Span, s *job.JobStats, times *jobTimes) {
+	setStatus(span, s)
+	span.End(trace.WithTimestamp(times.finished))
+	if jt.retry != nil {
+		setStatus(jt.retry, s)
+		jt.retry.End(trace.WithTimestamp(times.finished))
+		jt.retry = nil
+	}
+}
+
+// failureHandler start a span for a failure handler run. It is the root of a new trace
+// linked to the trace of the failed job
+func (t *jobTracer) failureHandler(j job.Job) trace.Span {
+	t.Lock()
+	jt, ok := t.traces[j]
+	t.Unlock()
+	opts := []trace.SpanStartOption{trace.WithNewRoot()}
+	if ok {
+		opts = append(opts, trace.WithLinks(trace.LinkFromContext(jt.rootCtx)))
+	}
+	_, span := tracing.Tracer().Start(context.Background(), "failure_handler "+j.Config().Name, opts...)
+	return span
+}
+
+// done end the root span of a job and stop tracking it
+func (t *jobTracer) done(j job.Job, s *job.JobStats) {
+	t.Lock()
+	jt, ok := t.traces[j]
+	delete(t.traces, j)
+	t.Unlock()
+	if !ok {
+		return
+	}
+	jt.root.SetAttributes(attribute.Int("job.retries", jt.retries))
+	setStatus(jt.root, s)
+	jt.root.End()
+}
+
+// setStatus set the status of a span from the outcome of a job
+func setStatus(span trace.Span, s *job.JobStats) {
+	if s.Status() == job.STATUS_SUCCESS {
+		span.SetStatus(codes.Ok, "")
+		return
+	}
+	span.SetStatus(codes.Error, "job did not succeed")
+}
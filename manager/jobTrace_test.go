@@ -0,0 +1,106 @@
+package manager
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/barracudanetworks/GoWorker/job"
+	"github.com/barracudanetworks/GoWorker/mock"
+	"github.com/barracudanetworks/GoWorker/tracing"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// recordSpans install a tracer provider that records every span ended
+func recordSpans() *tracetest.SpanRecorder {
+	r := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(r)))
+	return r
+}
+
+// spanNames returns the names of every span ended
+func spanNames(r *tracetest.SpanRecorder) map[string]sdktrace.ReadOnlySpan {
+	names := make(map[string]sdktrace.ReadOnlySpan)
+	for _, s := range r.Ended() {
+		names[s.Name()] = s
+	}
+	return names
+}
+
+// attempt run a single attempt of a job through the tracer
+func attempt(t *jobTracer, j job.Job, status job.Status) *job.JobStats {
+	now := time.Now()
+	times := &jobTimes{received: now, dispatched: now.Add(time.Millisecond)}
+	jt := t.received(j, now.Add(-time.Millisecond), times.received)
+	jt.dispatched(times)
+	span := jt.work(j, times)
+	stats := job.NewJobStats()
+	stats.End(status)
+	times.finished = time.Now()
+	jt.worked(span, stats, times)
+	return stats
+}
+
+func TestJobTrace(t *testing.T) {
+	r := recordSpans()
+	tracer := newJobTracer()
+	j := mock.NewMockJob()
+
+	// the producer of the job started a trace
+	ctx, producer := otel.Tracer("producer").Start(context.Background(), "enqueue")
+	tracing.Inject(ctx, j.Config())
+	producer.End()
+
+	tracer.done(j, attempt(tracer, j, job.STATUS_SUCCESS))
+
+	spans := spanNames(r)
+	for _, name := range []string{"fetch", "dispatch_wait", "work", "job test"} {
+		if _, ok := spans[name]; !ok {
+			t.Error("Missing span", name)
+		}
+	}
+	root := spans["job test"]
+	if root.Parent().SpanID() != producer.SpanContext().SpanID() {
+		t.Error("Job trace is not a child of the producer")
+	}
+	if spans["work"].Parent().SpanID() != root.SpanContext().SpanID() {
+		t.Error("Work span is not a child of the job")
+	}
+	if len(tracer.traces) != 0 {
+		t.Error("Trace was not cleaned up")
+	}
+}
+
+func TestJobTraceRetry(t *testing.T) {
+	r := recordSpans()
+	tracer := newJobTracer()
+	j := mock.NewMockJob()
+
+	attempt(tracer, j, job.STATUS_FAILURE)
+	stats := attempt(tracer, j, job.STATUS_FAILURE)
+
+	// the failure handler is linked to the failed job
+	handler := tracer.failureHandler(j)
+	handler.End()
+	tracer.done(j, stats)
+
+	spans := spanNames(r)
+	retry, ok := spans["retry"]
+	if !ok {
+		t.Fatal("Missing retry span")
+	}
+	root := spans["job test"]
+	if retry.Parent().SpanID() != root.SpanContext().SpanID() {
+		t.Error("Retry span is not a child of the job")
+	}
+
+	fh := spans["failure_handler test"]
+	if fh.Parent().IsValid() {
+		t.Error("Failure handler span should start a new trace")
+	}
+	if len(fh.Links()) != 1 || fh.Links()[0].SpanContext.SpanID() != root.SpanContext().SpanID() {
+		t.Error("Failure handler span is not linked to the job")
+	}
+}
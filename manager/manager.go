@@ -1,6 +1,7 @@
 package manager
 
 import (
+	"context"
 	"encoding/json"
 	"log"
 	"net/http"
@@ -11,9 +12,11 @@ import (
 
 	"strings"
 
+	"github.com/barracudanetworks/GoWorker/auth"
 	"github.com/barracudanetworks/GoWorker/config"
 	"github.com/barracudanetworks/GoWorker/job"
 	"github.com/barracudanetworks/GoWorker/provider"
+	"github.com/barracudanetworks/GoWorker/tracing"
 	"github.com/barracudanetworks/GoWorker/worker"
 )
 
@@ -40,7 +43,7 @@ type Manager struct {
 	// readyWorkers a map to buffered channels of workers of various types
 	readyWorkers map[string]chan worker.Worker
 	// jobChan channel the manager uses to receive work
-	jobChan chan job.Job
+	jobChan chan *queuedJob
 	// currentWorkers current number of workers per type
 	currentWorkers map[string]int
 	// redisConn is a connection to the redis server used for discovory
@@ -49,11 +52,30 @@ type Manager struct {
 	currentConfig *config.AppConfig
 	// statsServer
 	statsServer *http.ServeMux
+	// history persists rollups of the manager's stats, nil if history is disabled
+	history *StatsHistory
+	// push sends the manager's stats to a StatsD or Graphite server, nil if pushing is disabled
+	push *PushExporter
 	// FailureHandler is a worker that handles failed jobs which have reached their retry limit
 	failureHandlers []chan worker.Worker
 	// handleFailures if this is set, the manager will look for a failure handler worker for failed jobs
 	handleFailures bool
 	numWorkers     *Counter
+	// tracer holds the spans of every job the manager is holding
+	tracer *jobTracer
+	// stopTracing flushes and stops the trace exporter
+	stopTracing func(context.Context) error
+	// callbacks posts the results of jobs to their callback_url
+	callbacks *callbacks
+	// intake channel providers hand jobs over on, each job is stamped with the time it was handed over and queued
+	// on jobChan
+	intake chan job.Job
+}
+
+// queuedJob a job waiting on jobChan, and when its provider handed it over
+type queuedJob struct {
+	job      job.Job
+	received time.Time
 }
 
 // Manage create and manage workers
@@ -85,9 +107,19 @@ func (m *Manager) Manage() {
 		select {
 		case <-m.KillChan:
 			m.killAll()
+			if m.history != nil {
+				m.history.Close()
+			}
+			if m.push != nil {
+				m.push.Close()
+			}
+			m.callbacks.Close()
+			if err := m.stopTracing(context.Background()); err != nil {
+				log.Println(err)
+			}
 			return
-		case job := <-m.jobChan:
-			m.runJob(job)
+		case q := <-m.jobChan:
+			m.runJob(q.job, q.received)
 		}
 	}
 }
@@ -119,22 +151,49 @@ func (m *Manager) capasityByProvider(p provider.Provider) float64 {
 
 // requestWork takes a map of providers, and request work from each of them
 func (m *Manager) RequestWork(p provider.Provider, numJobs int) {
-	p.RequestWork(numJobs, m.jobChan)
+	m.Stats.activity.requested(p, numJobs)
+	err := p.RequestWork(numJobs, m.intake)
+	if err != nil {
+		log.Println(err)
+	}
+	m.Stats.activity.answered(p, err)
+}
+
+// takeIn stamp every job handed over by a provider with the time it was handed over, and queue it for the main loop.
+// intake is unbuffered, so a job is taken in as soon as it is sent, and its wait on jobChan counts as queue wait
+func (m *Manager) takeIn() {
+	for j := range m.intake {
+		m.jobChan <- &queuedJob{job: j, received: time.Now()}
+	}
 }
 
 // runJob takes a job, finds the best suited worker, and runs the job and waits for the results, after which performs cleanup tasks
-func (m *Manager) runJob(j job.Job) {
+func (m *Manager) runJob(j job.Job, received time.Time) {
+	times := newJobTimes(received)
+	jt := m.tracer.received(j, m.Stats.activity.fetched(j, times.received), times.received)
 	config := j.Config()
 	workerChan, ok := m.readyWorkers[config.Type]
 	if !ok {
 		log.Println("Unknown job type", config.Type)
+		stats := job.NewJobStats()
+		stats.End(job.STATUS_FAILURE)
+		m.tracer.done(j, stats)
 		return
 	}
 
+	m.callbacks.received(j)
+
 	// attempt to get an existing worker, if non is available, and the worker limit has not been reached, create a new one
 	worker := <-workerChan
+	times.dispatched = time.Now()
+	jt.dispatched(times)
+	m.Stats.workerStarted(j, worker, times)
 	go func() {
+		span := jt.work(j, times)
 		stats := worker.Work(j)
+		times.finished = time.Now()
+		jt.worked(span, stats, times)
+		m.Stats.workerFinished(j, worker, times)
 
 		// recycle worker and send it back on the worker chan
 		worker.Recycle()
@@ -148,10 +207,10 @@ func (m *Manager) runJob(j job.Job) {
 			m.handleFailure(j, stats)
 		} else {
 			// if the job succeded confirm and consume stats normally
-			if err := j.JobConfirmer().ConfirmJob(j); err != nil {
-				log.Println(err)
-			}
+			m.confirm(j, stats)
 			m.Stats.consumeStats(j, stats)
+			m.tracer.done(j, stats)
+			m.callbacks.done(j, stats)
 		}
 	}()
 }
@@ -167,11 +226,15 @@ func (m *Manager) handleFailure(j job.Job, s *job.JobStats) {
 	if config.Retries <= 0 {
 		s.End(job.STATUS_FAILURE)
 		m.Stats.consumeStats(j, s)
+		m.Stats.activity.failed(j, s)
 		if m.handleFailures {
 			for i := range m.failureHandlers {
 				worker := <-m.failureHandlers[i]
 				log.Println("sending failed job to failure handler")
+				span := m.tracer.failureHandler(j)
 				stats := worker.Work(j)
+				setStatus(span, stats)
+				span.End()
 				log.Printf("FAILURE_HANDLER::%s completed with status %d and %d retries. Job took %s to complete", config.Name, stats.Status(), stats.Retries(), stats.Duration())
 				m.failureHandlers[i] <- worker
 			}
@@ -179,14 +242,30 @@ func (m *Manager) handleFailure(j job.Job, s *job.JobStats) {
 		} else {
 			log.Printf("job %+v failed with no failure handler provided\n", j)
 		}
+		m.tracer.done(j, s)
+		m.callbacks.done(j, s)
+		m.confirm(j, s)
 	} else {
 		// set the job stats to a retry
 		s.End(job.STATUS_RETRY)
 		m.Stats.consumeStats(j, s)
+
+		// confirm the run before the retry can start, so the provider is done with it by then
+		m.confirm(j, s)
 		// if the job still has retries left, send it back to the manager to try again
-		m.jobChan <- j
+		m.jobChan <- &queuedJob{job: j, received: time.Now()}
+	}
+}
+
+// confirm tell the job's provider that the manager is done with this run of the job, and how it went if the provider wants to know
+func (m *Manager) confirm(j job.Job, s *job.JobStats) {
+	var err error
+	if rc, ok := j.JobConfirmer().(job.ResultConfirmer); ok {
+		err = rc.ConfirmResult(j, s)
+	} else {
+		err = j.JobConfirmer().ConfirmJob(j)
 	}
-	if err := j.JobConfirmer().ConfirmJob(j); err != nil {
+	if err != nil {
 		log.Println(err)
 	}
 }
@@ -200,6 +279,15 @@ func (m *Manager) killAll() error {
 			return err
 		}
 	}
+
+	// failure handlers are killed once they are done with the failure they are handling
+	for i := range m.failureHandlers {
+		worker := <-m.failureHandlers[i]
+		if worker != nil {
+			worker.Kill()
+		}
+		m.failureHandlers[i] <- worker
+	}
 	return nil
 }
 
@@ -247,6 +335,7 @@ func (m *Manager) populateWorkers(confs []config.ConfigPair) {
 			}
 			m.readyWorkers[string(c.Type)] <- w
 			m.allWorkers[m.numWorkers.Val()] = w
+			m.Stats.registerWorker(w, string(c.Type))
 			m.numWorkers.Inc()
 		}
 		log.Println("created", count.NumWorkers, c.Type, "workers")
@@ -286,7 +375,27 @@ func (m *Manager) Init(i interface{}) error {
 	}
 	m.numWorkers = &Counter{}
 	m.currentConfig = conf
-	m.jobChan = make(chan job.Job, 10)
+
+	stop, err := tracing.Init(conf.Tracing)
+	if err != nil {
+		return err
+	}
+	m.stopTracing = stop
+
+	// set up the keys shared by the stats server and the http provider before the providers are created
+	if err = auth.Init(conf.Auth); err != nil {
+		return err
+	}
+	tlsConf, err := auth.TLSConfig(conf.Auth.TLS)
+	if err != nil {
+		return err
+	}
+	if m.callbacks, err = newCallbacks(conf.Callback); err != nil {
+		return err
+	}
+	m.jobChan = make(chan *queuedJob, 10)
+	m.intake = make(chan job.Job)
+	go m.takeIn()
 
 	m.Stats = NewManagerStats(m)
 
@@ -294,10 +403,43 @@ func (m *Manager) Init(i interface{}) error {
 
 	// register handler
 	m.statsServer.HandleFunc("/manager/stats", m.Stats.ReportStats)
+	m.statsServer.HandleFunc("/manager/stats/token", m.Stats.ServeStreamToken)
+	m.statsServer.HandleFunc("/manager/stores/compact", CompactStore)
+
+	// start persisting stats if a history db has been configured
+	if conf.StatsHistoryDB != "" {
+		h, err := NewStatsHistory(m.Stats, conf.StatsHistoryDB, conf.StatsMinuteRetention, conf.StatsHourRetention)
+		if err != nil {
+			return err
+		}
+		m.history = h
+		m.statsServer.HandleFunc("/manager/stats/history", m.history.ReportHistory)
+		go m.history.Run()
+	}
+
+	// start pushing stats if a push protocol has been configured
+	if conf.Push.Protocol != "" {
+		p, err := NewPushExporter(m.Stats, conf.Push)
+		if err != nil {
+			return err
+		}
+		m.push = p
+		go m.push.Run()
+	}
 
-	// set up all of the web servers
+	// set up all of the web servers. The dashboard page holds no stats and is served to anyone, and the stream it
+	// reads, which a browser can't send a key to, also takes a token from /manager/stats/token
+	handler := http.NewServeMux()
+	handler.Handle("/", auth.Default().Handler(m.statsServer, true))
+	handler.HandleFunc("/manager/dashboard", m.Stats.ServeDashboard)
+	handler.Handle("/manager/stats/stream", auth.Default().TokenHandler(http.HandlerFunc(m.Stats.StreamStats), true))
+	srv := &http.Server{
+		Addr:      conf.StatsPort,
+		Handler:   handler,
+		TLSConfig: tlsConf,
+	}
 	go func() {
-		log.Fatal(http.ListenAndServe(conf.StatsPort, m.statsServer))
+		log.Fatal(auth.ListenAndServe(srv))
 	}()
 	return nil
 }
@@ -311,6 +453,7 @@ func NewManager() *Manager {
 	m.readyWorkers = make(map[string]chan worker.Worker)
 	m.currentWorkers = make(map[string]int)
 	m.statsServer = http.NewServeMux()
+	m.tracer = newJobTracer()
 	return m
 }
 
@@ -8,8 +8,10 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/barracudanetworks/GoWorker/database"
 	"github.com/barracudanetworks/GoWorker/job"
 	"github.com/barracudanetworks/GoWorker/provider"
+	"github.com/barracudanetworks/GoWorker/worker"
 )
 
 // Counter provides methods for atomically counting things
@@ -77,39 +79,134 @@ func (d *DurationCounter) Set(t time.Duration) {
 	d.Unlock()
 }
 
+// rateMark the job total a rate was last taken at, and when
+type rateMark struct {
+	total   uint64
+	checked time.Time
+}
+
+// rateWindow the job totals the last rates were taken at, so the next rates cover the jobs since then.
+// Each consumer of rates keeps its own window, so taking rates for one doesn't cut short the window of another
+type rateWindow struct {
+	start      time.Time
+	total      *rateMark
+	byType     map[string]*rateMark
+	byProvider map[provider.Provider]*rateMark
+	sync.Mutex
+}
+
+// newRateWindow a window whose first rates cover the jobs since start
+func newRateWindow(start time.Time) *rateWindow {
+	return &rateWindow{
+		start:      start,
+		total:      &rateMark{checked: start},
+		byType:     make(map[string]*rateMark),
+		byProvider: make(map[provider.Provider]*rateMark),
+	}
+}
+
+// rate the jobs per second since mark was taken, moving mark up to total. The window's lock must be held
+func (w *rateWindow) rate(mark *rateMark, total uint64) float64 {
+	now := time.Now()
+	jobs := total - mark.total
+	elapsed := now.Sub(mark.checked)
+	mark.total, mark.checked = total, now
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(jobs) / elapsed.Seconds()
+}
+
+// perSecond the rate of all jobs
+func (w *rateWindow) perSecond(total uint64) float64 {
+	w.Lock()
+	defer w.Unlock()
+	return w.rate(w.total, total)
+}
+
+// perSecondByType the rate of jobs of type t
+func (w *rateWindow) perSecondByType(t string, total uint64) float64 {
+	w.Lock()
+	defer w.Unlock()
+	mark, ok := w.byType[t]
+	if !ok {
+		mark = &rateMark{checked: w.start}
+		w.byType[t] = mark
+	}
+	return w.rate(mark, total)
+}
+
+// perSecondByProvider the rate of jobs from p
+func (w *rateWindow) perSecondByProvider(p provider.Provider, total uint64) float64 {
+	w.Lock()
+	defer w.Unlock()
+	mark, ok := w.byProvider[p]
+	if !ok {
+		mark = &rateMark{checked: w.start}
+		w.byProvider[p] = mark
+	}
+	return w.rate(mark, total)
+}
+
+// lastByType the total of jobs of type t the last rate was taken at
+func (w *rateWindow) lastByType(t string) uint64 {
+	w.Lock()
+	defer w.Unlock()
+	if mark, ok := w.byType[t]; ok {
+		return mark.total
+	}
+	return 0
+}
+
+// lastByProvider the total of jobs from p the last rate was taken at
+func (w *rateWindow) lastByProvider(p provider.Provider) uint64 {
+	w.Lock()
+	defer w.Unlock()
+	if mark, ok := w.byProvider[p]; ok {
+		return mark.total
+	}
+	return 0
+}
+
 // ManagerStats is a struct that holds statistics about a manager
 type ManagerStats struct {
-	lastTotalJobs            *Counter
-	lastStatsCheck           time.Time
-	lastStatsCheckByType     map[string]time.Time
-	lastStatsCheckByProvider map[provider.Provider]time.Time
-	lastTotalByType          map[string]*Counter
-	lastTotalByProvider      map[provider.Provider]*Counter
-	jobCountByType           map[string]*Counter
-	jobCountByProvider       map[provider.Provider]*Counter
-	jobDurationTotal         *DurationCounter
-	jobDurationByType        map[string]*DurationCounter
-	jobDurationByProvider    map[provider.Provider]*DurationCounter
-	startTime                time.Time
-	manager                  *Manager
+	// rates the window the rates reported by /manager/stats are taken over
+	rates *rateWindow
+
+	jobCountByType        map[string]*Counter
+	jobCountByProvider    map[provider.Provider]*Counter
+	jobDurationTotal      *DurationCounter
+	jobDurationByType     map[string]*DurationCounter
+	jobDurationByProvider map[provider.Provider]*DurationCounter
+	queueWaitTotal        *DurationCounter
+	queueWaitByType       map[string]*DurationCounter
+	queueWaitByProvider   map[provider.Provider]*DurationCounter
+	workerUsage           map[worker.Worker]*WorkerUsage
+	activity              *activity
+	startTime             time.Time
+	manager               *Manager
+
+	// waits guards the queue wait maps and workerUsage, which are written by workers and read by the stats server
+	waits sync.Mutex
 }
 
 // NewManagerStats initializes and returns a new instance of ManagerStats
 func NewManagerStats(man *Manager) *ManagerStats {
+	now := time.Now()
 	m := &ManagerStats{
-		lastStatsCheck:           time.Now(),
-		startTime:                time.Now(),
-		lastTotalJobs:            &Counter{},
-		jobCountByType:           make(map[string]*Counter),
-		jobCountByProvider:       make(map[provider.Provider]*Counter),
-		lastStatsCheckByType:     make(map[string]time.Time),
-		lastStatsCheckByProvider: make(map[provider.Provider]time.Time),
-		lastTotalByType:          make(map[string]*Counter),
-		lastTotalByProvider:      make(map[provider.Provider]*Counter),
-		jobDurationByType:        make(map[string]*DurationCounter),
-		jobDurationByProvider:    make(map[provider.Provider]*DurationCounter),
-		jobDurationTotal:         &DurationCounter{},
-		manager:                  man,
+		rates:                 newRateWindow(now),
+		startTime:             now,
+		jobCountByType:        make(map[string]*Counter),
+		jobCountByProvider:    make(map[provider.Provider]*Counter),
+		jobDurationByType:     make(map[string]*DurationCounter),
+		jobDurationByProvider: make(map[provider.Provider]*DurationCounter),
+		jobDurationTotal:      &DurationCounter{},
+		queueWaitTotal:        &DurationCounter{},
+		queueWaitByType:       make(map[string]*DurationCounter),
+		queueWaitByProvider:   make(map[provider.Provider]*DurationCounter),
+		workerUsage:           make(map[worker.Worker]*WorkerUsage),
+		activity:              newActivity(),
+		manager:               man,
 	}
 	return m
 }
@@ -133,54 +230,25 @@ func (m *ManagerStats) IncrementJobs(j job.Job) {
 
 // JobsPerSecond return the job per second
 func (m *ManagerStats) JobsPerSecond() float64 {
-	job := m.TotalJobs() - m.lastTotalJobs.Val()
-	elapsed := time.Now().Sub(m.lastStatsCheck)
-	m.lastStatsCheck = time.Now()
-	m.lastTotalJobs.Set(m.TotalJobs())
-	return float64(job) / elapsed.Seconds()
+	return m.rates.perSecond(m.TotalJobs())
 }
 
 // JobsPerSecondByType returns the job per second of a spesific type
 func (m *ManagerStats) JobsPerSecondByType(t string) float64 {
-	job := m.JobCountByType(t) - m.LastTotalByType(t)
-	_, ok := m.lastStatsCheckByType[t]
-	if !ok {
-		m.lastStatsCheckByType[t] = time.Now()
-	}
-	elapsed := time.Now().Sub(m.lastStatsCheckByType[t])
-	m.lastStatsCheckByType[t] = time.Now()
-	m.lastTotalByType[t].Set(m.JobCountByType(t))
-	return float64(job) / elapsed.Seconds()
+	return m.rates.perSecondByType(t, m.JobCountByType(t))
 }
 
 // JobsPerSecondByProvider returns the job per second for a given Provider
 func (m *ManagerStats) JobsPerSecondByProvider(p provider.Provider) float64 {
-	job := m.JobCountByProvider(p) - m.LastTotalByProvider(p)
-	_, ok := m.lastStatsCheckByProvider[p]
-	if !ok {
-		m.lastStatsCheckByProvider[p] = time.Now()
-	}
-	elapsed := time.Now().Sub(m.lastStatsCheckByProvider[p])
-	m.lastStatsCheckByProvider[p] = time.Now()
-	m.lastTotalByProvider[p].Set(m.JobCountByProvider(p))
-	return float64(job) / elapsed.Seconds()
+	return m.rates.perSecondByProvider(p, m.JobCountByProvider(p))
 }
 
 func (m *ManagerStats) LastTotalByType(t string) uint64 {
-	_, ok := m.lastTotalByType[t]
-	if !ok {
-		m.lastTotalByType[t] = &Counter{}
-	}
-
-	return m.lastTotalByType[t].Val()
+	return m.rates.lastByType(t)
 }
 
 func (m *ManagerStats) LastTotalByProvider(p provider.Provider) uint64 {
-	_, ok := m.lastTotalByProvider[p]
-	if !ok {
-		m.lastTotalByProvider[p] = &Counter{}
-	}
-	return m.lastTotalByProvider[p].Val()
+	return m.rates.lastByProvider(p)
 }
 
 // UpTime returns the uptime in seconds
@@ -188,7 +256,7 @@ func (m *ManagerStats) UpTime() time.Duration {
 	return time.Now().Sub(m.startTime)
 }
 
-//TotalJobs returns the total number of job processed
+// TotalJobs returns the total number of job processed
 func (m *ManagerStats) TotalJobs() uint64 {
 
 	sum := uint64(0)
@@ -226,7 +294,7 @@ func (m *ManagerStats) AverageDurationByType(t string) time.Duration {
 }
 
 func (m *ManagerStats) AverageDurationByProvider(p provider.Provider) time.Duration {
-	d := time.Duration(m.JobsPerSecondByProvider(p))
+	d := time.Duration(m.JobCountByProvider(p))
 	if d == 0 {
 		d = 1
 	}
@@ -258,19 +326,19 @@ func (m *ManagerStats) JobDurationByProvider(p provider.Provider) time.Duration
 }
 
 // collectJobsPerSecondByType
-func (m *ManagerStats) collectJobsPerSecondByType() map[string]float64 {
+func (m *ManagerStats) collectJobsPerSecondByType(w *rateWindow) map[string]float64 {
 	c := make(map[string]float64)
 	for t, _ := range m.jobCountByType {
-		c[t] = m.JobsPerSecondByType(t)
+		c[t] = w.perSecondByType(t, m.JobCountByType(t))
 	}
 	return c
 }
 
 // collectJobsPerSecondByProvider
-func (m *ManagerStats) collectJobsPerSecondByProvider() map[string]float64 {
+func (m *ManagerStats) collectJobsPerSecondByProvider(w *rateWindow) map[string]float64 {
 	c := make(map[string]float64)
 	for p, _ := range m.jobCountByProvider {
-		c[p.Name()] = m.JobsPerSecondByProvider(p)
+		c[p.Name()] = w.perSecondByProvider(p, m.JobCountByProvider(p))
 	}
 	return c
 }
@@ -376,6 +444,154 @@ func (m *ManagerStats) consumeTime(j job.Job, js *job.JobStats) {
 	m.jobDurationTotal.Add(js.Duration())
 }
 
+// consumeQueueWait using a jobTimes object. Modify the queue wait counters
+func (m *ManagerStats) consumeQueueWait(j job.Job, t *jobTimes) {
+	conf := j.Config()
+	var d *DurationCounter
+	p, ok := j.JobConfirmer().(provider.Provider)
+	if !ok {
+		log.Println(j.JobConfirmer(), "is not of correct type")
+		return
+	}
+
+	m.waits.Lock()
+	defer m.waits.Unlock()
+
+	// if we havent seen this provider before, create a wait tracker for it
+	d, ok = m.queueWaitByProvider[p]
+	if !ok {
+		d = &DurationCounter{}
+		m.queueWaitByProvider[p] = d
+	}
+	d.Add(t.QueueWait())
+
+	// " type before, create a wait tracker for it
+	d, ok = m.queueWaitByType[conf.Type]
+	if !ok {
+		d = &DurationCounter{}
+		m.queueWaitByType[conf.Type] = d
+	}
+	d.Add(t.QueueWait())
+
+	m.queueWaitTotal.Add(t.QueueWait())
+}
+
+// AverageQueueWait returns the average time a job waits for a free worker
+func (m *ManagerStats) AverageQueueWait() time.Duration {
+	return averageDuration(m.queueWaitTotal)
+}
+
+// AverageQueueWaitByType returns the average time a job of the given type waits for a free worker
+func (m *ManagerStats) AverageQueueWaitByType(t string) time.Duration {
+	m.waits.Lock()
+	defer m.waits.Unlock()
+	return averageDuration(m.queueWaitByType[t])
+}
+
+// AverageQueueWaitByProvider returns the average time a job from the given provider waits for a free worker
+func (m *ManagerStats) AverageQueueWaitByProvider(p provider.Provider) time.Duration {
+	m.waits.Lock()
+	defer m.waits.Unlock()
+	return averageDuration(m.queueWaitByProvider[p])
+}
+
+// registerWorker start tracking the busy and idle time of a worker in the given pool
+func (m *ManagerStats) registerWorker(w worker.Worker, pool string) {
+	m.waits.Lock()
+	defer m.waits.Unlock()
+	m.workerUsage[w] = NewWorkerUsage(pool)
+}
+
+// WorkerUsage returns the usage tracker for a worker, or nil if the worker is unknown
+func (m *ManagerStats) WorkerUsage(w worker.Worker) *WorkerUsage {
+	m.waits.Lock()
+	defer m.waits.Unlock()
+	return m.workerUsage[w]
+}
+
+// workerStarted mark a worker as busy and the job as in flight
+func (m *ManagerStats) workerStarted(j job.Job, w worker.Worker, t *jobTimes) {
+	if u := m.WorkerUsage(w); u != nil {
+		u.Start(t.dispatched)
+	}
+	m.activity.started(j, t.dispatched)
+}
+
+// workerFinished mark a worker as idle and record how long the job waited for it
+func (m *ManagerStats) workerFinished(j job.Job, w worker.Worker, t *jobTimes) {
+	if u := m.WorkerUsage(w); u != nil {
+		u.Stop(t.finished)
+	}
+	m.activity.finished(j)
+	m.consumeQueueWait(j, t)
+}
+
+// UtilizationByPool returns the percentage of time the workers of a pool have spent working
+func (m *ManagerStats) UtilizationByPool(pool string) float64 {
+	m.waits.Lock()
+	defer m.waits.Unlock()
+	return m.utilizationByPool(pool, time.Now())
+}
+
+// utilizationByPool the percentage of time up to now the workers of a pool have spent working. waits must be held
+func (m *ManagerStats) utilizationByPool(pool string, now time.Time) float64 {
+	var busy, total time.Duration
+	for _, u := range m.workerUsage {
+		if u.Pool != pool {
+			continue
+		}
+		u.Lock()
+		busy += u.busyAt(now)
+		total += now.Sub(u.created)
+		u.Unlock()
+	}
+	return percentOf(busy, total)
+}
+
+// collectUtilizationByPool
+func (m *ManagerStats) collectUtilizationByPool() map[string]float64 {
+	m.waits.Lock()
+	defer m.waits.Unlock()
+	now := time.Now()
+	c := make(map[string]float64)
+	for _, u := range m.workerUsage {
+		if _, ok := c[u.Pool]; !ok {
+			c[u.Pool] = m.utilizationByPool(u.Pool, now)
+		}
+	}
+	return c
+}
+
+// collectAverageQueueWaitsByType
+func (m *ManagerStats) collectAverageQueueWaitsByType() map[string]time.Duration {
+	m.waits.Lock()
+	defer m.waits.Unlock()
+	c := make(map[string]time.Duration)
+	for t, d := range m.queueWaitByType {
+		c[t] = averageDuration(d)
+	}
+	return c
+}
+
+// collectAverageQueueWaitsByProvider
+func (m *ManagerStats) collectAverageQueueWaitsByProvider() map[string]time.Duration {
+	m.waits.Lock()
+	defer m.waits.Unlock()
+	c := make(map[string]time.Duration)
+	for p, d := range m.queueWaitByProvider {
+		c[p.Name()] = averageDuration(d)
+	}
+	return c
+}
+
+// averageDuration get the average of a DurationCounter, or zero if nothing has been counted
+func averageDuration(d *DurationCounter) time.Duration {
+	if d == nil || d.c == nil || d.c.Val() == 0 {
+		return 0
+	}
+	return d.Avg()
+}
+
 // consumeStats takes a JobStats object, and applies it's stats to the ManagerStats
 func (m *ManagerStats) consumeStats(j job.Job, js *job.JobStats) {
 	m.IncrementJobs(j)
@@ -407,12 +623,17 @@ type ChannelStats struct {
 
 // collectStats creats a stats report fo the current state of the manager
 func (m *ManagerStats) collectStats() ManagerStatsReport {
+	return m.collectStatsOver(m.rates)
+}
+
+// collectStatsOver a report whose rates cover the jobs since rates were last taken from w
+func (m *ManagerStats) collectStatsOver(w *rateWindow) ManagerStatsReport {
 	msr := ManagerStatsReport{
 		Uptime:                    uint64(m.UpTime() / time.Second),
-		JobsPerSecond:             m.JobsPerSecond(),
-		JobsPerSecondByType:       m.collectJobsPerSecondByType(),
-		JobsPerSecondByProvider:   m.collectJobsPerSecondByProvider(),
-		AverageDuration:           m.jobDurationTotal.Val() / (time.Duration(m.TotalJobs())),
+		JobsPerSecond:             w.perSecond(m.TotalJobs()),
+		JobsPerSecondByType:       m.collectJobsPerSecondByType(w),
+		JobsPerSecondByProvider:   m.collectJobsPerSecondByProvider(w),
+		AverageDuration:           averageDuration(m.jobDurationTotal),
 		AverageDurationByType:     m.collectAverageDurationsByType(),
 		AverageDurationByProvider: m.collectAverageDurationsByProvider(),
 		TotalDurationByType:       m.collectTotalDurationsByType(),
@@ -424,6 +645,15 @@ func (m *ManagerStats) collectStats() ManagerStatsReport {
 		TotalAverageByType:        m.collectTotalAveragesByType(),
 		TotalAverageByProvider:    m.collectTotalAveragesByProvider(),
 		ChannelStats:              m.collectChannelStats(),
+		QueueWait:                 m.AverageQueueWait(),
+		QueueWaitByType:           m.collectAverageQueueWaitsByType(),
+		QueueWaitByProvider:       m.collectAverageQueueWaitsByProvider(),
+		UtilizationByPool:         m.collectUtilizationByPool(),
+		InFlight:                  m.activity.collectInFlight(),
+		RecentFailures:            m.activity.collectFailures(),
+		Providers:                 m.activity.collectProviders(),
+		Stores:                    database.Report(),
+		Callbacks:                 m.manager.callbacks.report(),
 	}
 	return msr
 }
@@ -463,4 +693,17 @@ type ManagerStatsReport struct {
 	AverageDuration           time.Duration            `json:"average_duration"`
 	TotalDurationByType       map[string]time.Duration `json:"total_duration_by_type"`
 	TotalDurationByProvider   map[string]time.Duration `json:"total_duration_by_provider"`
+	QueueWait                 time.Duration            `json:"average_queue_wait"`
+	QueueWaitByType           map[string]time.Duration `json:"average_queue_wait_by_type"`
+	QueueWaitByProvider       map[string]time.Duration `json:"average_queue_wait_by_provider"`
+	UtilizationByPool         map[string]float64       `json:"utilization_by_pool"`
+	InFlight                  []InFlightReport         `json:"in_flight"`
+	RecentFailures            []FailureReport          `json:"recent_failures"`
+	Providers                 []ProviderStatus         `json:"providers"`
+
+	// the size of every job store's db, and what retention and compaction have done to it
+	Stores map[string]map[string]interface{} `json:"stores"`
+
+	// what has become of the callbacks posted to jobs' callback_url
+	Callbacks *CallbackReport `json:"callbacks"`
 }
@@ -1,6 +1,7 @@
 package manager
 
 import (
+	"sync"
 	"testing"
 
 	"github.com/barracudanetworks/GoWorker/mock"
@@ -45,3 +46,37 @@ func TestJobsPerSecond(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestRateWindows(t *testing.T) {
+	m := NewManagerStats(TEST_MANAGER)
+	j := mock.NewMockJob()
+	m.IncrementJobs(j)
+	m.IncrementJobs(j)
+
+	// rates taken over one window don't move another
+	stream := newRateWindow(m.startTime)
+	if r := m.collectStatsOver(stream); r.JobsPerSecondByType["cli"] <= 0 {
+		t.Error("expected a rate for cli jobs", r.JobsPerSecondByType)
+	}
+	if m.LastTotalByType("cli") != 0 {
+		t.Error("stream window moved the stats window")
+	}
+	if m.JobsPerSecondByType("cli") <= 0 || m.LastTotalByType("cli") != 2 {
+		t.Error("expected a rate for cli jobs")
+	}
+
+	// many consumers may take rates at once
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			m.collectStats()
+		}()
+		go func() {
+			defer wg.Done()
+			m.collectStatsOver(newRateWindow(m.startTime))
+		}()
+	}
+	wg.Wait()
+}
@@ -2,8 +2,11 @@ package manager
 
 import (
 	"testing"
+	"time"
 
 	"github.com/barracudanetworks/GoWorker/config"
+	"github.com/barracudanetworks/GoWorker/job"
+	"github.com/barracudanetworks/GoWorker/mock"
 )
 
 var (
@@ -45,3 +48,100 @@ func TestManagerKill(t *testing.T) {
 	go TEST_MANAGER.Manage()
 	TEST_MANAGER.KillChan <- struct{}{}
 }
+
+// resultJob is a job whose confirmer wants to know how the job went
+type resultJob struct {
+	confirmed []job.Status
+}
+
+func (r *resultJob) Config() *job.JobConfig {
+	return &job.JobConfig{}
+}
+
+func (r *resultJob) JobConfirmer() job.JobConfirmer {
+	return r
+}
+
+func (r *resultJob) ConfirmJob(j job.Job) error {
+	r.confirmed = append(r.confirmed, job.STATUS_NEW)
+	return nil
+}
+
+func (r *resultJob) ConfirmResult(j job.Job, s *job.JobStats) error {
+	r.confirmed = append(r.confirmed, s.Status())
+	return nil
+}
+
+func TestConfirm(t *testing.T) {
+	j := &resultJob{}
+	s := job.NewJobStats()
+	s.End(job.STATUS_RETRY)
+	TEST_MANAGER.confirm(j, s)
+	s.End(job.STATUS_SUCCESS)
+	TEST_MANAGER.confirm(j, s)
+	if len(j.confirmed) != 2 || j.confirmed[0] != job.STATUS_RETRY || j.confirmed[1] != job.STATUS_SUCCESS {
+		t.Error("Result confirmers should be given the stats of each run", j.confirmed)
+	}
+
+	// plain confirmers are still confirmed
+	TEST_MANAGER.confirm(mock.NewMockJob(), s)
+}
+
+// retryJob is a job that notes how many runs were waiting to be retried when each run was confirmed
+type retryJob struct {
+	*mock.MockProvider
+	conf    *job.JobConfig
+	waiting []int
+	queue   chan *queuedJob
+}
+
+func (r *retryJob) Config() *job.JobConfig {
+	return r.conf
+}
+
+func (r *retryJob) JobConfirmer() job.JobConfirmer {
+	return r
+}
+
+func (r *retryJob) ConfirmJob(j job.Job) error {
+	return nil
+}
+
+func (r *retryJob) ConfirmResult(j job.Job, s *job.JobStats) error {
+	r.waiting = append(r.waiting, len(r.queue))
+	return nil
+}
+
+func TestConfirmBeforeRetry(t *testing.T) {
+	m := NewManager()
+	conf := config.DefaultAppConfig()
+	conf.StatsPort = "127.0.0.1:0"
+	if err := m.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	j := &retryJob{MockProvider: &mock.MockProvider{}, conf: &job.JobConfig{Retries: 2}, queue: m.jobChan}
+	s := job.NewJobStats()
+	s.End(job.STATUS_FAILURE)
+	m.handleFailure(j, s)
+	if len(j.waiting) != 1 || j.waiting[0] != 0 || len(m.jobChan) != 1 {
+		t.Error("The run should be confirmed before it is retried", j.waiting, len(m.jobChan))
+	}
+}
+
+func TestQueueWaitFromHandover(t *testing.T) {
+	m := NewManager()
+	conf := config.DefaultAppConfig()
+	conf.StatsPort = "127.0.0.1:0"
+	if err := m.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	sent := time.Now()
+	m.intake <- mock.NewMockJob()
+
+	// the job waits on the queue before the main loop gets to it
+	time.Sleep(20 * time.Millisecond)
+	q := <-m.jobChan
+	if q.received.Before(sent) || time.Since(q.received) < 20*time.Millisecond {
+		t.Error("The job should be stamped when its provider handed it over", q.received.Sub(sent))
+	}
+}
@@ -0,0 +1,225 @@
+package manager
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/barracudanetworks/GoWorker/config"
+)
+
+const (
+	PUSH_STATSD   = "statsd"
+	PUSH_GRAPHITE = "graphite"
+
+	// MAX_PACKET_SIZE keeps udp packets under the size of a typical ethernet frame
+	MAX_PACKET_SIZE = 1432
+)
+
+var (
+	UNKNOWN_PUSH_PROTOCOL = errors.New("manager: unknown push protocol")
+	DEFAULT_PUSH_TIMEOUT  = 5 * time.Second
+
+	// anything that would break up a metric path is replaced in names
+	badMetricChars = regexp.MustCompile(`[^A-Za-z0-9_\-]`)
+)
+
+// metricLabels the values a push prefix template can use
+type metricLabels struct {
+	Host     string
+	Type     string
+	Provider string
+	Pool     string
+	Channel  string
+}
+
+// PushExporter periodically pushes the manager's stats to a StatsD or Graphite server.
+// Job counts are sent as counters, averages as timers, and everything else as gauges
+type PushExporter struct {
+	protocol string
+	network  string
+	address  string
+	interval time.Duration
+	prefix   *template.Template
+	host     string
+	sampler  *statsSampler
+	conn     net.Conn
+	killChan chan struct{}
+}
+
+// NewPushExporter create a PushExporter for the given stats
+func NewPushExporter(stats *ManagerStats, conf config.PushConfig) (*PushExporter, error) {
+	p := &PushExporter{
+		protocol: conf.Protocol,
+		network:  conf.Network,
+		address:  conf.Address,
+		sampler:  newStatsSampler(stats),
+		killChan: make(chan struct{}),
+	}
+
+	switch p.protocol {
+	case PUSH_STATSD:
+		if p.network == "" {
+			p.network = "udp"
+		}
+	case PUSH_GRAPHITE:
+		if p.network == "" {
+			p.network = "tcp"
+		}
+	default:
+		return nil, UNKNOWN_PUSH_PROTOCOL
+	}
+
+	var err error
+	if p.interval, err = time.ParseDuration(conf.Interval); err != nil {
+		return nil, err
+	}
+	if p.prefix, err = template.New("prefix").Parse(conf.Prefix); err != nil {
+		return nil, err
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	p.host = sanitizeMetric(host)
+	return p, nil
+}
+
+// Run push stats every interval until Close is called
+func (p *PushExporter) Run() {
+	for {
+		select {
+		case <-p.killChan:
+			return
+		case now := <-time.After(p.interval):
+			if err := p.Push(now); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+// Close stop pushing stats and close the connection to the server
+func (p *PushExporter) Close() error {
+	close(p.killChan)
+	if p.conn != nil {
+		return p.conn.Close()
+	}
+	return nil
+}
+
+// Push sample the stats and send them to the server
+func (p *PushExporter) Push(now time.Time) error {
+	lines, err := p.format(p.sampler.sample(now))
+	if err != nil {
+		return err
+	}
+
+	if p.conn == nil {
+		if p.conn, err = net.DialTimeout(p.network, p.address, DEFAULT_PUSH_TIMEOUT); err != nil {
+			p.conn = nil
+			return err
+		}
+	}
+
+	// batch lines into as few packets as possible
+	buff := &bytes.Buffer{}
+	for _, l := range lines {
+		if buff.Len() > 0 && buff.Len()+len(l) > MAX_PACKET_SIZE {
+			if err = p.send(buff.Bytes()); err != nil {
+				return err
+			}
+			buff.Reset()
+		}
+		buff.WriteString(l)
+	}
+	if buff.Len() > 0 {
+		return p.send(buff.Bytes())
+	}
+	return nil
+}
+
+// send write a packet to the server. The connection is dropped on failure so the next push redials
+func (p *PushExporter) send(b []byte) error {
+	p.conn.SetWriteDeadline(time.Now().Add(DEFAULT_PUSH_TIMEOUT))
+	_, err := p.conn.Write(b)
+	if err != nil {
+		p.conn.Close()
+		p.conn = nil
+	}
+	return err
+}
+
+// format render every value of a point as a line in the exporter's protocol, sorted by name
+func (p *PushExporter) format(point StatsPoint) ([]string, error) {
+	keys := make([]string, 0, len(point.Values))
+	for k := range point.Values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	lines := make([]string, 0, len(keys))
+	for _, k := range keys {
+		name, err := p.name(k)
+		if err != nil {
+			return nil, err
+		}
+		v := point.Values[k]
+		kind := "g"
+		switch {
+		case strings.HasPrefix(k, JOB_COUNT_METRIC):
+			kind = "c"
+		case strings.HasPrefix(k, "average_"):
+			// durations are sampled in nanoseconds, timers are in milliseconds
+			kind = "ms"
+			v = v / float64(time.Millisecond)
+		}
+
+		if p.protocol == PUSH_STATSD {
+			lines = append(lines, fmt.Sprintf("%s:%g|%s\n", name, v, kind))
+		} else {
+			lines = append(lines, fmt.Sprintf("%s %g %d\n", name, v, point.Time.Unix()))
+		}
+	}
+	return lines, nil
+}
+
+// name build the full name of a metric from the prefix template
+func (p *PushExporter) name(key string) (string, error) {
+	metric, sub := splitMetricName(key)
+	labels := metricLabels{Host: p.host}
+	sub = sanitizeMetric(sub)
+	for suffix, label := range map[string]*string{
+		"_by_type":     &labels.Type,
+		"_by_provider": &labels.Provider,
+		"_by_pool":     &labels.Pool,
+	} {
+		if strings.HasSuffix(metric, suffix) {
+			metric = strings.TrimSuffix(metric, suffix)
+			*label = sub
+		}
+	}
+	if metric == "channel_queue" {
+		labels.Channel = sub
+	}
+
+	buff := &bytes.Buffer{}
+	if err := p.prefix.Execute(buff, labels); err != nil {
+		return "", err
+	}
+	return buff.String() + "." + metric, nil
+}
+
+// sanitizeMetric replace anything that is not safe in a metric path
+func sanitizeMetric(s string) string {
+	return badMetricChars.ReplaceAllString(s, "_")
+}
@@ -0,0 +1,107 @@
+package manager
+
+import (
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/barracudanetworks/GoWorker/config"
+	"github.com/barracudanetworks/GoWorker/mock"
+)
+
+// listenUDP start a local udp listener to stand in for a StatsD or Graphite server
+func listenUDP(t *testing.T) *net.UDPConn {
+	l, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+// pushHelper push one sample of stats with a single job to a local listener, and return what was received
+func pushHelper(t *testing.T, protocol string) string {
+	l := listenUDP(t)
+	defer l.Close()
+
+	conf := config.DefaultAppConfig().Push
+	conf.Protocol = protocol
+	conf.Network = "udp"
+	conf.Address = l.LocalAddr().String()
+	p, err := NewPushExporter(NewManagerStats(TEST_MANAGER), conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	p.sampler.stats.IncrementJobs(mock.NewMockJob())
+	if err = p.Push(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	// read every packet sent
+	received := ""
+	b := make([]byte, MAX_PACKET_SIZE)
+	for {
+		l.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, err := l.Read(b)
+		if err != nil {
+			break
+		}
+		if n > MAX_PACKET_SIZE {
+			t.Error("Packet is too large")
+		}
+		received += string(b[:n])
+	}
+	return received
+}
+
+func TestPushStatsd(t *testing.T) {
+	received := pushHelper(t, PUSH_STATSD)
+	host, _ := os.Hostname()
+	prefix := "goworker." + sanitizeMetric(host)
+
+	for _, line := range []string{
+		prefix + ".total_job:1|c",
+		prefix + ".type.cli.total_job:1|c",
+		prefix + ".provider.mock.total_job:1|c",
+		prefix + ".average_duration:0|ms",
+	} {
+		if !strings.Contains(received, line+"\n") {
+			t.Error("Missing statsd line", line, "in", received)
+		}
+	}
+}
+
+func TestPushGraphite(t *testing.T) {
+	received := pushHelper(t, PUSH_GRAPHITE)
+	if !strings.Contains(received, ".type.cli.total_job 1 ") {
+		t.Error("Missing graphite line in", received)
+	}
+}
+
+func TestPushPrefixTemplate(t *testing.T) {
+	p, err := NewPushExporter(TEST_MANAGER.Stats, config.PushConfig{
+		Protocol: PUSH_STATSD,
+		Interval: "1s",
+		Prefix:   "jobs.{{.Host}}.{{or .Type \"all\"}}",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, err := p.name(metricName("total_job_by_type", "my.type"))
+	if err != nil {
+		t.Error(err)
+	}
+	if name != "jobs."+p.host+".my_type.total_job" {
+		t.Error("Prefix template was not applied", name)
+	}
+}
+
+func TestPushUnknownProtocol(t *testing.T) {
+	_, err := NewPushExporter(TEST_MANAGER.Stats, config.PushConfig{Protocol: "carrier_pigeon"})
+	if err != UNKNOWN_PUSH_PROTOCOL {
+		t.Fail()
+	}
+}
@@ -0,0 +1,279 @@
+package manager
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/barracudanetworks/GoWorker/database"
+	"github.com/barracudanetworks/GoWorker/time_util"
+	"github.com/boltdb/bolt"
+)
+
+const (
+	RESOLUTION_MINUTE = "minute"
+	RESOLUTION_HOUR   = "hour"
+)
+
+var (
+	BAD_RESOLUTION = errors.New("manager: unknown stats resolution")
+	MISSING_METRIC = errors.New("manager: no metric given")
+	STATS_BUCKETS  = map[string][]byte{RESOLUTION_MINUTE: []byte("stats_minute"), RESOLUTION_HOUR: []byte("stats_hour")}
+)
+
+// StatsPoint holds the value of every metric for one interval
+type StatsPoint struct {
+	Time   time.Time          `json:"time"`
+	Values map[string]float64 `json:"values"`
+}
+
+// SeriesPoint holds the value of a single metric for one interval
+type SeriesPoint struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
+
+// StatsSeries is the response to a stats history query
+type StatsSeries struct {
+	Metric     string        `json:"metric"`
+	Resolution string        `json:"resolution"`
+	Points     []SeriesPoint `json:"points"`
+}
+
+// StatsHistory periodically rolls up the manager's stats and persists them to a bolt db
+type StatsHistory struct {
+	db        *bolt.DB
+	sampler   *statsSampler
+	retention map[string]time.Duration
+	killChan  chan struct{}
+}
+
+// NewStatsHistory open the history database and create a StatsHistory for the given stats
+func NewStatsHistory(stats *ManagerStats, dbName, minuteRetention, hourRetention string) (*StatsHistory, error) {
+	minute, err := time.ParseDuration(minuteRetention)
+	if err != nil {
+		return nil, err
+	}
+	hour, err := time.ParseDuration(hourRetention)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := database.Open(dbName)
+	if err != nil {
+		return nil, err
+	}
+
+	// initilize the buckets
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range STATS_BUCKETS {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		database.Close(db)
+		return nil, err
+	}
+
+	return &StatsHistory{
+		db:      db,
+		sampler: newStatsSampler(stats),
+		retention: map[string]time.Duration{
+			RESOLUTION_MINUTE: minute,
+			RESOLUTION_HOUR:   hour,
+		},
+		killChan: make(chan struct{}),
+	}, nil
+}
+
+// Run sample the stats every minute, and roll the samples up every hour, until Close is called
+func (h *StatsHistory) Run() {
+	for {
+		select {
+		case <-h.killChan:
+			return
+		case now := <-time.After(time.Minute):
+			if err := h.collect(now); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+// Close stop collecting stats and close the history database
+func (h *StatsHistory) Close() error {
+	close(h.killChan)
+	return database.Close(h.db)
+}
+
+// collect take a minute sample, roll up the previous hour if we have crossed into a new one, and prune old points
+func (h *StatsHistory) collect(now time.Time) error {
+	last := h.sampler.lastSample
+	err := h.write(RESOLUTION_MINUTE, h.sampler.sample(now))
+	if err != nil {
+		return err
+	}
+
+	// roll the minutes of the last hour up into a single point
+	if hour := now.Truncate(time.Hour); last.Truncate(time.Hour).Before(hour) {
+		points, err := h.Points(RESOLUTION_MINUTE, hour.Add(-time.Hour), hour.Add(-time.Nanosecond))
+		if err != nil {
+			return err
+		}
+		if len(points) > 0 {
+			err = h.write(RESOLUTION_HOUR, rollup(hour.Add(-time.Hour), points))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return h.prune(now)
+}
+
+// rollup combine many points into a single point at time t.
+// Job counts are summed, every other metric is averaged
+func rollup(t time.Time, points []StatsPoint) StatsPoint {
+	p := StatsPoint{
+		Time:   t,
+		Values: make(map[string]float64),
+	}
+	seen := make(map[string]int)
+	for i := range points {
+		for k, v := range points[i].Values {
+			p.Values[k] += v
+			seen[k] += 1
+		}
+	}
+	for k, n := range seen {
+		if !strings.HasPrefix(k, JOB_COUNT_METRIC) {
+			p.Values[k] = p.Values[k] / float64(n)
+		}
+	}
+	return p
+}
+
+// write persist a point at the given resolution
+func (h *StatsHistory) write(resolution string, p StatsPoint) error {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return database.WriteJob(h.db, STATS_BUCKETS[resolution], statsKey(p.Time), b)
+}
+
+// prune remove every point older than the retention of its resolution
+func (h *StatsHistory) prune(now time.Time) error {
+	for res, r := range h.retention {
+		n, err := database.DeleteBefore(h.db, STATS_BUCKETS[res], statsKey(now.Add(-r)))
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			log.Printf("pruned %d %s stats points", n, res)
+		}
+	}
+	return nil
+}
+
+// Points read every point at a resolution between from and to, inclusive
+func (h *StatsHistory) Points(resolution string, from, to time.Time) ([]StatsPoint, error) {
+	bucket, ok := STATS_BUCKETS[resolution]
+	if !ok {
+		return nil, BAD_RESOLUTION
+	}
+	_, values, err := database.ReadRange(h.db, bucket, statsKey(from), statsKey(to))
+	if err != nil {
+		return nil, err
+	}
+	points := make([]StatsPoint, len(values))
+	for i := range values {
+		if err = json.Unmarshal(values[i], &points[i]); err != nil {
+			return nil, err
+		}
+	}
+	return points, nil
+}
+
+// Series return the time series of a single metric at a resolution between from and to
+func (h *StatsHistory) Series(metric, resolution string, from, to time.Time) (*StatsSeries, error) {
+	if metric == "" {
+		return nil, MISSING_METRIC
+	}
+	points, err := h.Points(resolution, from, to)
+	if err != nil {
+		return nil, err
+	}
+	s := &StatsSeries{
+		Metric:     metric,
+		Resolution: resolution,
+		Points:     make([]SeriesPoint, 0, len(points)),
+	}
+	for i := range points {
+		if v, ok := points[i].Values[metric]; ok {
+			s.Points = append(s.Points, SeriesPoint{Time: points[i].Time, Value: v})
+		}
+	}
+	return s, nil
+}
+
+// ReportHistory an http.HandlerFunc that returns the time series for a metric.
+// Query params: metric, type or provider or pool, resolution (minute|hour), from and to (RFC3339)
+func (h *StatsHistory) ReportHistory(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	q := r.URL.Query()
+	metric := q.Get("metric")
+	for _, sub := range []string{"type", "provider", "pool", "channel"} {
+		if v := q.Get(sub); v != "" {
+			metric = metricName(metric, v)
+			break
+		}
+	}
+
+	resolution := q.Get("resolution")
+	if resolution == "" {
+		resolution = RESOLUTION_MINUTE
+	}
+
+	// default to the last day
+	to := time.Now()
+	from := to.Add(-24 * time.Hour)
+	var err error
+	if v := q.Get("from"); v != "" {
+		if from, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	s, err := h.Series(metric, resolution, from, to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(b)
+}
+
+// statsKey the key a point at time t is stored under. Keys are in UTC so they sort by time
+func statsKey(t time.Time) []byte {
+	return []byte(t.UTC().Format(time_util.TIME_FORMAT))
+}
@@ -0,0 +1,124 @@
+package manager
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/barracudanetworks/GoWorker/config"
+	"github.com/barracudanetworks/GoWorker/mock"
+)
+
+var (
+	testHistoryDB = os.TempDir() + "/goworker_stats_history_test.db"
+)
+
+func historyHelper(t *testing.T) *StatsHistory {
+	os.Remove(testHistoryDB)
+	h, err := NewStatsHistory(NewManagerStats(TEST_MANAGER), testHistoryDB, config.DEFAULT_STATS_MINUTE_RETENTION, config.DEFAULT_STATS_HOUR_RETENTION)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestStatsHistorySample(t *testing.T) {
+	h := historyHelper(t)
+	defer h.Close()
+
+	h.sampler.stats.IncrementJobs(mock.NewMockJob())
+	h.sampler.stats.IncrementJobs(mock.NewMockJob())
+	p := h.sampler.sample(time.Now())
+	if p.Values["total_job"] != 2 {
+		t.Error("Job count is not correct", p.Values["total_job"])
+	}
+	if p.Values["total_job_by_type:cli"] != 2 {
+		t.Error("Job count by type is not correct")
+	}
+
+	// counts only include jobs since the last sample
+	h.sampler.stats.IncrementJobs(mock.NewMockJob())
+	p = h.sampler.sample(time.Now())
+	if p.Values["total_job"] != 1 {
+		t.Error("Job count since last sample is not correct", p.Values["total_job"])
+	}
+}
+
+func TestStatsHistoryRollup(t *testing.T) {
+	now := time.Now()
+	p := rollup(now, []StatsPoint{
+		{Time: now, Values: map[string]float64{"total_job": 2, "average_duration": 10}},
+		{Time: now, Values: map[string]float64{"total_job": 3, "average_duration": 20}},
+	})
+	if p.Values["total_job"] != 5 {
+		t.Error("Job counts should be summed")
+	}
+	if p.Values["average_duration"] != 15 {
+		t.Error("Other metrics should be averaged")
+	}
+}
+
+func TestStatsHistoryCollect(t *testing.T) {
+	h := historyHelper(t)
+	defer h.Close()
+
+	hour := time.Now().Truncate(time.Hour)
+	h.sampler.lastSample = hour.Add(-2 * time.Minute)
+	h.sampler.stats.IncrementJobs(mock.NewMockJob())
+	if err := h.collect(hour.Add(-time.Minute)); err != nil {
+		t.Error(err)
+	}
+
+	// crossing into the next hour rolls up the minutes of the last one
+	h.sampler.stats.IncrementJobs(mock.NewMockJob())
+	if err := h.collect(hour.Add(time.Second)); err != nil {
+		t.Error(err)
+	}
+
+	s, err := h.Series("total_job", RESOLUTION_MINUTE, hour.Add(-time.Hour), hour.Add(time.Hour))
+	if err != nil {
+		t.Error(err)
+	}
+	if len(s.Points) != 2 {
+		t.Error("Expected two minute points, got", len(s.Points))
+	}
+
+	s, err = h.Series("total_job", RESOLUTION_HOUR, hour.Add(-time.Hour), hour)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(s.Points) != 1 || s.Points[0].Value != 1 {
+		t.Error("Hour rollup is not correct", s.Points)
+	}
+}
+
+func TestReportHistory(t *testing.T) {
+	h := historyHelper(t)
+	defer h.Close()
+
+	h.sampler.stats.IncrementJobs(mock.NewMockJob())
+	now := time.Now()
+	if err := h.write(RESOLUTION_MINUTE, h.sampler.sample(now)); err != nil {
+		t.Error(err)
+	}
+
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/manager/stats/history?metric=total_job_by_type&type=cli", nil)
+	h.ReportHistory(rw, req)
+	s := &StatsSeries{}
+	if err := json.Unmarshal(rw.Body.Bytes(), s); err != nil {
+		t.Fatal(err, rw.Body.String())
+	}
+	if s.Metric != "total_job_by_type:cli" || len(s.Points) != 1 || s.Points[0].Value != 1 {
+		t.Error("History report is not correct", rw.Body.String())
+	}
+
+	rw = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/manager/stats/history?metric=total_job&resolution=day", nil)
+	h.ReportHistory(rw, req)
+	if rw.Code != 400 {
+		t.Error("Expected a bad request for an unknown resolution")
+	}
+}
@@ -0,0 +1,94 @@
+package manager
+
+import (
+	"strings"
+	"time"
+)
+
+const (
+	// metrics with this prefix count jobs completed since the last sample
+	JOB_COUNT_METRIC = "total_job"
+	// separates a metric name from the type, provider or pool it belongs to
+	METRIC_SEPARATOR = ":"
+)
+
+// statsSampler flattens the manager's stats into points. Job counts in a point
+// only include the jobs completed since the previous sample
+type statsSampler struct {
+	stats      *ManagerStats
+	lastTotals map[string]uint64
+	lastSample time.Time
+}
+
+// newStatsSampler initializes and returns a new statsSampler
+func newStatsSampler(stats *ManagerStats) *statsSampler {
+	return &statsSampler{
+		stats:      stats,
+		lastTotals: make(map[string]uint64),
+		lastSample: time.Now(),
+	}
+}
+
+// sample flatten the current state of the manager's stats into a StatsPoint
+func (s *statsSampler) sample(now time.Time) StatsPoint {
+	m := s.stats
+	elapsed := now.Sub(s.lastSample).Seconds()
+	s.lastSample = now
+	p := StatsPoint{
+		Time:   now,
+		Values: make(map[string]float64),
+	}
+
+	// jobs completed since the last sample, and the rate they were completed at
+	count := func(name string, total uint64) {
+		n := total - s.lastTotals[name]
+		s.lastTotals[name] = total
+		p.Values[name] = float64(n)
+		if elapsed > 0 {
+			p.Values[strings.Replace(name, JOB_COUNT_METRIC, "job_per_second", 1)] = float64(n) / elapsed
+		}
+	}
+
+	count(JOB_COUNT_METRIC, m.TotalJobs())
+	for t, c := range m.collectJobTotalsByType() {
+		count(metricName(JOB_COUNT_METRIC+"_by_type", t), c)
+	}
+	for pro, c := range m.collectJobTotalsByProvider() {
+		count(metricName(JOB_COUNT_METRIC+"_by_provider", pro), c)
+	}
+
+	p.Values["average_duration"] = float64(averageDuration(m.jobDurationTotal))
+	for t, d := range m.collectAverageDurationsByType() {
+		p.Values[metricName("average_duration_by_type", t)] = float64(d)
+	}
+	p.Values["average_queue_wait"] = float64(m.AverageQueueWait())
+	for t, d := range m.collectAverageQueueWaitsByType() {
+		p.Values[metricName("average_queue_wait_by_type", t)] = float64(d)
+	}
+	for pro, d := range m.collectAverageQueueWaitsByProvider() {
+		p.Values[metricName("average_queue_wait_by_provider", pro)] = float64(d)
+	}
+	for pool, u := range m.collectUtilizationByPool() {
+		p.Values[metricName("utilization_by_pool", pool)] = u
+	}
+	p.Values["in_flight"] = float64(len(m.activity.collectInFlight()))
+	for c, s := range m.collectChannelStats() {
+		p.Values[metricName("channel_queue", c)] = float64(s.Queue)
+	}
+
+	return p
+}
+
+// metricName build the name of a metric that belongs to a type, provider or pool
+func metricName(metric, sub string) string {
+	return metric + METRIC_SEPARATOR + sub
+}
+
+// splitMetricName split a metric name into the metric and the type, provider or pool it belongs to
+func splitMetricName(name string) (metric, sub string) {
+	i := strings.Index(name, METRIC_SEPARATOR)
+	if i == -1 {
+		return name, ""
+	}
+	return name[:i], name[i+len(METRIC_SEPARATOR):]
+}
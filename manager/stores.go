@@ -0,0 +1,41 @@
+package manager
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/barracudanetworks/GoWorker/database"
+)
+
+// CompactReport the outcome of compacting a job store's db
+type CompactReport struct {
+	DB     string `json:"db"`
+	Before int64  `json:"before"`
+	After  int64  `json:"after"`
+}
+
+// CompactStore compact the db given by the db parameter, through a job store that has it open
+func CompactStore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "compaction must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+	db := r.URL.Query().Get("db")
+	before, after, err := database.CompactStore(db)
+	switch err {
+	case nil:
+	case database.STORE_NOT_OPEN:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case database.IN_USE:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(&CompactReport{DB: db, Before: before, After: after})
+}
@@ -0,0 +1,52 @@
+package manager
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/barracudanetworks/GoWorker/database"
+)
+
+func TestCompactStore(t *testing.T) {
+	db := os.TempDir() + "/goworker_compact_store_test.db"
+	defer os.Remove(db)
+	s, err := database.OpenStore("bolt", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	tests := []struct {
+		method string
+		db     string
+		code   int
+	}{
+		{"GET", db, http.StatusMethodNotAllowed},
+		{"POST", db + ".missing", http.StatusNotFound},
+		{"POST", db, http.StatusOK},
+	}
+	for _, test := range tests {
+		rw := httptest.NewRecorder()
+		CompactStore(rw, httptest.NewRequest(test.method, "/manager/stores/compact?db="+url.QueryEscape(test.db), nil))
+		if rw.Code != test.code {
+			t.Error(test.method, test.db, "expected", test.code, "got", rw.Code, rw.Body.String())
+		}
+	}
+
+	rw := httptest.NewRecorder()
+	CompactStore(rw, httptest.NewRequest("POST", "/manager/stores/compact?db="+url.QueryEscape(db), nil))
+	rep := &CompactReport{}
+	if err = json.Unmarshal(rw.Body.Bytes(), rep); err != nil {
+		t.Fatal(err)
+	}
+	if rep.DB != db || rep.After == 0 {
+		t.Error("Bad report", rep)
+	}
+	if stores := TEST_MANAGER.Stats.collectStats().Stores; stores[db]["compactions"] != uint64(2) {
+		t.Error("Expected the compactions in the stats", stores[db])
+	}
+}
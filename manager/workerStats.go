@@ -0,0 +1,104 @@
+package manager
+
+import (
+	"sync"
+	"time"
+)
+
+// jobTimes holds the points in time at which a job moved through the manager
+type jobTimes struct {
+	received   time.Time // the provider handed the job to the manager
+	dispatched time.Time // the job was handed to a worker
+	finished   time.Time // the worker returned the job
+}
+
+// newJobTimes create a jobTimes for a job its provider handed over at received
+func newJobTimes(received time.Time) *jobTimes {
+	return &jobTimes{
+		received: received,
+	}
+}
+
+// QueueWait how long the job waited for a free worker
+func (j *jobTimes) QueueWait() time.Duration {
+	return j.dispatched.Sub(j.received)
+}
+
+// Busy how long a worker spent on the job
+func (j *jobTimes) Busy() time.Duration {
+	return j.finished.Sub(j.dispatched)
+}
+
+// WorkerUsage tracks how much of its life a single worker has spent working
+type WorkerUsage struct {
+	Pool         string
+	busy         time.Duration
+	created      time.Time
+	workingSince time.Time
+	sync.Mutex
+}
+
+// NewWorkerUsage create a WorkerUsage for a worker in the given pool
+func NewWorkerUsage(pool string) *WorkerUsage {
+	return &WorkerUsage{
+		Pool:    pool,
+		created: time.Now(),
+	}
+}
+
+// Start mark the worker as busy as of t
+func (w *WorkerUsage) Start(t time.Time) {
+	w.Lock()
+	w.workingSince = t
+	w.Unlock()
+}
+
+// Stop mark the worker as idle as of t, and add the time spent working to the total
+func (w *WorkerUsage) Stop(t time.Time) {
+	w.Lock()
+	if !w.workingSince.IsZero() {
+		w.busy += t.Sub(w.workingSince)
+		w.workingSince = time.Time{}
+	}
+	w.Unlock()
+}
+
+// Busy returns the total time the worker has spent working, including the current job
+func (w *WorkerUsage) Busy() time.Duration {
+	w.Lock()
+	defer w.Unlock()
+	return w.busyAt(time.Now())
+}
+
+// Idle returns the total time the worker has spent waiting for work
+func (w *WorkerUsage) Idle() time.Duration {
+	w.Lock()
+	defer w.Unlock()
+	now := time.Now()
+	return now.Sub(w.created) - w.busyAt(now)
+}
+
+// Utilization returns the percentage of the worker's life that has been spent working
+func (w *WorkerUsage) Utilization() float64 {
+	w.Lock()
+	defer w.Unlock()
+	now := time.Now()
+	return percentOf(w.busyAt(now), now.Sub(w.created))
+}
+
+// busyAt the busy time as of t. The caller must hold the lock
+func (w *WorkerUsage) busyAt(t time.Time) time.Duration {
+	b := w.busy
+	if !w.workingSince.IsZero() {
+		b += t.Sub(w.workingSince)
+	}
+	return b
+}
+
+// percentOf returns part as a percentage of whole
+func percentOf(part, whole time.Duration) float64 {
+	if whole <= 0 {
+		return 0
+	}
+	return 100 * float64(part) / float64(whole)
+}
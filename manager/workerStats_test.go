@@ -0,0 +1,125 @@
+package manager
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/barracudanetworks/GoWorker/mock"
+	"github.com/barracudanetworks/GoWorker/worker/cli"
+)
+
+func TestJobTimes(t *testing.T) {
+	now := time.Now()
+	times := &jobTimes{
+		received:   now,
+		dispatched: now.Add(2 * time.Second),
+		finished:   now.Add(5 * time.Second),
+	}
+
+	if times.QueueWait() != 2*time.Second {
+		t.Error("Queue wait is not correct")
+	}
+
+	if times.Busy() != 3*time.Second {
+		t.Error("Busy time is not correct")
+	}
+}
+
+func TestWorkerUsage(t *testing.T) {
+	u := NewWorkerUsage("cli")
+	u.created = time.Now().Add(-10 * time.Second)
+
+	start := time.Now().Add(-4 * time.Second)
+	u.Start(start)
+	u.Stop(start.Add(4 * time.Second))
+
+	if u.Busy() != 4*time.Second {
+		t.Error("Busy time is not correct", u.Busy())
+	}
+
+	if u.Idle() < 6*time.Second {
+		t.Error("Idle time is not correct", u.Idle())
+	}
+
+	if u.Utilization() <= 0 || u.Utilization() > 50 {
+		t.Error("Utilization is not correct", u.Utilization())
+	}
+}
+
+func TestUtilizationByPool(t *testing.T) {
+	m := NewManagerStats(TEST_MANAGER)
+	busy := cli.NewCli()
+	idle := cli.NewCli()
+	m.registerWorker(busy, "cli")
+	m.registerWorker(idle, "cli")
+
+	// the busy worker has been working for its whole life
+	created := time.Now().Add(-time.Minute)
+	m.WorkerUsage(busy).created = created
+	m.WorkerUsage(idle).created = created
+	m.WorkerUsage(busy).Start(created)
+
+	u := m.UtilizationByPool("cli")
+	if u < 49 || u > 51 {
+		t.Error("Utilization by pool is not correct", u)
+	}
+
+	if m.UtilizationByPool("http") != 0 {
+		t.Error("Unknown pool should have no utilization")
+	}
+}
+
+func TestQueueWait(t *testing.T) {
+	m := NewManagerStats(TEST_MANAGER)
+	j := mock.NewMockJob()
+	now := time.Now()
+
+	m.workerFinished(j, cli.NewCli(), &jobTimes{
+		received:   now,
+		dispatched: now.Add(time.Second),
+		finished:   now.Add(2 * time.Second),
+	})
+
+	if m.AverageQueueWait() != time.Second {
+		t.Error("Average queue wait is not correct")
+	}
+
+	if m.AverageQueueWaitByType("cli") != time.Second {
+		t.Error("Average queue wait by type is not correct")
+	}
+
+	if m.AverageQueueWaitByType("http") != 0 {
+		t.Error("Wrong job type recorded")
+	}
+}
+
+func TestQueueWaitConcurrent(t *testing.T) {
+	m := NewManagerStats(TEST_MANAGER)
+	now := time.Now()
+
+	// workers record new types and pools while the stats are read
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			j := mock.NewMockJob()
+			j.Config().Type = fmt.Sprint("type", i)
+			w := cli.NewCli()
+			m.registerWorker(w, j.Config().Type)
+			m.workerFinished(j, w, &jobTimes{received: now, dispatched: now.Add(time.Second), finished: now.Add(2 * time.Second)})
+		}(i)
+		go func() {
+			defer wg.Done()
+			m.collectAverageQueueWaitsByType()
+			m.collectAverageQueueWaitsByProvider()
+			m.collectUtilizationByPool()
+		}()
+	}
+	wg.Wait()
+	if waits := m.collectAverageQueueWaitsByType(); len(waits) != 8 || waits["type0"] != time.Second {
+		t.Error("Queue waits by type are not correct", waits)
+	}
+}
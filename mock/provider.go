@@ -57,3 +57,8 @@ func (m *MockProvider) Init(i interface{}) error {
 func (m *MockProvider) Name() string {
 	return "mock"
 }
+
+// Report the state of the mock provider
+func (m *MockProvider) Report() map[string]interface{} {
+	return map[string]interface{}{"connection": "connected"}
+}
@@ -1,8 +1,8 @@
 package disk
 
 import (
-	"bytes"
 	"encoding/json"
+	"os"
 	"sync"
 	"time"
 
@@ -10,23 +10,33 @@ import (
 	"github.com/barracudanetworks/GoWorker/database"
 	"github.com/barracudanetworks/GoWorker/job"
 	"github.com/barracudanetworks/GoWorker/provider"
-	"github.com/barracudanetworks/GoWorker/time_util"
-	"github.com/boltdb/bolt"
 )
 
 func init() {
 	provider.LoadProvider(DiskFactory)
 }
 
-// Disk a provider that uses a bolt db on disk as it's repository of jobs
+// Disk a provider that uses a job store on disk as it's repository of jobs
 type Disk struct {
-	name      string
-	db        *bolt.DB
-	bucket    []byte
-	tmpBucket []byte
-	locks     *locker
-	dbName    string
-	target    float64
+	name   string
+	store  database.JobStore
+	bucket string
+	locks  *locker
+	dbName string
+	target float64
+
+	// leases
+	host            string
+	leaseTTL        time.Duration
+	recoverInterval time.Duration
+	killChan        chan struct{}
+	statsLock       sync.Mutex
+	recovered       uint64
+	lastOrphans     int
+	malformed       int
+
+	// retention
+	retention *database.Retention
 }
 
 // DiskConfig the config struct used to set up the provider
@@ -35,6 +45,19 @@ type DiskConfig struct {
 	Target float64 `json:"target" required:"false"`
 	DBName string  `json:"db_name" required:"false"`
 	Bucket string  `json:"bucket" required:"true"`
+
+	// storage
+	Store string `json:"store" required:"false" description:"The job store to keep db_name in, bolt or sqlite."`
+
+	// leases
+	LeaseTTL        string `json:"lease_ttl" required:"false" description:"How long a job can be out of the bucket before it is put back, unless this provider is still working on it."`
+	RecoverInterval string `json:"recover_interval" required:"false" description:"How often to put jobs whose lease has been abandoned back into the bucket."`
+
+	// retention
+	MaxJobs        int    `json:"max_jobs" required:"false" description:"The most jobs that may wait in the bucket, 0 for no limit."`
+	MaxBytes       int64  `json:"max_bytes" required:"false" description:"The most bytes of jobs that may wait in the bucket, 0 for no limit."`
+	MaxAge         string `json:"max_age" required:"false" description:"Evict jobs that have been due for longer than this. Empty for no limit."`
+	EvictionPolicy string `json:"eviction_policy" required:"false" description:"Evict the oldest or newest jobs when the bucket is over its limits, or reject new ones."`
 }
 
 // Locker holds locks for jobs
@@ -70,53 +93,63 @@ func (l *locker) unlockJob(j job.Job) []byte {
 	return key
 }
 
+// keys the keys of every locked job
+func (l *locker) keys() map[string]bool {
+	l.Lock()
+	defer l.Unlock()
+	keys := make(map[string]bool, len(l.l))
+	for _, k := range l.l {
+		keys[string(k)] = true
+	}
+	return keys
+}
+
+// count the number of locked jobs
+func (l *locker) count() int {
+	l.Lock()
+	defer l.Unlock()
+	return len(l.l)
+}
+
 // RequestWork collect work from the database
 func (d *Disk) RequestWork(n int, jobChan chan job.Job) error {
+	jobs, err := d.popDue(n, time.Now())
+	if err != nil {
+		return err
+	}
 
-	// get the time field for where we are scanning to
-	t := []byte(time.Now().Format(time_util.TIME_FORMAT))
-
-	// open up a read only view
-	err := d.db.View(func(tx *bolt.Tx) error {
-		// cycle though the jobs we have until we hit our limit
-		for i := 0; i < n; i++ {
-			// get a curser for our bucket
-			c := tx.Bucket(d.bucket).Cursor()
-
-			// hop to the first key
-			c.First()
-
-			// grab a key value pair
-			k, v := c.Next()
-
-			// if there is no key, we are done
-			if k == nil {
-				return nil
-			}
-
-			// get the time split from the hash value
-			index := bytes.Index(k, []byte("#"))
-			if index == -1 {
-			}
-
-			// if the time value is after now, end
-			if bytes.Compare(k[0:index], t) > 0 {
-				return nil
-			}
-
-			// parse and lock the job
-			j, err := d.popAndLock(k, v)
-			if err != nil {
-				return err
-			}
-
-			// send the job back on the job chan
-			jobChan <- j
-		}
-		return nil
+	// send the jobs back on the job chan once the transaction is over, so the manager can't hold it open
+	for _, j := range jobs {
+		jobChan <- j
+	}
+	return nil
+}
+
+// popDue lease up to n jobs that are due at now, earliest first, in a single transaction, and lock them.
+// Keys that aren't names made by time_util, and jobs that can't be parsed, are left where they are and
+// counted as malformed
+func (d *Disk) popDue(n int, now time.Time) ([]job.Job, error) {
+	entries, malformed, err := d.store.Lease(d.bucket, now, n, d.newLease(now), func(v []byte) bool {
+		_, err := d.parseJob(v)
+		return err == nil
 	})
+	if err != nil {
+		return nil, err
+	}
 
-	return err
+	jobs := make([]job.Job, 0, len(entries))
+	for _, e := range entries {
+		j, err := d.parseJob(e.Value)
+		if err != nil {
+			return nil, err
+		}
+		d.locks.lockJob(j, e.Key)
+		jobs = append(jobs, j)
+	}
+	d.statsLock.Lock()
+	d.malformed = malformed
+	d.statsLock.Unlock()
+	return jobs, nil
 }
 
 // ConfirmJob remove the job from the temporary list
@@ -131,8 +164,8 @@ func (d *Disk) WaitTime(target float64) time.Duration {
 
 // Close gracefully shut down the provider
 func (d *Disk) Close() error {
-	err := database.Close(d.db)
-	return err
+	close(d.killChan)
+	return d.store.Close()
 }
 
 // Target return the target jobs per second for this provider
@@ -143,9 +176,13 @@ func (d *Disk) Target() float64 {
 // ConfigStruct
 func (d *Disk) ConfigStruct() interface{} {
 	return &DiskConfig{
-		DBName: "my.db",
-		Bucket: "job_list",
-		Target: 20,
+		DBName:          "my.db",
+		Bucket:          "job_list",
+		Target:          20,
+		LeaseTTL:        DEFAULT_LEASE_TTL,
+		RecoverInterval: DEFAULT_RECOVER_INTERVAL,
+		Store:           database.DEFAULT_STORE,
+		EvictionPolicy:  database.EVICT_OLDEST,
 	}
 }
 
@@ -159,33 +196,38 @@ func (d *Disk) Init(i interface{}) error {
 	}
 
 	// set up the struct
-	d.bucket = []byte(conf.Bucket)
-	d.tmpBucket = []byte("tmp_" + conf.Bucket)
+	d.bucket = conf.Bucket
 	d.name = conf.Name
 	d.dbName = conf.DBName
 	d.locks = NewLocker()
+	d.killChan = make(chan struct{})
+	var err error
+	if d.leaseTTL, err = time.ParseDuration(conf.LeaseTTL); err != nil {
+		return err
+	}
+	if d.recoverInterval, err = time.ParseDuration(conf.RecoverInterval); err != nil {
+		return err
+	}
+	if d.host, err = os.Hostname(); err != nil {
+		return err
+	}
+	if d.retention, err = database.NewRetention(conf.MaxJobs, conf.MaxBytes, conf.MaxAge, conf.EvictionPolicy); err != nil {
+		return err
+	}
 
 	// open the conection to the database
-	db, err := database.Open(d.dbName)
-	if err != nil {
+	if d.store, err = database.OpenStore(conf.Store, d.dbName); err != nil {
 		return err
 	}
 
-	// initilize bucket
-	err = db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists(d.bucket)
-		if err != nil {
-			return err
-		}
-		_, err = tx.CreateBucketIfNotExists(d.tmpBucket)
+	// put back the jobs a crash left behind
+	if _, err = d.recover(time.Now()); err != nil {
 		return err
-	})
-
-	if err != nil {
+	}
+	if _, err = d.enforce(time.Now()); err != nil {
 		return err
 	}
-
-	d.db = db
+	go d.recoverLoop()
 
 	return nil
 }
@@ -214,52 +256,29 @@ func (d *Disk) parseJob(b []byte) (job.Job, error) {
 	return j, nil
 }
 
-// popAndLock grab a job from the the database, and set a lock on it
-func (d *Disk) popAndLock(k, v []byte) (job.Job, error) {
-
-	// parse a job from the value
-	j, err := d.parseJob(v)
-	if err != nil {
-		return nil, err
-	}
-
-	// set a lock for this job
-	d.locks.lockJob(j, k)
-
-	// put the job in the temporary bucket
-	err = d.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(d.tmpBucket)
-		return b.Put(k, v)
-	})
-	if err != nil {
-		return j, err
-	}
-
-	// remove the job from the regular bucket
-	err = d.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(d.bucket)
-		return b.Delete(k)
-	})
-	if err != nil {
-		return j, err
-	}
-
-	return j, nil
-}
-
-// unlockJob remove the lock from a job, and remove it from the temparary bucket
+// unlockJob remove the lock from a job, and remove it from the store
 func (d *Disk) unlockJob(j job.Job) error {
 
 	// remove the lock on the job
 	k := d.locks.unlockJob(j)
 
-	// remove the job from the temp bucket
-	err := d.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(d.tmpBucket)
-		return b.Delete(k)
-	})
+	// remove the job, and its lease, for good
+	return d.store.Ack(d.bucket, k)
+}
 
-	return err
+// Report the jobs out of the bucket, and how many abandoned ones have been put back, for the stats server
+func (d *Disk) Report() map[string]interface{} {
+	leased := d.leased()
+	d.statsLock.Lock()
+	defer d.statsLock.Unlock()
+	return map[string]interface{}{
+		"in_flight": d.locks.count(),
+		"leased":    leased,
+		"orphans":   d.lastOrphans,
+		"recovered": d.recovered,
+		"malformed": d.malformed,
+		"store":     database.ReportFile(d.store.Path()),
+	}
 }
 
 // DiskFactory create and return a disk provider
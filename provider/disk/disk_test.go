@@ -2,6 +2,9 @@ package disk
 
 import (
 	"encoding/json"
+	"fmt"
+	"math"
+	"os"
 	"testing"
 	"time"
 
@@ -9,6 +12,7 @@ import (
 	"github.com/barracudanetworks/GoWorker/job"
 	"github.com/barracudanetworks/GoWorker/mock"
 	"github.com/barracudanetworks/GoWorker/time_util"
+	"github.com/boltdb/bolt"
 )
 
 var (
@@ -17,6 +21,9 @@ var (
 		Target: 10,
 		DBName: "test.db",
 		Bucket: "test",
+
+		LeaseTTL:        DEFAULT_LEASE_TTL,
+		RecoverInterval: DEFAULT_RECOVER_INTERVAL,
 	}
 )
 
@@ -61,5 +68,287 @@ func addJobHelper(d *Disk) error {
 		return err
 	}
 
-	return database.WriteJob(d.db, d.bucket, key, b)
+	return d.store.Put(d.bucket, key, b)
+}
+
+// leaseHelper put a job under key straight into the store, leased under l, or without a lease if l is nil
+func leaseHelper(t *testing.T, d *Disk, key []byte, l *database.Lease) {
+	if err := d.store.Put(d.bucket, key, []byte(`{"name":"`+string(key)+`"}`)); err != nil {
+		t.Fatal(err)
+	}
+	lease := l
+	if lease == nil {
+		lease = d.newLease(time.Now())
+	}
+	entries, _, err := d.store.Lease(d.bucket, time.Now(), 1, lease, nil)
+	if err != nil || len(entries) != 1 || string(entries[0].Key) != string(key) {
+		t.Fatal("Unable to lease", string(key), err)
+	}
+	if l != nil {
+		return
+	}
+	err = d.store.(*database.BoltStore).DB().Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(database.LEASE_BUCKET_PREFIX + d.bucket)).Delete(key)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// state whether the job under key is ready, leased, or not in the store at all
+func state(d *Disk, key []byte) string {
+	leased, _ := d.store.Leased(d.bucket)
+	for _, e := range leased {
+		if string(e.Key) == string(key) {
+			if e.Lease == nil {
+				return "leased without a lease"
+			}
+			return "leased"
+		}
+	}
+	due, _ := d.store.Due(d.bucket, time.Now().Add(24*time.Hour), math.MaxInt32)
+	for _, e := range due {
+		if string(e.Key) == string(key) {
+			return "ready"
+		}
+	}
+	return ""
+}
+
+func TestRecover(t *testing.T) {
+	db := os.TempDir() + "/goworker_disk_recover_test.db"
+	defer os.Remove(db)
+	conf := *testConfig
+	conf.DBName = db
+	conf.Bucket = "recover"
+	d := DiskFactory().(*Disk)
+	if err := d.Init(&conf); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	now := time.Now()
+	crashed := d.newLease(now)
+	crashed.Pid += 1
+	expired := d.newLease(now.Add(-2 * d.leaseTTL))
+	expired.Owner = "other"
+	live := d.newLease(now)
+	live.Owner = "other"
+
+	keys := make(map[string][]byte)
+	for i, k := range []string{"none", "crashed", "expired", "live", "held"} {
+		keys[k] = time_util.TimeToName(now.Add(time.Duration(i-10)*time.Second), k)
+	}
+	leaseHelper(t, d, keys["none"], nil)
+	leaseHelper(t, d, keys["crashed"], crashed)
+	leaseHelper(t, d, keys["expired"], expired)
+	leaseHelper(t, d, keys["live"], live)
+
+	// a job this provider is working on keeps its lease past its expiry
+	leaseHelper(t, d, keys["held"], d.newLease(now.Add(-2*d.leaseTTL)))
+	held := &DiskJob{provider: d}
+	d.locks.lockJob(held, keys["held"])
+
+	n, err := d.recover(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Error("Expected 3 jobs to be recovered, got", n)
+	}
+	for _, k := range []string{"none", "crashed", "expired"} {
+		if state(d, keys[k]) != "ready" {
+			t.Error("Abandoned job was not put back", k, state(d, keys[k]))
+		}
+	}
+	for _, k := range []string{"live", "held"} {
+		if state(d, keys[k]) != "leased" {
+			t.Error("Leased job was put back", k, state(d, keys[k]))
+		}
+	}
+
+	// the held job's lease was renewed, so it survives even once the provider lets go of it
+	d.locks.unlockJob(held)
+	if n, _ = d.recover(now.Add(d.leaseTTL / 2)); n != 0 {
+		t.Error("A renewed lease was recovered", n)
+	}
+
+	rep := d.Report()
+	if rep["leased"] != 2 || rep["recovered"] != uint64(3) || rep["in_flight"] != 0 {
+		t.Error("Bad report", rep)
+	}
+}
+
+func TestLeaseOnRequest(t *testing.T) {
+	d := diskHelper()
+	if err := addJobHelper(d); err != nil {
+		t.Fatal(err)
+	}
+	c := make(chan job.Job, 1)
+	if err := d.RequestWork(1, c); err != nil {
+		t.Fatal(err)
+	}
+	j := <-c
+	var key []byte
+	for k := range d.locks.keys() {
+		key = []byte(k)
+	}
+	if state(d, key) != "leased" {
+		t.Error("A requested job should be leased")
+	}
+	if err := d.ConfirmJob(j); err != nil {
+		t.Error(err)
+	}
+	if state(d, key) != "" {
+		t.Error("A confirmed job's lease should be removed")
+	}
+}
+
+func TestPopDue(t *testing.T) {
+	db := os.TempDir() + "/goworker_disk_pop_test.db"
+	defer os.Remove(db)
+	now := time.Now()
+	at := func(offset time.Duration, suffix string) string {
+		return string(time_util.TimeToName(now.Add(offset), suffix))
+	}
+
+	// written in local time before names were in utc, an hour from now but sorting before now in utc
+	local := now.Add(time.Hour).In(time.FixedZone("", -12*60*60)).Format(time_util.TIME_FORMAT) + "#local"
+
+	tests := []struct {
+		name      string
+		keys      []string
+		n         int
+		want      []string
+		malformed int
+	}{
+		{"nothing", nil, 10, nil, 0},
+		{"the earliest job is not skipped", []string{at(-time.Second, "a")}, 10, []string{at(-time.Second, "a")}, 0},
+		{"due jobs in order", []string{at(-time.Second, "c"), at(-3*time.Second, "a"), at(-2*time.Second, "b")}, 10,
+			[]string{at(-3*time.Second, "a"), at(-2*time.Second, "b"), at(-time.Second, "c")}, 0},
+		{"no more than n", []string{at(-3*time.Second, "a"), at(-2*time.Second, "b"), at(-time.Second, "c")}, 2,
+			[]string{at(-3*time.Second, "a"), at(-2*time.Second, "b")}, 0},
+		{"future jobs wait", []string{at(-time.Second, "a"), at(time.Hour, "b"), at(2*time.Hour, "c")}, 10, []string{at(-time.Second, "a")}, 0},
+		{"only future jobs", []string{at(time.Second, "a")}, 10, nil, 0},
+		{"a job due now is due", []string{at(0, "a")}, 10, []string{at(0, "a")}, 0},
+		{"missing separator", []string{"no separator", at(-time.Second, "a")}, 10, []string{at(-time.Second, "a")}, 1},
+		{"a future local time key does not hide later keys", []string{local, at(-time.Second, "a")}, 10, []string{at(-time.Second, "a")}, 0},
+	}
+	for i, test := range tests {
+		conf := *testConfig
+		conf.DBName = db
+		conf.Bucket = fmt.Sprintf("pop_%d", i)
+		d := DiskFactory().(*Disk)
+		if err := d.Init(&conf); err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range test.keys {
+			if err := d.store.Put(d.bucket, []byte(k), []byte(`{"name":"`+k+`"}`)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		jobs, err := d.popDue(test.n, now)
+		if err != nil {
+			t.Error(test.name, err)
+		}
+		var got []string
+		for _, j := range jobs {
+			got = append(got, j.Config().Name)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Error(test.name, "expected", test.want, "got", got)
+		}
+		if d.Report()["malformed"] != test.malformed {
+			t.Error(test.name, "expected", test.malformed, "malformed keys, got", d.Report()["malformed"])
+		}
+
+		// the jobs are leased, and the rest are left alone
+		for _, k := range test.want {
+			if state(d, []byte(k)) != "leased" {
+				t.Error(test.name, "job was not moved under a lease", k)
+			}
+		}
+		if left := len(test.keys) - len(test.want); d.Report()["in_flight"] != len(test.want) || bucketCount(d) != left {
+			t.Error(test.name, "expected", left, "jobs left", d.Report())
+		}
+		d.Close()
+	}
+}
+
+// bucketCount the number of jobs waiting in d's queue
+func bucketCount(d *Disk) int {
+	n, _, _ := d.store.Count(d.bucket)
+	return n
+}
+
+// sharedStore a store that several processes can use at once
+type sharedStore struct {
+	database.JobStore
+}
+
+func (s sharedStore) Exclusive() bool {
+	return false
+}
+
+func TestOrphanedShared(t *testing.T) {
+	d := diskHelper()
+	defer d.Close()
+	d.store = sharedStore{d.store}
+	now := time.Now()
+
+	// another process' lease is only abandoned once it expires
+	other := d.newLease(now)
+	other.Pid += 1
+	if d.orphaned(other, false, now) {
+		t.Error("A live lease from another process was orphaned")
+	}
+	if !d.orphaned(other, false, now.Add(2*d.leaseTTL)) {
+		t.Error("An expired lease from another process was not orphaned")
+	}
+
+	// even when a job of the same name is held here
+	other.Owner = d.name
+	if !d.orphaned(other, true, now.Add(2*d.leaseTTL)) {
+		t.Error("Another process' lease was kept for a job held here")
+	}
+	if d.orphaned(d.newLease(now.Add(-2*d.leaseTTL)), true, now) {
+		t.Error("A held job was orphaned")
+	}
+}
+
+func TestEnforce(t *testing.T) {
+	db := os.TempDir() + "/goworker_disk_enforce_test.db"
+	defer os.Remove(db)
+	conf := *testConfig
+	conf.DBName = db
+	conf.Bucket = "enforce"
+	conf.MaxJobs = 2
+	d := DiskFactory().(*Disk)
+	if err := d.Init(&conf); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	for i := 0; i < 3; i++ {
+		if err := d.store.Put(d.bucket, time_util.TimeToName(time.Now(), fmt.Sprint(i)), []byte(`{}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n, err := d.enforce(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || bucketCount(d) != 2 {
+		t.Error("Expected the bucket to be cut down to 2 jobs", n, bucketCount(d))
+	}
+	store := d.Report()["store"].(map[string]interface{})
+	if store["evicted"].(map[string]uint64)[database.EVICTED_LIMIT] != 1 || store["file_size"].(int64) == 0 {
+		t.Error("Bad report", store)
+	}
+
+	conf.EvictionPolicy = "sometimes"
+	if err = DiskFactory().Init(&conf); err != database.BAD_POLICY {
+		t.Error("Expected a bad eviction policy", err)
+	}
 }
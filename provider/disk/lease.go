@@ -0,0 +1,122 @@
+package disk
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"github.com/barracudanetworks/GoWorker/database"
+)
+
+const (
+	DEFAULT_LEASE_TTL        = "5m"
+	DEFAULT_RECOVER_INTERVAL = "1m"
+)
+
+// newLease create a lease on a job for d, starting at now
+func (d *Disk) newLease(now time.Time) *database.Lease {
+	return &database.Lease{
+		Owner:   d.name,
+		Host:    d.host,
+		Pid:     os.Getpid(),
+		Leased:  now,
+		Expires: now.Add(d.leaseTTL),
+	}
+}
+
+// orphaned whether the job under a lease has been abandoned. When only one process at a time can open the
+// store, a lease taken by any other process was left behind by a crash. Otherwise a lease is abandoned once
+// it expires, unless this provider still holds the job
+func (d *Disk) orphaned(l *database.Lease, held bool, now time.Time) bool {
+	if l == nil {
+		return true
+	}
+	if d.store.Exclusive() && (l.Host != d.host || l.Pid != os.Getpid()) {
+		return true
+	}
+	if d.ours(l) && held {
+		return false
+	}
+	return now.After(l.Expires)
+}
+
+// ours whether a lease was taken by this provider
+func (d *Disk) ours(l *database.Lease) bool {
+	return l.Owner == d.name && l.Host == d.host && l.Pid == os.Getpid()
+}
+
+// recover move every job whose lease has been abandoned back into the queue, and renew the
+// leases of the jobs this provider holds. Returns the number of jobs recovered
+func (d *Disk) recover(now time.Time) (int, error) {
+	held := d.locks.keys()
+	leased, err := d.store.Leased(d.bucket)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, e := range leased {
+		k := string(e.Key)
+		if !d.orphaned(e.Lease, held[k], now) {
+			if held[k] && d.ours(e.Lease) {
+				err = d.store.Renew(d.bucket, e.Key, d.newLease(now))
+			}
+		} else if err = d.store.Requeue(d.bucket, e.Key); err == nil {
+			n += 1
+		}
+
+		// the job was acked since the leases were read
+		if err == database.NOT_LEASED {
+			err = nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+	d.statsLock.Lock()
+	d.recovered += uint64(n)
+	d.lastOrphans = n
+	d.statsLock.Unlock()
+	if n > 0 {
+		log.Println("Recovered", n, "abandoned jobs into bucket", d.bucket)
+	}
+	return n, nil
+}
+
+// recoverLoop recover abandoned jobs, and evict those past the bucket's retention, every recover
+// interval until the provider is closed
+func (d *Disk) recoverLoop() {
+	for {
+		select {
+		case <-d.killChan:
+			return
+		case <-time.After(d.recoverInterval):
+			if _, err := d.recover(time.Now()); err != nil {
+				log.Println(err)
+			}
+			if _, err := d.enforce(time.Now()); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+// enforce evict the jobs past the bucket's retention. Returns the number evicted
+func (d *Disk) enforce(now time.Time) (int, error) {
+	if !d.retention.Limited() {
+		return 0, nil
+	}
+	n, err := database.Enforce(d.store, d.bucket, d.retention, now)
+	if n > 0 {
+		log.Println("Evicted", n, "jobs from bucket", d.bucket)
+	}
+	return n, err
+}
+
+// leased the number of jobs out of the queue
+func (d *Disk) leased() int {
+	_, n, err := d.store.Count(d.bucket)
+	if err != nil {
+		log.Println(err)
+	}
+	return n
+}
@@ -0,0 +1,440 @@
+/*
+Package file provides jobs from files dropped into a folder. A file holds a single JSON job, a JSON
+array of jobs, or, in the ndjson format, a job per line. Each file is claimed by renaming it into a
+processing folder, and once every job in it has been confirmed it is moved to done, or to failed if
+any of its jobs failed.
+*/
+package file
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/barracudanetworks/GoWorker/config"
+	"github.com/barracudanetworks/GoWorker/job"
+	"github.com/barracudanetworks/GoWorker/provider"
+)
+
+const (
+	DEFAULT_ROOT_FOLDER    = "jobs"
+	DEFAULT_CHECK_INTERVAL = "10s"
+
+	FORMAT_JSON   = "json"
+	FORMAT_NDJSON = "ndjson"
+
+	PROCESSING_FOLDER = "processing"
+	DONE_FOLDER       = "done"
+	FAILED_FOLDER     = "failed"
+)
+
+var (
+	BAD_FORMAT = errors.New("file: format must be json or ndjson")
+	NO_WATCH   = errors.New("file: watching folders is not supported here")
+
+	// MAX_LINE the longest line an ndjson file may have
+	MAX_LINE = 16 * 1024 * 1024
+	// WAIT_TIME how long the manager waits between requests. A request with nothing to hand out waits
+	// for a file to be dropped in, or for the check interval, itself
+	WAIT_TIME = time.Second
+)
+
+func init() {
+	provider.Factories["file"] = FileFactory
+}
+
+// FileConfig the config struct used to set up the provider
+type FileConfig struct {
+	Name          string  `json:"name" required:"false"`
+	RootFolder    string  `json:"root_folder" required:"true" description:"The folder job files are dropped into."`
+	CheckInterval string  `json:"check_interval" required:"false" description:"How often to look for new files when none have been seen dropped in."`
+	Format        string  `json:"format" required:"false" description:"json for a job, or an array of jobs, per file. ndjson for a job per line. Files ending in .ndjson or .jsonl are always read as ndjson."`
+	Target        float64 `json:"target" required:"false"`
+}
+
+// File a provider that hands out the jobs in files dropped into a folder
+type File struct {
+	name          string
+	root          string
+	processing    string
+	format        string
+	checkInterval time.Duration
+	target        float64
+	pending       []*FileJob
+	claimed       map[string]*claimedFile
+	events        <-chan struct{}
+	killChan      chan struct{}
+	stats         map[string]uint64
+	sync.Mutex
+}
+
+// claimedFile a file that has been taken out of the root folder, and what has become of its jobs
+type claimedFile struct {
+	name        string
+	path        string
+	outstanding int
+	failed      bool
+}
+
+// ConfigStruct return the config struct with the default values filled in
+func (f *File) ConfigStruct() interface{} {
+	return &FileConfig{
+		RootFolder:    DEFAULT_ROOT_FOLDER,
+		CheckInterval: DEFAULT_CHECK_INTERVAL,
+		Format:        FORMAT_JSON,
+		Target:        20,
+	}
+}
+
+// Init create the provider's folders, put back the files a crashed process left behind, and start watching the root folder
+func (f *File) Init(i interface{}) error {
+	conf, ok := i.(*FileConfig)
+	if !ok {
+		return config.WRONG_CONFIG_TYPE
+	}
+	if conf.Format != FORMAT_JSON && conf.Format != FORMAT_NDJSON {
+		return BAD_FORMAT
+	}
+	var err error
+	if f.checkInterval, err = time.ParseDuration(conf.CheckInterval); err != nil {
+		return err
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	f.name = conf.Name
+	f.root = conf.RootFolder
+	f.format = conf.Format
+	f.target = conf.Target
+	f.processing = filepath.Join(f.root, PROCESSING_FOLDER, claimant(host, os.Getpid()))
+	f.claimed = make(map[string]*claimedFile)
+	f.killChan = make(chan struct{})
+	f.stats = make(map[string]uint64)
+
+	for _, dir := range []string{f.processing, filepath.Join(f.root, DONE_FOLDER), filepath.Join(f.root, FAILED_FOLDER)} {
+		if err = os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	if err = f.recover(host); err != nil {
+		return err
+	}
+
+	// fall back to checking every check interval
+	if f.events, err = watch(f.root, f.killChan); err != nil {
+		log.Println("Polling", f.root, "every", f.checkInterval, err)
+	}
+	return nil
+}
+
+// claimant the name of the folder a process claims files into
+func claimant(host string, pid int) string {
+	return host + "." + strconv.Itoa(pid)
+}
+
+// recover move the files claimed by processes on this host that are no longer running back into the root folder
+func (f *File) recover(host string) error {
+	dirs, err := ioutil.ReadDir(filepath.Join(f.root, PROCESSING_FOLDER))
+	if err != nil {
+		return err
+	}
+	for _, d := range dirs {
+		i := strings.LastIndexByte(d.Name(), '.')
+		if !d.IsDir() || i < 0 || d.Name()[:i] != host {
+			continue
+		}
+		pid, err := strconv.Atoi(d.Name()[i+1:])
+		if err != nil || pid == os.Getpid() || alive(pid) {
+			continue
+		}
+		dir := filepath.Join(f.root, PROCESSING_FOLDER, d.Name())
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if err = os.Rename(filepath.Join(dir, file.Name()), filepath.Join(f.root, file.Name())); err != nil {
+				return err
+			}
+			f.count("recovered")
+		}
+		log.Println("Recovered", len(files), "files abandoned in", dir)
+		os.Remove(dir)
+	}
+	return nil
+}
+
+// alive whether the process pid is running
+func alive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || err == syscall.EPERM
+}
+
+// RequestWork hand out up to n jobs. If there are none, wait for a file to be dropped in, or for the check interval, and look again
+func (f *File) RequestWork(n int, jobChan chan job.Job) error {
+	jobs, err := f.take(n)
+	if err != nil || len(jobs) > 0 || n <= 0 {
+		f.send(jobs, jobChan)
+		return err
+	}
+	select {
+	case <-f.events:
+	case <-time.After(f.checkInterval):
+	case <-f.killChan:
+		return nil
+	}
+	jobs, err = f.take(n)
+	f.send(jobs, jobChan)
+	return err
+}
+
+// send hand jobs to the manager
+func (f *File) send(jobs []*FileJob, jobChan chan job.Job) {
+	for _, j := range jobs {
+		jobChan <- j
+	}
+}
+
+// take up to n jobs, claiming more files as long as there are too few pending
+func (f *File) take(n int) ([]*FileJob, error) {
+	f.Lock()
+	defer f.Unlock()
+	if len(f.pending) < n {
+		names, err := f.waiting()
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			if len(f.pending) >= n {
+				break
+			}
+			if err = f.claim(name); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+	if n > len(f.pending) {
+		n = len(f.pending)
+	}
+	jobs := f.pending[:n]
+	f.pending = f.pending[n:]
+	return jobs, nil
+}
+
+// waiting the names of the files waiting in the root folder, in name order. Hidden files are left alone, so a
+// file can be written under a hidden name and renamed once it is complete
+func (f *File) waiting() ([]string, error) {
+	infos, err := ioutil.ReadDir(f.root)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, info := range infos {
+		if info.Mode().IsRegular() && !strings.HasPrefix(info.Name(), ".") {
+			names = append(names, info.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// claim move a file into the processing folder, and queue its jobs. The lock must be held. Losing the
+// file to another process is not an error
+func (f *File) claim(name string) error {
+	path := filepath.Join(f.processing, name)
+	if err := os.Rename(filepath.Join(f.root, name), path); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	f.count("claimed")
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	c := &claimedFile{name: name, path: path}
+	confs, bad, err := f.parse(name, b)
+	if err != nil {
+		log.Println("Unable to parse", name, err)
+		f.count("malformed")
+		c.failed = true
+	}
+	if bad > 0 {
+		log.Println("Unable to parse", bad, "jobs in", name)
+		f.stats["malformed"] += uint64(bad)
+		c.failed = true
+	}
+	if len(confs) == 0 {
+		return f.finish(c)
+	}
+	c.outstanding = len(confs)
+	f.claimed[path] = c
+	for _, conf := range confs {
+		f.pending = append(f.pending, &FileJob{conf: conf, provider: f, file: c})
+	}
+	return nil
+}
+
+// parse the jobs in a file, and the number of lines that couldn't be parsed
+func (f *File) parse(name string, b []byte) ([]*job.JobConfig, int, error) {
+	ext := strings.ToLower(filepath.Ext(name))
+	if f.format == FORMAT_NDJSON || ext == ".ndjson" || ext == ".jsonl" {
+		return parseLines(b)
+	}
+
+	// a json file holds a job, or an array of them
+	b = bytes.TrimSpace(b)
+	if len(b) > 0 && b[0] == '[' {
+		var raws []json.RawMessage
+		if err := json.Unmarshal(b, &raws); err != nil {
+			return nil, 0, err
+		}
+		confs := make([]*job.JobConfig, 0, len(raws))
+		for _, raw := range raws {
+			conf, err := job.ParseConfig(raw)
+			if err != nil {
+				return nil, 0, err
+			}
+			confs = append(confs, conf)
+		}
+		return confs, 0, nil
+	}
+	conf, err := job.ParseConfig(b)
+	if err != nil {
+		return nil, 0, err
+	}
+	return []*job.JobConfig{conf}, 0, nil
+}
+
+// parseLines parse a job from every line that isn't blank
+func parseLines(b []byte) ([]*job.JobConfig, int, error) {
+	var confs []*job.JobConfig
+	bad := 0
+	s := bufio.NewScanner(bytes.NewReader(b))
+	s.Buffer(make([]byte, 64*1024), MAX_LINE)
+	for s.Scan() {
+		line := bytes.TrimSpace(s.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		conf, err := job.ParseConfig(append([]byte{}, line...))
+		if err != nil {
+			bad += 1
+			continue
+		}
+		confs = append(confs, conf)
+	}
+	return confs, bad, s.Err()
+}
+
+// ConfirmResult note a job that failed for good, so its file is moved to failed once the rest of its jobs are done
+func (f *File) ConfirmResult(j job.Job, s *job.JobStats) error {
+	if s.Status() == job.STATUS_RETRY {
+		return nil
+	}
+	if s.Status() == job.STATUS_FAILURE {
+		f.Lock()
+		j.(*FileJob).file.failed = true
+		f.Unlock()
+	}
+	return f.ConfirmJob(j)
+}
+
+// ConfirmJob count a job as done, and move its file out of the processing folder once every job in it is
+func (f *File) ConfirmJob(j job.Job) error {
+	fj := j.(*FileJob)
+	f.Lock()
+	defer f.Unlock()
+	fj.file.outstanding -= 1
+	if fj.file.outstanding > 0 {
+		return nil
+	}
+	delete(f.claimed, fj.file.path)
+	return f.finish(fj.file)
+}
+
+// finish move a file to the done folder, or the failed folder if any of its jobs failed. The lock must be held
+func (f *File) finish(c *claimedFile) error {
+	folder := DONE_FOLDER
+	if c.failed {
+		folder = FAILED_FOLDER
+	}
+	f.count(folder)
+	return os.Rename(c.path, unique(filepath.Join(f.root, folder, c.name)))
+}
+
+// unique path, or path with the time added if there is already a file there
+func unique(path string) string {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return path
+	}
+	return fmt.Sprintf("%s.%d", path, time.Now().UnixNano())
+}
+
+// count add one to a stat. The lock must be held
+func (f *File) count(stat string) {
+	f.stats[stat] += 1
+}
+
+// WaitTime return how long to wait before asking for more work
+func (f *File) WaitTime(target float64) time.Duration {
+	return WAIT_TIME
+}
+
+// Close stop watching the root folder. Files still being processed are put back by the next process to start on this host
+func (f *File) Close() error {
+	close(f.killChan)
+	return nil
+}
+
+// Target return the target jobs per second for this provider
+func (f *File) Target() float64 {
+	return f.target
+}
+
+// Name return the name of the provider
+func (f *File) Name() string {
+	if f.name != "" {
+		return f.name
+	}
+	return "file_" + f.root
+}
+
+// Report the jobs waiting to be handed out, the files being processed, and what has become of the rest, for the stats server
+func (f *File) Report() map[string]interface{} {
+	f.Lock()
+	defer f.Unlock()
+	rep := map[string]interface{}{
+		"pending":    len(f.pending),
+		"processing": len(f.claimed),
+		"watching":   f.events != nil,
+	}
+	for stat, n := range f.stats {
+		rep[stat] = n
+	}
+	return rep
+}
+
+// FileFactory create and return a file provider
+func FileFactory() provider.Provider {
+	return &File{}
+}
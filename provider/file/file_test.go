@@ -0,0 +1,207 @@
+package file
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/barracudanetworks/GoWorker/job"
+)
+
+const (
+	testJob = `{"type":"test","retries":0,"payload":{}}`
+)
+
+func fileHelper(t *testing.T, format, interval string) *File {
+	root, err := ioutil.TempDir("", "goworker_file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := FileFactory().(*File)
+	conf := f.ConfigStruct().(*FileConfig)
+	conf.RootFolder = root
+	conf.Format = format
+	conf.CheckInterval = interval
+	if err = f.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func cleanup(f *File) {
+	f.Close()
+	os.RemoveAll(f.root)
+}
+
+func drop(t *testing.T, f *File, name, content string) {
+	if err := ioutil.WriteFile(filepath.Join(f.root, name), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func request(t *testing.T, f *File, n int) []job.Job {
+	c := make(chan job.Job, n)
+	if err := f.RequestWork(n, c); err != nil {
+		t.Fatal(err)
+	}
+	close(c)
+	var jobs []job.Job
+	for j := range c {
+		jobs = append(jobs, j)
+	}
+	return jobs
+}
+
+func exists(f *File, folder, name string) bool {
+	_, err := os.Stat(filepath.Join(f.root, folder, name))
+	return err == nil
+}
+
+func TestInitBadFormat(t *testing.T) {
+	f := FileFactory().(*File)
+	conf := f.ConfigStruct().(*FileConfig)
+	conf.Format = "xml"
+	if err := f.Init(conf); err != BAD_FORMAT {
+		t.Error("expected", BAD_FORMAT, "got", err)
+	}
+}
+
+func TestRequestWork(t *testing.T) {
+	f := fileHelper(t, FORMAT_JSON, "10ms")
+	defer cleanup(f)
+	drop(t, f, "a.json", testJob)
+	drop(t, f, "b.json", "["+testJob+","+testJob+"]")
+	drop(t, f, "c.ndjson", testJob+"\n\n"+testJob+"\n")
+	drop(t, f, ".hidden", testJob)
+
+	// files are claimed in name order, and only as many as are needed
+	jobs := request(t, f, 2)
+	if len(jobs) != 2 {
+		t.Fatal("expected 2 jobs, got", len(jobs))
+	}
+	if !exists(f, "", "c.ndjson") {
+		t.Error("c.ndjson was claimed before it was needed")
+	}
+	jobs = append(jobs, request(t, f, 10)...)
+	if len(jobs) != 5 {
+		t.Fatal("expected 5 jobs, got", len(jobs))
+	}
+	if !exists(f, "", ".hidden") {
+		t.Error("hidden file was claimed")
+	}
+	if jobs[0].Config().Type != "test" {
+		t.Error("expected a test job, got", jobs[0].Config().Type)
+	}
+
+	// nothing left, the request waits out the check interval
+	if jobs := request(t, f, 1); len(jobs) != 0 {
+		t.Error("expected no jobs, got", len(jobs))
+	}
+}
+
+func TestConfirm(t *testing.T) {
+	f := fileHelper(t, FORMAT_NDJSON, "10ms")
+	defer cleanup(f)
+	drop(t, f, "good", testJob+"\n"+testJob)
+	drop(t, f, "bad", testJob+"\n"+testJob)
+	drop(t, f, "malformed", testJob+"\n{")
+	drop(t, f, "empty", "")
+
+	jobs := request(t, f, 4)
+	if len(jobs) != 4 {
+		t.Fatal("expected 4 jobs, got", len(jobs))
+	}
+	if !exists(f, DONE_FOLDER, "empty") {
+		t.Error("empty file wasn't moved to done")
+	}
+
+	// jobs are handed out in name order: bad, bad, good, good
+	success, failure, retry := job.NewJobStats(), job.NewJobStats(), job.NewJobStats()
+	success.End(job.STATUS_SUCCESS)
+	failure.End(job.STATUS_FAILURE)
+	retry.Retry()
+	for i, s := range []*job.JobStats{retry, failure, success, success} {
+		if err := f.ConfirmResult(jobs[i], s); err != nil {
+			t.Error(err)
+		}
+	}
+	if !exists(f, "", filepath.Join(PROCESSING_FOLDER, filepath.Base(f.processing), "bad")) {
+		t.Error("bad was moved before all of its jobs were confirmed")
+	}
+	f.ConfirmResult(jobs[0], success)
+	if !exists(f, FAILED_FOLDER, "bad") {
+		t.Error("bad wasn't moved to failed")
+	}
+	if !exists(f, DONE_FOLDER, "good") {
+		t.Error("good wasn't moved to done")
+	}
+
+	// the good line in a malformed file still runs, but the file is failed
+	for _, j := range request(t, f, 2) {
+		f.ConfirmResult(j, success)
+	}
+	if !exists(f, FAILED_FOLDER, "malformed") {
+		t.Error("malformed wasn't moved to failed")
+	}
+	if rep := f.Report(); rep["malformed"] != uint64(1) || rep["processing"] != 0 {
+		t.Error("unexpected report", rep)
+	}
+}
+
+func TestRecover(t *testing.T) {
+	f := fileHelper(t, FORMAT_JSON, "10ms")
+	defer cleanup(f)
+	host, _ := os.Hostname()
+
+	// a process that is no longer running, and one on another host
+	dead := filepath.Join(f.root, PROCESSING_FOLDER, claimant(host, 1<<30))
+	other := filepath.Join(f.root, PROCESSING_FOLDER, claimant("elsewhere", 1))
+	for _, dir := range []string{dead, other} {
+		os.MkdirAll(dir, 0755)
+		ioutil.WriteFile(filepath.Join(dir, "job.json"), []byte(testJob), 0644)
+	}
+	if err := f.recover(host); err != nil {
+		t.Fatal(err)
+	}
+	if !exists(f, "", "job.json") {
+		t.Error("abandoned file wasn't put back")
+	}
+	if _, err := os.Stat(dead); !os.IsNotExist(err) {
+		t.Error("abandoned folder wasn't removed")
+	}
+	if _, err := os.Stat(filepath.Join(other, "job.json")); err != nil {
+		t.Error("file claimed on another host was put back")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("folders are only watched on linux")
+	}
+	f := fileHelper(t, FORMAT_JSON, "1h")
+	defer cleanup(f)
+	if f.Report()["watching"] != true {
+		t.Fatal("root folder isn't being watched")
+	}
+
+	done := make(chan []job.Job)
+	go func() {
+		done <- request(t, f, 1)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	tmp := filepath.Join(f.root, ".job.json")
+	ioutil.WriteFile(tmp, []byte(testJob), 0644)
+	os.Rename(tmp, filepath.Join(f.root, "job.json"))
+
+	select {
+	case jobs := <-done:
+		if len(jobs) != 1 {
+			t.Error("expected 1 job, got", len(jobs))
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("dropping a file in didn't wake the request")
+	}
+}
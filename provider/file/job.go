@@ -0,0 +1,20 @@
+package file
+
+import "github.com/barracudanetworks/GoWorker/job"
+
+// FileJob a job read from a file, that points back to a file provider
+type FileJob struct {
+	provider *File
+	conf     *job.JobConfig
+	file     *claimedFile
+}
+
+// Config return this jobs config
+func (f *FileJob) Config() *job.JobConfig {
+	return f.conf
+}
+
+// JobConfirmer return the provider this job points back to
+func (f *FileJob) JobConfirmer() job.JobConfirmer {
+	return f.provider
+}
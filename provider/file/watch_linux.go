@@ -0,0 +1,44 @@
+//go:build linux
+// +build linux
+
+package file
+
+import (
+	"os"
+	"syscall"
+)
+
+// watch signal on the returned channel whenever a file is written or moved into dir, until done is closed
+func watch(dir string, done chan struct{}) (<-chan struct{}, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = syscall.InotifyAddWatch(fd, dir, syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	// a non blocking file is read through the runtime's poller, so closing it ends a read in progress
+	f := os.NewFile(uintptr(fd), "inotify")
+	events := make(chan struct{}, 1)
+	go func() {
+		<-done
+		f.Close()
+	}()
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			if _, err := f.Read(buf); err != nil {
+				return
+			}
+
+			// the files are listed when work is requested, so the events only need to wake a request up
+			select {
+			case events <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return events, nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package file
+
+// watch folders can only be watched on linux, other platforms poll every check interval
+func watch(dir string, done chan struct{}) (<-chan struct{}, error) {
+	return nil, NO_WATCH
+}
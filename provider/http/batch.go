@@ -0,0 +1,207 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	std_http "net/http"
+	"strings"
+
+	"github.com/barracudanetworks/GoWorker/auth"
+)
+
+var (
+	BATCH_TOO_LARGE  = errors.New("http: batch holds more than max_batch jobs")
+	BATCH_INVALID    = errors.New("http: batch holds jobs that can't be run, none were queued")
+	BATCH_UNQUEUABLE = errors.New("http: atomic batch holds more than max_queued jobs, so there can never be room for it")
+)
+
+// BatchItem what became of one job in a batch
+type BatchItem struct {
+	Index  int    `json:"index"`
+	ID     string `json:"id,omitempty"`
+	Status string `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// BatchResult what became of every job in a batch
+type BatchResult struct {
+	Accepted int          `json:"accepted"`
+	Rejected int          `json:"rejected"`
+	Error    string       `json:"error,omitempty"`
+	Items    []*BatchItem `json:"items"`
+}
+
+// accept note a job that was queued
+func (b *BatchResult) accept(i int, j *HttpJob) {
+	b.Accepted += 1
+	b.Items = append(b.Items, &BatchItem{Index: i, ID: j.id, Status: JOB_QUEUED})
+}
+
+// reject note a job that wasn't
+func (b *BatchResult) reject(i int, err error) {
+	b.Rejected += 1
+	b.Items = append(b.Items, &BatchItem{Index: i, Error: err.Error()})
+}
+
+// batchReader reads the jobs in a batch one at a time, from a json array or a job per line
+type batchReader struct {
+	dec   *json.Decoder
+	lines *bufio.Scanner
+}
+
+// newBatchReader read a json array if the body starts with one, or a job per line otherwise
+func newBatchReader(r io.Reader) (*batchReader, error) {
+	br := bufio.NewReader(r)
+	for {
+		c, err := br.Peek(1)
+		if err == io.EOF {
+			return &batchReader{lines: bufio.NewScanner(br)}, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if !strings.ContainsRune(" \t\r\n", rune(c[0])) {
+			break
+		}
+		br.ReadByte()
+	}
+	if c, _ := br.Peek(1); c[0] != '[' {
+		s := bufio.NewScanner(br)
+		s.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		return &batchReader{lines: s}, nil
+	}
+	dec := json.NewDecoder(br)
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	return &batchReader{dec: dec}, nil
+}
+
+// next the next job in the batch, or io.EOF once there are none left
+func (b *batchReader) next() ([]byte, error) {
+	if b.lines != nil {
+		for b.lines.Scan() {
+			if line := bytes.TrimSpace(b.lines.Bytes()); len(line) > 0 {
+				return append([]byte{}, line...), nil
+			}
+		}
+		if err := b.lines.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+	if !b.dec.More() {
+		return nil, io.EOF
+	}
+	var raw json.RawMessage
+	err := b.dec.Decode(&raw)
+	return raw, err
+}
+
+// addBatch an http.Handlerfunc that queues every job in the body of a request, as if each had been posted in async mode.
+// Jobs are queued as they are read unless ?atomic=true is set, in which case either every job is queued or none are
+func (h *Http) addBatch(rw std_http.ResponseWriter, req *std_http.Request) {
+	if req.Method != "POST" {
+		rw.Header().Set("Allow", "POST")
+		writeError(rw, std_http.StatusMethodNotAllowed, errors.New(req.Method+" is not allowed"))
+		return
+	}
+	r, err := newBatchReader(req.Body)
+	if err != nil {
+		writeError(rw, std_http.StatusBadRequest, err)
+		return
+	}
+	if req.URL.Query().Get("atomic") == "true" {
+		code, res := h.addAtomicBatch(r, auth.FromContext(req.Context()))
+		writeJSON(rw, code, res)
+		return
+	}
+
+	res := &BatchResult{Items: []*BatchItem{}}
+	code := std_http.StatusAccepted
+	for i := 0; ; i++ {
+		b, err := r.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			code, res.Error = std_http.StatusBadRequest, err.Error()
+			break
+		}
+		if i >= h.maxBatch {
+			code, res.Error = std_http.StatusRequestEntityTooLarge, BATCH_TOO_LARGE.Error()
+			break
+		}
+
+		jc, err := parseJob(b, auth.FromContext(req.Context()))
+		if err != nil {
+			res.reject(i, err)
+			continue
+		}
+		j, err := h.submit(jc)
+		if err != nil {
+			res.reject(i, err)
+			continue
+		}
+		res.accept(i, j)
+	}
+	if code == std_http.StatusAccepted && res.Rejected > 0 {
+		code = std_http.StatusMultiStatus
+	}
+	writeJSON(rw, code, res)
+}
+
+// addAtomicBatch read and check every job in a batch, then queue them all if there is room for them all
+func (h *Http) addAtomicBatch(r *batchReader, k *auth.Key) (int, *BatchResult) {
+	res := &BatchResult{Items: []*BatchItem{}}
+	var jobs []*HttpJob
+	for i := 0; ; i++ {
+		b, err := r.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			res.Error = err.Error()
+			return std_http.StatusBadRequest, res
+		}
+		if i >= h.maxBatch {
+			res.Error = BATCH_TOO_LARGE.Error()
+			return std_http.StatusRequestEntityTooLarge, res
+		}
+		if i >= cap(h.queue) {
+			res.Error = BATCH_UNQUEUABLE.Error()
+			return std_http.StatusRequestEntityTooLarge, res
+		}
+
+		jc, err := parseJob(b, k)
+		if err == nil {
+			var j *HttpJob
+			if j, err = h.newJob(jc); err == nil {
+				jobs = append(jobs, j)
+				continue
+			}
+		}
+		res.reject(i, err)
+	}
+	if res.Rejected > 0 {
+		res.Error = BATCH_INVALID.Error()
+		return std_http.StatusUnprocessableEntity, res
+	}
+
+	h.jobsLock.Lock()
+	defer h.jobsLock.Unlock()
+	if room := cap(h.queue) - len(h.queue); room < len(jobs) {
+		res.Error = fmt.Sprintf("%s, room for %d of %d", QUEUE_FULL, room, len(jobs))
+		return std_http.StatusServiceUnavailable, res
+	}
+	for i, j := range jobs {
+		// the room in the queue was checked under the lock, so this doesn't fail
+		if err := h.enqueue(j); err != nil {
+			res.reject(i, err)
+			continue
+		}
+		res.accept(i, j)
+	}
+	return std_http.StatusAccepted, res
+}
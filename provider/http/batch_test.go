@@ -0,0 +1,189 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	std_http "net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/barracudanetworks/GoWorker/job"
+)
+
+func decodeBatch(t *testing.T, rw *httptest.ResponseRecorder) *BatchResult {
+	r := &BatchResult{}
+	if err := json.Unmarshal(rw.Body.Bytes(), r); err != nil {
+		t.Fatal(err, rw.Body.String())
+	}
+	return r
+}
+
+func TestBatch(t *testing.T) {
+	h := httpHelper(t, nil)
+	defer h.Close()
+
+	for _, tc := range []struct {
+		name     string
+		path     string
+		body     string
+		code     int
+		accepted int
+		rejected int
+	}{
+		{"array", "", "[" + testJob + "," + testJob + "]", std_http.StatusAccepted, 2, 0},
+		{"ndjson", "", testJob + "\n\n" + testJob + "\n", std_http.StatusAccepted, 2, 0},
+		{"empty", "", "", std_http.StatusAccepted, 0, 0},
+		{"partial", "", testJob + "\n{\n" + `{"name":"no type"}`, std_http.StatusMultiStatus, 1, 2},
+		{"bad array", "", "[" + testJob + ",{", std_http.StatusBadRequest, 1, 0},
+		{"too large", "", "[" + testJob + "," + testJob + "," + testJob + "," + testJob + "]", std_http.StatusRequestEntityTooLarge, 3, 0},
+		{"atomic", "?atomic=true", testJob + "\n" + testJob, std_http.StatusAccepted, 2, 0},
+		{"atomic invalid", "?atomic=true", testJob + "\n{", std_http.StatusUnprocessableEntity, 0, 1},
+		{"atomic too large", "?atomic=true", "[" + testJob + "," + testJob + "," + testJob + "," + testJob + "]", std_http.StatusRequestEntityTooLarge, 0, 0},
+	} {
+		h.maxBatch = 3
+		before := len(h.queue)
+		rw := serve(h, "POST", DEFAULT_BATCH_ENDPOINT+tc.path, tc.body)
+		r := decodeBatch(t, rw)
+		if rw.Code != tc.code || r.Accepted != tc.accepted || r.Rejected != tc.rejected {
+			t.Error(tc.name, "unexpected result", rw.Code, rw.Body.String())
+		}
+		if len(h.queue)-before != tc.accepted {
+			t.Error(tc.name, "expected", tc.accepted, "jobs queued, got", len(h.queue)-before)
+		}
+		for _, item := range r.Items {
+			if item.ID != "" {
+				if rw := serve(h, "GET", DEFAULT_STATUS_ENDPOINT+item.ID, ""); rw.Code != std_http.StatusOK {
+					t.Error(tc.name, "accepted job can't be checked on", rw.Code)
+				}
+			}
+		}
+	}
+}
+
+func TestAtomicBatchQueueFull(t *testing.T) {
+	h := httpHelper(t, func(c *HttpConfig) {
+		c.MaxQueued = 2
+	})
+	defer h.Close()
+	serve(h, "POST", DEFAULT_ENDPOINT+"?mode=async", testJob)
+
+	rw := serve(h, "POST", DEFAULT_BATCH_ENDPOINT+"?atomic=true", testJob+"\n"+testJob)
+	if rw.Code != std_http.StatusServiceUnavailable || len(h.queue) != 1 {
+		t.Error("unexpected result", rw.Code, len(h.queue), rw.Body.String())
+	}
+
+	// a batch that could never fit is turned away before it is read through
+	rw = serve(h, "POST", DEFAULT_BATCH_ENDPOINT+"?atomic=true", testJob+"\n"+testJob+"\n"+testJob)
+	if r := decodeBatch(t, rw); rw.Code != std_http.StatusRequestEntityTooLarge || r.Error != BATCH_UNQUEUABLE.Error() || len(h.queue) != 1 {
+		t.Error("unexpected result", rw.Code, len(h.queue), rw.Body.String())
+	}
+
+	// without atomic, as many as fit are queued
+	rw = serve(h, "POST", DEFAULT_BATCH_ENDPOINT, testJob+"\n"+testJob)
+	if r := decodeBatch(t, rw); rw.Code != std_http.StatusMultiStatus || r.Accepted != 1 || r.Items[1].Error != QUEUE_FULL.Error() {
+		t.Error("unexpected result", rw.Code, rw.Body.String())
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	h := httpHelper(t, func(c *HttpConfig) {
+		c.Mode = MODE_ASYNC
+		c.MaxQueued = 1
+	})
+	defer h.Close()
+	post := func(path, key, body string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		req.Header.Set(IDEMPOTENCY_HEADER, key)
+		h.server.ServeHTTP(rw, req)
+		return rw
+	}
+
+	first := post(DEFAULT_ENDPOINT, "a", testJob)
+	again := post(DEFAULT_ENDPOINT, "a", testJob)
+	if again.Code != first.Code || again.Body.String() != first.Body.String() || again.Header().Get(REPLAYED_HEADER) != "true" {
+		t.Error("repeated request wasn't given the same response", again.Code, again.Body.String())
+	}
+	if len(h.queue) != 1 {
+		t.Error("repeated request queued another job")
+	}
+	if rw := post(DEFAULT_ENDPOINT, "a", `{"name":"other","type":"cli"}`); rw.Code != std_http.StatusUnprocessableEntity {
+		t.Error("expected 422 got", rw.Code)
+	}
+	if rw := post(DEFAULT_ENDPOINT+"?mode=sync", "a", testJob); rw.Code != std_http.StatusUnprocessableEntity {
+		t.Error("expected 422 for another mode got", rw.Code)
+	}
+	if rw := post(DEFAULT_BATCH_ENDPOINT, "b", strings.Repeat(" ", DEFAULT_MAX_BODY+1)); rw.Code != std_http.StatusRequestEntityTooLarge {
+		t.Error("expected 413 got", rw.Code)
+	}
+
+	// a key is only good for its own endpoint, and a 5xx response isn't kept
+	if rw := post(DEFAULT_BATCH_ENDPOINT+"?atomic=true", "a", testJob); rw.Code != std_http.StatusServiceUnavailable {
+		t.Error("expected 503 got", rw.Code)
+	}
+	jobs := make(chan job.Job, 1)
+	go h.RequestWork(1, jobs)
+	<-jobs
+	if rw := post(DEFAULT_BATCH_ENDPOINT+"?atomic=true", "a", testJob); rw.Code != std_http.StatusAccepted {
+		t.Error("expected 202 got", rw.Code, rw.Body.String())
+	}
+}
+
+func TestIdempotencyKeyInUse(t *testing.T) {
+	r := newReplays(time.Hour)
+	if rep, err := r.begin("a", [32]byte{1}); rep != nil || err != nil {
+		t.Fatal("unexpected replay", rep, err)
+	}
+	if _, err := r.begin("a", [32]byte{1}); err != KEY_IN_USE {
+		t.Error("expected", KEY_IN_USE, "got", err)
+	}
+	r.finish("a", &recorder{code: std_http.StatusServiceUnavailable})
+	if _, err := r.begin("a", [32]byte{2}); err != nil {
+		t.Error("forgotten key can't be used again", err)
+	}
+}
+
+func TestIdempotencyKeyQueued(t *testing.T) {
+	h := httpHelper(t, nil)
+	defer h.Close()
+	post := func(ctx context.Context) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", DEFAULT_ENDPOINT, strings.NewReader(testJob)).WithContext(ctx)
+		req.Header.Set(IDEMPOTENCY_HEADER, "a")
+		h.server.ServeHTTP(rw, req)
+		return rw
+	}
+
+	// the client gives up on a sync request once its job is queued
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		for len(h.queue) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+	}()
+	post(ctx)
+
+	rw := post(context.Background())
+	if rw.Code != std_http.StatusAccepted || rw.Header().Get("Location") == "" || rw.Header().Get(REPLAYED_HEADER) != "true" {
+		t.Error("expected a 202 for the queued job, got", rw.Code, rw.Body.String())
+	}
+	if len(h.queue) != 1 {
+		t.Error("repeated request queued another job")
+	}
+
+	jobs := make(chan job.Job, 1)
+	go h.RequestWork(1, jobs)
+	j := <-jobs
+	s := job.NewJobStats()
+	s.End(job.STATUS_FAILURE)
+	h.ConfirmResult(j, s)
+	rw = post(context.Background())
+	r := &Result{}
+	json.Unmarshal(rw.Body.Bytes(), r)
+	if rw.Code != std_http.StatusInternalServerError || r.ID != j.(*HttpJob).id || r.Status != "failure" {
+		t.Error("expected the job's result, got", rw.Code, rw.Body.String())
+	}
+}
@@ -1,23 +1,46 @@
 /*
 Package http provider allows for jobs to be manualy inserted into the manager though an http api.
 This provider can be enabled though the config file, just as any other provider. However, the manager will not pull this provider for jobs.
+
+In sync mode a request is answered once its job is done, with the job's result and a status code to match. In async mode it
+is answered straight away with a 202 and the job's id, and the job can then be checked on with GET {status_endpoint}{id}, or
+cancelled with DELETE {status_endpoint}{id} as long as it hasn't been handed to a worker yet.
 */
 package http
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
-	"fmt"
 	"io/ioutil"
 	"log"
 	std_http "net/http"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/barracudanetworks/GoWorker/auth"
+	"github.com/barracudanetworks/GoWorker/config"
 	"github.com/barracudanetworks/GoWorker/job"
 	"github.com/barracudanetworks/GoWorker/provider"
 )
 
 const (
 	DEFAULT_ENDPOINT = "/job/add"
+
+	DEFAULT_STATUS_ENDPOINT = "/job/"
+	DEFAULT_RESULT_TTL      = "1h"
+	DEFAULT_MAX_OUTPUT      = 1024 * 1024
+	DEFAULT_MAX_QUEUED      = 1000
+	DEFAULT_MAX_BODY        = 32 << 20
+
+	MODE_SYNC  = "sync"
+	MODE_ASYNC = "async"
+
+	DEFAULT_BATCH_ENDPOINT  = "/job/batch"
+	DEFAULT_MAX_BATCH       = DEFAULT_MAX_QUEUED
+	DEFAULT_IDEMPOTENCY_TTL = "24h"
 )
 
 var (
@@ -27,6 +50,15 @@ var (
 	}
 
 	NOT_HTTP_JOB = errors.New("This job is not of the correct type. Expecting type *HttpJob")
+
+	BAD_MODE      = errors.New("http: mode must be sync or async")
+	QUEUE_FULL    = errors.New("http: too many jobs are waiting for a worker")
+	JOB_NOT_FOUND = errors.New("http: no such job")
+	JOB_STARTED   = errors.New("http: job has already been handed to a worker")
+	MISSING_TYPE  = errors.New("http: job has no type")
+
+	BAD_MAX_OUTPUT = errors.New("http: max_output can't be negative")
+	BAD_MAX_BODY   = errors.New("http: max_body must be more than 0")
 )
 
 func init() {
@@ -42,6 +74,22 @@ func init() {
 type HttpConfig struct {
 	ListOn   string `json:"listen_on"`
 	Endpoint string `json:"endpoint"`
+
+	// results
+	Mode           string `json:"mode" required:"false" description:"sync to answer a request once its job is done, async to answer straight away with the job's id. A request may pick with ?mode=."`
+	StatusEndpoint string `json:"status_endpoint" required:"false" description:"Jobs are checked on with GET, and cancelled with DELETE, on this path followed by their id."`
+	ResultTTL      string `json:"result_ttl" required:"false" description:"How long the result of a finished job is kept."`
+	MaxOutput      int    `json:"max_output" required:"false" description:"The most output to keep from a job, the rest is cut off."`
+	MaxQueued      int    `json:"max_queued" required:"false" description:"The most jobs that may wait for a worker, more are turned away with a 503."`
+	MaxBody        int64  `json:"max_body" required:"false" description:"The largest body, in bytes, a job may be posted with. Larger ones are turned away with a 413."`
+
+	// batches
+	BatchEndpoint  string `json:"batch_endpoint" required:"false" description:"Takes a json array of jobs, or a job per line, and queues each of them as if it had been posted in async mode."`
+	MaxBatch       int    `json:"max_batch" required:"false" description:"The most jobs a batch may hold."`
+	IdempotencyTTL string `json:"idempotency_ttl" required:"false" description:"How long the response to a request with an Idempotency-Key is kept, to be given again to requests with the same key."`
+
+	// security, requests are authenticated with the keys in the app config's auth block
+	TLS config.TLSConfig `json:"tls"`
 }
 
 // Http is a provider that allows for manual insertion of jobs
@@ -50,10 +98,47 @@ type Http struct {
 	endPoint  string
 	listen_on string
 	server    *std_http.ServeMux
+
+	// results
+	mode       string
+	statusPath string
+	resultTTL  time.Duration
+	maxOutput  int
+	maxBody    int64
+	queue      chan *HttpJob
+	jobs       map[string]*HttpJob
+	jobsLock   sync.Mutex
+	killChan   chan struct{}
+	srv        *std_http.Server
+
+	// batches
+	maxBatch int
+	replays  *replays
+
+	// security
+	auth *auth.Authenticator
+}
+
+// errorResponse the body of a request that failed
+type errorResponse struct {
+	Error string `json:"error"`
 }
 
 func (h *Http) ConfigStruct() interface{} {
-	return &HttpConfig{}
+	return &HttpConfig{
+		Endpoint:       DEFAULT_ENDPOINT,
+		Mode:           MODE_SYNC,
+		StatusEndpoint: DEFAULT_STATUS_ENDPOINT,
+		ResultTTL:      DEFAULT_RESULT_TTL,
+		MaxOutput:      DEFAULT_MAX_OUTPUT,
+		MaxQueued:      DEFAULT_MAX_QUEUED,
+		MaxBody:        DEFAULT_MAX_BODY,
+
+		// batches
+		BatchEndpoint:  DEFAULT_BATCH_ENDPOINT,
+		MaxBatch:       DEFAULT_MAX_BATCH,
+		IdempotencyTTL: DEFAULT_IDEMPOTENCY_TTL,
+	}
 }
 
 // Init init a http provider and start it's webserver
@@ -62,36 +147,119 @@ func (h *Http) Init(i interface{}) error {
 	if !ok {
 		return provider.WRONG_CONFIG_TYPE
 	}
+	if conf.Mode != MODE_SYNC && conf.Mode != MODE_ASYNC {
+		return BAD_MODE
+	}
+	if conf.MaxOutput < 0 {
+		return BAD_MAX_OUTPUT
+	}
+	if conf.MaxBody <= 0 {
+		return BAD_MAX_BODY
+	}
+	var err error
+	if h.resultTTL, err = time.ParseDuration(conf.ResultTTL); err != nil {
+		return err
+	}
+	idempotencyTTL, err := time.ParseDuration(conf.IdempotencyTTL)
+	if err != nil {
+		return err
+	}
+	h.maxBatch = conf.MaxBatch
+	h.replays = newReplays(idempotencyTTL)
+	h.mode = conf.Mode
+	h.statusPath = conf.StatusEndpoint
+	h.maxOutput = conf.MaxOutput
+	h.maxBody = conf.MaxBody
+	h.queue = make(chan *HttpJob, conf.MaxQueued)
+	h.jobs = make(map[string]*HttpJob)
+	h.killChan = make(chan struct{})
+
+	h.auth = auth.Default()
+	tlsConf, err := auth.TLSConfig(conf.TLS)
+	if err != nil {
+		return err
+	}
+
 	h.endPoint = conf.Endpoint
 	h.server = std_http.NewServeMux()
-	h.server.HandleFunc(conf.Endpoint, h.addNewJob)
+	h.server.Handle(conf.Endpoint, h.authenticated(h.idempotent(h.addNewJob)))
+	h.server.Handle(conf.StatusEndpoint, h.authenticated(h.jobStatus))
+	h.server.Handle(conf.BatchEndpoint, h.authenticated(h.idempotent(h.addBatch)))
 	h.listen_on = conf.ListOn
+	h.srv = &std_http.Server{Addr: conf.ListOn, Handler: h.server, TLSConfig: tlsConf}
 
 	// handle the function
 	go func() {
-		log.Fatal(std_http.ListenAndServe(conf.ListOn, h.server))
+		if err := auth.ListenAndServe(h.srv); err != std_http.ErrServerClosed {
+			log.Fatal(err)
+		}
 	}()
 	return nil
 }
 
-// ConfirmJob
+// ConfirmJob count the job as a success
 func (h *Http) ConfirmJob(j job.Job) error {
+	s := job.NewJobStats()
+	s.End(job.STATUS_SUCCESS)
+	return h.ConfirmResult(j, s)
+}
+
+// ConfirmResult note how a run of the job went. Once it has succeeded or failed for good, answer the request waiting on it
+func (h *Http) ConfirmResult(j job.Job, s *job.JobStats) error {
 	// assume that all jobs coming into this confirmer are of type HttpJob
 	hj, ok := j.(*HttpJob)
 	if !ok {
 		return NOT_HTTP_JOB
 	}
-	// make sure the http response is taken care of
-	<-hj.confirmChan
+	h.jobsLock.Lock()
+	defer h.jobsLock.Unlock()
+	hj.state = s.Status().String()
+	if s.Status() == job.STATUS_RETRY {
+		hj.retries += 1
+		return nil
+	}
+	hj.status = s.Status()
+	hj.duration = s.Duration()
+	h.finish(hj)
 	return nil
 }
 
-// RequestWork register a new handler function. Then hold the provider open for ever.
+// finish wake up the request waiting on a job, and forget the job once its result has been kept long enough.
+// The jobs lock must be held
+func (h *Http) finish(j *HttpJob) {
+	j.finished = time.Now()
+	close(j.done)
+	time.AfterFunc(h.resultTTL, func() {
+		h.jobsLock.Lock()
+		delete(h.jobs, j.id)
+		h.jobsLock.Unlock()
+	})
+}
+
+// RequestWork hand the jobs that are posted to the manager, until the provider is closed
 func (h *Http) RequestWork(n int, c chan job.Job) error {
 	h.jobChan = c
+	for {
+		select {
+		case j := <-h.queue:
+			if h.start(j) {
+				c <- j
+			}
+		case <-h.killChan:
+			return nil
+		}
+	}
+}
 
-	<-make(chan struct{})
-	return nil
+// start mark a job as handed to a worker, unless it has been cancelled
+func (h *Http) start(j *HttpJob) bool {
+	h.jobsLock.Lock()
+	defer h.jobsLock.Unlock()
+	if j.state != JOB_QUEUED {
+		return false
+	}
+	j.state = JOB_RUNNING
+	return true
 }
 
 // WaitTime
@@ -99,9 +267,10 @@ func (h *Http) WaitTime(t float64) time.Duration {
 	return 0 * time.Second
 }
 
-// Close
+// Close stop the webserver, and stop handing jobs to the manager
 func (h *Http) Close() error {
-	return nil
+	close(h.killChan)
+	return h.srv.Close()
 }
 
 // Target return 0.0 as this provider can not be limited
@@ -114,35 +283,241 @@ func (h *Http) Name() string {
 	return "http_" + h.listen_on + h.endPoint
 }
 
-// addNewJob an http.Handlerfunc that parses a job from the body of a request, and sends it on the jobChan
+// Report the number of jobs the provider knows of in each state, for the stats server
+func (h *Http) Report() map[string]interface{} {
+	h.jobsLock.Lock()
+	defer h.jobsLock.Unlock()
+	states := make(map[string]int)
+	for _, j := range h.jobs {
+		states[j.state] += 1
+	}
+	return map[string]interface{}{
+		"jobs":   states,
+		"queued": len(h.queue),
+	}
+}
+
+// addNewJob an http.Handlerfunc that parses a job from the body of a request, and queues it for the manager
 func (h *Http) addNewJob(rw std_http.ResponseWriter, req *std_http.Request) {
-	b, err := ioutil.ReadAll(req.Body)
+	mode := req.URL.Query().Get("mode")
+	if mode == "" {
+		mode = h.mode
+	}
+	if mode != MODE_SYNC && mode != MODE_ASYNC {
+		writeError(rw, std_http.StatusBadRequest, BAD_MODE)
+		return
+	}
+
+	b, err := h.readBody(rw, req)
 	if err != nil {
-		fmt.Fprint(rw, err)
+		writeError(rw, bodyErrorCode(err), err)
+		return
 	}
 
 	var jc *job.JobConfig
-	jc, err = job.ParseConfig(b)
-	if err != nil {
-		log.Println(err, b)
-		fmt.Fprint(rw, err)
+	jc, err = parseJob(b, auth.FromContext(req.Context()))
+	if err == auth.FORBIDDEN {
+		writeError(rw, std_http.StatusForbidden, err)
+		return
+	} else if err != nil {
+		log.Println(err, string(b))
+		writeError(rw, std_http.StatusBadRequest, err)
+		return
+	}
+
+	j, err := h.submit(jc)
+	if err == QUEUE_FULL {
+		writeError(rw, std_http.StatusServiceUnavailable, err)
+		return
+	} else if err != nil {
+		writeError(rw, std_http.StatusInternalServerError, err)
+		return
+	}
+	h.claim(req, j)
+
+	if mode == MODE_ASYNC {
+		rw.Header().Set("Location", h.statusPath+j.id)
+		writeJSON(rw, std_http.StatusAccepted, h.result(j))
 		return
 	}
-	// make the job able to write back to the requester
-	jc.OutputWriter = rw
 
-	// create a new HttpJob and send it to the manager
+	// hold this request open until the job is done, a client that gives up leaves the job running
+	select {
+	case <-j.done:
+	case <-req.Context().Done():
+		return
+	}
+	h.writeResult(rw, j)
+}
+
+// writeResult answer with what has become of a job: its result once it is done, or a 202 and where to check on it
+// until then
+func (h *Http) writeResult(rw std_http.ResponseWriter, j *HttpJob) {
+	select {
+	case <-j.done:
+	default:
+		rw.Header().Set("Location", h.statusPath+j.id)
+		writeJSON(rw, std_http.StatusAccepted, h.result(j))
+		return
+	}
+	h.jobsLock.Lock()
+	code := std_http.StatusConflict
+	if j.state != JOB_CANCELLED {
+		code = int(STATUS_TO_HTTP_CODE[j.status])
+	}
+	h.jobsLock.Unlock()
+	writeJSON(rw, code, h.result(j))
+}
+
+// parseJob parse a job from a request, and make sure it can be run, and that the key the request was made with may submit it
+func parseJob(b []byte, k *auth.Key) (*job.JobConfig, error) {
+	jc, err := job.ParseConfig(b)
+	if err != nil {
+		return nil, err
+	}
+	if jc.Type == "" {
+		return nil, MISSING_TYPE
+	}
+	if !k.Allows(jc.Type) {
+		return nil, auth.FORBIDDEN
+	}
+	return jc, nil
+}
+
+// authenticated let requests through to next if they were made with a valid key
+func (h *Http) authenticated(next std_http.HandlerFunc) std_http.Handler {
+	return h.auth.Handler(next, false)
+}
+
+// newJob create a job from its config
+func (h *Http) newJob(jc *job.JobConfig) (*HttpJob, error) {
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
 	j := &HttpJob{
-		config:         jc,
-		provider:       h,
-		responseWriter: rw,
-		request:        req,
-		confirmChan:    make(chan struct{}),
+		id:        id,
+		config:    jc,
+		provider:  h,
+		output:    job.NewOutputBuffer(h.maxOutput),
+		done:      make(chan struct{}),
+		state:     JOB_QUEUED,
+		submitted: time.Now(),
 	}
-	h.jobChan <- j
 
-	// hold this request open until the response is ready to be written
-	j.confirmChan <- struct{}{}
+	// keep what the job writes back to the requester
+	jc.OutputWriter = j.output
+	return j, nil
+}
+
+// enqueue queue a job for the manager. The jobs lock must be held, so the room left in the queue can only grow
+// while it is held
+func (h *Http) enqueue(j *HttpJob) error {
+	select {
+	case h.queue <- j:
+		h.jobs[j.id] = j
+		return nil
+	default:
+		return QUEUE_FULL
+	}
+}
+
+// submit create a job from its config, and queue it for the manager
+func (h *Http) submit(jc *job.JobConfig) (*HttpJob, error) {
+	j, err := h.newJob(jc)
+	if err != nil {
+		return nil, err
+	}
+	h.jobsLock.Lock()
+	defer h.jobsLock.Unlock()
+	if err = h.enqueue(j); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// jobStatus an http.Handlerfunc that reports on the job named by the path with GET, and cancels it with DELETE
+func (h *Http) jobStatus(rw std_http.ResponseWriter, req *std_http.Request) {
+	id := strings.TrimPrefix(req.URL.Path, h.statusPath)
+	h.jobsLock.Lock()
+	j, ok := h.jobs[id]
+	h.jobsLock.Unlock()
+
+	// jobs the key couldn't have submitted are none of its business
+	if !ok || !auth.FromContext(req.Context()).Allows(j.config.Type) {
+		writeError(rw, std_http.StatusNotFound, JOB_NOT_FOUND)
+		return
+	}
+
+	switch req.Method {
+	case "GET":
+		writeJSON(rw, std_http.StatusOK, h.result(j))
+	case "DELETE":
+		if err := h.cancel(j); err != nil {
+			writeJSON(rw, std_http.StatusConflict, h.result(j))
+			return
+		}
+		writeJSON(rw, std_http.StatusOK, h.result(j))
+	default:
+		rw.Header().Set("Allow", "GET, DELETE")
+		writeError(rw, std_http.StatusMethodNotAllowed, errors.New(req.Method+" is not allowed"))
+	}
+}
+
+// cancel a job that hasn't been handed to a worker yet
+func (h *Http) cancel(j *HttpJob) error {
+	h.jobsLock.Lock()
+	defer h.jobsLock.Unlock()
+	if j.state != JOB_QUEUED {
+		return JOB_STARTED
+	}
+	j.state = JOB_CANCELLED
+	h.finish(j)
+	return nil
+}
+
+// result what has become of a job
+func (h *Http) result(j *HttpJob) *Result {
+	h.jobsLock.Lock()
+	defer h.jobsLock.Unlock()
+	return j.result()
+}
+
+// writeJSON write v as the body of the response
+func writeJSON(rw std_http.ResponseWriter, code int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(code)
+	if err := json.NewEncoder(rw).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
+
+// writeError write err as the body of the response
+func writeError(rw std_http.ResponseWriter, code int, err error) {
+	writeJSON(rw, code, &errorResponse{Error: err.Error()})
+}
+
+// readBody read the body of a request, up to max_body bytes
+func (h *Http) readBody(rw std_http.ResponseWriter, req *std_http.Request) ([]byte, error) {
+	return ioutil.ReadAll(std_http.MaxBytesReader(rw, req.Body, h.maxBody))
+}
+
+// bodyErrorCode the status code for a body that couldn't be read
+func bodyErrorCode(err error) int {
+	var tooLarge *std_http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return std_http.StatusRequestEntityTooLarge
+	}
+	return std_http.StatusBadRequest
+}
+
+// newID a random id for a job
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
 }
 
 // HttpFactory factory for new http request
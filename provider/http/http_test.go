@@ -0,0 +1,256 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	std_http "net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/barracudanetworks/GoWorker/auth"
+	"github.com/barracudanetworks/GoWorker/config"
+	"github.com/barracudanetworks/GoWorker/job"
+)
+
+const (
+	testJob = `{"name":"test","type":"cli","retries":2,"capture_output":true}`
+)
+
+func httpHelper(t *testing.T, edit func(*HttpConfig)) *Http {
+	h := HttpFactory().(*Http)
+	conf := h.ConfigStruct().(*HttpConfig)
+	conf.ListOn = "127.0.0.1:0"
+	if edit != nil {
+		edit(conf)
+	}
+	if err := h.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// serve run a request against the provider's handlers
+func serve(h *Http, method, path, body string) *httptest.ResponseRecorder {
+	rw := httptest.NewRecorder()
+	h.server.ServeHTTP(rw, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return rw
+}
+
+func decode(t *testing.T, rw *httptest.ResponseRecorder) *Result {
+	r := &Result{}
+	if err := json.Unmarshal(rw.Body.Bytes(), r); err != nil {
+		t.Fatal(err, rw.Body.String())
+	}
+	return r
+}
+
+func stats(s job.Status) *job.JobStats {
+	stats := job.NewJobStats()
+	if s == job.STATUS_RETRY {
+		stats.Retry()
+	} else {
+		stats.End(s)
+	}
+	return stats
+}
+
+func TestInitBadMode(t *testing.T) {
+	h := HttpFactory().(*Http)
+	conf := h.ConfigStruct().(*HttpConfig)
+	conf.Mode = "later"
+	if err := h.Init(conf); err != BAD_MODE {
+		t.Error("expected", BAD_MODE, "got", err)
+	}
+	conf = h.ConfigStruct().(*HttpConfig)
+	conf.MaxOutput = -1
+	if err := h.Init(conf); err != BAD_MAX_OUTPUT {
+		t.Error("expected", BAD_MAX_OUTPUT, "got", err)
+	}
+	conf = h.ConfigStruct().(*HttpConfig)
+	conf.MaxBody = 0
+	if err := h.Init(conf); err != BAD_MAX_BODY {
+		t.Error("expected", BAD_MAX_BODY, "got", err)
+	}
+}
+
+func TestSync(t *testing.T) {
+	h := httpHelper(t, nil)
+	defer h.Close()
+	jobs := make(chan job.Job)
+	go h.RequestWork(1, jobs)
+
+	for _, tc := range []struct {
+		status job.Status
+		code   int
+	}{
+		{job.STATUS_SUCCESS, std_http.StatusOK},
+		{job.STATUS_FAILURE, std_http.StatusInternalServerError},
+	} {
+		done := make(chan *httptest.ResponseRecorder)
+		go func() {
+			done <- serve(h, "POST", DEFAULT_ENDPOINT, testJob)
+		}()
+		j := <-jobs
+		fmt.Fprint(j.Config().OutputWriter, "hello")
+		h.ConfirmResult(j, stats(tc.status))
+
+		rw := <-done
+		if rw.Code != tc.code {
+			t.Error("expected", tc.code, "got", rw.Code)
+		}
+		r := decode(t, rw)
+		if r.Status != tc.status.String() || r.Output != "hello" || r.Finished == nil || r.ID != j.(*HttpJob).ID() {
+			t.Error("unexpected result", rw.Body.String())
+		}
+	}
+}
+
+func TestAsync(t *testing.T) {
+	h := httpHelper(t, nil)
+	defer h.Close()
+
+	rw := serve(h, "POST", DEFAULT_ENDPOINT+"?mode=async", testJob)
+	if rw.Code != std_http.StatusAccepted {
+		t.Fatal("expected 202 got", rw.Code)
+	}
+	r := decode(t, rw)
+	if r.Status != JOB_QUEUED || rw.Header().Get("Location") != DEFAULT_STATUS_ENDPOINT+r.ID {
+		t.Error("unexpected result", rw.Body.String(), rw.Header())
+	}
+	jobs := make(chan job.Job)
+	go h.RequestWork(1, jobs)
+	j := <-jobs
+
+	// a retry is reported, and can't be cancelled
+	h.ConfirmResult(j, stats(job.STATUS_RETRY))
+	rw = serve(h, "GET", DEFAULT_STATUS_ENDPOINT+r.ID, "")
+	if r := decode(t, rw); rw.Code != std_http.StatusOK || r.Status != "retry" || r.Retries != 1 {
+		t.Error("unexpected result", rw.Code, rw.Body.String())
+	}
+	if rw = serve(h, "DELETE", DEFAULT_STATUS_ENDPOINT+r.ID, ""); rw.Code != std_http.StatusConflict {
+		t.Error("expected 409 got", rw.Code)
+	}
+
+	h.ConfirmResult(j, stats(job.STATUS_SUCCESS))
+	rw = serve(h, "GET", DEFAULT_STATUS_ENDPOINT+r.ID, "")
+	if r := decode(t, rw); r.Status != "success" || r.Finished == nil {
+		t.Error("unexpected result", rw.Body.String())
+	}
+	if rw = serve(h, "GET", DEFAULT_STATUS_ENDPOINT+"nope", ""); rw.Code != std_http.StatusNotFound {
+		t.Error("expected 404 got", rw.Code)
+	}
+	if rw = serve(h, "PUT", DEFAULT_STATUS_ENDPOINT+r.ID, ""); rw.Code != std_http.StatusMethodNotAllowed {
+		t.Error("expected 405 got", rw.Code)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	h := httpHelper(t, func(c *HttpConfig) {
+		c.Mode = MODE_ASYNC
+	})
+	defer h.Close()
+	r := decode(t, serve(h, "POST", DEFAULT_ENDPOINT, testJob))
+	rw := serve(h, "DELETE", DEFAULT_STATUS_ENDPOINT+r.ID, "")
+	if r := decode(t, rw); rw.Code != std_http.StatusOK || r.Status != JOB_CANCELLED {
+		t.Error("unexpected result", rw.Code, rw.Body.String())
+	}
+
+	// a cancelled job is never handed out
+	jobs := make(chan job.Job)
+	go h.RequestWork(1, jobs)
+	select {
+	case <-jobs:
+		t.Error("cancelled job was handed to the manager")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestResultTTL(t *testing.T) {
+	h := httpHelper(t, func(c *HttpConfig) {
+		c.Mode = MODE_ASYNC
+		c.ResultTTL = "10ms"
+	})
+	defer h.Close()
+	r := decode(t, serve(h, "POST", DEFAULT_ENDPOINT, testJob))
+	serve(h, "DELETE", DEFAULT_STATUS_ENDPOINT+r.ID, "")
+	time.Sleep(50 * time.Millisecond)
+	if rw := serve(h, "GET", DEFAULT_STATUS_ENDPOINT+r.ID, ""); rw.Code != std_http.StatusNotFound {
+		t.Error("expected 404 got", rw.Code)
+	}
+}
+
+func TestBadRequests(t *testing.T) {
+	h := httpHelper(t, func(c *HttpConfig) {
+		c.MaxQueued = 1
+	})
+	defer h.Close()
+	if rw := serve(h, "POST", DEFAULT_ENDPOINT, "{"); rw.Code != std_http.StatusBadRequest {
+		t.Error("expected 400 got", rw.Code)
+	}
+	if rw := serve(h, "POST", DEFAULT_ENDPOINT+"?mode=later", testJob); rw.Code != std_http.StatusBadRequest {
+		t.Error("expected 400 got", rw.Code)
+	}
+	h.maxBody = int64(len(testJob)) - 1
+	if rw := serve(h, "POST", DEFAULT_ENDPOINT+"?mode=async", testJob); rw.Code != std_http.StatusRequestEntityTooLarge {
+		t.Error("expected 413 got", rw.Code)
+	}
+	h.maxBody = DEFAULT_MAX_BODY
+
+	// nothing is taking jobs, so the second waits on a full queue
+	if rw := serve(h, "POST", DEFAULT_ENDPOINT+"?mode=async", testJob); rw.Code != std_http.StatusAccepted {
+		t.Error("expected 202 got", rw.Code)
+	}
+	if rw := serve(h, "POST", DEFAULT_ENDPOINT+"?mode=async", testJob); rw.Code != std_http.StatusServiceUnavailable {
+		t.Error("expected 503 got", rw.Code)
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	if err := auth.Init(config.AuthConfig{
+		Keys: []config.KeyConfig{
+			{ID: "cli", Key: "cli-secret", Types: []string{"cli"}},
+			{ID: "http", Key: "http-secret", Types: []string{"http"}},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer auth.Init(config.AuthConfig{})
+	h := httpHelper(t, func(c *HttpConfig) {
+		c.Mode = MODE_ASYNC
+	})
+	defer h.Close()
+	send := func(method, path, key, body string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set(auth.KEY_HEADER, key)
+		h.server.ServeHTTP(rw, req)
+		return rw
+	}
+
+	if rw := serve(h, "POST", DEFAULT_ENDPOINT, testJob); rw.Code != std_http.StatusUnauthorized {
+		t.Error("expected 401 got", rw.Code)
+	}
+	if rw := send("POST", DEFAULT_ENDPOINT, "http-secret", testJob); rw.Code != std_http.StatusForbidden {
+		t.Error("expected 403 got", rw.Code)
+	}
+	rw := send("POST", DEFAULT_ENDPOINT, "cli-secret", testJob)
+	if rw.Code != std_http.StatusAccepted {
+		t.Fatal("expected 202 got", rw.Code, rw.Body.String())
+	}
+
+	// a job can only be checked on by a key allowed to submit it
+	id := decode(t, rw).ID
+	if rw := send("GET", DEFAULT_STATUS_ENDPOINT+id, "cli-secret", ""); rw.Code != std_http.StatusOK {
+		t.Error("expected 200 got", rw.Code)
+	}
+	if rw := send("GET", DEFAULT_STATUS_ENDPOINT+id, "http-secret", ""); rw.Code != std_http.StatusNotFound {
+		t.Error("expected 404 got", rw.Code)
+	}
+
+	rw = send("POST", DEFAULT_BATCH_ENDPOINT, "http-secret", testJob+"\n"+`{"name":"web","type":"http"}`)
+	if r := decodeBatch(t, rw); rw.Code != std_http.StatusMultiStatus || r.Accepted != 1 || r.Items[0].Error != auth.FORBIDDEN.Error() {
+		t.Error("unexpected result", rw.Code, rw.Body.String())
+	}
+}
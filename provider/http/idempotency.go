@@ -0,0 +1,198 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"io/ioutil"
+	std_http "net/http"
+	"sync"
+	"time"
+
+	"github.com/barracudanetworks/GoWorker/auth"
+)
+
+const (
+	IDEMPOTENCY_HEADER = "Idempotency-Key"
+	REPLAYED_HEADER    = "Idempotent-Replayed"
+)
+
+var (
+	KEY_IN_USE   = errors.New("http: a request with this Idempotency-Key is still being handled")
+	KEY_MISMATCH = errors.New("http: this Idempotency-Key was used with a different request")
+)
+
+// replay the response to a request made with an idempotency key
+type replay struct {
+	hash   [sha256.Size]byte
+	done   bool
+	code   int
+	header std_http.Header
+	body   []byte
+
+	// the job the request queued, answered for instead of a response that was never given or was a 5xx
+	job *HttpJob
+}
+
+// replayKey the context key the idempotency key of a request is kept under
+type replayKey struct{}
+
+// answered whether the response kept can be given again as it is
+func (r *replay) answered() bool {
+	return r.code != 0 && r.code < 500
+}
+
+// replays the responses to requests made with idempotency keys, kept for ttl
+type replays struct {
+	ttl     time.Duration
+	entries map[string]*replay
+	sync.Mutex
+}
+
+// newReplays keep the responses to requests made with idempotency keys for ttl
+func newReplays(ttl time.Duration) *replays {
+	return &replays{
+		ttl:     ttl,
+		entries: make(map[string]*replay),
+	}
+}
+
+// begin claim key for a request with a body hashing to hash. Returns the finished response if the
+// key has been used before
+func (r *replays) begin(key string, hash [sha256.Size]byte) (*replay, error) {
+	r.Lock()
+	defer r.Unlock()
+	rep, ok := r.entries[key]
+	if !ok {
+		r.entries[key] = &replay{hash: hash}
+		return nil, nil
+	}
+	if rep.hash != hash {
+		return nil, KEY_MISMATCH
+	}
+	if !rep.done {
+		return nil, KEY_IN_USE
+	}
+	return rep, nil
+}
+
+// queued note the job queued by the request that claimed key
+func (r *replays) queued(key string, j *HttpJob) {
+	r.Lock()
+	defer r.Unlock()
+	if rep, ok := r.entries[key]; ok {
+		rep.job = j
+	}
+}
+
+// finish keep the response to the request that claimed key. A request that wasn't answered, or was answered with a
+// 5xx, is forgotten unless it queued a job
+func (r *replays) finish(key string, rec *recorder) {
+	r.Lock()
+	defer r.Unlock()
+	rep := r.entries[key]
+	if (rec.code == 0 || rec.code >= 500) && rep.job == nil {
+		delete(r.entries, key)
+		return
+	}
+	rep.done = true
+	rep.code = rec.code
+	rep.header = rec.Header().Clone()
+	rep.body = rec.body.Bytes()
+	time.AfterFunc(r.ttl, func() {
+		r.Lock()
+		delete(r.entries, key)
+		r.Unlock()
+	})
+}
+
+// recorder keeps a copy of a response as it is written
+type recorder struct {
+	std_http.ResponseWriter
+	code int
+	body bytes.Buffer
+}
+
+// WriteHeader note the status code
+func (r *recorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// Write keep a copy of the body
+func (r *recorder) Write(p []byte) (int, error) {
+	if r.code == 0 {
+		r.code = std_http.StatusOK
+	}
+	r.body.Write(p)
+	return r.ResponseWriter.Write(p)
+}
+
+// idempotent answer a request with an Idempotency-Key the same way the first request with that key was answered.
+// Where that request queued a job but was never answered, or was answered with a 5xx, the job is answered for as it
+// is now. Otherwise such requests aren't kept, so they can be tried again
+func (h *Http) idempotent(next std_http.HandlerFunc) std_http.HandlerFunc {
+	return func(rw std_http.ResponseWriter, req *std_http.Request) {
+		key := req.Header.Get(IDEMPOTENCY_HEADER)
+		if key == "" {
+			next(rw, req)
+			return
+		}
+		b, err := h.readBody(rw, req)
+		if err != nil {
+			writeError(rw, bodyErrorCode(err), err)
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(b))
+
+		// a key is only good for the endpoint, and the api key, it was used with
+		key = req.URL.Path + " " + key
+		if k := auth.FromContext(req.Context()); k != nil {
+			key = k.ID + " " + key
+		}
+		rep, err := h.replays.begin(key, fingerprint(req, b))
+		switch {
+		case err == KEY_IN_USE:
+			writeError(rw, std_http.StatusConflict, err)
+			return
+		case err == KEY_MISMATCH:
+			writeError(rw, std_http.StatusUnprocessableEntity, err)
+			return
+		case rep != nil && !rep.answered():
+			rw.Header().Set(REPLAYED_HEADER, "true")
+			h.writeResult(rw, rep.job)
+			return
+		case rep != nil:
+			for k, v := range rep.header {
+				rw.Header()[k] = v
+			}
+			rw.Header().Set(REPLAYED_HEADER, "true")
+			rw.WriteHeader(rep.code)
+			rw.Write(rep.body)
+			return
+		}
+
+		rec := &recorder{ResponseWriter: rw}
+		next(rec, req.WithContext(context.WithValue(req.Context(), replayKey{}, key)))
+		h.replays.finish(key, rec)
+	}
+}
+
+// fingerprint what a request asks for: its method, its query, with the parameters in order, and its body
+func fingerprint(req *std_http.Request, body []byte) [sha256.Size]byte {
+	h := sha256.New()
+	io.WriteString(h, req.Method+"\n"+req.URL.Query().Encode()+"\n")
+	h.Write(body)
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// claim note the job queued by a request, so a request with the same Idempotency-Key can be answered for it
+func (h *Http) claim(req *std_http.Request, j *HttpJob) {
+	if key, ok := req.Context().Value(replayKey{}).(string); ok {
+		h.replays.queued(key, j)
+	}
+}
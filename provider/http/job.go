@@ -1,15 +1,46 @@
 package http
 
-import "github.com/barracudanetworks/GoWorker/job"
-import std_http "net/http"
+import (
+	"time"
+
+	"github.com/barracudanetworks/GoWorker/job"
+)
+
+const (
+	// the states of a job, along with the final status of a run
+	JOB_QUEUED    = "queued"
+	JOB_RUNNING   = "running"
+	JOB_CANCELLED = "cancelled"
+)
 
 // HttpJob is a job created by the http provider
 type HttpJob struct {
-	config         *job.JobConfig
-	provider       *Http
-	responseWriter std_http.ResponseWriter
-	request        *std_http.Request
-	confirmChan    chan struct{}
+	id       string
+	config   *job.JobConfig
+	provider *Http
+	output   *job.OutputBuffer
+	done     chan struct{}
+
+	// guarded by the provider's jobs lock
+	state     string
+	status    job.Status
+	retries   int
+	duration  time.Duration
+	submitted time.Time
+	finished  time.Time
+}
+
+// Result what has become of a job, returned by the job's status endpoint, and by a sync request once the job is done
+type Result struct {
+	ID        string        `json:"id"`
+	Name      string        `json:"name"`
+	Status    string        `json:"status"`
+	Retries   int           `json:"retries"`
+	Duration  time.Duration `json:"duration,omitempty"`
+	Output    string        `json:"output,omitempty"`
+	Truncated bool          `json:"truncated,omitempty"`
+	Submitted time.Time     `json:"submitted"`
+	Finished  *time.Time    `json:"finished,omitempty"`
 }
 
 // config return the JobConfig for this job
@@ -21,3 +52,26 @@ func (h *HttpJob) Config() *job.JobConfig {
 func (h *HttpJob) JobConfirmer() job.JobConfirmer {
 	return h.provider
 }
+
+// ID the id the job can be checked on by
+func (h *HttpJob) ID() string {
+	return h.id
+}
+
+// result what has become of the job. The provider's jobs lock must be held
+func (h *HttpJob) result() *Result {
+	r := &Result{
+		ID:        h.id,
+		Name:      h.config.Name,
+		Status:    h.state,
+		Retries:   h.retries,
+		Duration:  h.duration,
+		Submitted: h.submitted,
+	}
+	r.Output, r.Truncated = h.output.String()
+	if !h.finished.IsZero() {
+		finished := h.finished
+		r.Finished = &finished
+	}
+	return r
+}
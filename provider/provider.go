@@ -45,6 +45,12 @@ type Provider interface {
 	Name() string
 }
 
+// Reporter is implemented by providers that can report on their own state, such as the health of
+// their connection to the outside world. The report is included in the manager's stats
+type Reporter interface {
+	Report() map[string]interface{}
+}
+
 // ProviderFactory build and return a new provider
 type ProviderFactory func() Provider
 
@@ -0,0 +1,112 @@
+package redis
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/barracudanetworks/GoWorker/job"
+	redigo "github.com/garyburd/redigo/redis"
+)
+
+const (
+	DEFAULT_REPLY_TTL = "1h"
+)
+
+var (
+	// MAX_REPLY_OUTPUT the most captured output to send with a completion, the rest is cut off
+	MAX_REPLY_OUTPUT = 64 * 1024
+)
+
+// Completion is published to the completion channel, and pushed to a job's reply_to list, when the job succeeds or fails for good
+type Completion struct {
+	Name      string        `json:"name"`
+	List      string        `json:"list"`
+	Status    string        `json:"status"`
+	Duration  time.Duration `json:"duration"`
+	Retries   int           `json:"retries"`
+	Output    string        `json:"output,omitempty"`
+	Truncated bool          `json:"truncated,omitempty"`
+	Metadata  job.Metadata  `json:"metadata,omitempty"`
+	Time      time.Time     `json:"time"`
+}
+
+// wantsCompletion whether anyone will be told when j is done
+func (r *Redis) wantsCompletion(j *RedisJob) bool {
+	return r.completionChannel != "" || j.config.ReplyTo != ""
+}
+
+// completion describe how j went
+func (r *Redis) completion(j *RedisJob, s *job.JobStats) *Completion {
+	c := &Completion{
+		Name:     j.config.Name,
+		List:     j.list,
+		Status:   s.Status().String(),
+		Duration: s.Duration(),
+		Retries:  j.retries,
+		Metadata: j.config.Metadata,
+		Time:     time.Now(),
+	}
+	if j.output != nil {
+		c.Output, c.Truncated = j.output.String()
+	}
+	return c
+}
+
+// notify publish the completion of j to the completion channel, and push it to j's reply_to list
+func (r *Redis) notify(j *RedisJob, s *job.JobStats) error {
+	b, err := json.Marshal(r.completion(j, s))
+	if err != nil {
+		return err
+	}
+	c := r.get()
+	defer r.release(c)
+	if j.config.ReplyTo != "" {
+		key := r.tmpSet.key(j.config.ReplyTo)
+		c.Send("LPUSH", key, b)
+		if r.replyTTL > 0 {
+			c.Send("PEXPIRE", key, int64(r.replyTTL/time.Millisecond))
+		}
+	}
+	if r.completionChannel != "" {
+		c.Send("PUBLISH", r.tmpSet.key(r.completionChannel), b)
+	}
+	replies, err := redigo.Values(c.Do(""))
+	for i := 0; err == nil && i < len(replies); i++ {
+		if e, ok := replies[i].(redigo.Error); ok {
+			err = e
+		}
+	}
+	r.completed(err == nil)
+	return err
+}
+
+// completed count a completion that was, or failed to be, sent
+func (r *Redis) completed(ok bool) {
+	r.Lock()
+	defer r.Unlock()
+	if ok {
+		r.notified += 1
+	} else {
+		r.notifyErrors += 1
+	}
+}
+
+// ConfirmResult confirm a job once it has succeeded or failed for good, first telling whoever is waiting on it how it went.
+// A job that will be retried keeps its lease, so no other manager picks it up in the meantime
+func (r *Redis) ConfirmResult(j job.Job, s *job.JobStats) error {
+	rj := j.(*RedisJob)
+	if s.Status() == job.STATUS_RETRY {
+		rj.retries += 1
+		if rj.output != nil {
+			rj.output.Reset()
+		}
+		return nil
+	}
+	if r.wantsCompletion(rj) {
+		if err := r.notify(rj, s); err != nil {
+			log.Println("Unable to send the completion of", rj.config.Name, err)
+		}
+	}
+	return r.ConfirmJob(j)
+}
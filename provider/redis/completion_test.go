@@ -0,0 +1,111 @@
+package redis
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/barracudanetworks/GoWorker/job"
+	redigo "github.com/garyburd/redigo/redis"
+)
+
+func TestCompletion(t *testing.T) {
+	list := testList + "TestCompletion"
+	r := RedisFactory().(*Redis)
+	conf := r.ConfigStruct().(*RedisConfig)
+	conf.Host = "localhost"
+	conf.Port = "6379"
+	conf.JobList = list
+	conf.Namespace = "completion"
+	conf.CompletionChannel = "done"
+	if err := r.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// listen for the completion before the job is done
+	sub, err := redigo.Dial("tcp", "localhost:6379")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	psc := redigo.PubSubConn{Conn: sub}
+	if err = psc.Subscribe("completion:done"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := psc.Receive().(redigo.Subscription); !ok {
+		t.Fatal("Expected a subscription")
+	}
+
+	replyTo := list + ":reply"
+	c := r.get()
+	c.Do("RPUSH", r.tmpSet.key(list), fmt.Sprintf(`{"name":"rpc","type":"cli","capture_output":true,"retries":2,"reply_to":%q,"metadata":{"request":"42"}}`, replyTo))
+	r.release(c)
+
+	jobChan := make(chan job.Job, 1)
+	if err = r.RequestWork(1, jobChan); err != nil {
+		t.Fatal(err)
+	}
+	j := (<-jobChan).(*RedisJob)
+
+	// a retry keeps the lease and throws away the output of the failed run
+	j.Config().OutputWriter.Write([]byte("failed"))
+	s := job.NewJobStats()
+	s.End(job.STATUS_RETRY)
+	if err = r.ConfirmResult(j, s); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.tmpSet.locks[j]; !ok {
+		t.Fatal("A job being retried should keep its lease")
+	}
+
+	j.Config().OutputWriter.Write([]byte("answer"))
+	s = job.NewJobStats()
+	s.End(job.STATUS_SUCCESS)
+	if err = r.ConfirmResult(j, s); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.tmpSet.locks[j]; ok {
+		t.Error("The lease should be given up once the job is done")
+	}
+
+	check := func(b []byte) {
+		var comp Completion
+		if err := json.Unmarshal(b, &comp); err != nil {
+			t.Fatal(err)
+		}
+		if comp.Name != "rpc" || comp.Status != "success" || comp.Retries != 1 || comp.Output != "answer" || comp.List != list || comp.Metadata.Get("request") != "42" {
+			t.Error("Bad completion", comp)
+		}
+	}
+
+	c = r.get()
+	ttl, _ := redigo.Int64(c.Do("PTTL", r.tmpSet.key(replyTo)))
+	reply, err := redigo.Bytes(c.Do("RPOP", r.tmpSet.key(replyTo)))
+	r.release(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(reply)
+	if ttl <= 0 {
+		t.Error("The reply list should expire", ttl)
+	}
+
+	done := make(chan interface{})
+	go func() { done <- psc.Receive() }()
+	select {
+	case m := <-done:
+		msg, ok := m.(redigo.Message)
+		if !ok {
+			t.Fatal("Expected a message", m)
+		}
+		check(msg.Data)
+	case <-time.After(time.Second):
+		t.Error("No completion was published")
+	}
+
+	if rep := r.Report()["completions"].(map[string]interface{}); rep["sent"] != uint64(1) {
+		t.Error("Bad report", rep)
+	}
+}
@@ -0,0 +1,130 @@
+package redis
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	STATE_CONNECTING   = "connecting"
+	STATE_CONNECTED    = "connected"
+	STATE_DISCONNECTED = "disconnected"
+)
+
+var (
+	MIN_RECONNECT_WAIT    = 100 * time.Millisecond
+	MAX_RECONNECT_WAIT    = 30 * time.Second
+	HEALTH_CHECK_INTERVAL = 10 * time.Second
+	WAITING_TO_RECONNECT  = errors.New("redis: waiting to reconnect")
+)
+
+// connState tracks the health of the connection to redis, and how long to back off
+// before dialing again after a failure
+type connState struct {
+	state      string
+	since      time.Time
+	lastErr    error
+	failures   uint
+	nextDial   time.Time
+	reconnects uint64
+	sync.Mutex
+}
+
+// newConnState initializes and returns a new connState
+func newConnState() *connState {
+	return &connState{
+		state: STATE_CONNECTING,
+		since: time.Now(),
+	}
+}
+
+// allowDial returns an error if we are still backing off from the last failed dial
+func (c *connState) allowDial(now time.Time) error {
+	c.Lock()
+	defer c.Unlock()
+	if c.failures > 0 && now.Before(c.nextDial) {
+		return WAITING_TO_RECONNECT
+	}
+	return nil
+}
+
+// dialed record the outcome of a dial
+func (c *connState) dialed(now time.Time, err error) {
+	c.Lock()
+	defer c.Unlock()
+	if err != nil {
+		c.failed(now, err)
+		c.nextDial = now.Add(backoff(c.failures))
+		return
+	}
+	if c.state == STATE_DISCONNECTED {
+		c.reconnects += 1
+	}
+	if c.state != STATE_CONNECTED {
+		c.state = STATE_CONNECTED
+		c.since = now
+	}
+	c.failures = 0
+}
+
+// lost record a failed command on a connection that was thought to be healthy
+func (c *connState) lost(now time.Time, err error) {
+	c.Lock()
+	defer c.Unlock()
+	c.lastErr = err
+	if c.state == STATE_CONNECTED {
+		c.state = STATE_DISCONNECTED
+		c.since = now
+	}
+}
+
+// failed must be called with the lock held
+func (c *connState) failed(now time.Time, err error) {
+	c.lastErr = err
+	c.failures += 1
+	if c.state != STATE_DISCONNECTED {
+		c.state = STATE_DISCONNECTED
+		c.since = now
+	}
+}
+
+// connected is the connection currently thought to be healthy
+func (c *connState) connected() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.state == STATE_CONNECTED
+}
+
+// Report the connection state for the stats server
+func (c *connState) Report() map[string]interface{} {
+	c.Lock()
+	defer c.Unlock()
+	r := map[string]interface{}{
+		"connection": c.state,
+		"since":      c.since,
+		"reconnects": c.reconnects,
+	}
+	if c.lastErr != nil {
+		r["last_error"] = c.lastErr.Error()
+	}
+	if c.state == STATE_DISCONNECTED {
+		r["next_dial"] = c.nextDial
+	}
+	return r
+}
+
+// backoff how long to wait before dialing again after n failures in a row
+func backoff(n uint) time.Duration {
+	if n == 0 {
+		return 0
+	}
+	d := MIN_RECONNECT_WAIT
+	for i := uint(1); i < n && d < MAX_RECONNECT_WAIT; i++ {
+		d *= 2
+	}
+	if d > MAX_RECONNECT_WAIT {
+		d = MAX_RECONNECT_WAIT
+	}
+	return d
+}
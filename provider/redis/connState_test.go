@@ -0,0 +1,57 @@
+package redis
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	if backoff(0) != 0 {
+		t.Error("No failures should not back off")
+	}
+	if backoff(1) != MIN_RECONNECT_WAIT || backoff(3) != 4*MIN_RECONNECT_WAIT {
+		t.Error("Backoff should double with every failure", backoff(1), backoff(3))
+	}
+	if backoff(100) != MAX_RECONNECT_WAIT {
+		t.Error("Backoff should be capped", backoff(100))
+	}
+}
+
+func TestConnStateReconnect(t *testing.T) {
+	c := newConnState()
+	now := time.Now()
+	c.dialed(now, nil)
+	if !c.connected() {
+		t.Error("Should be connected after a good dial")
+	}
+
+	c.dialed(now, errors.New("refused"))
+	if c.connected() {
+		t.Error("Should not be connected after a failed dial")
+	}
+	if c.allowDial(now) != WAITING_TO_RECONNECT {
+		t.Error("Should back off after a failed dial")
+	}
+	if c.allowDial(now.Add(MIN_RECONNECT_WAIT)) != nil {
+		t.Error("Should dial again once the backoff is over")
+	}
+
+	c.dialed(now.Add(MIN_RECONNECT_WAIT), nil)
+	rep := c.Report()
+	if rep["connection"] != STATE_CONNECTED || rep["reconnects"] != uint64(1) || rep["last_error"] != "refused" {
+		t.Error("Report is not correct", rep)
+	}
+}
+
+func TestConnStateLost(t *testing.T) {
+	c := newConnState()
+	c.dialed(time.Now(), nil)
+	c.lost(time.Now(), errors.New("EOF"))
+	if c.connected() {
+		t.Error("A lost connection should not be connected")
+	}
+	if c.allowDial(time.Now()) != nil {
+		t.Error("A lost connection should be redialed right away")
+	}
+}
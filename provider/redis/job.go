@@ -6,6 +6,9 @@ import "github.com/barracudanetworks/GoWorker/job"
 type RedisJob struct {
 	config   *job.JobConfig
 	provider *Redis
+	list     string
+	retries  int
+	output   *job.OutputBuffer
 }
 
 // Config return the JobConfig for this job
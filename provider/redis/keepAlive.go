@@ -2,9 +2,10 @@ package redis
 
 import (
 	"log"
+	"sync"
 	"time"
 
-	"github.com/barracudanetworks/GoWorker/lua"
+	redigo "github.com/garyburd/redigo/redis"
 )
 
 // keepAlive holds a function that keeps the lock alive
@@ -13,21 +14,27 @@ type keepAlive struct {
 	ttl      time.Duration
 	key      string
 	job      *RedisJob
+	once     sync.Once
 }
 
-// KeepAlive keep this bitch alive
+// KeepAlive push back the expiry of the job's lease until it is killed, or the lease is lost
 func (k *keepAlive) KeepAlive(r *Redis) {
-	var err error
+	leases := r.tmpSet.leasesKey(k.job.list)
 	for {
 		select {
 		case <-time.After(k.ttl / 2):
-			r.Lock()
-			_, err = lua.KEEP_ALIVE_SCRIPT.Do(r.conn, k.key, int(k.ttl.Seconds()))
+			// keep trying on failure, redis may come back before the lease expires
+			c := r.get()
+			ok, err := redigo.Bool(r.tmpSet.scripts.KeepAlive.Do(c, leases, k.key, leaseExpiry(time.Now())))
+			r.release(c)
 			if err != nil {
 				log.Println(err)
+				continue
+			}
+			if !ok {
+				log.Println("Lease", k.key, "was lost")
 				return
 			}
-			r.Unlock()
 
 		case <-k.killChan:
 			log.Println("Job", k.key, "completed")
@@ -36,7 +43,9 @@ func (k *keepAlive) KeepAlive(r *Redis) {
 	}
 }
 
-// Kill stop keeping the lock alive
+// Kill stop keeping the lock alive. It may be called more than once
 func (k *keepAlive) Kill() {
-	k.killChan <- struct{}{}
+	k.once.Do(func() {
+		close(k.killChan)
+	})
 }
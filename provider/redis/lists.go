@@ -0,0 +1,126 @@
+package redis
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	ORDER_PRIORITY = "priority"
+	ORDER_WEIGHTED = "weighted"
+)
+
+var (
+	UNKNOWN_LIST_ORDER = errors.New("redis: unknown list order")
+	NO_JOB_LISTS       = errors.New("redis: no job lists given")
+)
+
+// ListConfig contains config options for one of the lists a redis provider pulls jobs from
+type ListConfig struct {
+	Name   string  `json:"name" required:"true" description:"The list in redis to pull jobs from."`
+	Weight int     `json:"weight" required:"false" description:"The share of jobs to take from this list when lists are weighted. Defaults to 1."`
+	Target float64 `json:"target" required:"false" description:"The most jobs per second to take from this list."`
+}
+
+// jobList is one of the lists a redis provider pulls jobs from, along with its stats
+type jobList struct {
+	name     string
+	weight   int
+	target   float64
+	tokens   float64
+	refilled time.Time
+	length   uint64
+	fetched  uint64
+	orphans  uint64
+}
+
+// newJobList create a jobList from its config
+func newJobList(conf ListConfig, now time.Time) *jobList {
+	l := &jobList{
+		name:     conf.Name,
+		weight:   conf.Weight,
+		target:   conf.Target,
+		refilled: now,
+	}
+	if l.weight <= 0 {
+		l.weight = 1
+	}
+	return l
+}
+
+// allowance how many jobs the list's target lets us take at now, or -1 if there is no target.
+// The allowance builds up at the target rate, up to the most the manager could ask for while it waits
+func (l *jobList) allowance(now time.Time) int {
+	if l.target <= 0 {
+		return -1
+	}
+	l.tokens += l.target * now.Sub(l.refilled).Seconds()
+	if max := l.target * MAX_WAIT_TIME.Seconds(); l.tokens > max {
+		l.tokens = max
+	}
+	l.refilled = now
+	return int(l.tokens)
+}
+
+// took record that n jobs were taken from the list
+func (l *jobList) took(n int) {
+	l.fetched += uint64(n)
+	if l.target > 0 {
+		l.tokens -= float64(n)
+	}
+}
+
+// report the stats of the list
+func (l *jobList) report() map[string]interface{} {
+	return map[string]interface{}{
+		"name":    l.name,
+		"weight":  l.weight,
+		"target":  l.target,
+		"length":  l.length,
+		"fetched": l.fetched,
+		"orphans": l.orphans,
+	}
+}
+
+// planFetch decide how many of num jobs to take from each list. available is the most each list can give.
+// In priority order earlier lists are drained before later ones are touched. In weighted order jobs are
+// spread across the lists in proportion to their weights using smooth weighted round robin
+func planFetch(order string, weights, available []int, num int) ([]int, error) {
+	plan := make([]int, len(available))
+	switch order {
+	case ORDER_PRIORITY, "":
+		for i := range available {
+			if num <= 0 {
+				break
+			}
+			plan[i] = available[i]
+			if plan[i] > num {
+				plan[i] = num
+			}
+			num -= plan[i]
+		}
+	case ORDER_WEIGHTED:
+		current := make([]int, len(available))
+		for ; num > 0; num-- {
+			total, best := 0, -1
+			for i := range available {
+				if available[i]-plan[i] <= 0 {
+					continue
+				}
+				current[i] += weights[i]
+				total += weights[i]
+				if best == -1 || current[i] > current[best] {
+					best = i
+				}
+			}
+			if best == -1 {
+				break
+			}
+			current[best] -= total
+			plan[best] += 1
+		}
+	default:
+		return nil, UNKNOWN_LIST_ORDER
+	}
+	return plan, nil
+}
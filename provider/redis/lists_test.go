@@ -0,0 +1,93 @@
+package redis
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/barracudanetworks/GoWorker/job"
+)
+
+func TestPlanFetch(t *testing.T) {
+	tests := []struct {
+		order     string
+		weights   []int
+		available []int
+		num       int
+		plan      []int
+	}{
+		{ORDER_PRIORITY, []int{1, 1}, []int{5, 5}, 3, []int{3, 0}},
+		{ORDER_PRIORITY, []int{1, 1}, []int{2, 5}, 4, []int{2, 2}},
+		{ORDER_PRIORITY, []int{1, 1}, []int{0, 1}, 4, []int{0, 1}},
+		{ORDER_WEIGHTED, []int{3, 1}, []int{10, 10}, 8, []int{6, 2}},
+		{ORDER_WEIGHTED, []int{3, 1}, []int{1, 10}, 4, []int{1, 3}},
+		{ORDER_WEIGHTED, []int{1, 1}, []int{0, 0}, 4, []int{0, 0}},
+	}
+	for _, test := range tests {
+		plan, err := planFetch(test.order, test.weights, test.available, test.num)
+		if err != nil {
+			t.Error(err)
+		}
+		if !reflect.DeepEqual(plan, test.plan) {
+			t.Errorf("%s %v of %v: expected %v got %v", test.order, test.weights, test.available, test.plan, plan)
+		}
+	}
+
+	if _, err := planFetch("random", nil, nil, 1); err != UNKNOWN_LIST_ORDER {
+		t.Error("Expected an unknown order error")
+	}
+}
+
+func TestListAllowance(t *testing.T) {
+	now := time.Now()
+	l := newJobList(ListConfig{Name: "test", Target: 10}, now)
+	if l.allowance(now.Add(time.Second)) != 10 {
+		t.Error("Allowance should build up at the target rate")
+	}
+	l.took(4)
+	if l.allowance(now.Add(time.Second)) != 6 {
+		t.Error("Jobs taken should come out of the allowance")
+	}
+	if l.allowance(now.Add(time.Hour)) != int(10*MAX_WAIT_TIME.Seconds()) {
+		t.Error("Allowance should be capped")
+	}
+
+	unlimited := newJobList(ListConfig{Name: "test"}, now)
+	if unlimited.allowance(now) != -1 || unlimited.weight != 1 {
+		t.Error("A list without a target should be unlimited with a weight of one")
+	}
+}
+
+func TestRequestWorkPriority(t *testing.T) {
+	r := RedisFactory().(*Redis)
+	conf := r.ConfigStruct().(*RedisConfig)
+	conf.Host = "localhost"
+	conf.Port = "6379"
+	conf.Lists = []ListConfig{{Name: testList + "urgent"}, {Name: testList + "bulk"}}
+	if err := r.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	addJobs(r, testList+"urgent", 2)
+	addJobs(r, testList+"bulk", 2)
+
+	// urgent is drained before bulk is touched
+	jobChan := make(chan job.Job, 3)
+	if err := r.RequestWork(3, jobChan); err != nil {
+		t.Fatal(err)
+	}
+	close(jobChan)
+	lists := map[string]int{}
+	for j := range jobChan {
+		lists[j.(*RedisJob).list] += 1
+		r.ConfirmJob(j)
+	}
+	if lists[testList+"urgent"] != 2 || lists[testList+"bulk"] != 1 {
+		t.Error("Jobs were not taken in priority order", lists)
+	}
+
+	rep := r.Report()["lists"].([]map[string]interface{})
+	if rep[0]["fetched"] != uint64(2) || rep[1]["fetched"] != uint64(1) {
+		t.Error("List stats are not correct", rep)
+	}
+}
@@ -0,0 +1,62 @@
+package redis
+
+import (
+	"testing"
+
+	"github.com/barracudanetworks/GoWorker/job"
+)
+
+// namespaceHelper create a redis provider reading list in namespace
+func namespaceHelper(t *testing.T, namespace, list string) *Redis {
+	r := RedisFactory().(*Redis)
+	conf := r.ConfigStruct().(*RedisConfig)
+	conf.Host = "localhost"
+	conf.Port = "6379"
+	conf.JobList = list
+	conf.Namespace = namespace
+	if err := r.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestNamespaces(t *testing.T) {
+	list := testList + "TestNamespaces"
+	a := namespaceHelper(t, "a", list)
+	defer a.Close()
+	b := namespaceHelper(t, "b", list)
+	defer b.Close()
+
+	addJobs(a, list, 2)
+	addJobs(b, list, 1)
+	if a.lenList(list) != 2 || b.lenList(list) != 1 {
+		t.Fatal("Lists with the same name in different namespaces should be separate")
+	}
+
+	// orphan a job in a, b must not pick it up
+	token := addOrphanJob(a)
+	orphans, err := b.tmpSet.GetOrphan(b, list, 10)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(orphans) != 0 {
+		t.Error("Orphan from another namespace was taken", orphans)
+	}
+
+	jobChan := make(chan job.Job, 10)
+	if err = b.RequestWork(10, jobChan); err != nil {
+		t.Error(err)
+	}
+	if len(jobChan) != 1 {
+		t.Error("Expected only the job in b's namespace, got", len(jobChan))
+	}
+
+	// a gets its orphan back along with its own jobs
+	orphans, err = a.tmpSet.GetOrphan(a, list, 10)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(orphans) != 1 || a.tmpSet.locks[orphans[0]].key != token {
+		t.Error("Orphan was not found in its own namespace", orphans)
+	}
+}
@@ -0,0 +1,316 @@
+package redis
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/barracudanetworks/GoWorker/database"
+	"github.com/boltdb/bolt"
+	redigo "github.com/garyburd/redigo/redis"
+)
+
+const (
+	DEFAULT_SPILL_DB          = "redis_spill.db"
+	DEFAULT_OVERFLOW_INTERVAL = "10s"
+	SPILL_BUCKET_PREFIX       = "spill:"
+
+	OVERFLOW_IDLE      = "idle"
+	OVERFLOW_SPILLING  = "spilling"
+	OVERFLOW_REFILLING = "refilling"
+)
+
+var (
+	BAD_TRANSACTION = errors.New("redis: unexpected transaction reply")
+
+	// SPILL_BATCH the most jobs moved in or out of redis at once
+	SPILL_BATCH = 100
+
+	// OVERFLOW_BUSY_INTERVAL how long to wait between batches while spilling or refilling
+	OVERFLOW_BUSY_INTERVAL = 100 * time.Millisecond
+
+	// LOW_WATERMARK_RATIO the low watermark, as a fraction of the high watermark, when one is not given
+	LOW_WATERMARK_RATIO = 0.8
+)
+
+// overflow moves jobs out of redis into a local bolt db when redis' memory use is over its high watermark,
+// and pushes them back once it is under its low watermark. Jobs are spilled from the back of the least
+// important lists first, and refilled from the front of what was spilled, so each list's order is kept.
+// Jobs pushed while others were spilled end up in front of them
+type overflow struct {
+	r          *Redis
+	db         *bolt.DB
+	high       int64
+	low        int64
+	interval   time.Duration
+	usedMemory func() (int64, error)
+	state      string
+	used       int64
+	spilled    uint64
+	refilled   uint64
+	stored     int
+	killChan   chan struct{}
+	done       chan struct{}
+	sync.Mutex
+}
+
+// newOverflow open the spill db and create an overflow for r
+func newOverflow(r *Redis, dbName string, high, low int64, interval time.Duration) (*overflow, error) {
+	db, err := database.Open(dbName)
+	if err != nil {
+		return nil, err
+	}
+	if low <= 0 || low > high {
+		low = int64(float64(high) * LOW_WATERMARK_RATIO)
+	}
+	o := &overflow{
+		r:          r,
+		db:         db,
+		high:       high,
+		low:        low,
+		interval:   interval,
+		usedMemory: r.usedMemory,
+		state:      OVERFLOW_IDLE,
+		killChan:   make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+
+	// pick up where we left off if jobs were spilled before a restart
+	err = db.View(func(tx *bolt.Tx) error {
+		for _, l := range r.lists {
+			if b := tx.Bucket(o.bucket(l.name)); b != nil {
+				o.stored += b.Stats().KeyN
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		database.Close(db)
+		return nil, err
+	}
+	return o, nil
+}
+
+// bucket the bucket the spilled jobs of a list are kept in
+func (o *overflow) bucket(list string) []byte {
+	return []byte(SPILL_BUCKET_PREFIX + o.r.tmpSet.key(list))
+}
+
+// Run check redis' memory use every interval, spilling or refilling a batch of jobs at a time, until Close is called
+func (o *overflow) Run() {
+	defer close(o.done)
+	wait := o.interval
+	for {
+		select {
+		case <-o.killChan:
+			return
+		case <-time.After(wait):
+			wait = o.interval
+			moved, err := o.step()
+			if err != nil {
+				log.Println(err)
+			}
+			if moved > 0 {
+				wait = OVERFLOW_BUSY_INTERVAL
+			}
+		}
+	}
+}
+
+// Close stop moving jobs and close the spill db, once the batch being moved, if any, has been moved
+func (o *overflow) Close() error {
+	close(o.killChan)
+	<-o.done
+	return database.Close(o.db)
+}
+
+// step spill or refill a single batch of jobs depending on redis' memory use. Returns the number of jobs moved
+func (o *overflow) step() (int, error) {
+	used, err := o.usedMemory()
+	if err != nil {
+		return 0, err
+	}
+	o.Lock()
+	o.used = used
+	stored := o.stored
+	o.Unlock()
+
+	switch {
+	case used > o.high:
+		return o.spill()
+	case used < o.low && stored > 0:
+		return o.refill()
+	}
+	o.setState(OVERFLOW_IDLE)
+	return 0, nil
+}
+
+// spill move a batch of jobs from the back of the least important list that has any into the spill db
+func (o *overflow) spill() (int, error) {
+	for i := len(o.r.lists) - 1; i >= 0; i-- {
+		list := o.r.lists[i].name
+		jobs, err := o.take(list, SPILL_BATCH)
+		if err != nil {
+			return 0, err
+		}
+		if len(jobs) == 0 {
+			continue
+		}
+		o.setState(OVERFLOW_SPILLING)
+
+		err = o.db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists(o.bucket(list))
+			if err != nil {
+				return err
+			}
+			batch, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			for i, j := range jobs {
+				if err = b.Put(spillKey(batch, i), j); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			// put the jobs back where they came from rather than lose them
+			if pErr := o.push(list, jobs); pErr != nil {
+				log.Println("Lost", len(jobs), "jobs from list", list, pErr)
+			}
+			return 0, err
+		}
+
+		o.Lock()
+		o.spilled += uint64(len(jobs))
+		o.stored += len(jobs)
+		o.Unlock()
+		log.Println("Spilled", len(jobs), "jobs from list", list, "to disk")
+		return len(jobs), nil
+	}
+	return 0, nil
+}
+
+// refill move the jobs spilled from nearest the front of the most important list that has any back into redis.
+// The jobs are only pushed once their removal from the spill db has been committed, so they are never in both
+func (o *overflow) refill() (int, error) {
+	for _, l := range o.r.lists {
+		var keys, jobs [][]byte
+		err := o.db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket(o.bucket(l.name))
+			if b == nil {
+				return nil
+			}
+			c := b.Cursor()
+			for k, v := c.First(); k != nil && len(jobs) < SPILL_BATCH; k, v = c.Next() {
+				keys = append(keys, append([]byte{}, k...))
+				jobs = append(jobs, append([]byte{}, v...))
+			}
+			for _, k := range keys {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+		if len(jobs) == 0 {
+			continue
+		}
+		if err = o.push(l.name, jobs); err != nil {
+			// put the jobs back where they came from rather than lose them
+			if uErr := o.unrefill(l.name, keys, jobs); uErr != nil {
+				log.Println("Lost", len(jobs), "jobs spilled from list", l.name, uErr)
+			}
+			return 0, err
+		}
+
+		o.setState(OVERFLOW_REFILLING)
+		o.Lock()
+		o.refilled += uint64(len(jobs))
+		o.stored -= len(jobs)
+		o.Unlock()
+		log.Println("Refilled", len(jobs), "jobs into list", l.name)
+		return len(jobs), nil
+	}
+	return 0, nil
+}
+
+// unrefill put jobs that couldn't be pushed back into the spill db under the keys they were taken from
+func (o *overflow) unrefill(list string, keys, jobs [][]byte) error {
+	return o.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(o.bucket(list))
+		if err != nil {
+			return err
+		}
+		for i, k := range keys {
+			if err = b.Put(k, jobs[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// take remove up to n jobs from the back of a list
+func (o *overflow) take(list string, n int) ([][]byte, error) {
+	c := o.r.get()
+	defer o.r.release(c)
+	key := o.r.tmpSet.key(list)
+	c.Send("MULTI")
+	c.Send("LRANGE", key, -n, -1)
+	c.Send("LTRIM", key, 0, -n-1)
+	reply, err := redigo.Values(c.Do("EXEC"))
+	if err != nil {
+		return nil, err
+	}
+	if len(reply) != 2 {
+		return nil, BAD_TRANSACTION
+	}
+	return redigo.ByteSlices(reply[0], nil)
+}
+
+// push add jobs to the back of a list, in order
+func (o *overflow) push(list string, jobs [][]byte) error {
+	c := o.r.get()
+	defer o.r.release(c)
+	_, err := c.Do("RPUSH", redigo.Args{}.Add(o.r.tmpSet.key(list)).AddFlat(jobs)...)
+	return err
+}
+
+// setState note what the overflow is doing
+func (o *overflow) setState(state string) {
+	o.Lock()
+	defer o.Unlock()
+	o.state = state
+}
+
+// report the overflow's state and how many jobs it has moved
+func (o *overflow) report() map[string]interface{} {
+	o.Lock()
+	defer o.Unlock()
+	return map[string]interface{}{
+		"state":          o.state,
+		"used_memory":    o.used,
+		"high_watermark": o.high,
+		"low_watermark":  o.low,
+		"spilled":        o.spilled,
+		"refilled":       o.refilled,
+		"stored":         o.stored,
+	}
+}
+
+// spillKey the key of the i'th job of a spilled batch. Each batch is taken from in front of the last,
+// so later batches sort first, and keys sort in the order the jobs were in the list
+func spillKey(batch uint64, i int) []byte {
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint64(b, math.MaxUint64-batch)
+	binary.BigEndian.PutUint32(b[8:], uint32(i))
+	return b
+}
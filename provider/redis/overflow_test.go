@@ -0,0 +1,173 @@
+package redis
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	redigo "github.com/garyburd/redigo/redis"
+)
+
+// overflowHelper create a redis provider that spills list into db
+func overflowHelper(t *testing.T, list, db string) *Redis {
+	r := RedisFactory().(*Redis)
+	conf := r.ConfigStruct().(*RedisConfig)
+	conf.Host = "localhost"
+	conf.Port = "6379"
+	conf.JobList = list
+	conf.DumpOnLimit = true
+	conf.MemLimit = "1000"
+	conf.LowWatermark = "500"
+	conf.SpillDB = db
+	conf.OverflowInterval = "1h"
+	if err := r.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// spillDir create a temporary directory for spill dbs
+func spillDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "overflow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestOverflow(t *testing.T) {
+	list := testList + "TestOverflow"
+	dir := spillDir(t)
+	defer os.RemoveAll(dir)
+	r := overflowHelper(t, list, filepath.Join(dir, "spill.db"))
+	defer r.Close()
+
+	batch := SPILL_BATCH
+	SPILL_BATCH = 2
+	defer func() { SPILL_BATCH = batch }()
+
+	c := r.get()
+	for i := 0; i < 5; i++ {
+		c.Do("RPUSH", r.tmpSet.key(list), strconv.Itoa(i))
+	}
+	r.release(c)
+
+	var used int64 = 2000
+	r.overflow.usedMemory = func() (int64, error) { return used, nil }
+
+	// spill everything, a batch at a time
+	for _, want := range []int{2, 2, 1, 0} {
+		n, err := r.overflow.step()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != want {
+			t.Fatal("Expected to spill", want, "jobs, spilled", n)
+		}
+	}
+	if r.lenList(list) != 0 {
+		t.Error("List should be empty after spilling", r.lenList(list))
+	}
+	if rep := r.overflow.report(); rep["spilled"] != uint64(5) || rep["stored"] != 5 || rep["state"] != OVERFLOW_SPILLING {
+		t.Error("Bad report after spilling", rep)
+	}
+
+	// between the watermarks nothing moves
+	used = 800
+	if n, _ := r.overflow.step(); n != 0 {
+		t.Error("Jobs moved between the watermarks", n)
+	}
+
+	// refill everything, the list must come back in the same order
+	used = 100
+	for _, want := range []int{2, 2, 1, 0} {
+		n, err := r.overflow.step()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != want {
+			t.Fatal("Expected to refill", want, "jobs, refilled", n)
+		}
+	}
+	c = r.get()
+	jobs, err := redigo.Strings(c.Do("LRANGE", r.tmpSet.key(list), 0, -1))
+	c.Do("DEL", r.tmpSet.key(list))
+	r.release(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, j := range jobs {
+		if j != strconv.Itoa(i) {
+			t.Fatal("Refilled list is out of order", jobs)
+		}
+	}
+	if len(jobs) != 5 {
+		t.Error("Expected 5 jobs back in the list, got", len(jobs))
+	}
+	if rep := r.overflow.report(); rep["refilled"] != uint64(5) || rep["stored"] != 0 || rep["state"] != OVERFLOW_IDLE {
+		t.Error("Bad report after refilling", rep)
+	}
+}
+
+func TestOverflowRestart(t *testing.T) {
+	list := testList + "TestOverflowRestart"
+	dir := spillDir(t)
+	defer os.RemoveAll(dir)
+	db := filepath.Join(dir, "spill.db")
+	r := overflowHelper(t, list, db)
+
+	c := r.get()
+	c.Do("RPUSH", r.tmpSet.key(list), "a", "b", "c")
+	r.release(c)
+	r.overflow.usedMemory = func() (int64, error) { return 2000, nil }
+	if _, err := r.overflow.step(); err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+
+	// a new provider using the same db knows about the jobs spilled by the last one
+	r = overflowHelper(t, list, db)
+	defer r.Close()
+	if rep := r.overflow.report(); rep["stored"] != 3 {
+		t.Error("Expected 3 stored jobs after a restart, got", rep["stored"])
+	}
+}
+
+func TestOverflowRefillFailure(t *testing.T) {
+	list := testList + "TestOverflowRefillFailure"
+	dir := spillDir(t)
+	defer os.RemoveAll(dir)
+	r := overflowHelper(t, list, filepath.Join(dir, "spill.db"))
+	defer r.Close()
+
+	c := r.get()
+	defer r.release(c)
+	c.Do("RPUSH", r.tmpSet.key(list), "a", "b")
+	var used int64 = 2000
+	r.overflow.usedMemory = func() (int64, error) { return used, nil }
+	if n, err := r.overflow.step(); n != 2 || err != nil {
+		t.Fatal("Expected to spill 2 jobs", n, err)
+	}
+
+	// a key of the wrong type can't be pushed to, the jobs must stay on disk
+	c.Do("SET", r.tmpSet.key(list), "not a list")
+	used = 100
+	if _, err := r.overflow.step(); err == nil {
+		t.Fatal("Expected the refill to fail")
+	}
+	if rep := r.overflow.report(); rep["stored"] != 2 || rep["refilled"] != uint64(0) {
+		t.Error("Failed refill changed the report", rep)
+	}
+
+	c.Do("DEL", r.tmpSet.key(list))
+	if n, err := r.overflow.step(); n != 2 || err != nil {
+		t.Fatal("Expected to refill 2 jobs", n, err)
+	}
+	jobs, _ := redigo.Strings(c.Do("LRANGE", r.tmpSet.key(list), 0, -1))
+	c.Do("DEL", r.tmpSet.key(list))
+	if len(jobs) != 2 || jobs[0] != "a" || jobs[1] != "b" {
+		t.Error("Expected the jobs back in order, got", jobs)
+	}
+}
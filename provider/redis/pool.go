@@ -0,0 +1,116 @@
+package redis
+
+import (
+	"time"
+
+	redigo "github.com/garyburd/redigo/redis"
+)
+
+// connPool is a pool of connections to a redis server that keeps track of the health of the connection.
+// Dialing backs off after a failure, and connections that have sat idle, or were borrowed while redis
+// was unreachable, are checked before use
+type connPool struct {
+	*redigo.Pool
+	dialer   *dialer
+	state    *connState
+	killChan chan struct{}
+}
+
+// newConnPool create a pool of connections made by d, and start monitoring it
+func newConnPool(d *dialer, size, maxIdle int, idleTimeout time.Duration) *connPool {
+	p := &connPool{
+		dialer:   d,
+		state:    newConnState(),
+		killChan: make(chan struct{}),
+	}
+	p.Pool = &redigo.Pool{
+		MaxActive:   size,
+		MaxIdle:     maxIdle,
+		IdleTimeout: idleTimeout,
+		Wait:        true,
+		Dial: func() (redigo.Conn, error) {
+			now := time.Now()
+			if err := p.state.allowDial(now); err != nil {
+				return nil, err
+			}
+			c, err := d.dial()
+			p.state.dialed(now, err)
+			return c, err
+		},
+		TestOnBorrow: func(c redigo.Conn, t time.Time) error {
+			if time.Since(t) < time.Minute && p.state.connected() {
+				return nil
+			}
+			_, err := c.Do("PING")
+			if err == nil {
+				p.state.dialed(time.Now(), nil)
+			}
+			return err
+		},
+	}
+	go p.monitor()
+	return p
+}
+
+// parseTimeouts parse the idle, dial, read and write timeouts of a pool
+func parseTimeouts(timeouts ...string) ([]time.Duration, error) {
+	d := make([]time.Duration, len(timeouts))
+	for i := range timeouts {
+		var err error
+		if d[i], err = time.ParseDuration(timeouts[i]); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// get borrow a connection from the pool. It must be given back with release
+func (p *connPool) get() redigo.Conn {
+	return p.Get()
+}
+
+// release give a connection back to the pool, noting if it has gone bad
+func (p *connPool) release(c redigo.Conn) {
+	if err := c.Err(); err != nil && err != WAITING_TO_RECONNECT {
+		p.state.lost(time.Now(), err)
+	}
+	c.Close()
+}
+
+// ping check that redis can be reached
+func (p *connPool) ping() error {
+	c := p.get()
+	defer p.release(c)
+	_, err := c.Do("PING")
+	return err
+}
+
+// monitor ping redis periodically so a lost connection is noticed, and redialed, even when the pool is idle
+func (p *connPool) monitor() {
+	for {
+		select {
+		case <-p.killChan:
+			return
+		case <-time.After(HEALTH_CHECK_INTERVAL):
+			p.ping()
+		}
+	}
+}
+
+// Report the state of the connection to redis, and the pool, for the stats server
+func (p *connPool) Report() map[string]interface{} {
+	rep := p.state.Report()
+	stats := p.Stats()
+	rep["active"] = stats.ActiveCount
+	rep["idle"] = stats.IdleCount
+	for k, v := range p.dialer.report() {
+		rep[k] = v
+	}
+	return rep
+}
+
+// Close stop monitoring the connection and close all of the connections in the pool
+func (p *connPool) Close() error {
+	close(p.killChan)
+	return p.Pool.Close()
+}
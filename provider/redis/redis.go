@@ -12,32 +12,39 @@ import (
 	"sync"
 	"time"
 
+	"github.com/barracudanetworks/GoWorker/config"
 	"github.com/barracudanetworks/GoWorker/job"
+	"github.com/barracudanetworks/GoWorker/lua"
 	"github.com/barracudanetworks/GoWorker/provider"
-	"github.com/barracudanetworks/GoWorker/worker/disk"
 	"github.com/eliothedeman/memString"
 	redigo "github.com/garyburd/redigo/redis"
 )
 
 const (
-	DEFAULT_POOL_SIZE = 2
-	DEFAULT_MAX_IDLE  = 100
-	DEFAULT_HOST      = "localhost"
-	DEFAULT_PORT      = "6379"
-	DEFAULT_JOB_LIST  = "job_list"
-	TEMP_JOB_LIST     = "tmp_job_list"
+	DEFAULT_POOL_SIZE    = 10
+	DEFAULT_MAX_IDLE     = 3
+	DEFAULT_IDLE_TIMEOUT = "4m"
+	DEFAULT_DIAL_TIMEOUT = "5s"
+	DEFAULT_IO_TIMEOUT   = "10s"
+	DEFAULT_HOST         = "localhost"
+	DEFAULT_PORT         = "6379"
+	DEFAULT_JOB_LIST     = "job_list"
+	TEMP_JOB_LIST        = "tmp_job_list"
 )
 
 var (
 	MAX_WAIT_TIME    = 10 * time.Second
 	DEFAULT_TIMEOUT  = 10 * time.Second
 	REDIS_INFO_ERROR = errors.New("redis: failed to parse redis info")
+
+	LEGACY_NAMESPACE = errors.New("redis: requeue_legacy can't be used with a namespace, older versions never had one")
 )
 
 // init load this provider into the master map of providers
 func init() {
 	if provider.Factories != nil {
 		provider.Factories["redis"] = RedisFactory
+		provider.Factories["redis_stream"] = StreamFactory
 	} else {
 		log.Println("Unable to load redis provider factory")
 	}
@@ -45,26 +52,67 @@ func init() {
 
 // RedisConfig contains config options for a redis provider
 type RedisConfig struct {
-	Host        string  `json:"host" required:"true" description:"The host of the redis server to connect to"`
-	Port        string  `json:"port" required:"true" description:"Port of the redis server to connect to."`
-	JobList     string  `json:"job_list" required:"true" description:"The list in redis to pull jobs from."`
-	DumpOnLimit bool    `json:"dump_on_limit" required:"false" description:"When the redis server reaches this level of memory, start dumping the job list to disk. The file worker must be enabled to use this feature."`
-	MemLimit    string  `json:"memory_limit" required:"false" description:"The point at which to dump the job list to disk. This will have no effect if dump_on_limit is not enabled."`
+	Host        string  `json:"host" required:"false" description:"The host of the redis server to connect to. Required unless sentinels or cluster is given."`
+	Port        string  `json:"port" required:"false" description:"Port of the redis server to connect to."`
+	JobList     string  `json:"job_list" required:"false" description:"The list in redis to pull jobs from. Required unless lists is given."`
+	DumpOnLimit bool    `json:"dump_on_limit" required:"false" description:"When the redis server reaches memory_limit, spill jobs to a local bolt db until it is back under memory_low_watermark, then push them back."`
+	MemLimit    string  `json:"memory_limit" required:"false" description:"The point at which to spill jobs to disk. This will have no effect if dump_on_limit is not enabled."`
 	Target      float64 `json:"target" required:"false" description:"The target jobs per second for this jobs on this job_list."`
+	Namespace   string  `json:"namespace" required:"false" description:"Prefix every key with this, so deployments sharing a redis server leave each other's jobs alone."`
+
+	// overflow
+	LowWatermark     string `json:"memory_low_watermark" required:"false" description:"The point at which spilled jobs are pushed back into redis. Defaults to 80% of memory_limit."`
+	SpillDB          string `json:"spill_db" required:"false" description:"The bolt db to spill jobs to."`
+	OverflowInterval string `json:"overflow_interval" required:"false" description:"How often to check redis' memory use."`
+
+	// completion notifications
+	CompletionChannel string `json:"completion_channel" required:"false" description:"Publish the outcome of every job that succeeds or fails for good to this channel."`
+	ReplyTTL          string `json:"reply_ttl" required:"false" description:"How long a job's reply_to list is kept after its result is pushed to it."`
+
+	// sentinel and cluster
+	Sentinels  []string `json:"sentinels" required:"false" description:"host:port of the sentinels to ask where the master is. Takes the place of host and port."`
+	MasterName string   `json:"master_name" required:"false" description:"The name the sentinels know the master by."`
+	Cluster    []string `json:"cluster" required:"false" description:"host:port of some of the nodes of a redis cluster to discover the rest from. Takes the place of host and port."`
+
+	// multiple lists
+	Lists []ListConfig `json:"lists" required:"false" description:"The lists in redis to pull jobs from, most important first. Takes the place of job_list."`
+	Order string       `json:"order" required:"false" description:"How to pick which list to take jobs from, priority drains each list before the next, weighted spreads jobs by weight."`
+
+	// connection pool
+	PoolSize     int    `json:"pool_size" required:"false" description:"The most connections to redis to have open at once."`
+	MaxIdle      int    `json:"max_idle" required:"false" description:"The most idle connections to keep in the pool."`
+	IdleTimeout  string `json:"idle_timeout" required:"false" description:"Close connections that have been idle for this long."`
+	DialTimeout  string `json:"dial_timeout" required:"false" description:"How long to wait when connecting to redis."`
+	ReadTimeout  string `json:"read_timeout" required:"false" description:"How long to wait for a reply from redis."`
+	WriteTimeout string `json:"write_timeout" required:"false" description:"How long to wait when sending a command to redis."`
+
+	// upgrades
+	RequeueLegacy bool `json:"requeue_legacy" required:"false" description:"On start up, put the jobs left in flight by an older version, which kept each under its own key, back on the first list. Only one provider on a server should set this, and it can't have a namespace."`
 }
 
 // Redis holds a pool of redis connections that are used to talk to the database
 type Redis struct {
-	conn redigo.Conn
+	pool *connPool
 	*sync.Mutex
 	host        string
 	port        string
 	tmpSet      *TmpSet
 	JobList     string
-	memoryLimit int64
-	dumpOnLImit bool
+	lists       []*jobList
+	order       string
+	overflow    *overflow
 	lastJobChan chan job.Job
 	target      float64
+
+	// completion notifications
+	completionChannel string
+	replyTTL          time.Duration
+	notified          uint64
+	notifyErrors      uint64
+
+	// lua script versions
+	scriptsChecked time.Time
+	otherScripts   []string
 }
 
 func (r *Redis) Target() float64 {
@@ -72,7 +120,18 @@ func (r *Redis) Target() float64 {
 }
 
 func (r *Redis) ConfigStruct() interface{} {
-	return &RedisConfig{}
+	return &RedisConfig{
+		ReplyTTL:         DEFAULT_REPLY_TTL,
+		SpillDB:          DEFAULT_SPILL_DB,
+		OverflowInterval: DEFAULT_OVERFLOW_INTERVAL,
+		Order:            ORDER_PRIORITY,
+		PoolSize:         DEFAULT_POOL_SIZE,
+		MaxIdle:          DEFAULT_MAX_IDLE,
+		IdleTimeout:      DEFAULT_IDLE_TIMEOUT,
+		DialTimeout:      DEFAULT_DIAL_TIMEOUT,
+		ReadTimeout:      DEFAULT_IO_TIMEOUT,
+		WriteTimeout:     DEFAULT_IO_TIMEOUT,
+	}
 }
 
 // Init initilize the redis provider
@@ -81,106 +140,163 @@ func (r *Redis) Init(i interface{}) error {
 	if !ok {
 		return provider.WRONG_CONFIG_TYPE
 	}
-	c, err := redigo.Dial("tcp", conf.Host+":"+conf.Port)
+	if conf.RequeueLegacy && conf.Namespace != "" {
+		return LEGACY_NAMESPACE
+	}
+	t, err := parseTimeouts(conf.IdleTimeout, conf.DialTimeout, conf.ReadTimeout, conf.WriteTimeout)
+	if err != nil {
+		return err
+	}
+
+	// a single job_list is a list of one
+	lists := conf.Lists
+	if len(lists) == 0 {
+		if conf.JobList == "" {
+			return NO_JOB_LISTS
+		}
+		lists = []ListConfig{{Name: conf.JobList, Target: conf.Target}}
+	}
+	switch conf.Order {
+	case ORDER_PRIORITY, ORDER_WEIGHTED, "":
+	default:
+		return UNKNOWN_LIST_ORDER
+	}
+	r.order = conf.Order
+	r.lists = make([]*jobList, len(lists))
+	now := time.Now()
+	for i := range lists {
+		r.lists[i] = newJobList(lists[i], now)
+	}
 	r.host = conf.Host
 	r.port = conf.Port
-	r.conn = c
+	d, err := newDialer(conf.Host+":"+conf.Port, conf.Sentinels, conf.MasterName, conf.Cluster, t[1], t[2], t[3])
+	if err != nil {
+		return err
+	}
+	r.pool = newConnPool(d, conf.PoolSize, conf.MaxIdle, t[0])
 	r.Mutex = &sync.Mutex{}
-	r.JobList = conf.JobList
-	r.tmpSet = NewTmpSet("tmp_job:")
-	r.dumpOnLImit = conf.DumpOnLimit
-	r.memoryLimit, _ = memString.ParseMemory(conf.MemLimit)
+	r.JobList = r.lists[0].name
+	scripts, err := lua.Load(config.LUA_PATH)
+	if err != nil {
+		return err
+	}
+	if len(scripts.Overridden) > 0 {
+		log.Println("Using lua scripts", scripts.Overridden, "from", config.LUA_PATH)
+	}
+	r.tmpSet = NewTmpSet(conf.Namespace, scripts)
+	r.tmpSet.cluster = d.clustered()
+	r.completionChannel = conf.CompletionChannel
+	if r.replyTTL, err = time.ParseDuration(conf.ReplyTTL); err != nil {
+		return err
+	}
 	r.target = conf.Target
+	if r.target == 0 {
+		for _, l := range r.lists {
+			r.target += l.target
+		}
+	}
 
-	// if we need to dump on memory limit, start a routine to check for the limit
-	if r.dumpOnLImit {
-		go func(m int64) {
-			for {
-				if r.CheckMemory(m) {
-					log.Println("Memory limit of", m, "bytes has been reached on redis hosts", r.host+":"+r.port)
-					stop := make(chan struct{})
-					// drain the list until we are under the limit
-					go r.Drain(stop)
-					for {
-						// if we are under the limit, stop draining
-						if !r.CheckMemory(m) {
-							stop <- struct{}{}
-							break
-						}
-						time.Sleep(1 * time.Second)
-					}
-				}
-				time.Sleep(10 * time.Second)
+	// spill jobs to disk when redis is running out of memory
+	if conf.DumpOnLimit {
+		high, err := memString.ParseMemory(conf.MemLimit)
+		if err != nil {
+			return err
+		}
+		var low int64
+		if conf.LowWatermark != "" {
+			if low, err = memString.ParseMemory(conf.LowWatermark); err != nil {
+				return err
 			}
-		}(r.memoryLimit)
+		}
+		interval, err := time.ParseDuration(conf.OverflowInterval)
+		if err != nil {
+			return err
+		}
+		if r.overflow, err = newOverflow(r, conf.SpillDB, high, low, interval); err != nil {
+			return err
+		}
+		go r.overflow.Run()
 	}
-	return err
+
+	// redis being down at start up is no different than it going down later, the pool will keep trying
+	if err := r.loadScripts(); err != nil {
+		log.Println("Unable to load lua scripts into redis for", r.Name(), err)
+		return nil
+	}
+	r.checkScripts(time.Now())
+
+	// jobs left in flight by a version that kept each job under its own key. That version never ran on a cluster
+	if conf.RequeueLegacy && !r.tmpSet.cluster {
+		n, locked, err := r.tmpSet.RequeueLegacy(r, r.JobList)
+		if err != nil {
+			log.Println("Unable to requeue jobs left in flight by an older version", err)
+		} else if n > 0 || locked > 0 {
+			log.Printf("Put %d jobs left in flight by an older version back on %s, %d are still held by older managers", n, r.JobList, locked)
+		}
+	}
+	return nil
 }
 
-// Drain pull jobs off redis and wrap them in a file job to be written to disk.
-// this can be done if redis starts running out of memory.
-// Drain will continue to remove jobs from redis until it either:
-// a : gets a signal on it's stop channel
-// b : runs out of jobs in the redis cue
-// c : the connection to redis is closed
-func (r *Redis) Drain(stopChan chan struct{}) {
+// get borrow a connection from the pool. It must be given back with release
+func (r *Redis) get() redigo.Conn {
+	return r.pool.get()
+}
+
+// release give a connection back to the pool
+func (r *Redis) release(c redigo.Conn) {
+	r.pool.release(c)
+}
+
+// Report the state of the connection to redis, and the stats of each list, for the stats server
+func (r *Redis) Report() map[string]interface{} {
+	rep := r.pool.Report()
 	r.Lock()
-	jobChan := r.lastJobChan
-	r.Unlock()
-	log.Println("Started draining jobs from list", r.JobList)
-	var err error
-	for {
-		select {
-		case <-stopChan:
-			break
-		default:
-			j := r.popJob()
-			if j == nil {
-				return
-			}
-			conf := j.Config()
-			// wrap the job in a file job
-			fc := &disk.DiskParams{}
-			fc.ExicutionTime = time.Now().Unix()
-			fc.Job, err = json.Marshal(conf)
-			if err != nil {
-				log.Println(err)
-				continue
-			}
-			// switch the job to a file type
-			conf.Type = "file"
-			var b []byte
-			b, err = json.Marshal(fc)
-			if err != nil {
-				log.Println(err)
-			}
-			conf.Params = json.RawMessage(b)
-			jobChan <- j
-		}
+	defer r.Unlock()
+	lists := make([]map[string]interface{}, len(r.lists))
+	for i, l := range r.lists {
+		lists[i] = l.report()
+	}
+	rep["order"] = r.order
+	rep["lists"] = lists
+	rep["scripts"] = r.tmpSet.scripts.Version
+	if len(r.otherScripts) > 0 {
+		rep["other_scripts"] = r.otherScripts
+	}
+	if r.overflow != nil {
+		rep["overflow"] = r.overflow.report()
 	}
-	log.Println("Done draining jobs fro list", r.JobList)
+	rep["completions"] = map[string]interface{}{
+		"channel": r.completionChannel,
+		"sent":    r.notified,
+		"errors":  r.notifyErrors,
+	}
+	return rep
 }
 
 // CheckMemory check to see if the memory limit for the redis server has been hit
 func (r *Redis) CheckMemory(max int64) bool {
-	var b []byte
-	var err error
-	var i interface{}
-	r.Lock()
-	i, err = r.conn.Do("info")
-	r.Unlock()
-	b, err = redigo.Bytes(i, err)
+	n, err := r.usedMemory()
 	if err != nil {
 		log.Println(err)
 		return false
 	}
-	n, err := parseRedisInfoInt(b, "used_memory")
-	return n > r.memoryLimit
+	return n > max
+}
+
+// usedMemory how much memory the redis server is using
+func (r *Redis) usedMemory() (int64, error) {
+	c := r.get()
+	b, err := redigo.Bytes(c.Do("info", "memory"))
+	r.release(c)
+	if err != nil {
+		return 0, err
+	}
+	return parseRedisInfoInt(b, "used_memory")
 }
 
 // popJob pops a job off of the redis list then pushes it to the temparary list
-func (r *Redis) popJob() job.Job {
-	job, err := r.tmpSet.PopAndLock(r)
+func (r *Redis) popJob(list string) job.Job {
+	job, err := r.tmpSet.PopAndLock(r, list)
 	if err != nil {
 		log.Println(err)
 		return nil
@@ -190,10 +306,10 @@ func (r *Redis) popJob() job.Job {
 
 // lenList get the length of a give list
 func (r *Redis) lenList(list string) uint64 {
-	r.Lock()
-	defer r.Unlock()
+	c := r.get()
+	defer r.release(c)
 	var l uint64
-	v, err := r.conn.Do("llen", list)
+	v, err := c.Do("llen", r.tmpSet.key(list))
 	l, err = redigo.Uint64(v, err)
 	if err != nil {
 		log.Println(err)
@@ -208,30 +324,41 @@ func (r *Redis) pushJob(j *RedisJob, list string) error {
 	if err != nil {
 		return err
 	}
-	r.Lock()
-	defer r.Unlock()
-	_, err = r.conn.Do("lpush", list, b)
+	c := r.get()
+	defer r.release(c)
+	_, err = c.Do("lpush", r.tmpSet.key(list), b)
 	return err
 }
 
 // ConfirmJob removes the job from the tmp list on the redis server, signifying success
 func (r *Redis) ConfirmJob(j job.Job) error {
-	r.tmpSet.ConfirmJob(j.(*RedisJob), r)
-	return nil
+	return r.tmpSet.ConfirmJob(j.(*RedisJob), r)
 }
 
 // createJob returns a pointer to a new RedisJob
 func (r *Redis) createJob(config *job.JobConfig) *RedisJob {
-	return &RedisJob{
+	j := &RedisJob{
 		config:   config,
 		provider: r,
+		list:     r.JobList,
+	}
+
+	// keep the output to send along with the completion
+	if config.CaptureOutput && config.OutputWriter == nil && r.wantsCompletion(j) {
+		j.output = job.NewOutputBuffer(MAX_REPLY_OUTPUT)
+		config.OutputWriter = j.output
 	}
+	return j
 }
 
-// Close close all of the connections to redis
+// Close stop spilling jobs and close all of the connections to redis
 func (r *Redis) Close() error {
-	r.conn.Close()
-	return r.conn.Close()
+	if r.overflow != nil {
+		if err := r.overflow.Close(); err != nil {
+			log.Println(err)
+		}
+	}
+	return r.pool.Close()
 }
 
 // Name
@@ -243,30 +370,66 @@ func (r *Redis) Name() string {
 func (r *Redis) RequestWork(num int, jobChan chan job.Job) error {
 	r.Lock()
 	r.lastJobChan = jobChan
+	checked := r.scriptsChecked
 	r.Unlock()
-	// get orphan jobs first
-	orphans, err := r.tmpSet.GetOrphan(r, num)
-	if err != nil {
-		return err
+	if now := time.Now(); now.Sub(checked) > SCRIPT_REGISTRY_REFRESH {
+		r.checkScripts(now)
+	}
+
+	// get orphan jobs first, from the most important lists first
+	for _, l := range r.lists {
+		if num <= 0 {
+			break
+		}
+		orphans, err := r.tmpSet.GetOrphan(r, l.name, num)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < len(orphans); i++ {
+			jobChan <- orphans[i]
+		}
+		num -= len(orphans)
+		r.Lock()
+		l.orphans += uint64(len(orphans))
+		r.Unlock()
 	}
-	for i := 0; i < len(orphans); i++ {
-		jobChan <- orphans[i]
+	if num <= 0 {
+		return nil
 	}
-	num -= len(orphans)
 
-	// only attempt to get as many jobs as are in the redis queue
-	numJobs := r.lenList(r.JobList)
-	if int(numJobs) < num {
-		num = int(numJobs)
+	// only attempt to get as many jobs as are in each list, and as its target allows
+	now := time.Now()
+	weights := make([]int, len(r.lists))
+	available := make([]int, len(r.lists))
+	for i, l := range r.lists {
+		n := r.lenList(l.name)
+		r.Lock()
+		l.length = n
+		weights[i] = l.weight
+		available[i] = int(n)
+		if a := l.allowance(now); a >= 0 && a < available[i] {
+			available[i] = a
+		}
+		r.Unlock()
+	}
+	plan, err := planFetch(r.order, weights, available, num)
+	if err != nil {
+		return err
 	}
 
 	// get new jobs that have not been orphaned
-	var j job.Job
-	for i := 0; i < num; i++ {
-		j = r.popJob()
-		if j != nil {
+	for i, l := range r.lists {
+		var n int
+		for ; n < plan[i]; n++ {
+			j := r.popJob(l.name)
+			if j == nil {
+				break
+			}
 			jobChan <- j
 		}
+		r.Lock()
+		l.took(n)
+		r.Unlock()
 	}
 	return nil
 }
@@ -278,14 +441,23 @@ func (r *Redis) WaitTime(target float64) time.Duration {
 
 // NewRedis create a new redis connection provider
 func NewRedis(url string, poolSize int, JobList string) (*Redis, error) {
-	c, err := redigo.Dial("tcp", url)
+	t, _ := parseTimeouts(DEFAULT_IDLE_TIMEOUT, DEFAULT_DIAL_TIMEOUT, DEFAULT_IO_TIMEOUT, DEFAULT_IO_TIMEOUT)
+	scripts, err := lua.Load("")
+	if err != nil {
+		return nil, err
+	}
+	d, err := newDialer(url, nil, "", nil, t[1], t[2], t[3])
+	if err != nil {
+		return nil, err
+	}
 	r := &Redis{
-		conn:    c,
+		pool:    newConnPool(d, poolSize, DEFAULT_MAX_IDLE, t[0]),
 		Mutex:   &sync.Mutex{},
 		JobList: JobList,
-		tmpSet:  NewTmpSet("test_prefix:"),
+		lists:   []*jobList{newJobList(ListConfig{Name: JobList}, time.Now())},
+		tmpSet:  NewTmpSet("", scripts),
 	}
-	return r, err
+	return r, r.pool.ping()
 }
 
 // RedisFactory constructs a new redis provider from a ProviderConfig and returns it along with any errors
@@ -87,6 +87,27 @@ func TestNewRedisBadUrl(t *testing.T) {
 	}
 }
 
+func TestRedisReport(t *testing.T) {
+	rep := testRedis.Report()
+	if rep["connection"] != STATE_CONNECTED {
+		t.Error("Provider should report being connected", rep)
+	}
+
+	r, err := NewRedis("localhost:1", 10, testList)
+	if err == nil {
+		t.Error("Expected an error dialing a closed port")
+	}
+	defer r.Close()
+	if rep = r.Report(); rep["connection"] != STATE_DISCONNECTED || rep["last_error"] == nil {
+		t.Error("Provider should report being disconnected", rep)
+	}
+
+	// commands fail fast while backing off
+	if r.pool.ping() != WAITING_TO_RECONNECT {
+		t.Error("Expected to be waiting to reconnect")
+	}
+}
+
 func TestPushJob(t *testing.T) {
 	config, parseErr := job.ParseConfig(testJson)
 	if parseErr != nil {
@@ -110,7 +131,7 @@ func TestProvider(t *testing.T) {
 func TestParseJob(t *testing.T) {
 	// upload test json
 	testRedis.pushJob(testJob(testRedis), testList)
-	j := testRedis.popJob()
+	j := testRedis.popJob(testList)
 	if j == nil {
 		t.Error("popJob returned a bad job")
 	}
@@ -155,7 +176,9 @@ func TestRequestWork10Jobs(t *testing.T) {
 }
 
 func TestCleanup(t *testing.T) {
-	testRedis.conn.Do("flushall")
+	c := testRedis.get()
+	defer testRedis.release(c)
+	c.Do("flushall")
 }
 
 // helper function for adding and arbitrary  number of jobs to a list
@@ -0,0 +1,72 @@
+package redis
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	redigo "github.com/garyburd/redigo/redis"
+)
+
+const (
+	// SCRIPT_REGISTRY the hash, in each namespace, of the lua script versions in use and when each was last seen
+	SCRIPT_REGISTRY = "goworker:scripts"
+)
+
+var (
+	SCRIPT_REGISTRY_TTL     = 5 * time.Minute
+	SCRIPT_REGISTRY_REFRESH = time.Minute
+)
+
+// registerScripts record that version of the scripts is in use, and return the other versions in use.
+// A version that has not been seen for longer than the registry ttl is forgotten
+func registerScripts(c redigo.Conn, key, version string, now time.Time) ([]string, error) {
+	if _, err := c.Do("HSET", key, version, msec(now)); err != nil {
+		return nil, err
+	}
+	seen, err := redigo.Int64Map(c.Do("HGETALL", key))
+	if err != nil {
+		return nil, err
+	}
+	others := []string{}
+	for v, t := range seen {
+		if v == version {
+			continue
+		}
+		if t < msec(now.Add(-SCRIPT_REGISTRY_TTL)) {
+			if _, err = c.Do("HDEL", key, v); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		others = append(others, v)
+	}
+	sort.Strings(others)
+	return others, nil
+}
+
+// loadScripts load the provider's scripts into redis' script cache
+func (r *Redis) loadScripts() error {
+	c := r.get()
+	defer r.release(c)
+	return r.tmpSet.scripts.Preload(c)
+}
+
+// checkScripts register the provider's script version in its namespace, and complain if other
+// managers sharing the namespace run different scripts
+func (r *Redis) checkScripts(now time.Time) {
+	c := r.get()
+	others, err := registerScripts(c, r.tmpSet.key(SCRIPT_REGISTRY), r.tmpSet.scripts.Version, now)
+	r.release(c)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if len(others) > 0 {
+		log.Println("Lua script versions", others, "are in use alongside", r.tmpSet.scripts.Version, "for", r.Name())
+	}
+	r.Lock()
+	r.scriptsChecked = now
+	r.otherScripts = others
+	r.Unlock()
+}
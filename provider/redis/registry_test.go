@@ -0,0 +1,48 @@
+package redis
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRegisterScripts(t *testing.T) {
+	r, err := NewRedis("localhost:6379", 10, testList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	c := r.get()
+	defer r.release(c)
+	key := testList + SCRIPT_REGISTRY
+	now := time.Now()
+
+	others, err := registerScripts(c, key, "old", now.Add(-2*SCRIPT_REGISTRY_TTL))
+	if err != nil || len(others) != 0 {
+		t.Error("A lone version should see no others", others, err)
+	}
+	others, err = registerScripts(c, key, "new", now)
+	if err != nil || len(others) != 0 {
+		t.Error("A version that has not been seen in a while should be forgotten", others, err)
+	}
+	others, err = registerScripts(c, key, "newer", now)
+	if err != nil || len(others) != 1 || others[0] != "new" {
+		t.Error("A mismatched version should be reported", others, err)
+	}
+}
+
+func TestCheckScripts(t *testing.T) {
+	r := namespaceHelper(t, testList+"TestCheckScripts", "test")
+	defer r.Close()
+	if r.Report()["scripts"] != r.tmpSet.scripts.Version || r.Report()["other_scripts"] != nil {
+		t.Error("Only one script version should be in use", r.Report())
+	}
+
+	// another manager in the namespace runs different scripts
+	c := r.get()
+	registerScripts(c, r.tmpSet.key(SCRIPT_REGISTRY), "other", time.Now())
+	r.release(c)
+	r.checkScripts(time.Now())
+	if others, ok := r.Report()["other_scripts"].([]string); !ok || len(others) != 1 {
+		t.Error("Mismatched scripts were not reported", r.Report())
+	}
+}
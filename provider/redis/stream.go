@@ -0,0 +1,541 @@
+package redis
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/barracudanetworks/GoWorker/job"
+	"github.com/barracudanetworks/GoWorker/provider"
+	redigo "github.com/garyburd/redigo/redis"
+)
+
+const (
+	DEFAULT_STREAM_FIELD   = "job"
+	DEFAULT_MAX_DELIVERIES = 5
+	DEFAULT_CLAIM_IDLE     = "1m"
+	DEAD_LETTER_SUFFIX     = ":dead"
+
+	// PENDING_PAGE how many of a consumer's pending entries to ask for at a time
+	PENDING_PAGE = 100
+)
+
+var (
+	BAD_STREAM_REPLY = errors.New("redis: malformed stream reply")
+	MISSING_FIELD    = errors.New("redis: stream entry has no job field")
+)
+
+// StreamConfig contains config options for a redis stream provider
+type StreamConfig struct {
+	Host          string  `json:"host" required:"false" description:"The host of the redis server to connect to. Required unless sentinels or cluster is given."`
+	Port          string  `json:"port" required:"false" description:"Port of the redis server to connect to."`
+	Stream        string  `json:"stream" required:"true" description:"The stream to read jobs from."`
+	Group         string  `json:"group" required:"true" description:"The consumer group to read the stream as. It is created if it does not exist."`
+	Consumer      string  `json:"consumer" required:"false" description:"The name of this manager in the consumer group. Defaults to hostname-pid."`
+	Field         string  `json:"field" required:"false" description:"The field of a stream entry that holds the job."`
+	DeadLetter    string  `json:"dead_letter_stream" required:"false" description:"Where to move entries that have been delivered too many times. Defaults to the stream name with :dead appended. In a cluster it must share the stream's slot."`
+	MaxDeliveries int     `json:"max_deliveries" required:"false" description:"How many times an entry can be delivered before it is moved to the dead letter stream."`
+	ClaimIdle     string  `json:"claim_idle" required:"false" description:"How long an entry can sit unconfirmed before another consumer may claim it."`
+	Target        float64 `json:"target" required:"false" description:"The target jobs per second for jobs on this stream."`
+	Namespace     string  `json:"namespace" required:"false" description:"Prefix the stream and dead letter stream with this, so deployments sharing a redis server leave each other's jobs alone."`
+
+	// sentinel and cluster
+	Sentinels  []string `json:"sentinels" required:"false" description:"host:port of the sentinels to ask where the master is. Takes the place of host and port."`
+	MasterName string   `json:"master_name" required:"false" description:"The name the sentinels know the master by."`
+	Cluster    []string `json:"cluster" required:"false" description:"host:port of some of the nodes of a redis cluster to discover the rest from. Takes the place of host and port."`
+
+	// connection pool
+	PoolSize     int    `json:"pool_size" required:"false" description:"The most connections to redis to have open at once."`
+	MaxIdle      int    `json:"max_idle" required:"false" description:"The most idle connections to keep in the pool."`
+	IdleTimeout  string `json:"idle_timeout" required:"false" description:"Close connections that have been idle for this long."`
+	DialTimeout  string `json:"dial_timeout" required:"false" description:"How long to wait when connecting to redis."`
+	ReadTimeout  string `json:"read_timeout" required:"false" description:"How long to wait for a reply from redis."`
+	WriteTimeout string `json:"write_timeout" required:"false" description:"How long to wait when sending a command to redis."`
+}
+
+// streamEntry a single entry read from a stream. fields is nil if the entry has been deleted
+type streamEntry struct {
+	id     string
+	fields map[string]string
+}
+
+// StreamJob contains information about a job read from a redis stream
+type StreamJob struct {
+	id       string
+	config   *job.JobConfig
+	provider *Stream
+}
+
+// Config return the JobConfig for this job
+func (s *StreamJob) Config() *job.JobConfig {
+	return s.config
+}
+
+// JobConfirmer return this job's provider
+func (s *StreamJob) JobConfirmer() job.JobConfirmer {
+	return s.provider
+}
+
+// ID the id of the entry the job was read from
+func (s *StreamJob) ID() string {
+	return s.id
+}
+
+// Stream provides jobs read from a redis stream by a consumer group. Entries are acknowledged once the job is confirmed.
+// Entries left unacknowledged by a consumer that went away are claimed by another, and entries that have been delivered
+// too many times are moved to a dead letter stream
+type Stream struct {
+	pool          *connPool
+	stream        string
+	group         string
+	consumer      string
+	field         string
+	deadLetter    string
+	maxDeliveries int64
+	claimIdle     time.Duration
+	claimCursor   string
+	grouped       bool
+	inFlight      map[string]bool
+	claimed       uint64
+	deadLettered  uint64
+	target        float64
+	killChan      chan struct{}
+	sync.Mutex
+}
+
+// StreamFactory returns a new, uninitialized, redis stream provider
+func StreamFactory() provider.Provider {
+	return &Stream{}
+}
+
+func (s *Stream) Target() float64 {
+	return s.target
+}
+
+func (s *Stream) ConfigStruct() interface{} {
+	return &StreamConfig{
+		Field:         DEFAULT_STREAM_FIELD,
+		MaxDeliveries: DEFAULT_MAX_DELIVERIES,
+		ClaimIdle:     DEFAULT_CLAIM_IDLE,
+		PoolSize:      DEFAULT_POOL_SIZE,
+		MaxIdle:       DEFAULT_MAX_IDLE,
+		IdleTimeout:   DEFAULT_IDLE_TIMEOUT,
+		DialTimeout:   DEFAULT_DIAL_TIMEOUT,
+		ReadTimeout:   DEFAULT_IO_TIMEOUT,
+		WriteTimeout:  DEFAULT_IO_TIMEOUT,
+	}
+}
+
+// Init initilize the redis stream provider
+func (s *Stream) Init(i interface{}) error {
+	conf, ok := i.(*StreamConfig)
+	if !ok {
+		return provider.WRONG_CONFIG_TYPE
+	}
+	var err error
+	if s.claimIdle, err = time.ParseDuration(conf.ClaimIdle); err != nil {
+		return err
+	}
+	t, err := parseTimeouts(conf.IdleTimeout, conf.DialTimeout, conf.ReadTimeout, conf.WriteTimeout)
+	if err != nil {
+		return err
+	}
+
+	s.stream = namespaced(conf.Namespace, conf.Stream)
+	s.group = conf.Group
+	s.consumer = conf.Consumer
+	if s.consumer == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return err
+		}
+		s.consumer = fmt.Sprintf("%s-%d", host, os.Getpid())
+	}
+	d, err := newDialer(conf.Host+":"+conf.Port, conf.Sentinels, conf.MasterName, conf.Cluster, t[1], t[2], t[3])
+	if err != nil {
+		return err
+	}
+	s.field = conf.Field
+	s.deadLetter = namespaced(conf.Namespace, conf.DeadLetter)
+	if conf.DeadLetter == "" {
+		s.deadLetter = s.stream + DEAD_LETTER_SUFFIX
+		if d.clustered() {
+			// dead lettering moves an entry in a transaction, which a cluster only allows within one slot
+			s.deadLetter = sameSlot("", s.stream) + DEAD_LETTER_SUFFIX
+		}
+	}
+	s.maxDeliveries = int64(conf.MaxDeliveries)
+	s.claimCursor = "0-0"
+	s.inFlight = make(map[string]bool)
+	s.target = conf.Target
+	s.killChan = make(chan struct{})
+	s.pool = newConnPool(d, conf.PoolSize, conf.MaxIdle, t[0])
+
+	// redis being down at start up is no different than it going down later, the group is created once it is back
+	if err = s.ensureGroup(); err != nil {
+		log.Println("Unable to create consumer group", s.group, "on stream", s.stream, err)
+	}
+	go s.keepAlive()
+	return nil
+}
+
+// ensureGroup create the consumer group, and the stream, if they do not exist
+func (s *Stream) ensureGroup() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.grouped {
+		return nil
+	}
+	c := s.pool.get()
+	defer s.pool.release(c)
+	_, err := c.Do("XGROUP", "CREATE", s.stream, s.group, "0", "MKSTREAM")
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	s.grouped = true
+	return nil
+}
+
+// RequestWork claim entries abandoned by other consumers, then read new entries, and send them to the manager
+func (s *Stream) RequestWork(num int, jobChan chan job.Job) error {
+	if err := s.ensureGroup(); err != nil {
+		return err
+	}
+	jobs, err := s.claim(num)
+	if left := num - len(jobs); left > 0 {
+		if err != nil {
+			log.Println(err)
+		}
+		var read []*StreamJob
+		read, err = s.read(left)
+		jobs = append(jobs, read...)
+	}
+	for _, j := range jobs {
+		jobChan <- j
+	}
+
+	// the group is gone if redis lost its data, create it again next time
+	if err != nil && strings.HasPrefix(err.Error(), "NOGROUP") {
+		s.Lock()
+		s.grouped = false
+		s.Unlock()
+	}
+	return err
+}
+
+// read up to max entries that have never been delivered to any consumer in the group
+func (s *Stream) read(max int) ([]*StreamJob, error) {
+	c := s.pool.get()
+	defer s.pool.release(c)
+	reply, err := redigo.Values(c.Do("XREADGROUP", "GROUP", s.group, s.consumer, "COUNT", max, "STREAMS", s.stream, ">"))
+	if err == redigo.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// the reply is a list of [stream, entries] pairs, we only read one stream
+	if len(reply) != 1 {
+		return nil, BAD_STREAM_REPLY
+	}
+	pair, err := redigo.Values(reply[0], nil)
+	if err != nil || len(pair) != 2 {
+		return nil, BAD_STREAM_REPLY
+	}
+	entries, err := parseEntries(pair[1])
+	if err != nil {
+		return nil, err
+	}
+	jobs := make([]*StreamJob, 0, len(entries))
+	for _, e := range entries {
+		if j := s.entryJob(c, e, 1); j != nil {
+			jobs = append(jobs, j)
+		}
+	}
+	return jobs, nil
+}
+
+// claim up to max entries that have sat unacknowledged for longer than the claim idle time
+func (s *Stream) claim(max int) ([]*StreamJob, error) {
+	c := s.pool.get()
+	defer s.pool.release(c)
+	s.Lock()
+	cursor := s.claimCursor
+	s.Unlock()
+	reply, err := redigo.Values(c.Do("XAUTOCLAIM", s.stream, s.group, s.consumer, int64(s.claimIdle/time.Millisecond), cursor, "COUNT", max))
+	if err != nil {
+		return nil, err
+	}
+	if len(reply) < 2 {
+		return nil, BAD_STREAM_REPLY
+	}
+
+	// pick up where we left off next time
+	next, err := redigo.String(reply[0], nil)
+	if err != nil {
+		return nil, BAD_STREAM_REPLY
+	}
+	s.Lock()
+	s.claimCursor = next
+	s.Unlock()
+
+	entries, err := parseEntries(reply[1])
+	if err != nil {
+		return nil, err
+	}
+	jobs := make([]*StreamJob, 0, len(entries))
+	for _, e := range entries {
+		deliveries, err := s.deliveries(c, e.id)
+		if err != nil {
+			return jobs, err
+		}
+		if j := s.entryJob(c, e, deliveries); j != nil {
+			jobs = append(jobs, j)
+			s.Lock()
+			s.claimed += 1
+			s.Unlock()
+		}
+	}
+	return jobs, nil
+}
+
+// deliveries how many times an entry has been delivered
+func (s *Stream) deliveries(c redigo.Conn, id string) (int64, error) {
+	reply, err := redigo.Values(c.Do("XPENDING", s.stream, s.group, id, id, 1))
+	if err != nil {
+		return 0, err
+	}
+	if len(reply) == 0 {
+		return 0, nil
+	}
+	pending, err := redigo.Values(reply[0], nil)
+	if err != nil || len(pending) != 4 {
+		return 0, BAD_STREAM_REPLY
+	}
+	return redigo.Int64(pending[3], nil)
+}
+
+// entryJob turn an entry into a job. Entries that have been deleted are acknowledged, and entries that can
+// not be parsed or have been delivered too many times are dead lettered, nil is returned for both
+func (s *Stream) entryJob(c redigo.Conn, e streamEntry, deliveries int64) *StreamJob {
+	if e.fields == nil {
+		if _, err := c.Do("XACK", s.stream, s.group, e.id); err != nil {
+			log.Println(err)
+		}
+		return nil
+	}
+	if deliveries > s.maxDeliveries {
+		s.kill(c, e, deliveries, "too many deliveries")
+		return nil
+	}
+	raw, ok := e.fields[s.field]
+	if !ok {
+		s.kill(c, e, deliveries, MISSING_FIELD.Error())
+		return nil
+	}
+	conf, err := job.ParseConfig([]byte(raw))
+	if err != nil {
+		s.kill(c, e, deliveries, err.Error())
+		return nil
+	}
+
+	s.Lock()
+	s.inFlight[e.id] = true
+	s.Unlock()
+	return &StreamJob{
+		id:       e.id,
+		config:   conf,
+		provider: s,
+	}
+}
+
+// kill move an entry to the dead letter stream, noting where it came from and why
+func (s *Stream) kill(c redigo.Conn, e streamEntry, deliveries int64, reason string) {
+	args := redigo.Args{}.Add(s.deadLetter, "*")
+	for k, v := range e.fields {
+		args = args.Add(k, v)
+	}
+	args = args.Add("source_stream", s.stream, "source_id", e.id, "deliveries", deliveries, "reason", reason)
+
+	c.Send("MULTI")
+	c.Send("XADD", args...)
+	c.Send("XACK", s.stream, s.group, e.id)
+	if _, err := c.Do("EXEC"); err != nil {
+		log.Println("Unable to dead letter entry", e.id, "from stream", s.stream, err)
+		return
+	}
+	log.Println("Moved entry", e.id, "from stream", s.stream, "to", s.deadLetter+":", reason)
+	s.Lock()
+	s.deadLettered += 1
+	s.Unlock()
+}
+
+// keepAlive periodically reset the idle time of entries that are being worked on so no other consumer claims them
+func (s *Stream) keepAlive() {
+	for {
+		select {
+		case <-s.killChan:
+			return
+		case <-time.After(s.claimIdle / 2):
+			if err := s.renew(); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+// renew reset the idle time of the entries in flight that this consumer still owns. Entries another consumer has
+// claimed are left to it, and are no longer in flight here
+func (s *Stream) renew() error {
+	s.Lock()
+	ids := make([]string, 0, len(s.inFlight))
+	for id := range s.inFlight {
+		ids = append(ids, id)
+	}
+	s.Unlock()
+	if len(ids) == 0 {
+		return nil
+	}
+
+	c := s.pool.get()
+	defer s.pool.release(c)
+	owned, err := s.owned(c)
+	if err != nil {
+		return err
+	}
+	args := redigo.Args{}.Add(s.stream, s.group, s.consumer, int64(s.claimIdle/4/time.Millisecond))
+	s.Lock()
+	for _, id := range ids {
+		if owned[id] {
+			args = args.Add(id)
+		} else {
+			delete(s.inFlight, id)
+		}
+	}
+	s.Unlock()
+	if len(args) == 4 {
+		return nil
+	}
+
+	// JUSTID leaves the delivery count alone. An entry claimed by another consumer between XPENDING and here has not
+	// been idle long enough to be taken back
+	_, err = c.Do("XCLAIM", args.Add("JUSTID")...)
+	return err
+}
+
+// owned the ids of the entries pending for this consumer
+func (s *Stream) owned(c redigo.Conn) (map[string]bool, error) {
+	owned := make(map[string]bool)
+	start := "-"
+	for {
+		reply, err := redigo.Values(c.Do("XPENDING", s.stream, s.group, start, "+", PENDING_PAGE, s.consumer))
+		if err != nil {
+			return nil, err
+		}
+		var id string
+		for _, r := range reply {
+			entry, err := redigo.Values(r, nil)
+			if err != nil || len(entry) == 0 {
+				return nil, BAD_STREAM_REPLY
+			}
+			if id, err = redigo.String(entry[0], nil); err != nil {
+				return nil, BAD_STREAM_REPLY
+			}
+			owned[id] = true
+		}
+		if len(reply) < PENDING_PAGE {
+			return owned, nil
+		}
+		if start, err = nextID(id); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// nextID the smallest entry id after id
+func nextID(id string) (string, error) {
+	i := strings.LastIndex(id, "-")
+	if i < 0 {
+		return "", BAD_STREAM_REPLY
+	}
+	seq, err := strconv.ParseUint(id[i+1:], 10, 64)
+	if err != nil {
+		return "", BAD_STREAM_REPLY
+	}
+	return id[:i+1] + strconv.FormatUint(seq+1, 10), nil
+}
+
+// ConfirmJob acknowledge the job's entry so it is not delivered again
+func (s *Stream) ConfirmJob(j job.Job) error {
+	sj, ok := j.(*StreamJob)
+	if !ok {
+		return JOB_NOT_FOUND
+	}
+	s.Lock()
+	delete(s.inFlight, sj.id)
+	s.Unlock()
+	c := s.pool.get()
+	defer s.pool.release(c)
+	_, err := c.Do("XACK", s.stream, s.group, sj.id)
+	return err
+}
+
+// WaitTime given a target of jobs persecond, how long should the manager wait before asking for more work
+func (s *Stream) WaitTime(target float64) time.Duration {
+	return MAX_WAIT_TIME
+}
+
+// Close stop keeping entries alive and close all of the connections to redis
+func (s *Stream) Close() error {
+	close(s.killChan)
+	return s.pool.Close()
+}
+
+// Name
+func (s *Stream) Name() string {
+	return "redis_stream_" + s.stream
+}
+
+// Report the state of the connection to redis and the consumer for the stats server
+func (s *Stream) Report() map[string]interface{} {
+	r := s.pool.Report()
+	s.Lock()
+	defer s.Unlock()
+	r["consumer"] = s.consumer
+	r["in_flight"] = len(s.inFlight)
+	r["claimed"] = s.claimed
+	r["dead_lettered"] = s.deadLettered
+	return r
+}
+
+// parseEntries parse a list of [id, [field, value, ...]] stream entries
+func parseEntries(reply interface{}) ([]streamEntry, error) {
+	raw, err := redigo.Values(reply, nil)
+	if err != nil {
+		return nil, BAD_STREAM_REPLY
+	}
+	entries := make([]streamEntry, 0, len(raw))
+	for i := range raw {
+		parts, err := redigo.Values(raw[i], nil)
+		if err != nil || len(parts) != 2 {
+			return nil, BAD_STREAM_REPLY
+		}
+		e := streamEntry{}
+		if e.id, err = redigo.String(parts[0], nil); err != nil {
+			return nil, BAD_STREAM_REPLY
+		}
+		if parts[1] != nil {
+			if e.fields, err = redigo.StringMap(parts[1], nil); err != nil {
+				return nil, BAD_STREAM_REPLY
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
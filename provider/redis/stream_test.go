@@ -0,0 +1,198 @@
+package redis
+
+import (
+	"testing"
+	"time"
+
+	"github.com/barracudanetworks/GoWorker/job"
+	redigo "github.com/garyburd/redigo/redis"
+)
+
+// streamHelper create a stream provider reading stream as consumer
+func streamHelper(t *testing.T, stream, consumer, claimIdle string, maxDeliveries int) *Stream {
+	s := StreamFactory().(*Stream)
+	conf := s.ConfigStruct().(*StreamConfig)
+	conf.Host = "localhost"
+	conf.Port = "6379"
+	conf.Stream = stream
+	conf.Group = "test_group"
+	conf.Consumer = consumer
+	conf.ClaimIdle = claimIdle
+	conf.MaxDeliveries = maxDeliveries
+	if err := s.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// addEntry add a job to a stream
+func addEntry(t *testing.T, s *Stream, raw []byte) {
+	c := s.pool.get()
+	defer s.pool.release(c)
+	if _, err := c.Do("XADD", s.stream, "*", s.field, raw); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// pending the number of entries in the stream that have not been acknowledged
+func pending(t *testing.T, s *Stream) int {
+	c := s.pool.get()
+	defer s.pool.release(c)
+	reply, err := redigo.Values(c.Do("XPENDING", s.stream, s.group))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, _ := redigo.Int(reply[0], nil)
+	return n
+}
+
+// requestJobs request num jobs from a stream provider and return what it sent
+func requestJobs(t *testing.T, s *Stream, num int) []job.Job {
+	jobChan := make(chan job.Job, num)
+	if err := s.RequestWork(num, jobChan); err != nil {
+		t.Fatal(err)
+	}
+	close(jobChan)
+	jobs := []job.Job{}
+	for j := range jobChan {
+		jobs = append(jobs, j)
+	}
+	return jobs
+}
+
+func TestStreamRequestWork(t *testing.T) {
+	s := streamHelper(t, testList+"TestStreamRequestWork", "a", DEFAULT_CLAIM_IDLE, DEFAULT_MAX_DELIVERIES)
+	defer s.Close()
+	addEntry(t, s, testJson)
+	addEntry(t, s, testJson)
+
+	jobs := requestJobs(t, s, 10)
+	if len(jobs) != 2 {
+		t.Fatal("Expected two jobs, got", len(jobs))
+	}
+	confirmConfig(jobs[0].Config(), t)
+	if pending(t, s) != 2 {
+		t.Error("Jobs should be pending until they are confirmed")
+	}
+	for _, j := range jobs {
+		if err := s.ConfirmJob(j); err != nil {
+			t.Error(err)
+		}
+	}
+	if pending(t, s) != 0 {
+		t.Error("Confirmed jobs should be acknowledged")
+	}
+}
+
+func TestStreamClaim(t *testing.T) {
+	stream := testList + "TestStreamClaim"
+	a := streamHelper(t, stream, "a", "10ms", DEFAULT_MAX_DELIVERIES)
+	b := streamHelper(t, stream, "b", "10ms", DEFAULT_MAX_DELIVERIES)
+	defer b.Close()
+	addEntry(t, a, testJson)
+
+	// a reads the job and goes away without confirming it
+	if len(requestJobs(t, a, 1)) != 1 {
+		t.Fatal("Job was not read")
+	}
+	a.Close()
+	time.Sleep(20 * time.Millisecond)
+
+	jobs := requestJobs(t, b, 1)
+	if len(jobs) != 1 {
+		t.Fatal("Abandoned job was not claimed")
+	}
+	if err := b.ConfirmJob(jobs[0]); err != nil {
+		t.Error(err)
+	}
+	if b.Report()["claimed"] != uint64(1) || pending(t, b) != 0 {
+		t.Error("Claimed job was not confirmed", b.Report())
+	}
+}
+
+func TestStreamKeepAlive(t *testing.T) {
+	stream := testList + "TestStreamKeepAlive"
+	a := streamHelper(t, stream, "a", "20ms", DEFAULT_MAX_DELIVERIES)
+	defer a.Close()
+	b := streamHelper(t, stream, "b", "20ms", DEFAULT_MAX_DELIVERIES)
+	defer b.Close()
+	addEntry(t, a, testJson)
+
+	// a is still working on the job, so b must not claim it
+	jobs := requestJobs(t, a, 1)
+	time.Sleep(50 * time.Millisecond)
+	if len(requestJobs(t, b, 1)) != 0 {
+		t.Error("Job in flight was claimed")
+	}
+	a.ConfirmJob(jobs[0])
+}
+
+func TestStreamKeepAliveLost(t *testing.T) {
+	stream := testList + "TestStreamKeepAliveLost"
+	a := streamHelper(t, stream, "a", "20ms", DEFAULT_MAX_DELIVERIES)
+	defer a.Close()
+	addEntry(t, a, testJson)
+	jobs := requestJobs(t, a, 1)
+	if len(jobs) != 1 {
+		t.Fatal("Job was not read")
+	}
+
+	// b takes the entry over, a must not take it back once it has sat idle again
+	c := a.pool.get()
+	defer a.pool.release(c)
+	id := jobs[0].(*StreamJob).ID()
+	if _, err := c.Do("XCLAIM", a.stream, a.group, "b", 0, id, "JUSTID"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if err := a.renew(); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := redigo.Values(c.Do("XPENDING", a.stream, a.group, "-", "+", 10, "b"))
+	if err != nil || len(reply) != 1 {
+		t.Error("Entry claimed by another consumer was taken back", reply, err)
+	}
+	if a.Report()["in_flight"] != 0 {
+		t.Error("Entry claimed by another consumer is still in flight", a.Report())
+	}
+}
+
+func TestNextID(t *testing.T) {
+	if id, err := nextID("1526919030474-55"); err != nil || id != "1526919030474-56" {
+		t.Error("unexpected next id", id, err)
+	}
+	if _, err := nextID("garbage"); err != BAD_STREAM_REPLY {
+		t.Error("expected", BAD_STREAM_REPLY, "got", err)
+	}
+}
+
+func TestStreamDeadLetter(t *testing.T) {
+	stream := testList + "TestStreamDeadLetter"
+	a := streamHelper(t, stream, "a", "10ms", 1)
+	b := streamHelper(t, stream, "b", "10ms", 1)
+	defer b.Close()
+	addEntry(t, a, testJson)
+	addEntry(t, a, []byte("not a job"))
+
+	// the bad job is dead lettered right away
+	if len(requestJobs(t, a, 2)) != 1 {
+		t.Fatal("Expected only the good job")
+	}
+	a.Close()
+
+	// the good job is claimed by b, which is one delivery too many
+	time.Sleep(20 * time.Millisecond)
+	if len(requestJobs(t, b, 1)) != 0 {
+		t.Error("Job should have been dead lettered")
+	}
+
+	c := b.pool.get()
+	defer b.pool.release(c)
+	n, err := redigo.Int(c.Do("XLEN", stream+DEAD_LETTER_SUFFIX))
+	if err != nil {
+		t.Error(err)
+	}
+	if n != 2 || b.Report()["dead_lettered"] != uint64(1) || pending(t, b) != 0 {
+		t.Error("Both jobs should have been dead lettered", n, b.Report())
+	}
+}
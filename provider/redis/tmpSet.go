@@ -1,11 +1,11 @@
 package redis
 
 import (
-	"crypto/sha1"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
-	"fmt"
-	"hash"
 	"log"
+	"strings"
 	"time"
 
 	"sync"
@@ -17,69 +17,77 @@ import (
 
 var (
 	JOB_NOT_FOUND = errors.New("redis: job not found")
+	BAD_LEASE     = errors.New("redis: malformed lease reply")
+
+	// LOCK_TTL how long a job's lease lives without being kept alive
+	LOCK_TTL = 30 * time.Second
 )
 
 const (
-	TMP_JOB_LOCK_PREFIX = "tmp_job:lock:"
+	TMP_JOB_PREFIX = "tmp_job:"
+	PROCESSING_KEY = "processing:"
+	LEASES_KEY     = "leases:"
+
+	// the keys jobs in flight were kept under, outside of any namespace, before leases were tracked per list
+	LEGACY_VALUE_PREFIX = "tmp_job:value:"
+	LEGACY_LOCK_PREFIX  = "tmp_job:lock:"
 )
 
-// TmpSet is a set in redis which holds temporary data
+// TmpSet holds the jobs of a list that are in flight. Each job is stored in a hash under its lease token,
+// and leased in a sorted set scored by the time the lease expires, so finding orphans is a range query.
+// Every key, including the lists themselves, is in the set's namespace
 type TmpSet struct {
-	fuzzyGet   *redigo.Script
-	getOrphan  *redigo.Script
-	popAndLock *redigo.Script
-	confirm    *redigo.Script
-	locks      map[*RedisJob]*keepAlive
-	sha1       hash.Hash
+	scripts *lua.Scripts
+	locks   map[*RedisJob]*keepAlive
 	*sync.Mutex
-	prefix string
+	namespace string
+
+	// cluster hash tag the keys of each list's leases with the list, so a script's keys share a slot
+	cluster bool
 }
 
-// Get a single job and lock it
-func (t *TmpSet) PopAndLock(r *Redis) (*RedisJob, error) {
-	r.Lock()
-	iJob, err := t.popAndLock.Do(r.conn, r.JobList, 30)
-	raw, rErr := redigo.Bytes(iJob, err)
-	if rErr != nil {
-		r.Unlock()
-		return nil, rErr
-	}
+// key the name of a key in the set's namespace
+func (t *TmpSet) key(name string) string {
+	return namespaced(t.namespace, name)
+}
 
-	// let go of the connections
-	r.Unlock()
+// processingKey the hash holding the in flight jobs of a list
+func (t *TmpSet) processingKey(list string) string {
+	return t.listKey(TMP_JOB_PREFIX+PROCESSING_KEY, list)
+}
 
-	jobConfig, err := job.ParseConfig(raw)
+// leasesKey the sorted set holding the lease expiry times of the in flight jobs of a list
+func (t *TmpSet) leasesKey(list string) string {
+	return t.listKey(TMP_JOB_PREFIX+LEASES_KEY, list)
+}
+
+// listKey the name of a key belonging to list. In a cluster it is in the same slot as the list
+func (t *TmpSet) listKey(prefix, list string) string {
+	if t.cluster {
+		return sameSlot(t.key(prefix), t.key(list))
+	}
+	return t.key(prefix + list)
+}
+
+// Get a single job off of list and lock it
+func (t *TmpSet) PopAndLock(r *Redis, list string) (*RedisJob, error) {
+	token, err := newLeaseToken()
 	if err != nil {
 		return nil, err
 	}
+	c := r.get()
+	reply, err := redigo.Strings(t.scripts.PopAndLock.Do(c, t.key(list), t.processingKey(list), t.leasesKey(list), leaseExpiry(time.Now()), token))
 
-	job := &RedisJob{
-		config:   jobConfig,
-		provider: r,
+	// let go of the connection
+	r.release(c)
+	if err != nil {
+		return nil, err
 	}
-
-	t.Lock()
-	// rest the hasher
-	t.sha1.Reset()
-	t.sha1.Write(raw)
-
-	// set the lock key
-	keep := &keepAlive{
-		killChan: make(chan struct{}),
-		ttl:      time.Duration(30),
-		key:      fmt.Sprintf("%x", t.sha1.Sum(nil)),
-		job:      job,
+	jobs, err := t.lease(r, list, reply)
+	if err != nil {
+		return nil, err
 	}
-	log.Println(keep.key)
-	t.sha1.Reset()
-
-	// start the keep alive
-	go keep.KeepAlive(r)
-
-	t.locks[job] = keep
-	t.Unlock()
-
-	return job, nil
+	return jobs[0], nil
 }
 
 // ConfirmJob confirms a job
@@ -91,81 +99,137 @@ func (t *TmpSet) ConfirmJob(j *RedisJob, r *Redis) error {
 		return JOB_NOT_FOUND
 	}
 
-	// stop updating the job's lock
+	// stop updating the job's lock. If the confirm fails the lease expires, and the job is picked up again as an orphan
 	k.Kill()
-	r.Lock()
-	t.confirm.Do(r.conn, k.key)
-	r.Unlock()
-
-	// delete the lock
 	delete(t.locks, j)
-
-	return nil
+	c := r.get()
+	_, err := t.scripts.Confirm.Do(c, t.processingKey(j.list), t.leasesKey(j.list), k.key)
+	r.release(c)
+	return err
 }
 
-// GetAllOrphan gets all of the orphaned jobs in the redis list
-func (t *TmpSet) GetOrphan(r *Redis, max int) ([]*RedisJob, error) {
-	r.Lock()
-	defer r.Unlock()
+// RequeueLegacy put the jobs left in flight by a version that kept each job under its own key back on list.
+// Jobs whose lock still exists are held by a manager running that version, and are left to it. Returns how many
+// jobs were put back, and how many are still locked
+func (t *TmpSet) RequeueLegacy(r *Redis, list string) (int, int, error) {
+	c := r.get()
+	defer r.release(c)
+	requeued, locked := 0, 0
+	cursor := "0"
+	for {
+		reply, err := redigo.Values(c.Do("SCAN", cursor, "MATCH", LEGACY_VALUE_PREFIX+"*", "COUNT", 1000))
+		if err != nil {
+			return requeued, locked, err
+		}
+		var keys []string
+		if _, err = redigo.Scan(reply, &cursor, &keys); err != nil {
+			return requeued, locked, err
+		}
+		for _, key := range keys {
+			lock := LEGACY_LOCK_PREFIX + strings.TrimPrefix(key, LEGACY_VALUE_PREFIX)
+			n, err := redigo.Int(t.scripts.RequeueLegacy.Do(c, key, lock, t.key(list)))
+			if err != nil {
+				return requeued, locked, err
+			}
+			if n == 1 {
+				requeued += 1
+			} else {
+				locked += 1
+			}
+		}
+		if cursor == "0" {
+			return requeued, locked, nil
+		}
+	}
+}
 
-	tmp, err := t.getOrphan.Do(r.conn, max)
-	rawJobs, bErr := redigo.Strings(tmp, err)
-	if bErr != nil {
-		log.Println(bErr)
+// GetOrphan gets up to max jobs from list whose leases have expired, and leases them again
+func (t *TmpSet) GetOrphan(r *Redis, list string, max int) ([]*RedisJob, error) {
+	if max <= 0 {
+		return []*RedisJob{}, nil
+	}
+	now := time.Now()
+	c := r.get()
+	reply, err := redigo.Strings(t.scripts.GetOrphan.Do(c, t.processingKey(list), t.leasesKey(list), msec(now), leaseExpiry(now), max))
+	r.release(c)
+	if err != nil {
+		log.Println(err)
 		return []*RedisJob{}, err
 	}
+	return t.lease(r, list, reply)
+}
+
+// lease parse a flat list of lease token, job pairs from list and keep each lease alive
+func (t *TmpSet) lease(r *Redis, list string, reply []string) ([]*RedisJob, error) {
+	if len(reply)%2 != 0 {
+		return nil, BAD_LEASE
+	}
 
 	// make a slice to hold all of the jobs once they are parsed
-
-	jobs := make([]*RedisJob, len(rawJobs))
-	for i := 0; i < len(jobs); i++ {
+	jobs := make([]*RedisJob, 0, len(reply)/2)
+	for i := 0; i < len(reply); i += 2 {
 
 		// parse the json blob
-		conf, pErr := job.ParseConfig([]byte(rawJobs[i]))
-		if pErr != nil {
-			return jobs, pErr
+		conf, err := job.ParseConfig([]byte(reply[i+1]))
+		if err != nil {
+			return jobs, err
 		}
 
-		jobs[i] = &RedisJob{
-			provider: r,
-			config:   conf,
-		}
-		t.Lock()
-		// rest the hasher
-		t.sha1.Reset()
-		t.sha1.Write([]byte(rawJobs[i]))
+		j := r.createJob(conf)
+		j.list = list
 
-		// set the lock key
 		keep := &keepAlive{
 			killChan: make(chan struct{}),
-			ttl:      time.Duration(30),
-			key:      fmt.Sprintf("%x", t.sha1.Sum(nil)),
-			job:      jobs[i],
+			ttl:      LOCK_TTL,
+			key:      reply[i],
+			job:      j,
 		}
-		t.sha1.Reset()
 
 		// start the keep alive
 		go keep.KeepAlive(r)
 
-		t.locks[jobs[i]] = keep
-
+		t.Lock()
+		t.locks[j] = keep
 		t.Unlock()
+		jobs = append(jobs, j)
 	}
-
 	return jobs, nil
 }
 
-// NewTmpSet create and return a new TmpSet
-func NewTmpSet(prefix string) *TmpSet {
+// NewTmpSet create and return a new TmpSet in the given namespace, using the given scripts
+func NewTmpSet(namespace string, scripts *lua.Scripts) *TmpSet {
 	t := &TmpSet{
-		fuzzyGet:   lua.GET_BY_FUZZY_KEY_SCRIPT,
-		getOrphan:  lua.GET_ORPHAN_SCRIPT,
-		popAndLock: lua.POP_AND_LOCK_SCRIPT,
-		confirm:    lua.CONFIRM_SCRIPT,
-		prefix:     prefix,
-		locks:      make(map[*RedisJob]*keepAlive),
-		Mutex:      &sync.Mutex{},
-		sha1:       sha1.New(),
+		scripts:   scripts,
+		namespace: namespace,
+		locks:     make(map[*RedisJob]*keepAlive),
+		Mutex:     &sync.Mutex{},
 	}
 	return t
 }
+
+// namespaced the name of a key in a namespace. The empty namespace leaves keys alone
+func namespaced(namespace, key string) string {
+	if namespace == "" {
+		return key
+	}
+	return namespace + ":" + key
+}
+
+// newLeaseToken a random token identifying a single lease of a job
+func newLeaseToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// msec a time in milliseconds, the unit lease expiry times are stored in
+func msec(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// leaseExpiry when a lease taken or kept alive at now will expire
+func leaseExpiry(now time.Time) int64 {
+	return msec(now.Add(LOCK_TTL))
+}
@@ -5,8 +5,10 @@ import (
 	"fmt"
 	"log"
 	"testing"
+	"time"
 
 	"github.com/barracudanetworks/GoWorker/job"
+	redigo "github.com/garyburd/redigo/redis"
 )
 
 var (
@@ -41,7 +43,7 @@ func TestPopAndLock(t *testing.T) {
 		t.Error(err)
 	}
 	addJobs(r, "job_list", 1)
-	set, sErr := r.tmpSet.PopAndLock(r)
+	set, sErr := r.tmpSet.PopAndLock(r, r.JobList)
 	if sErr != nil {
 		t.Error(sErr)
 	}
@@ -57,26 +59,196 @@ func TestGetAllOrphan(t *testing.T) {
 		t.Error(err)
 	}
 
-	addOrphanJob(r)
-	_, err = r.tmpSet.GetOrphan(r, 1)
+	token := addOrphanJob(r)
+	jobs, err := r.tmpSet.GetOrphan(r, r.JobList, 1)
 	if err != nil {
 		t.Error(err)
 	}
+	if len(jobs) != 1 || r.tmpSet.locks[jobs[0]].key != token {
+		t.Fatal("Orphan was not found", jobs)
+	}
+
+	// the orphan is leased again, so it is not an orphan anymore
+	jobs, err = r.tmpSet.GetOrphan(r, r.JobList, 1)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(jobs) != 0 {
+		t.Error("Leased job should not be an orphan", jobs)
+	}
+}
+
+func TestConfirmLease(t *testing.T) {
+	r, err := NewRedis("localhost:6379", 10, testList+"TestConfirmLease")
+	if err != nil {
+		t.Error(err)
+	}
+	addJobs(r, r.JobList, 1)
+	j, err := r.tmpSet.PopAndLock(r, r.JobList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = r.tmpSet.ConfirmJob(j, r); err != nil {
+		t.Error(err)
+	}
+
+	c := r.get()
+	defer r.release(c)
+	n, _ := redigo.Int(c.Do("hlen", r.tmpSet.processingKey(r.JobList)))
+	m, _ := redigo.Int(c.Do("zcard", r.tmpSet.leasesKey(r.JobList)))
+	if n != 0 || m != 0 {
+		t.Error("Confirmed job was not removed", n, m)
+	}
+}
+
+func TestDuplicateJobs(t *testing.T) {
+	r, err := NewRedis("localhost:6379", 10, testList+"TestDuplicateJobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := testJob(r)
+	r.pushJob(j, r.JobList)
+	r.pushJob(j, r.JobList)
+
+	jobChan := make(chan job.Job, 2)
+	if err = r.RequestWork(2, jobChan); err != nil {
+		t.Fatal(err)
+	}
+	first, second := (<-jobChan).(*RedisJob), (<-jobChan).(*RedisJob)
+	if r.tmpSet.locks[first].key == r.tmpSet.locks[second].key {
+		t.Fatal("Identical jobs share a lease")
+	}
+
+	// confirming one job must leave the other leased
+	c := r.get()
+	defer r.release(c)
+	if err = r.ConfirmJob(first); err != nil {
+		t.Error(err)
+	}
+	n, _ := redigo.Int(c.Do("hlen", r.tmpSet.processingKey(r.JobList)))
+	m, _ := redigo.Int(c.Do("zcard", r.tmpSet.leasesKey(r.JobList)))
+	if n != 1 || m != 1 {
+		t.Error("Confirming one job touched the other's lease", n, m)
+	}
+	if err = r.ConfirmJob(second); err != nil {
+		t.Error(err)
+	}
+	n, _ = redigo.Int(c.Do("hlen", r.tmpSet.processingKey(r.JobList)))
+	if n != 0 {
+		t.Error("Both jobs should have been confirmed", n)
+	}
+}
+
+func TestConfirmFailure(t *testing.T) {
+	r, err := NewRedis("localhost:6379", 10, testList+"TestConfirmFailure")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addJobs(r, r.JobList, 1)
+	j, err := r.tmpSet.PopAndLock(r, r.JobList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	confirm := r.tmpSet.scripts.Confirm
+	defer func() { r.tmpSet.scripts.Confirm = confirm }()
+	r.tmpSet.scripts.Confirm = redigo.NewScript(2, "return redis.error_reply('confirm failed')")
+	if err = r.tmpSet.ConfirmJob(j, r); err == nil {
+		t.Fatal("expected the confirm to fail")
+	}
+
+	// the lease is let go of, and left to expire
+	if _, ok := r.tmpSet.locks[j]; ok {
+		t.Error("lock was kept after a failed confirm")
+	}
+	if err = r.tmpSet.ConfirmJob(j, r); err != JOB_NOT_FOUND {
+		t.Error("expected", JOB_NOT_FOUND, "got", err)
+	}
+}
+
+func TestRequeueLegacy(t *testing.T) {
+	r, err := NewRedis("localhost:6379", 10, testList+"TestRequeueLegacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := r.get()
+	defer r.release(c)
+	c.Do("set", LEGACY_VALUE_PREFIX+"orphan", `{"name":"orphan"}`)
+	c.Do("set", LEGACY_VALUE_PREFIX+"held", `{"name":"held"}`)
+	c.Do("set", LEGACY_LOCK_PREFIX+"held", "", "EX", 30)
+	defer c.Do("del", LEGACY_VALUE_PREFIX+"held", LEGACY_LOCK_PREFIX+"held")
 
+	n, locked, err := r.tmpSet.RequeueLegacy(r, r.JobList)
+	if err != nil || n != 1 || locked != 1 {
+		t.Fatal("unexpected sweep", n, locked, err)
+	}
+	if v, _ := redigo.String(c.Do("lpop", r.tmpSet.key(r.JobList))); v != `{"name":"orphan"}` {
+		t.Error("orphan was not put back", v)
+	}
+	if ok, _ := redigo.Bool(c.Do("exists", LEGACY_VALUE_PREFIX+"orphan")); ok {
+		t.Error("orphan was left behind")
+	}
 }
 
-// addOrphanJob add an orphan job
+func TestRequeueLegacyOptIn(t *testing.T) {
+	list := testList + "TestRequeueLegacyOptIn"
+	r := RedisFactory().(*Redis)
+	conf := r.ConfigStruct().(*RedisConfig)
+	conf.Host = "localhost"
+	conf.Port = "6379"
+	conf.JobList = list
+	conf.Namespace = "optin"
+	conf.RequeueLegacy = true
+	if err := r.Init(conf); err != LEGACY_NAMESPACE {
+		t.Fatal("expected", LEGACY_NAMESPACE, "got", err)
+	}
+
+	// without requeue_legacy legacy jobs are left alone
+	c, err := redigo.Dial("tcp", "localhost:6379")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Do("del", list)
+	defer c.Do("del", list)
+	c.Do("set", LEGACY_VALUE_PREFIX+"optin", `{"name":"optin"}`)
+	defer c.Do("del", LEGACY_VALUE_PREFIX+"optin")
+	r = namespaceHelper(t, "", list)
+	defer r.Close()
+	if ok, _ := redigo.Bool(c.Do("exists", LEGACY_VALUE_PREFIX+"optin")); !ok || r.lenList(list) != 0 {
+		t.Error("legacy job was requeued without requeue_legacy")
+	}
+
+	conf = r.ConfigStruct().(*RedisConfig)
+	conf.Host = "localhost"
+	conf.Port = "6379"
+	conf.JobList = list
+	conf.RequeueLegacy = true
+	s := RedisFactory().(*Redis)
+	if err = s.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if ok, _ := redigo.Bool(c.Do("exists", LEGACY_VALUE_PREFIX+"optin")); ok || s.lenList(list) != 1 {
+		t.Error("legacy job was not requeued with requeue_legacy")
+	}
+}
+
+// addOrphanJob add an in flight job to the job_list whose lease has expired, and return its lease token
 func addOrphanJob(r *Redis) string {
 	j := testJob(r)
-	b, err := json.Marshal(j)
+	b, err := json.Marshal(j.config)
 	if err != nil {
 		log.Fatal(err)
 	}
-	r.Lock()
-	_, err = r.conn.Do("set", fmt.Sprintf("tmp_job:value:%d", test_job_count), b)
-	r.Unlock()
+	token := fmt.Sprintf("orphan:%d", test_job_count)
+	c := r.get()
+	defer r.release(c)
+	_, err = c.Do("hset", r.tmpSet.processingKey(r.JobList), token, b)
+	if err == nil {
+		_, err = c.Do("zadd", r.tmpSet.leasesKey(r.JobList), msec(time.Now().Add(-time.Second)), token)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
-	return fmt.Sprintf("tmp_job:value:%d", test_job_count)
+	return token
 }
@@ -0,0 +1,598 @@
+package redis
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	redigo "github.com/garyburd/redigo/redis"
+)
+
+const (
+	MODE_SINGLE   = "single"
+	MODE_SENTINEL = "sentinel"
+	MODE_CLUSTER  = "cluster"
+
+	// CLUSTER_SLOTS the number of hash slots a redis cluster splits its keys across
+	CLUSTER_SLOTS = 16384
+)
+
+var (
+	NO_MASTER_NAME  = errors.New("redis: master_name is required with sentinels")
+	NO_MASTER       = errors.New("redis: no sentinel knows the master")
+	NOT_MASTER      = errors.New("redis: sentinel gave an address that is not a master")
+	NO_CLUSTER_NODE = errors.New("redis: no cluster node serves the slot")
+	BAD_SLOTS_REPLY = errors.New("redis: malformed cluster slots reply")
+
+	// keylessCommands commands that do not take a key, which may be sent to any node of a cluster
+	keylessCommands = map[string]bool{
+		"ASKING": true, "CLUSTER": true, "DISCARD": true, "EXEC": true, "INFO": true,
+		"MULTI": true, "PING": true, "ROLE": true, "SCRIPT": true, "TIME": true,
+	}
+)
+
+// dialer connects to redis, either to a single server, to the master a set of sentinels agree on, or to a cluster
+type dialer struct {
+	mode      string
+	addr      string
+	sentinels []string
+	master    string
+	cluster   *cluster
+	opts      []redigo.DialOption
+	sync.Mutex
+}
+
+// newDialer create a dialer. Sentinels take the place of addr, and cluster nodes take the place of both
+func newDialer(addr string, sentinels []string, master string, nodes []string, dialTimeout, readTimeout, writeTimeout time.Duration) (*dialer, error) {
+	d := &dialer{
+		mode: MODE_SINGLE,
+		addr: addr,
+		opts: []redigo.DialOption{
+			redigo.DialConnectTimeout(dialTimeout),
+			redigo.DialReadTimeout(readTimeout),
+			redigo.DialWriteTimeout(writeTimeout),
+		},
+	}
+	switch {
+	case len(nodes) > 0:
+		d.mode = MODE_CLUSTER
+		d.cluster = newCluster(nodes, d.dialAddr)
+	case len(sentinels) > 0:
+		if master == "" {
+			return nil, NO_MASTER_NAME
+		}
+		d.mode = MODE_SENTINEL
+		d.sentinels = append([]string{}, sentinels...)
+		d.master = master
+		d.addr = ""
+	}
+	return d, nil
+}
+
+// clustered whether the dialer connects to a redis cluster
+func (d *dialer) clustered() bool {
+	return d.mode == MODE_CLUSTER
+}
+
+// dial open a connection to redis
+func (d *dialer) dial() (redigo.Conn, error) {
+	switch d.mode {
+	case MODE_SENTINEL:
+		return d.dialMaster()
+	case MODE_CLUSTER:
+		return newClusterConn(d.cluster), nil
+	}
+	return d.dialAddr(d.addr)
+}
+
+// dialAddr open a connection to a single redis server
+func (d *dialer) dialAddr(addr string) (redigo.Conn, error) {
+	return redigo.Dial("tcp", addr, d.opts...)
+}
+
+// dialMaster ask each sentinel in turn where the master is, and connect to it.
+// The sentinel that answered is asked first next time
+func (d *dialer) dialMaster() (redigo.Conn, error) {
+	d.Lock()
+	sentinels := append([]string{}, d.sentinels...)
+	d.Unlock()
+
+	err := NO_MASTER
+	for i, s := range sentinels {
+		var addr string
+		if addr, err = d.askSentinel(s); err != nil {
+			continue
+		}
+		var c redigo.Conn
+		if c, err = d.dialAddr(addr); err != nil {
+			continue
+		}
+		if err = checkMaster(c); err != nil {
+			c.Close()
+			continue
+		}
+
+		d.Lock()
+		d.addr = addr
+		if i > 0 {
+			d.sentinels = append([]string{s}, append(sentinels[:i:i], sentinels[i+1:]...)...)
+		}
+		d.Unlock()
+		return &masterConn{Conn: c}, nil
+	}
+	return nil, err
+}
+
+// askSentinel ask a sentinel for the address of the master
+func (d *dialer) askSentinel(sentinel string) (string, error) {
+	c, err := d.dialAddr(sentinel)
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+	reply, err := redigo.Strings(c.Do("SENTINEL", "get-master-addr-by-name", d.master))
+	if err == redigo.ErrNil || len(reply) != 2 {
+		return "", NO_MASTER
+	}
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(reply[0], reply[1]), nil
+}
+
+// report where the dialer is connecting to, for the stats server
+func (d *dialer) report() map[string]interface{} {
+	d.Lock()
+	defer d.Unlock()
+	rep := map[string]interface{}{
+		"mode": d.mode,
+	}
+	switch d.mode {
+	case MODE_SINGLE:
+		rep["address"] = d.addr
+	case MODE_SENTINEL:
+		rep["master"] = d.addr
+		rep["master_name"] = d.master
+		rep["sentinels"] = d.sentinels
+	case MODE_CLUSTER:
+		rep["nodes"] = d.cluster.nodes()
+	}
+	return rep
+}
+
+// checkMaster make sure a connection is to a master. Servers too old to know ROLE are taken at their word
+func checkMaster(c redigo.Conn) error {
+	reply, err := redigo.Values(c.Do("ROLE"))
+	if _, ok := err.(redigo.Error); ok {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(reply) == 0 {
+		return NOT_MASTER
+	}
+	if role, _ := redigo.String(reply[0], nil); role != "master" {
+		return NOT_MASTER
+	}
+	return nil
+}
+
+// masterConn is a connection to a master found through sentinels. Once the master has been demoted,
+// the connection reports itself broken so the pool drops it and the next dial finds the new master
+type masterConn struct {
+	redigo.Conn
+	err error
+}
+
+func (c *masterConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	reply, err := c.Conn.Do(cmd, args...)
+	c.demoted(err)
+	return reply, err
+}
+
+func (c *masterConn) Receive() (interface{}, error) {
+	reply, err := c.Conn.Receive()
+	c.demoted(err)
+	return reply, err
+}
+
+func (c *masterConn) Err() error {
+	if c.err != nil {
+		return c.err
+	}
+	return c.Conn.Err()
+}
+
+// demoted note if err says the server is no longer a master
+func (c *masterConn) demoted(err error) {
+	if e, ok := err.(redigo.Error); ok && strings.HasPrefix(string(e), "READONLY") {
+		c.err = e
+	}
+}
+
+// cluster knows which node of a redis cluster serves each hash slot
+type cluster struct {
+	seeds  []string
+	dial   func(addr string) (redigo.Conn, error)
+	slots  []string
+	loaded bool
+	sync.RWMutex
+}
+
+// newCluster create a cluster that discovers its slots from seeds
+func newCluster(seeds []string, dial func(string) (redigo.Conn, error)) *cluster {
+	return &cluster{
+		seeds: append([]string{}, seeds...),
+		dial:  dial,
+		slots: make([]string, CLUSTER_SLOTS),
+	}
+}
+
+// refresh ask the known nodes, then the seeds, which node serves each slot
+func (cl *cluster) refresh() error {
+	err := NO_CLUSTER_NODE
+	for _, addr := range append(cl.nodes(), cl.seeds...) {
+		var c redigo.Conn
+		if c, err = cl.dial(addr); err != nil {
+			continue
+		}
+		var reply []interface{}
+		reply, err = redigo.Values(c.Do("CLUSTER", "SLOTS"))
+		c.Close()
+		if err != nil {
+			continue
+		}
+		var slots []string
+		if slots, err = parseSlots(reply); err != nil {
+			continue
+		}
+		cl.Lock()
+		cl.slots = slots
+		cl.loaded = true
+		cl.Unlock()
+		return nil
+	}
+	return err
+}
+
+// node the address of the node serving slot
+func (cl *cluster) node(slot int) (string, error) {
+	cl.RLock()
+	loaded, addr := cl.loaded, cl.slots[slot]
+	cl.RUnlock()
+	if addr != "" {
+		return addr, nil
+	}
+	if !loaded {
+		if err := cl.refresh(); err != nil {
+			return "", err
+		}
+		return cl.node(slot)
+	}
+	return "", NO_CLUSTER_NODE
+}
+
+// any the address of a node to send keyless commands to
+func (cl *cluster) any() (string, error) {
+	if nodes := cl.nodes(); len(nodes) > 0 {
+		return nodes[0], nil
+	}
+	if err := cl.refresh(); err != nil {
+		return "", err
+	}
+	if nodes := cl.nodes(); len(nodes) > 0 {
+		return nodes[0], nil
+	}
+	return "", NO_CLUSTER_NODE
+}
+
+// moved note that slot has moved to addr
+func (cl *cluster) moved(slot int, addr string) {
+	cl.Lock()
+	defer cl.Unlock()
+	cl.slots[slot] = addr
+}
+
+// nodes the addresses of every node serving a slot, in slot order
+func (cl *cluster) nodes() []string {
+	cl.RLock()
+	defer cl.RUnlock()
+	var nodes []string
+	seen := make(map[string]bool)
+	for _, addr := range cl.slots {
+		if addr != "" && !seen[addr] {
+			seen[addr] = true
+			nodes = append(nodes, addr)
+		}
+	}
+	return nodes
+}
+
+// parseSlots parse the reply of CLUSTER SLOTS into the address of the master of each slot
+func parseSlots(reply []interface{}) ([]string, error) {
+	slots := make([]string, CLUSTER_SLOTS)
+	for _, r := range reply {
+		s, err := redigo.Values(r, nil)
+		if err != nil || len(s) < 3 {
+			return nil, BAD_SLOTS_REPLY
+		}
+		start, err := redigo.Int(s[0], nil)
+		if err != nil {
+			return nil, BAD_SLOTS_REPLY
+		}
+		end, err := redigo.Int(s[1], nil)
+		if err != nil || start < 0 || end >= CLUSTER_SLOTS || start > end {
+			return nil, BAD_SLOTS_REPLY
+		}
+		master, err := redigo.Values(s[2], nil)
+		if err != nil || len(master) < 2 {
+			return nil, BAD_SLOTS_REPLY
+		}
+		host, err := redigo.String(master[0], nil)
+		if err != nil {
+			return nil, BAD_SLOTS_REPLY
+		}
+		port, err := redigo.Int(master[1], nil)
+		if err != nil {
+			return nil, BAD_SLOTS_REPLY
+		}
+		addr := net.JoinHostPort(host, strconv.Itoa(port))
+		for i := start; i <= end; i++ {
+			slots[i] = addr
+		}
+	}
+	return slots, nil
+}
+
+// command a command waiting to be sent
+type command struct {
+	name string
+	args []interface{}
+}
+
+// clusterConn is a connection to a redis cluster. It is bound to the node serving the first key it is
+// given, and stays bound until all replies have been read, so pipelines and transactions over keys in
+// the same slot go to one node. Commands sent before the first key are held until the node is known
+type clusterConn struct {
+	cl        *cluster
+	conns     map[string]redigo.Conn
+	bound     redigo.Conn
+	pending   []command
+	pipelined bool
+	err       error
+}
+
+// newClusterConn create a connection to cl. Nodes are connected to when they are first needed
+func newClusterConn(cl *cluster) *clusterConn {
+	return &clusterConn{
+		cl:    cl,
+		conns: make(map[string]redigo.Conn),
+	}
+}
+
+func (c *clusterConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if cmd == "" {
+		// the pool ends each borrow by reading every reply, after which the connection is free to move
+		defer c.unbind()
+		if c.bound == nil && len(c.pending) == 0 {
+			return nil, nil
+		}
+	}
+	if err := c.bind(cmd, args); err != nil {
+		return nil, err
+	}
+	reply, err := c.bound.Do(cmd, args...)
+	if redirect, ok := err.(redigo.Error); ok && !c.pipelined {
+		return c.redirect(redirect, reply, cmd, args)
+	}
+	c.pipelined = false
+	return reply, err
+}
+
+func (c *clusterConn) Send(cmd string, args ...interface{}) error {
+	if c.bound == nil {
+		if _, ok := commandKey(cmd, args); !ok {
+			c.pending = append(c.pending, command{cmd, args})
+			return nil
+		}
+		if err := c.bind(cmd, args); err != nil {
+			return err
+		}
+	}
+	c.pipelined = true
+	return c.bound.Send(cmd, args...)
+}
+
+func (c *clusterConn) Flush() error {
+	if err := c.bind("", nil); err != nil {
+		return err
+	}
+	return c.bound.Flush()
+}
+
+func (c *clusterConn) Receive() (interface{}, error) {
+	if c.bound == nil {
+		return nil, NO_CLUSTER_NODE
+	}
+	return c.bound.Receive()
+}
+
+func (c *clusterConn) Err() error {
+	if c.err != nil {
+		return c.err
+	}
+	for _, n := range c.conns {
+		if err := n.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *clusterConn) Close() error {
+	var err error
+	for _, n := range c.conns {
+		if cErr := n.Close(); cErr != nil {
+			err = cErr
+		}
+	}
+	return err
+}
+
+// bind pick the node for cmd, or the held commands, if the connection is not bound yet, and send it the held commands
+func (c *clusterConn) bind(cmd string, args []interface{}) error {
+	if c.bound != nil {
+		return nil
+	}
+	key, ok := commandKey(cmd, args)
+	for i := 0; !ok && i < len(c.pending); i++ {
+		key, ok = commandKey(c.pending[i].name, c.pending[i].args)
+	}
+	var addr string
+	var err error
+	if ok {
+		addr, err = c.cl.node(hashSlot(key))
+	} else {
+		addr, err = c.cl.any()
+	}
+	if err != nil {
+		return err
+	}
+	if c.bound, err = c.conn(addr); err != nil {
+		return err
+	}
+	for _, p := range c.pending {
+		if err = c.bound.Send(p.name, p.args...); err != nil {
+			return err
+		}
+		c.pipelined = true
+	}
+	c.pending = nil
+	return nil
+}
+
+// unbind free the connection to move to another node
+func (c *clusterConn) unbind() {
+	c.bound = nil
+	c.pending = nil
+	c.pipelined = false
+}
+
+// conn the connection to the node at addr, connecting to it if need be
+func (c *clusterConn) conn(addr string) (redigo.Conn, error) {
+	if n, ok := c.conns[addr]; ok && n.Err() == nil {
+		return n, nil
+	}
+	n, err := c.cl.dial(addr)
+	if err != nil {
+		c.err = err
+		return nil, err
+	}
+	c.conns[addr] = n
+	return n, nil
+}
+
+// redirect follow a MOVED or ASK error by sending cmd again to the node it names
+func (c *clusterConn) redirect(e redigo.Error, reply interface{}, cmd string, args []interface{}) (interface{}, error) {
+	f := strings.Fields(string(e))
+	if len(f) != 3 || (f[0] != "MOVED" && f[0] != "ASK") {
+		return reply, e
+	}
+	slot, err := strconv.Atoi(f[1])
+	if err != nil {
+		return reply, e
+	}
+	n, err := c.conn(f[2])
+	if err != nil {
+		return nil, err
+	}
+	if f[0] == "ASK" {
+		if _, err = n.Do("ASKING"); err != nil {
+			return nil, err
+		}
+		return n.Do(cmd, args...)
+	}
+	c.cl.moved(slot, f[2])
+	c.bound = n
+	return n.Do(cmd, args...)
+}
+
+// commandKey the key cmd is run against, if it takes one
+func commandKey(cmd string, args []interface{}) (string, bool) {
+	name := strings.ToUpper(cmd)
+	if name == "" || keylessCommands[name] {
+		return "", false
+	}
+	i := 0
+	switch name {
+	case "EVAL", "EVALSHA":
+		if len(args) < 3 {
+			return "", false
+		}
+		if n, err := strconv.Atoi(fmt.Sprint(args[1])); err != nil || n == 0 {
+			return "", false
+		}
+		i = 2
+	case "XGROUP", "XINFO":
+		i = 1
+	case "XREAD", "XREADGROUP":
+		i = -1
+		for j := range args {
+			if s, ok := args[j].(string); ok && strings.ToUpper(s) == "STREAMS" {
+				i = j + 1
+				break
+			}
+		}
+	}
+	if i < 0 || i >= len(args) {
+		return "", false
+	}
+	switch k := args[i].(type) {
+	case string:
+		return k, true
+	case []byte:
+		return string(k), true
+	}
+	return "", false
+}
+
+// hashTag the part of key redis cluster hashes to pick its slot. Keys that share a hash tag share a slot
+func hashTag(key string) string {
+	if s := strings.IndexByte(key, '{'); s >= 0 {
+		if e := strings.IndexByte(key[s+1:], '}'); e > 0 {
+			return key[s+1 : s+1+e]
+		}
+	}
+	return key
+}
+
+// sameSlot a key made of prefix that redis cluster puts in the same slot as key
+func sameSlot(prefix, key string) string {
+	return prefix + "{" + hashTag(key) + "}"
+}
+
+// hashSlot the slot of key in a redis cluster
+func hashSlot(key string) int {
+	return int(crc16([]byte(hashTag(key))) % CLUSTER_SLOTS)
+}
+
+// crc16 the CRC16-CCITT (XMODEM) checksum redis cluster uses for key slots
+func crc16(b []byte) uint16 {
+	var crc uint16
+	for _, c := range b {
+		crc ^= uint16(c) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
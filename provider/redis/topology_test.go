@@ -0,0 +1,329 @@
+package redis
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/barracudanetworks/GoWorker/job"
+	redigo "github.com/garyburd/redigo/redis"
+)
+
+// fakeServer start a server that speaks just enough of the redis protocol to stand in for a sentinel
+// or cluster node. handle is given each command and returns the reply, which may be a redigo.Error
+func fakeServer(t *testing.T, handle func(args []string) interface{}) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				r := bufio.NewReader(c)
+				for {
+					args, err := readCommand(r)
+					if err != nil {
+						return
+					}
+					fmt.Fprint(c, encodeReply(handle(args)))
+				}
+			}(c)
+		}
+	}()
+	return l.Addr().String(), func() { l.Close() }
+}
+
+// readCommand read a command sent as an array of bulk strings
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		if _, err = r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		if args[i], err = r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		args[i] = strings.TrimSpace(args[i])
+	}
+	return args, nil
+}
+
+// encodeReply encode a reply in the redis protocol
+func encodeReply(reply interface{}) string {
+	switch r := reply.(type) {
+	case nil:
+		return "$-1\r\n"
+	case redigo.Error:
+		return "-" + string(r) + "\r\n"
+	case int:
+		return ":" + strconv.Itoa(r) + "\r\n"
+	case string:
+		return "$" + strconv.Itoa(len(r)) + "\r\n" + r + "\r\n"
+	case []interface{}:
+		s := "*" + strconv.Itoa(len(r)) + "\r\n"
+		for _, v := range r {
+			s += encodeReply(v)
+		}
+		return s
+	}
+	return "-ERR unknown reply\r\n"
+}
+
+// slotsReply a CLUSTER SLOTS reply giving every slot to addr
+func slotsReply(addr string) []interface{} {
+	host, port, _ := net.SplitHostPort(addr)
+	p, _ := strconv.Atoi(port)
+	return []interface{}{[]interface{}{0, CLUSTER_SLOTS - 1, []interface{}{host, p, "node"}}}
+}
+
+func TestHashSlot(t *testing.T) {
+	if crc16([]byte("123456789")) != 0x31C3 {
+		t.Error("Bad checksum", crc16([]byte("123456789")))
+	}
+	if hashSlot("foo") != 12182 {
+		t.Error("Bad slot for foo", hashSlot("foo"))
+	}
+	if hashSlot("{user1000}.following") != hashSlot("{user1000}.followers") {
+		t.Error("Keys with the same hash tag should share a slot")
+	}
+	tags := map[string]string{
+		"foo":           "foo",
+		"a{b}c":         "b",
+		"foo{}{bar}":    "foo{}{bar}",
+		"foo{{bar}}zap": "{bar",
+		"foo{bar}{zap}": "bar",
+	}
+	for key, tag := range tags {
+		if hashTag(key) != tag {
+			t.Error("Bad hash tag for", key, hashTag(key))
+		}
+	}
+	for _, key := range []string{"ns:jobs", "jobs", "{jobs}:x"} {
+		if hashSlot(sameSlot("tmp_job:leases:", key)) != hashSlot(key) {
+			t.Error("Key is not in the same slot as", key)
+		}
+	}
+}
+
+func TestCommandKey(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		args []interface{}
+		key  string
+	}{
+		{"LPOP", []interface{}{"a"}, "a"},
+		{"rpush", []interface{}{[]byte("b"), "job"}, "b"},
+		{"EVALSHA", []interface{}{"sha", 3, "c", "d", "e"}, "c"},
+		{"EVALSHA", []interface{}{"sha", 0}, ""},
+		{"XGROUP", []interface{}{"CREATE", "s", "g", "0"}, "s"},
+		{"XREADGROUP", []interface{}{"GROUP", "g", "c", "COUNT", 1, "STREAMS", "s", ">"}, "s"},
+		{"MULTI", nil, ""},
+		{"INFO", []interface{}{"memory"}, ""},
+		{"", nil, ""},
+	}
+	for _, test := range tests {
+		key, ok := commandKey(test.cmd, test.args)
+		if key != test.key || ok != (test.key != "") {
+			t.Error("Bad key for", test.cmd, test.args, key, ok)
+		}
+	}
+}
+
+func TestParseSlots(t *testing.T) {
+	reply := []interface{}{
+		[]interface{}{int64(0), int64(99), []interface{}{[]byte("10.0.0.1"), int64(7000), []byte("a")}},
+		[]interface{}{int64(100), int64(CLUSTER_SLOTS - 1), []interface{}{[]byte("10.0.0.2"), int64(7001)}, []interface{}{[]byte("10.0.0.3"), int64(7002)}},
+	}
+	slots, err := parseSlots(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slots[0] != "10.0.0.1:7000" || slots[99] != "10.0.0.1:7000" || slots[100] != "10.0.0.2:7001" || slots[CLUSTER_SLOTS-1] != "10.0.0.2:7001" {
+		t.Error("Slots were not given to their masters")
+	}
+	if _, err = parseSlots([]interface{}{[]interface{}{int64(5), int64(1)}}); err != BAD_SLOTS_REPLY {
+		t.Error("Expected a bad reply", err)
+	}
+}
+
+func TestSentinel(t *testing.T) {
+	if _, err := newDialer("", []string{"localhost:26379"}, "", nil, time.Second, time.Second, time.Second); err != NO_MASTER_NAME {
+		t.Error("A master name should be required", err)
+	}
+
+	// the first sentinel does not know the master, the second does
+	unknown, closeUnknown := fakeServer(t, func(args []string) interface{} {
+		return nil
+	})
+	defer closeUnknown()
+	known, closeKnown := fakeServer(t, func(args []string) interface{} {
+		if len(args) == 3 && args[0] == "SENTINEL" && args[2] == "mymaster" {
+			return []interface{}{"127.0.0.1", "6379"}
+		}
+		return redigo.Error("ERR unknown command")
+	})
+	defer closeKnown()
+
+	d, err := newDialer("", []string{unknown, known}, "mymaster", nil, time.Second, time.Second, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := d.dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err = c.Do("PING"); err != nil {
+		t.Error(err)
+	}
+	rep := d.report()
+	if rep["mode"] != MODE_SENTINEL || rep["master"] != "127.0.0.1:6379" {
+		t.Error("Bad report", rep)
+	}
+	if d.sentinels[0] != known {
+		t.Error("The sentinel that knew the master should be asked first", d.sentinels)
+	}
+}
+
+func TestSentinelNotMaster(t *testing.T) {
+	replica, closeReplica := fakeServer(t, func(args []string) interface{} {
+		return []interface{}{"slave", "127.0.0.1", 6379, "connected", 0}
+	})
+	defer closeReplica()
+	host, port, _ := net.SplitHostPort(replica)
+	sentinel, closeSentinel := fakeServer(t, func(args []string) interface{} {
+		return []interface{}{host, port}
+	})
+	defer closeSentinel()
+
+	d, err := newDialer("", []string{sentinel}, "mymaster", nil, time.Second, time.Second, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = d.dial(); err != NOT_MASTER {
+		t.Error("A replica should not be used as the master", err)
+	}
+}
+
+func TestMasterConnDemoted(t *testing.T) {
+	demoted, closeDemoted := fakeServer(t, func(args []string) interface{} {
+		return redigo.Error("READONLY You can't write against a read only replica.")
+	})
+	defer closeDemoted()
+	c, err := redigo.Dial("tcp", demoted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &masterConn{Conn: c}
+	defer m.Close()
+	m.Do("RPUSH", "a", "b")
+	if m.Err() == nil {
+		t.Error("A demoted master's connection should be broken")
+	}
+}
+
+func TestClusterConn(t *testing.T) {
+	// the seed says node holds every slot, but node has moved every key to the real server
+	node, closeNode := fakeServer(t, func(args []string) interface{} {
+		return redigo.Error(fmt.Sprintf("MOVED %d 127.0.0.1:6379", hashSlot(args[1])))
+	})
+	defer closeNode()
+	slots := slotsReply(node)
+	seed, closeSeed := fakeServer(t, func(args []string) interface{} {
+		return slots
+	})
+	defer closeSeed()
+
+	d, err := newDialer("", nil, "", []string{seed}, time.Second, time.Second, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !d.clustered() {
+		t.Fatal("Dialer should be clustered")
+	}
+	pool := newConnPool(d, 2, 1, time.Minute)
+	defer pool.Close()
+
+	key := testList + "TestClusterConn"
+	c := pool.get()
+	if _, err = c.Do("RPUSH", key, "a"); err != nil {
+		t.Fatal(err)
+	}
+	pool.release(c)
+
+	// the move is remembered, and transactions go to the node that holds the key
+	c = pool.get()
+	c.Send("MULTI")
+	c.Send("RPUSH", key, "b")
+	c.Send("LRANGE", key, 0, -1)
+	reply, err := redigo.Values(c.Do("EXEC"))
+	c.Do("DEL", key)
+	pool.release(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jobs, _ := redigo.Strings(reply[1], nil); len(jobs) != 2 {
+		t.Error("Expected both pushes in the list", jobs)
+	}
+	if nodes := d.cluster.nodes(); len(nodes) != 2 {
+		t.Error("Expected the moved slot to be served by another node", nodes)
+	}
+}
+
+func TestClusterProvider(t *testing.T) {
+	seed, closeSeed := fakeServer(t, func(args []string) interface{} {
+		return slotsReply("127.0.0.1:6379")
+	})
+	defer closeSeed()
+
+	list := testList + "TestClusterProvider"
+	r := RedisFactory().(*Redis)
+	conf := r.ConfigStruct().(*RedisConfig)
+	conf.JobList = list
+	conf.Namespace = "cluster"
+	conf.Cluster = []string{seed}
+	if err := r.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// every key a script touches must be in the list's slot
+	slot := hashSlot(r.tmpSet.key(list))
+	if hashSlot(r.tmpSet.processingKey(list)) != slot || hashSlot(r.tmpSet.leasesKey(list)) != slot {
+		t.Error("Lease keys are not in the list's slot", r.tmpSet.processingKey(list), r.tmpSet.leasesKey(list))
+	}
+
+	addJobs(r, list, 3)
+	jobChan := make(chan job.Job, 3)
+	if err := r.RequestWork(3, jobChan); err != nil {
+		t.Fatal(err)
+	}
+	if len(jobChan) != 3 {
+		t.Fatal("Expected 3 jobs, got", len(jobChan))
+	}
+	for i := 0; i < 3; i++ {
+		if err := r.ConfirmJob(<-jobChan); err != nil {
+			t.Error(err)
+		}
+	}
+	if rep := r.Report(); rep["mode"] != MODE_CLUSTER {
+		t.Error("Bad report", rep)
+	}
+}
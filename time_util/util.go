@@ -1,6 +1,7 @@
 package time_util
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"time"
@@ -12,10 +13,30 @@ var (
 )
 
 // TimeToName given a time, return the file name representing that time
-// format: RFC3339
+// format: RFC3339 in UTC, so names sort in time order
 // suffix can be any string. This will be stripped when converting from
 // file name to time later. The suffix is there merely to diferentiate
 // between files at similar times
 func TimeToName(t time.Time, suffix string) []byte {
-	return []byte(fmt.Sprintf("%s#%s", t.Format(TIME_FORMAT), suffix))
+	return []byte(fmt.Sprintf("%s#%s", t.UTC().Format(TIME_FORMAT), suffix))
+}
+
+// NameToTime given a name made by TimeToName, return the time it represents and its suffix.
+// Names written in local time, before names were in UTC, are understood too
+func NameToTime(name []byte) (time.Time, string, error) {
+	i := bytes.IndexByte(name, '#')
+	if i == -1 {
+		return time.Time{}, "", BAD_FORMAT
+	}
+	t, err := time.Parse(TIME_FORMAT, string(name[:i]))
+	if err != nil {
+		return time.Time{}, "", BAD_FORMAT
+	}
+	return t, string(name[i+1:]), nil
+}
+
+// InUTC whether the time in a name is in UTC. Names in UTC sort in time order, names written in local time may not
+func InUTC(name []byte) bool {
+	i := bytes.IndexByte(name, '#')
+	return i > 0 && name[i-1] == 'Z'
 }
@@ -1,16 +1,51 @@
 package time_util
 
 import (
+	"bytes"
 	"testing"
 	"time"
 )
 
 var (
-	test_time = time.Date(2014, 12, 22, 0, 0, 0, 0, time.Local)
+	test_time = time.Date(2014, 12, 22, 0, 0, 0, 0, time.FixedZone("EST", -5*60*60))
 )
 
 func TestTimeToName(t *testing.T) {
-	if string(TimeToName(test_time, "test")) != "2014-12-22T00:00:00-05:00#test" {
-		t.Fail()
+	if string(TimeToName(test_time, "test")) != "2014-12-22T05:00:00Z#test" {
+		t.Error("Bad name", string(TimeToName(test_time, "test")))
+	}
+}
+
+func TestNameSortsByTime(t *testing.T) {
+	// the later time is earlier in the day where it was written
+	early := TimeToName(time.Date(2014, 12, 22, 10, 0, 0, 0, time.FixedZone("JST", 9*60*60)), "a")
+	late := TimeToName(time.Date(2014, 12, 22, 0, 0, 0, 0, time.FixedZone("EST", -5*60*60)), "b")
+	if bytes.Compare(early, late) >= 0 {
+		t.Error("Names do not sort by time", string(early), string(late))
+	}
+}
+
+func TestNameToTime(t *testing.T) {
+	tests := []struct {
+		name   string
+		time   time.Time
+		suffix string
+		err    error
+		utc    bool
+	}{
+		{"2014-12-22T05:00:00Z#test", test_time, "test", nil, true},
+		{"2014-12-22T00:00:00-05:00#test", test_time, "test", nil, false},
+		{"2014-12-22T05:00:00Z#a#b", test_time, "a#b", nil, true},
+		{"2014-12-22T05:00:00Z", time.Time{}, "", BAD_FORMAT, false},
+		{"yesterday#test", time.Time{}, "", BAD_FORMAT, false},
+	}
+	for _, test := range tests {
+		tm, suffix, err := NameToTime([]byte(test.name))
+		if err != test.err || !tm.Equal(test.time) || suffix != test.suffix {
+			t.Error("Bad parse of", test.name, tm, suffix, err)
+		}
+		if InUTC([]byte(test.name)) != test.utc {
+			t.Error("Bad time zone for", test.name)
+		}
 	}
 }
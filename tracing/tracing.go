@@ -0,0 +1,118 @@
+/*
+Package tracing sets up OpenTelemetry tracing for GoWorker, and carries trace context between
+producers, the manager and workers in the metadata of a job.
+*/
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+
+	"github.com/barracudanetworks/GoWorker/config"
+	"github.com/barracudanetworks/GoWorker/job"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	TRACER_NAME = "github.com/barracudanetworks/GoWorker"
+
+	EXPORTER_OTLP   = "otlp"
+	EXPORTER_STDOUT = "stdout"
+	EXPORTER_FILE   = "file"
+)
+
+var (
+	UNKNOWN_EXPORTER = errors.New("tracing: unknown exporter")
+
+	// Propagator reads and writes trace context on job metadata and http headers
+	Propagator propagation.TextMapPropagator = propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	)
+)
+
+// Init configure the global tracer provider from the given config.
+// The returned function flushes and stops the exporter, and must be called on shutdown
+func Init(conf config.TracingConfig) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(Propagator)
+	if conf.Exporter == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exp, err := newExporter(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(conf.SampleRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceName(conf.ServiceName),
+		)),
+	)
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// newExporter create the span exporter named in the config
+func newExporter(conf config.TracingConfig) (sdktrace.SpanExporter, error) {
+	switch conf.Exporter {
+	case EXPORTER_OTLP:
+		opts := []otlptracehttp.Option{}
+		if conf.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(conf.Endpoint))
+		}
+		if conf.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		return otlptracehttp.New(context.Background(), opts...)
+
+	case EXPORTER_STDOUT:
+		return stdouttrace.New(stdouttrace.WithPrettyPrint())
+
+	case EXPORTER_FILE:
+		f, err := os.OpenFile(conf.File, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0660)
+		if err != nil {
+			return nil, err
+		}
+		return stdouttrace.New(stdouttrace.WithWriter(f))
+	}
+	return nil, UNKNOWN_EXPORTER
+}
+
+// Tracer returns the tracer used for jobs
+func Tracer() trace.Tracer {
+	return otel.Tracer(TRACER_NAME)
+}
+
+// Extract returns a context holding the trace context found in a job's metadata, if any
+func Extract(ctx context.Context, conf *job.JobConfig) context.Context {
+	if conf.Metadata == nil {
+		return ctx
+	}
+	return Propagator.Extract(ctx, conf.Metadata)
+}
+
+// Inject write the trace context held by ctx into a job's metadata
+func Inject(ctx context.Context, conf *job.JobConfig) {
+	if conf.Metadata == nil {
+		conf.Metadata = make(job.Metadata)
+	}
+	Propagator.Inject(ctx, conf.Metadata)
+}
+
+// InjectHeaders copy the trace context from a job's metadata onto outgoing http headers
+func InjectHeaders(conf *job.JobConfig, h http.Header) {
+	Propagator.Inject(Extract(context.Background(), conf), propagation.HeaderCarrier(h))
+}
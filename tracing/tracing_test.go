@@ -0,0 +1,60 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/barracudanetworks/GoWorker/config"
+	"github.com/barracudanetworks/GoWorker/job"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestInitDisabled(t *testing.T) {
+	stop, err := Init(config.TracingConfig{})
+	if err != nil {
+		t.Error(err)
+	}
+	if err = stop(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestInitUnknownExporter(t *testing.T) {
+	_, err := Init(config.TracingConfig{Exporter: "carrier_pigeon"})
+	if err != UNKNOWN_EXPORTER {
+		t.Fail()
+	}
+}
+
+func TestInjectExtract(t *testing.T) {
+	tp := sdktrace.NewTracerProvider()
+	ctx, span := tp.Tracer("test").Start(context.Background(), "producer")
+	defer span.End()
+
+	conf := &job.JobConfig{}
+	Inject(ctx, conf)
+	if conf.Metadata.Get("traceparent") == "" {
+		t.Fatal("Trace context was not written to the job's metadata")
+	}
+
+	sc := trace.SpanContextFromContext(Extract(context.Background(), conf))
+	if sc.TraceID() != span.SpanContext().TraceID() {
+		t.Error("Extracted trace does not match the injected trace")
+	}
+}
+
+func TestInjectHeaders(t *testing.T) {
+	tp := sdktrace.NewTracerProvider()
+	ctx, span := tp.Tracer("test").Start(context.Background(), "work")
+	defer span.End()
+
+	conf := &job.JobConfig{}
+	Inject(ctx, conf)
+	h := http.Header{}
+	InjectHeaders(conf, h)
+	if h.Get("traceparent") != conf.Metadata.Get("traceparent") {
+		t.Error("Trace headers were not injected", h)
+	}
+}
@@ -13,7 +13,6 @@ import (
 	"github.com/barracudanetworks/GoWorker/job"
 	"github.com/barracudanetworks/GoWorker/time_util"
 	"github.com/barracudanetworks/GoWorker/worker"
-	"github.com/boltdb/bolt"
 )
 
 const (
@@ -29,11 +28,12 @@ var (
 	JOB_BUCKET = []byte("job_list")
 )
 
-// Disk a worker which writes jobs to a boltDisk
+// Disk a worker which writes jobs to a job store on disk
 type Disk struct {
-	db     *bolt.DB
-	bucket []byte
-	hasher hash.Hash
+	store     database.JobStore
+	bucket    string
+	hasher    hash.Hash
+	retention *database.Retention
 }
 
 type DiskParams struct {
@@ -44,6 +44,15 @@ type DiskParams struct {
 type DiskConfig struct {
 	DB_Name string `json:"db_name" required:"true"`
 	Bucket  string `json:"bucket" required:"true" description:"the bucket to insert jobs into"`
+
+	// storage
+	Store string `json:"store" required:"false" description:"The job store to keep db_name in, bolt or sqlite."`
+
+	// retention
+	MaxJobs        int    `json:"max_jobs" required:"false" description:"The most jobs that may wait in the bucket, 0 for no limit."`
+	MaxBytes       int64  `json:"max_bytes" required:"false" description:"The most bytes of jobs that may wait in the bucket, 0 for no limit."`
+	MaxAge         string `json:"max_age" required:"false" description:"Evict jobs that have been due for longer than this. Empty for no limit."`
+	EvictionPolicy string `json:"eviction_policy" required:"false" description:"Evict the oldest or newest jobs when the bucket is over its limits, or reject new ones."`
 }
 
 // Work write a job to disk using a bolt Disk
@@ -91,6 +100,10 @@ func (d *Disk) Kill() error {
 func (d *Disk) ConfigStruct() interface{} {
 	return &DiskConfig{
 		DB_Name: DEFAULT_Disk,
+		Store:   database.DEFAULT_STORE,
+
+		// retention
+		EvictionPolicy: database.EVICT_OLDEST,
 	}
 }
 
@@ -101,26 +114,25 @@ func (d *Disk) Init(i interface{}) error {
 		return config.WRONG_CONFIG_TYPE
 	}
 
-	// attempt to open the database
-	db, err := database.Open(conf.DB_Name)
+	retention, err := database.NewRetention(conf.MaxJobs, conf.MaxBytes, conf.MaxAge, conf.EvictionPolicy)
 	if err != nil {
 		return err
 	}
-	d.hasher = sha1.New()
-
-	d.db = db
 
-	// create the bucket if it doesn't exist
-	d.bucket = []byte(conf.Bucket)
-	err = d.db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists(d.bucket)
+	// attempt to open the database
+	store, err := database.OpenStore(conf.Store, conf.DB_Name)
+	if err != nil {
 		return err
-	})
+	}
+	d.hasher = sha1.New()
 
-	return err
+	d.store = store
+	d.bucket = conf.Bucket
+	d.retention = retention
+	return nil
 }
 
-// writeJob write a job to the boltDisk
+// writeJob write a job to the store
 func (d *Disk) writeJob(j job.Job) error {
 	conf := j.Config()
 
@@ -132,7 +144,15 @@ func (d *Disk) writeJob(j job.Job) error {
 
 	key := d.getKey(params)
 
-	err = database.WriteJob(d.db, d.bucket, key, params.Job)
+	if !d.retention.Limited() {
+		return d.store.Put(d.bucket, key, params.Job)
+	}
+
+	// a full bucket either turns the job away, or makes room for it once it is in
+	if err = database.Admit(d.store, d.bucket, d.retention, key, params.Job); err != nil {
+		return err
+	}
+	_, err = database.Enforce(d.store, d.bucket, d.retention, time.Now())
 	return err
 }
 
@@ -1,7 +1,10 @@
 package disk
 
 import (
+	"math"
+	"os"
 	"testing"
+	"time"
 
 	"github.com/barracudanetworks/GoWorker/database"
 	"github.com/barracudanetworks/GoWorker/job"
@@ -45,6 +48,16 @@ func TestInit(t *testing.T) {
 	}
 }
 
+func TestInitUnknownStore(t *testing.T) {
+	w := DiskFactory()
+	conf := w.ConfigStruct().(*DiskConfig)
+	conf.Bucket = "test_bucket"
+	conf.Store = "nope"
+	if err := w.Init(conf); err != database.STORE_NOT_EXIST {
+		t.Error("Expected an unknown store to be refused", err)
+	}
+}
+
 func TestWork(t *testing.T) {
 	w := DiskFactory().(*Disk)
 	conf := w.ConfigStruct().(*DiskConfig)
@@ -67,12 +80,52 @@ func TestWork(t *testing.T) {
 		t.Error(err)
 	}
 	// read the job
-	jc, jErr := database.ReadJob(w.db, w.bucket, w.getKey(p))
+	entries, jErr := w.store.Due(w.bucket, time.Unix(p.ExicutionTime, 0), math.MaxInt32)
 	if jErr != nil {
-		t.Error(err)
+		t.Error(jErr)
+	}
+	var jc *job.JobConfig
+	for _, e := range entries {
+		if string(e.Key) == string(w.getKey(p)) {
+			jc, jErr = job.ParseConfig(e.Value)
+		}
+	}
+	if jc == nil || jErr != nil {
+		t.Fatal("The job was not written", jErr)
 	}
 
 	if string(jc.Params) != string(mock.NewMockJob().Config().Params) {
 		t.Fail()
 	}
 }
+
+func TestWorkRetention(t *testing.T) {
+	db := os.TempDir() + "/goworker_disk_worker_retention_test.db"
+	defer os.Remove(db)
+	for _, policy := range []string{database.EVICT_REJECT, database.EVICT_NEWEST} {
+		os.Remove(db)
+		w := DiskFactory().(*Disk)
+		conf := w.ConfigStruct().(*DiskConfig)
+		conf.DB_Name = db
+		conf.Bucket = "retention"
+		conf.MaxJobs = 1
+		conf.EvictionPolicy = policy
+		if err := w.Init(conf); err != nil {
+			t.Fatal(err)
+		}
+
+		first := w.Work(mock.NewDiskJob(mock.NewMockJob()))
+		w.Recycle()
+		second := w.Work(mock.NewDiskJob(mock.NewMockJob()))
+		if first.Status() != job.STATUS_SUCCESS {
+			t.Error(policy, "the first job should fit")
+		}
+		if (second.Status() == job.STATUS_SUCCESS) != (policy != database.EVICT_REJECT) {
+			t.Error(policy, "unexpected status for the job that doesn't fit", second.Status())
+		}
+		if jobs, _, _ := w.store.Usage(w.bucket); jobs != 1 {
+			t.Error(policy, "expected the bucket to be kept to 1 job, has", jobs)
+		}
+		w.store.Close()
+	}
+}
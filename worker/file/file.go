@@ -0,0 +1,188 @@
+/*
+Package file provides a worker that writes jobs to files in a folder, as a json array, a job per line, or
+a tar archive with a file per job. As a failure handler with raw set, it keeps the jobs that failed
+exactly as they were received, so they can be dropped back into a file provider's folder to run again.
+*/
+package file
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/barracudanetworks/GoWorker/config"
+	"github.com/barracudanetworks/GoWorker/job"
+	"github.com/barracudanetworks/GoWorker/worker"
+)
+
+const (
+	DEFAULT_NAME            = "jobs"
+	DEFAULT_ROOT_FOLDER     = "jobs"
+	DEFAULT_ROTATE_INTERVAL = "1h"
+
+	FORMAT_JSON   = "json"
+	FORMAT_NDJSON = "ndjson"
+	FORMAT_TAR    = "tar"
+)
+
+var (
+	BAD_FORMAT = errors.New("file: format must be json, ndjson or tar")
+
+	OUTPUT_CONFLICT = errors.New("file: workers with the same root_folder and name must have the same format, gzip, max_size and rotate_interval")
+)
+
+func init() {
+	worker.Factories["file"] = FileFactory
+}
+
+// File a worker that writes jobs to rotating files
+type File struct {
+	out           *output
+	raw           bool
+	includeOutput bool
+	killed        sync.Once
+}
+
+// FileConfig the config struct used to set up the worker
+type FileConfig struct {
+	Name           string `json:"name" required:"false" description:"What the files written are named after. Workers with the same root_folder and name share their files."`
+	RootFolder     string `json:"root_folder" required:"true" description:"The folder to write files to."`
+	Format         string `json:"format" required:"false" description:"json for an array of jobs per file, ndjson for a job per line, or tar for a file per job."`
+	Raw            bool   `json:"raw" required:"false" description:"Write jobs exactly as they were received."`
+	IncludeOutput  bool   `json:"include_output" required:"false" description:"Write each job along with the output captured from it, and the time it was written."`
+	Gzip           bool   `json:"gzip" required:"false" description:"Compress the files written."`
+	MaxSize        int64  `json:"max_size" required:"false" description:"Start a new file once one has this many bytes, 0 for no limit."`
+	RotateInterval string `json:"rotate_interval" required:"false" description:"Start a new file once one has been open this long. Empty to only start a new file at max_size."`
+}
+
+// Record a job written along with its output
+type Record struct {
+	Job    json.RawMessage `json:"job"`
+	Output string          `json:"output,omitempty"`
+	Time   time.Time       `json:"time"`
+}
+
+// Work write a job to the current file
+func (f *File) Work(j job.Job) *job.JobStats {
+	stats := job.NewJobStats()
+	b, err := f.record(j.Config())
+	if err == nil {
+		err = f.out.write(b)
+	}
+	if err != nil {
+		log.Println(err)
+		stats.End(job.STATUS_FAILURE)
+		return stats
+	}
+	stats.End(job.STATUS_SUCCESS)
+	return stats
+}
+
+// record the bytes to write for a job
+func (f *File) record(conf *job.JobConfig) ([]byte, error) {
+	b := conf.Raw()
+	if !f.raw || len(b) == 0 {
+		var err error
+		if b, err = json.Marshal(conf); err != nil {
+			return nil, err
+		}
+	}
+	if f.includeOutput {
+		var err error
+		b, err = json.Marshal(&Record{
+			Job:    b,
+			Output: capturedOutput(conf),
+			Time:   time.Now(),
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// a line per job
+	if f.out.format == FORMAT_NDJSON {
+		buf := &bytes.Buffer{}
+		if err := json.Compact(buf, b); err != nil {
+			return nil, err
+		}
+		b = buf.Bytes()
+	}
+	return b, nil
+}
+
+// capturedOutput the output captured from a job, if it was captured somewhere that can be read back
+func capturedOutput(conf *job.JobConfig) string {
+	if !conf.CaptureOutput {
+		return ""
+	}
+	switch w := conf.OutputWriter.(type) {
+	case *job.OutputBuffer:
+		s, _ := w.String()
+		return s
+	case interface {
+		Bytes() []byte
+	}:
+		return string(w.Bytes())
+	case fmt.Stringer:
+		return w.String()
+	}
+	return ""
+}
+
+// Recycle this is a noop as the worker keeps no state between jobs
+func (f *File) Recycle() {}
+
+// Kill stop writing, and finish the current file once every worker sharing it has been killed
+func (f *File) Kill() error {
+	var err error
+	f.killed.Do(func() {
+		err = f.out.release()
+	})
+	return err
+}
+
+// ConfigStruct return the config struct with the default values filled in
+func (f *File) ConfigStruct() interface{} {
+	return &FileConfig{
+		Name:           DEFAULT_NAME,
+		RootFolder:     DEFAULT_ROOT_FOLDER,
+		Format:         FORMAT_NDJSON,
+		RotateInterval: DEFAULT_ROTATE_INTERVAL,
+	}
+}
+
+// Init set the worker up for use
+func (f *File) Init(i interface{}) error {
+	conf, ok := i.(*FileConfig)
+	if !ok {
+		return config.WRONG_CONFIG_TYPE
+	}
+	if conf.Format != FORMAT_JSON && conf.Format != FORMAT_NDJSON && conf.Format != FORMAT_TAR {
+		return BAD_FORMAT
+	}
+	var interval time.Duration
+	if conf.RotateInterval != "" {
+		var err error
+		if interval, err = time.ParseDuration(conf.RotateInterval); err != nil {
+			return err
+		}
+	}
+
+	out, err := openOutput(conf.RootFolder, conf.Name, conf.Format, conf.Gzip, conf.MaxSize, interval)
+	if err != nil {
+		return err
+	}
+	f.out = out
+	f.raw = conf.Raw
+	f.includeOutput = conf.IncludeOutput
+	return nil
+}
+
+// FileFactory create and return a file worker
+func FileFactory() worker.Worker {
+	return &File{}
+}
@@ -0,0 +1,339 @@
+package file
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/barracudanetworks/GoWorker/job"
+)
+
+const (
+	rawJob = `{"name": "test", "type": "cli", "params": {"command": "echo"}, "retries": 1}`
+)
+
+// testJob a job parsed from rawJob
+type testJob struct {
+	conf *job.JobConfig
+}
+
+func (t *testJob) Config() *job.JobConfig {
+	return t.conf
+}
+
+func (t *testJob) JobConfirmer() job.JobConfirmer {
+	return nil
+}
+
+func newJob(t *testing.T) *testJob {
+	conf, err := job.ParseConfig([]byte(rawJob))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testJob{conf: conf}
+}
+
+func fileHelper(t *testing.T, edit func(*FileConfig)) *File {
+	root, err := ioutil.TempDir("", "goworker_file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := FileFactory().(*File)
+	conf := f.ConfigStruct().(*FileConfig)
+	conf.RootFolder = root
+	if edit != nil {
+		edit(conf)
+	}
+	if err = f.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func work(t *testing.T, f *File, n int) {
+	for i := 0; i < n; i++ {
+		if s := f.Work(newJob(t)); s.Status() != job.STATUS_SUCCESS {
+			t.Fatal("expected success, got", s.Status())
+		}
+	}
+}
+
+// finished the files that have been given their real names
+func finished(t *testing.T, dir string) []string {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, info := range infos {
+		if !strings.HasPrefix(info.Name(), ".") {
+			names = append(names, filepath.Join(dir, info.Name()))
+		}
+	}
+	return names
+}
+
+// records read every job written to a file
+func records(t *testing.T, path, format string) [][]byte {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var r io.Reader = file
+	if strings.HasSuffix(path, ".gz") {
+		if r, err = gzip.NewReader(file); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var recs [][]byte
+	switch format {
+	case FORMAT_JSON:
+		var raws []json.RawMessage
+		if err = json.NewDecoder(r).Decode(&raws); err != nil {
+			t.Fatal(err)
+		}
+		for _, raw := range raws {
+			recs = append(recs, raw)
+		}
+	case FORMAT_NDJSON:
+		s := bufio.NewScanner(r)
+		for s.Scan() {
+			recs = append(recs, append([]byte{}, s.Bytes()...))
+		}
+	case FORMAT_TAR:
+		tr := tar.NewReader(r)
+		for {
+			if _, err = tr.Next(); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			b, err := ioutil.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			recs = append(recs, b)
+		}
+	}
+	return recs
+}
+
+func TestInitBadFormat(t *testing.T) {
+	f := FileFactory().(*File)
+	conf := f.ConfigStruct().(*FileConfig)
+	conf.Format = "xml"
+	if err := f.Init(conf); err != BAD_FORMAT {
+		t.Error("expected", BAD_FORMAT, "got", err)
+	}
+}
+
+func TestWorkFormats(t *testing.T) {
+	for _, format := range []string{FORMAT_JSON, FORMAT_NDJSON, FORMAT_TAR} {
+		for _, gz := range []bool{false, true} {
+			f := fileHelper(t, func(c *FileConfig) {
+				c.Format = format
+				c.Gzip = gz
+			})
+			work(t, f, 3)
+			if files := finished(t, f.out.dir); len(files) != 0 {
+				t.Error(format, gz, "file was finished before it was rotated", files)
+			}
+			dir := f.out.dir
+			if err := f.Kill(); err != nil {
+				t.Fatal(err)
+			}
+
+			files := finished(t, dir)
+			if len(files) != 1 {
+				t.Fatal(format, gz, "expected 1 file, got", files)
+			}
+			if gz != strings.HasSuffix(files[0], ".gz") {
+				t.Error(format, gz, "unexpected file name", files[0])
+			}
+			recs := records(t, files[0], format)
+			if len(recs) != 3 {
+				t.Fatal(format, gz, "expected 3 jobs, got", len(recs))
+			}
+			conf, err := job.ParseConfig(recs[2])
+			if err != nil || conf.Name != "test" || conf.Retries != 1 {
+				t.Error(format, gz, "bad job written", string(recs[2]), err)
+			}
+			os.RemoveAll(dir)
+		}
+	}
+}
+
+func TestRaw(t *testing.T) {
+	f := fileHelper(t, func(c *FileConfig) {
+		c.Format = FORMAT_TAR
+		c.Raw = true
+	})
+	defer os.RemoveAll(f.out.dir)
+	work(t, f, 1)
+	dir := f.out.dir
+	f.Kill()
+	if recs := records(t, finished(t, dir)[0], FORMAT_TAR); string(recs[0]) != rawJob {
+		t.Error("expected the raw job, got", string(recs[0]))
+	}
+}
+
+func TestIncludeOutput(t *testing.T) {
+	f := fileHelper(t, func(c *FileConfig) {
+		c.IncludeOutput = true
+	})
+	defer os.RemoveAll(f.out.dir)
+	j := newJob(t)
+	j.conf.CaptureOutput = true
+	j.conf.OutputWriter = bytes.NewBufferString("hello")
+	f.Work(j)
+	dir := f.out.dir
+	f.Kill()
+
+	rec := &Record{}
+	if err := json.Unmarshal(records(t, finished(t, dir)[0], FORMAT_NDJSON)[0], rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Output != "hello" || rec.Time.IsZero() {
+		t.Error("unexpected record", rec)
+	}
+	if conf, err := job.ParseConfig(rec.Job); err != nil || conf.Name != "test" {
+		t.Error("bad job written", string(rec.Job), err)
+	}
+}
+
+func TestRotateSize(t *testing.T) {
+	f := fileHelper(t, func(c *FileConfig) {
+		c.MaxSize = int64(len(rawJob))
+	})
+	defer os.RemoveAll(f.out.dir)
+
+	// every job fills a file
+	work(t, f, 3)
+	if files := finished(t, f.out.dir); len(files) != 3 {
+		t.Error("expected 3 files, got", files)
+	}
+	f.Kill()
+}
+
+func TestRotateInterval(t *testing.T) {
+	f := fileHelper(t, func(c *FileConfig) {
+		c.RotateInterval = "50ms"
+	})
+	defer os.RemoveAll(f.out.dir)
+	work(t, f, 2)
+	time.Sleep(200 * time.Millisecond)
+	files := finished(t, f.out.dir)
+	if len(files) != 1 {
+		t.Fatal("expected 1 file, got", files)
+	}
+	if recs := records(t, files[0], FORMAT_NDJSON); len(recs) != 2 {
+		t.Error("expected 2 jobs, got", len(recs))
+	}
+	f.Kill()
+}
+
+func TestShared(t *testing.T) {
+	a := fileHelper(t, nil)
+	defer os.RemoveAll(a.out.dir)
+	b := FileFactory().(*File)
+	conf := b.ConfigStruct().(*FileConfig)
+	conf.RootFolder = a.out.dir
+	if err := b.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	if a.out != b.out {
+		t.Fatal("workers writing to the same folder don't share their files")
+	}
+
+	// a worker can't share the files with other settings
+	c := FileFactory().(*File)
+	conf = c.ConfigStruct().(*FileConfig)
+	conf.RootFolder = a.out.dir
+	conf.Gzip = true
+	if err := c.Init(conf); err != OUTPUT_CONFLICT {
+		t.Error("expected", OUTPUT_CONFLICT, "got", err)
+	}
+	work(t, a, 1)
+	work(t, b, 1)
+
+	// the file is finished once both workers have been killed, killing one twice doesn't count
+	a.Kill()
+	a.Kill()
+	if files := finished(t, a.out.dir); len(files) != 0 {
+		t.Error("file was finished while a worker was still writing to it")
+	}
+	b.Kill()
+	files := finished(t, a.out.dir)
+	if len(files) != 1 {
+		t.Fatal("expected 1 file, got", files)
+	}
+	if recs := records(t, files[0], FORMAT_NDJSON); len(recs) != 2 {
+		t.Error("expected 2 jobs, got", len(recs))
+	}
+}
+
+func TestRecoverOrphans(t *testing.T) {
+	host, _ := os.Hostname()
+	for _, tc := range []struct {
+		format string
+		gzip   bool
+	}{
+		{FORMAT_NDJSON, false},
+		{FORMAT_JSON, false},
+		{FORMAT_JSON, true},
+		{FORMAT_TAR, false},
+		{FORMAT_TAR, true},
+	} {
+		f := fileHelper(t, func(conf *FileConfig) {
+			conf.Format = tc.format
+			conf.Gzip = tc.gzip
+		})
+		root := f.out.dir
+		work(t, f, 2)
+
+		// crash: the file is left hidden and unfinished, under a process that is no longer running
+		f.out.file.Close()
+		orphan := strings.TrimSuffix(f.out.path, claimant(host, os.Getpid())) + claimant(host, 1<<30)
+		os.Rename(f.out.path, orphan)
+		outputsLock.Lock()
+		delete(outputs, filepath.Join(filepath.Clean(root), f.out.name))
+		outputsLock.Unlock()
+
+		// one on another host, and one that was never written to, are left alone and removed
+		other := strings.TrimSuffix(orphan, claimant(host, 1<<30)) + claimant("elsewhere", 1<<30)
+		ioutil.WriteFile(other, nil, 0644)
+		empty := filepath.Join(root, strings.Replace(filepath.Base(orphan), "-", "-0", 1))
+		ioutil.WriteFile(empty, nil, 0644)
+
+		g := fileHelper(t, func(conf *FileConfig) {
+			conf.RootFolder = root
+			conf.Format = tc.format
+		})
+		files := finished(t, root)
+		if len(files) != 1 || files[0] != f.out.final {
+			t.Fatal(tc, "expected", f.out.final, "got", files)
+		}
+		if recs := records(t, files[0], tc.format); len(recs) != 2 {
+			t.Error(tc, "expected 2 jobs, got", len(recs))
+		}
+		if _, err := os.Stat(other); err != nil {
+			t.Error(tc, "file of another host was touched", err)
+		}
+		if _, err := os.Stat(empty); !os.IsNotExist(err) {
+			t.Error(tc, "empty file wasn't removed", err)
+		}
+		g.Kill()
+		os.RemoveAll(root)
+	}
+}
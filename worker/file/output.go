@@ -0,0 +1,357 @@
+package file
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	// outputs the outputs open in this process, by folder and name, shared by every worker writing to them
+	outputs     = make(map[string]*output)
+	outputsLock sync.Mutex
+)
+
+// output a file that jobs are written to, that is replaced by a new one once it is too big or too old.
+// A file is written under a hidden name, followed by the host and pid writing it, and given its real name once it
+// is finished
+type output struct {
+	dir      string
+	name     string
+	format   string
+	gzip     bool
+	maxSize  int64
+	interval time.Duration
+	users    int
+
+	// the file being written
+	file    *os.File
+	counter *counter
+	gz      *gzip.Writer
+	tar     *tar.Writer
+	w       io.Writer
+	path    string
+	final   string
+	records int
+	timer   *time.Timer
+
+	sync.Mutex
+}
+
+// counter counts the bytes written to the file
+type counter struct {
+	w io.Writer
+	n int64
+}
+
+// Write write p to the file and count it
+func (c *counter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// openOutput the output for name in dir, created if no worker has opened it yet. Returns OUTPUT_CONFLICT if a worker
+// opened it with other settings
+func openOutput(dir, name, format string, gz bool, maxSize int64, interval time.Duration) (*output, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	outputsLock.Lock()
+	defer outputsLock.Unlock()
+	key := filepath.Join(filepath.Clean(dir), name)
+	o, ok := outputs[key]
+	if !ok {
+		if err := recoverOutputs(dir, name, format); err != nil {
+			return nil, err
+		}
+		o = &output{
+			dir:      dir,
+			name:     name,
+			format:   format,
+			gzip:     gz,
+			maxSize:  maxSize,
+			interval: interval,
+		}
+		outputs[key] = o
+	} else if o.format != format || o.gzip != gz || o.maxSize != maxSize || o.interval != interval {
+		return nil, OUTPUT_CONFLICT
+	}
+	o.users += 1
+	return o, nil
+}
+
+// release stop using the output, and finish its file once no one is
+func (o *output) release() error {
+	outputsLock.Lock()
+	o.users -= 1
+	last := o.users == 0
+	if last {
+		delete(outputs, filepath.Join(filepath.Clean(o.dir), o.name))
+	}
+	outputsLock.Unlock()
+	if !last {
+		return nil
+	}
+	o.Lock()
+	defer o.Unlock()
+	return o.rotate()
+}
+
+// write add a record to the file, starting a new file first if there isn't one, and finishing it if it has grown too big
+func (o *output) write(record []byte) error {
+	o.Lock()
+	defer o.Unlock()
+	if o.file == nil {
+		if err := o.open(); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	switch o.format {
+	case FORMAT_JSON:
+		sep := ",\n"
+		if o.records == 0 {
+			sep = "[\n"
+		}
+		if _, err = io.WriteString(o.w, sep); err == nil {
+			_, err = o.w.Write(record)
+		}
+	case FORMAT_NDJSON:
+		if _, err = o.w.Write(record); err == nil {
+			_, err = io.WriteString(o.w, "\n")
+		}
+	case FORMAT_TAR:
+		hdr := &tar.Header{
+			Name:    fmt.Sprintf("%08d.json", o.records+1),
+			Mode:    0644,
+			Size:    int64(len(record)),
+			ModTime: time.Now(),
+		}
+		if err = o.tar.WriteHeader(hdr); err == nil {
+			_, err = o.tar.Write(record)
+		}
+		if err == nil {
+			err = o.tar.Flush()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	o.records += 1
+
+	// flush every record, so the file can be read up to the last job even if this process dies
+	if o.gz != nil {
+		if err = o.gz.Flush(); err != nil {
+			return err
+		}
+	}
+	if o.maxSize > 0 && o.counter.n >= o.maxSize {
+		return o.rotate()
+	}
+	return nil
+}
+
+// open start a new file. The lock must be held
+func (o *output) open() error {
+	name := fmt.Sprintf("%s-%s.%s", o.name, time.Now().UTC().Format("20060102T150405.000000000"), o.format)
+	if o.gzip {
+		name += ".gz"
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(o.dir, "."+name+"."+claimant(host, os.Getpid()))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	o.file = f
+	o.final = filepath.Join(o.dir, name)
+	o.path = path
+	o.records = 0
+	o.counter = &counter{w: f}
+	o.w = o.counter
+	if o.gzip {
+		o.gz = gzip.NewWriter(o.counter)
+		o.w = o.gz
+	}
+	if o.format == FORMAT_TAR {
+		o.tar = tar.NewWriter(o.w)
+	}
+	if o.interval > 0 {
+		o.timer = time.AfterFunc(o.interval, func() {
+			o.Lock()
+			defer o.Unlock()
+			if o.file == f {
+				if err := o.rotate(); err != nil {
+					log.Println(err)
+				}
+			}
+		})
+	}
+	return nil
+}
+
+// rotate finish the file and give it its real name, the next record starts a new one. The lock must be held
+func (o *output) rotate() error {
+	if o.file == nil {
+		return nil
+	}
+	if o.timer != nil {
+		o.timer.Stop()
+	}
+
+	var err error
+	switch o.format {
+	case FORMAT_JSON:
+		_, err = io.WriteString(o.w, "\n]\n")
+	case FORMAT_TAR:
+		err = o.tar.Close()
+	}
+	if o.gz != nil {
+		if gzErr := o.gz.Close(); err == nil {
+			err = gzErr
+		}
+	}
+	if closeErr := o.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(o.path, o.final)
+	}
+	o.file, o.gz, o.tar, o.timer = nil, nil, nil, nil
+	return err
+}
+
+// claimant what a hidden file is followed by, so it can be told apart from the files of other processes
+func claimant(host string, pid int) string {
+	return host + "." + strconv.Itoa(pid)
+}
+
+// recoverOutputs finish the hidden files for name in dir left behind by processes on this host that are no longer
+// running, and give them their real names
+func recoverOutputs(dir, name, format string) error {
+	host, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range files {
+		hidden := info.Name()
+		if info.IsDir() || !strings.HasPrefix(hidden, "."+name+"-") {
+			continue
+		}
+		i := strings.LastIndexByte(hidden, '.')
+		if i < 0 || !strings.HasSuffix(hidden[:i], "."+host) {
+			continue
+		}
+		pid, err := strconv.Atoi(hidden[i+1:])
+		if err != nil || pid == os.Getpid() || alive(pid) {
+			continue
+		}
+		final := hidden[1 : i-len(host)-1]
+		if !strings.HasSuffix(strings.TrimSuffix(final, ".gz"), "."+format) {
+			continue
+		}
+		if err = finishOrphan(filepath.Join(dir, hidden), filepath.Join(dir, final), format); err != nil {
+			return err
+		}
+		log.Println("Finished", final, "abandoned by process", pid)
+	}
+	return nil
+}
+
+// finishOrphan end the file at path the way its format needs, and give it its real name. Compressed files are
+// written again, since a gzip stream cut off without its trailer can't be added to. A file nothing was written to
+// is removed
+func finishOrphan(path, final, format string) error {
+	var ending string
+	switch format {
+	case FORMAT_JSON:
+		ending = "\n]\n"
+	case FORMAT_TAR:
+		ending = string(make([]byte, 1024))
+	}
+	if !strings.HasSuffix(final, ".gz") {
+		if info, err := os.Stat(path); err != nil || info.Size() == 0 {
+			os.Remove(path)
+			return nil
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(f, ending)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+		return os.Rename(path, final)
+	}
+
+	// keep what can be read back, every record was flushed as it was written
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	data := &bytes.Buffer{}
+	if gz, err := gzip.NewReader(f); err == nil {
+		io.Copy(data, gz)
+	}
+	f.Close()
+	if data.Len() == 0 {
+		return os.Remove(path)
+	}
+	data.WriteString(ending)
+
+	tmp := path + ".finishing"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	_, err = gz.Write(data.Bytes())
+	if gzErr := gz.Close(); err == nil {
+		err = gzErr
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err = os.Rename(tmp, final); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// alive whether the process pid is running
+func alive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || err == syscall.EPERM
+}
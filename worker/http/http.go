@@ -10,6 +10,7 @@ import (
 	"net/url"
 
 	"github.com/barracudanetworks/GoWorker/job"
+	"github.com/barracudanetworks/GoWorker/tracing"
 	"github.com/barracudanetworks/GoWorker/worker"
 )
 
@@ -74,6 +75,9 @@ func (h *Http) Work(j job.Job) *job.JobStats {
 	}
 	r.Header = generateHeader(params)
 
+	// pass the trace context of the job on to the server we are calling
+	tracing.InjectHeaders(config, r.Header)
+
 	// start new goroutine to make http call
 	go func() {
 		response, err := h.client.Do(r)